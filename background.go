@@ -4,17 +4,23 @@ import (
 	"context"
 	"time"
 
+	"github.com/evergreen-ci/logkeeper/env"
+	"github.com/evergreen-ci/logkeeper/storage"
 	"github.com/mongodb/grip"
 	"github.com/mongodb/grip/message"
 )
 
-const backgroundLoggingInterval = 15 * time.Second
+const (
+	backgroundLoggingInterval = 15 * time.Second
+	storageHealthTimeout      = 5 * time.Second
+)
 
 func BackgroundLogging(ctx context.Context) {
 	ticker := time.NewTicker(backgroundLoggingInterval)
 	defer ticker.Stop()
 	grip.Debug("starting stats collector")
 
+	lastFlush := time.Now()
 	for {
 		select {
 		case <-ctx.Done():
@@ -22,6 +28,59 @@ func BackgroundLogging(ctx context.Context) {
 		case <-ticker.C:
 			grip.Info(message.CollectSystemInfo())
 			grip.Info(message.CollectBasicGoStats())
+			logStorageStats(time.Since(lastFlush))
+			logStorageHealth(ctx, storageHealthTimeout)
+			lastFlush = time.Now()
 		}
 	}
 }
+
+// logStorageStats logs the count and latencies of each type of bucket
+// operation performed since the last flush.
+func logStorageStats(interval time.Duration) {
+	for operation, stats := range storage.FlushOperationStats() {
+		grip.Info(message.Fields{
+			"message":    "storage operation stats",
+			"operation":  operation,
+			"count":      stats.Count,
+			"latency_ms": sliceStats(stats.LatencyMS, durationBins),
+			"interval":   interval,
+		})
+	}
+}
+
+// logStorageHealth logs whether the bucket could be reached and how long it
+// took to find out. The probe gives up after timeout so that a hanging bucket
+// doesn't stall the stats collector.
+func logStorageHealth(ctx context.Context, timeout time.Duration) {
+	bucket := env.Bucket()
+	if bucket == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	pingErr := make(chan error, 1)
+	go func() { pingErr <- bucket.Ping(ctx) }()
+
+	var err error
+	select {
+	case err = <-pingErr:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	msg := message.Fields{
+		"message":    "storage health",
+		"available":  err == nil,
+		"latency_ms": float64(time.Since(start)) / float64(time.Millisecond),
+	}
+	if err != nil {
+		msg["error"] = err.Error()
+		grip.Warning(msg)
+		return
+	}
+	grip.Info(msg)
+}
@@ -3,8 +3,17 @@ package logkeeper
 import (
 	"context"
 	"testing"
+	"time"
 
+	"github.com/evergreen-ci/logkeeper/env"
+	"github.com/evergreen-ci/logkeeper/storage"
+	"github.com/evergreen-ci/logkeeper/testutil"
+	"github.com/evergreen-ci/pail"
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
+	"github.com/mongodb/grip/send"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestBackgroundLogging(t *testing.T) {
@@ -16,3 +25,78 @@ func TestBackgroundLogging(t *testing.T) {
 		BackgroundLogging(ctx)
 	})
 }
+
+func TestLogStorageStats(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer testutil.SetBucket(t, "testdata/simple")()
+	storage.FlushOperationStats()
+
+	defer func(s send.Sender) { assert.NoError(t, grip.SetSender(s)) }(grip.GetSender())
+	sender := send.NewMockSender("")
+	require.NoError(t, grip.SetSender(sender))
+
+	_, err := env.Bucket().Exists(ctx, "builds/5a75f537726934e4b62833ab6d5dca41/metadata.json")
+	require.NoError(t, err)
+	_, err = env.Bucket().Exists(ctx, "DNE")
+	require.NoError(t, err)
+
+	logStorageStats(time.Second)
+	require.Len(t, sender.Messages, 1)
+	msg := sender.Messages[0].Raw().(message.Fields)
+	assert.Equal(t, storage.OperationExists, msg["operation"])
+	assert.Equal(t, 2, msg["count"])
+	latencyStats, ok := msg["latency_ms"].(message.Fields)
+	require.True(t, ok)
+	assert.NotEmpty(t, latencyStats["histogram"])
+
+	logStorageStats(time.Second)
+	assert.Len(t, sender.Messages, 1)
+}
+
+type hangingBucket struct {
+	pail.Bucket
+}
+
+func (b hangingBucket) Exists(ctx context.Context, key string) (bool, error) {
+	<-ctx.Done()
+	return false, ctx.Err()
+}
+
+func TestLogStorageHealth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer testutil.SetBucket(t, "")()
+
+	defer func(s send.Sender) { assert.NoError(t, grip.SetSender(s)) }(grip.GetSender())
+	sender := send.NewMockSender("")
+	require.NoError(t, grip.SetSender(sender))
+
+	t.Run("Available", func(t *testing.T) {
+		sender.Messages = nil
+		storage.FlushOperationStats()
+
+		logStorageHealth(ctx, time.Second)
+		require.Len(t, sender.Messages, 1)
+		msg := sender.Messages[0].Raw().(message.Fields)
+		assert.Equal(t, "storage health", msg["message"])
+		assert.Equal(t, true, msg["available"])
+		assert.Contains(t, msg, "latency_ms")
+		assert.NotContains(t, msg, "error")
+		assert.Empty(t, storage.FlushOperationStats())
+	})
+	t.Run("Unavailable", func(t *testing.T) {
+		sender.Messages = nil
+		original := env.Bucket()
+		defer func() { require.NoError(t, env.SetBucket(original)) }()
+		require.NoError(t, env.SetBucket(&storage.Bucket{Bucket: hangingBucket{Bucket: original.Bucket}}))
+
+		start := time.Now()
+		logStorageHealth(ctx, 10*time.Millisecond)
+		assert.Less(t, time.Since(start), time.Second)
+		require.Len(t, sender.Messages, 1)
+		msg := sender.Messages[0].Raw().(message.Fields)
+		assert.Equal(t, false, msg["available"])
+		assert.NotEmpty(t, msg["error"])
+	})
+}
@@ -0,0 +1,72 @@
+package logkeeper
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DefaultConcurrencyRetryAfter is how long clients turned away by a
+// ConcurrencyLimiter are told to wait before retrying by default.
+const DefaultConcurrencyRetryAfter = time.Second
+
+// concurrencyExemptPaths are the paths a ConcurrencyLimiter never turns
+// away, so that health checks still succeed while the service is saturated.
+var concurrencyExemptPaths = map[string]bool{"/status": true}
+
+// ConcurrencyLimiter is a middleware that limits how many requests are
+// handled at once across the whole process.
+type ConcurrencyLimiter struct {
+	slots      chan struct{}
+	retryAfter time.Duration
+}
+
+// NewConcurrencyLimiter returns a middleware that handles at most limit
+// requests at once and responds to any more with a 503 telling clients to
+// retry after retryAfter, or after DefaultConcurrencyRetryAfter if it's zero
+// or less. A limit of zero or less means requests aren't limited.
+func NewConcurrencyLimiter(limit int, retryAfter time.Duration) *ConcurrencyLimiter {
+	if retryAfter <= 0 {
+		retryAfter = DefaultConcurrencyRetryAfter
+	}
+	l := &ConcurrencyLimiter{retryAfter: retryAfter}
+	if limit > 0 {
+		l.slots = make(chan struct{}, limit)
+	}
+
+	return l
+}
+
+// Middleware calls the next handler if fewer than the limit of requests are
+// being handled, and otherwise responds immediately with a 503. Requests for
+// exempt paths, such as the health check, are always handled and don't count
+// toward the limit.
+func (l *ConcurrencyLimiter) Middleware(next http.Handler) http.Handler {
+	if l.slots == nil {
+		return next
+	}
+
+	// Retry-After is in whole seconds, so round up rather than telling
+	// clients to retry immediately.
+	retryAfter := strconv.Itoa(int(math.Ceil(l.retryAfter.Seconds())))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if concurrencyExemptPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			w.Header().Set("Retry-After", retryAfter)
+			http.Error(w, "too many concurrent requests", http.StatusServiceUnavailable)
+			return
+		}
+		// Release the slot even if the handler panics, otherwise every
+		// panic would permanently lower the limit.
+		defer func() { <-l.slots }()
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,78 @@
+package logkeeper
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrencyLimiter(t *testing.T) {
+	lk := NewLogkeeper(LogkeeperOptions{URL: "https://logkeeper.com"})
+	router := lk.NewRouter()
+
+	const limit = 3
+	limiter := NewConcurrencyLimiter(limit, 1500*time.Millisecond)
+	release := make(chan struct{})
+	handler := limiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/block":
+			<-release
+		case "/panic":
+			panic("handler panicked")
+		default:
+			router.ServeHTTP(w, r)
+		}
+	}))
+
+	t.Run("Saturated", func(t *testing.T) {
+		var wg sync.WaitGroup
+		codes := make(chan int, limit)
+		for i := 0; i < limit; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				codes <- doReq(t, handler, http.MethodGet, nil, "/block", nil).Code
+			}()
+		}
+		require.Eventually(t, func() bool {
+			return len(limiter.slots) == limit
+		}, 10*time.Second, 10*time.Millisecond)
+
+		resp := doReq(t, handler, http.MethodGet, nil, "/block", nil)
+		assert.Equal(t, http.StatusServiceUnavailable, resp.Code)
+		assert.Equal(t, "2", resp.Header().Get("Retry-After"))
+
+		resp = doReq(t, handler, http.MethodGet, nil, "/status", nil)
+		assert.Equal(t, http.StatusOK, resp.Code)
+
+		close(release)
+		wg.Wait()
+		close(codes)
+		for code := range codes {
+			assert.Equal(t, http.StatusOK, code)
+		}
+		assert.Zero(t, len(limiter.slots))
+
+		resp = doReq(t, handler, http.MethodGet, nil, "/build/DNE", nil)
+		assert.Equal(t, http.StatusNotFound, resp.Code)
+	})
+	t.Run("ReleasedOnPanic", func(t *testing.T) {
+		for i := 0; i < limit+1; i++ {
+			assert.Panics(t, func() {
+				handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/panic", nil))
+			})
+		}
+		assert.Zero(t, len(limiter.slots))
+	})
+	t.Run("NoLimit", func(t *testing.T) {
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+		handler := NewConcurrencyLimiter(0, 0).Middleware(next)
+		resp := doReq(t, handler, http.MethodGet, nil, "/block", nil)
+		assert.Equal(t, http.StatusOK, resp.Code)
+	})
+}
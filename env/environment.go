@@ -2,20 +2,29 @@ package env
 
 import (
 	"sync"
+	"time"
 
 	"github.com/evergreen-ci/logkeeper/storage"
 	"github.com/pkg/errors"
 )
 
 type environment struct {
-	bucket *storage.Bucket
+	bucket              *storage.Bucket
+	shardBuildKeys      bool
+	testWindowTolerance time.Duration
+	chunkManifests      bool
+	maxMergeIterators   int
 	sync.RWMutex
 }
 
+// DefaultMaxMergeIterators is the default maximum number of iterators a
+// single merge of log iterators accepts.
+const DefaultMaxMergeIterators = 1000
+
 var globalEnv *environment
 
 func init() {
-	globalEnv = &environment{}
+	globalEnv = &environment{maxMergeIterators: DefaultMaxMergeIterators}
 }
 
 // SetBucket caches a storage bucket to be available from the environment.
@@ -38,3 +47,76 @@ func Bucket() *storage.Bucket {
 
 	return globalEnv.bucket
 }
+
+// SetShardBuildKeys sets whether new build keys are written under a
+// sub-prefix derived from the build ID rather than directly under the builds
+// prefix.
+func SetShardBuildKeys(shard bool) {
+	globalEnv.Lock()
+	defer globalEnv.Unlock()
+	globalEnv.shardBuildKeys = shard
+}
+
+// ShardBuildKeys returns whether new build keys are written under a sub-prefix
+// derived from the build ID.
+func ShardBuildKeys() bool {
+	globalEnv.RLock()
+	defer globalEnv.RUnlock()
+
+	return globalEnv.shardBuildKeys
+}
+
+// SetTestWindowTolerance sets how much the time range of build lines returned
+// with a test's lines is extended on either side, so that lines logged near a
+// test's boundary aren't dropped because of clock skew between the test's
+// start and the lines' timestamps.
+func SetTestWindowTolerance(tolerance time.Duration) {
+	globalEnv.Lock()
+	defer globalEnv.Unlock()
+	globalEnv.testWindowTolerance = tolerance
+}
+
+// TestWindowTolerance returns how much the time range of build lines returned
+// with a test's lines is extended on either side.
+func TestWindowTolerance() time.Duration {
+	globalEnv.RLock()
+	defer globalEnv.RUnlock()
+
+	return globalEnv.testWindowTolerance
+}
+
+// SetChunkManifests sets whether new builds keep a manifest of their keys
+// that reads use instead of listing the build's keys.
+func SetChunkManifests(enabled bool) {
+	globalEnv.Lock()
+	defer globalEnv.Unlock()
+	globalEnv.chunkManifests = enabled
+}
+
+// ChunkManifests returns whether new builds keep a manifest of their keys that
+// reads use instead of listing the build's keys.
+func ChunkManifests() bool {
+	globalEnv.RLock()
+	defer globalEnv.RUnlock()
+
+	return globalEnv.chunkManifests
+}
+
+// SetMaxMergeIterators sets the maximum number of iterators a single merge of
+// log iterators accepts, so that a request can't exhaust memory by merging
+// the logs of too many builds or tests at once. Zero or less means there's
+// no limit.
+func SetMaxMergeIterators(n int) {
+	globalEnv.Lock()
+	defer globalEnv.Unlock()
+	globalEnv.maxMergeIterators = n
+}
+
+// MaxMergeIterators returns the maximum number of iterators a single merge of
+// log iterators accepts, or zero or less if there's no limit.
+func MaxMergeIterators() int {
+	globalEnv.RLock()
+	defer globalEnv.RUnlock()
+
+	return globalEnv.maxMergeIterators
+}
@@ -25,13 +25,34 @@ const (
 	chanBufferSize       = 1000
 	loggerStatsInterval  = 10 * time.Second
 	statsLimit           = 100000
-	logErrorPercentage   = 10
 	bytesPerMB           = 1024 * 1024
+	redactedHeaderValue  = "[redacted]"
 )
 
+// DefaultLogErrorPercentage is the default percentage of errors adding
+// responses to the response buffer that are logged.
+const DefaultLogErrorPercentage = 10
+
+// DefaultRedactedHeaders are the request headers whose values are redacted
+// from request logs by default since they hold credentials.
+var DefaultRedactedHeaders = []string{"Authorization", "Api-Key", "Cookie"}
+
+// loggedHeaders are the canonical names of the request headers whose values
+// may be logged. Any other header is left out of request logs entirely, so
+// that credentials in headers nobody thought to redact never reach them.
+var loggedHeaders = map[string]bool{
+	"Accept":           true,
+	"Accept-Encoding":  true,
+	"Content-Encoding": true,
+	"Content-Length":   true,
+	"Content-Type":     true,
+	"User-Agent":       true,
+}
+
 var (
-	durationBins = []float64{0, 250, 500, 1000, 5000, 30000, 60000, math.MaxFloat64}
-	sizeBins     = []float64{0, 0.5, 1, 5, 10, 50, math.MaxFloat64}
+	durationBins     = []float64{0, 250, 500, 1000, 5000, 30000, 60000, math.MaxFloat64}
+	sizeBins         = []float64{0, 0.5, 1, 5, 10, 50, math.MaxFloat64}
+	interarrivalBins = []float64{0, 10, 100, 1000, 10000, 60000, math.MaxFloat64}
 )
 
 // Logger is a middleware handler that aggregates statistics on responses. Route statistics are periodically logged.
@@ -45,17 +66,31 @@ type Logger struct {
 	statsByRoute map[string]routeStats
 	cacheIsFull  bool
 	lastReset    time.Time
+
+	// lastRequestTime is the start time of the most recent request to each
+	// route. It is only accessed from responseLoggerLoop.
+	lastRequestTime map[string]time.Time
+
+	// redactedHeaders is the set of canonical names of the request headers
+	// whose values are redacted from request logs.
+	redactedHeaders map[string]bool
+
+	// logErrorPercentage is the percentage of errors adding responses to
+	// the response buffer that are logged.
+	logErrorPercentage int
 }
 
 type routeStats struct {
-	durationMS   []float64
-	requestMB    []float64
-	responseMB   []float64
-	statusCounts map[int]int
+	durationMS     []float64
+	requestMB      []float64
+	responseMB     []float64
+	interarrivalMS []float64
+	statusCounts   map[int]int
 }
 
 type routeResponse struct {
 	route        string
+	start        time.Time
 	duration     time.Duration
 	responseSize int
 	requestSize  int
@@ -64,11 +99,55 @@ type routeResponse struct {
 
 // NewLogger returns a new Logger instance and starts its background goroutines.
 func NewLogger(ctx context.Context) *Logger {
+	return NewLoggerWithRedactedHeaders(ctx, DefaultRedactedHeaders)
+}
+
+// NewLoggerWithRedactedHeaders returns a new Logger like NewLogger that
+// redacts the values of the given request headers, rather than those of
+// DefaultRedactedHeaders, from request logs. Header names are case
+// insensitive.
+func NewLoggerWithRedactedHeaders(ctx context.Context, redactedHeaders []string) *Logger {
+	return NewLoggerWithOptions(ctx, LoggerOptions{
+		RedactedHeaders:    redactedHeaders,
+		LogErrorPercentage: DefaultLogErrorPercentage,
+	})
+}
+
+// LoggerOptions configures a Logger.
+type LoggerOptions struct {
+	// RedactedHeaders are the names of the request headers whose values
+	// are redacted from request logs. Header names are case insensitive.
+	RedactedHeaders []string
+	// LogErrorPercentage is the percentage, from 0 to 100, of errors
+	// adding responses to the response buffer that are logged. Zero
+	// never logs them.
+	LogErrorPercentage int
+}
+
+// ValidateLogErrorPercentage returns an error if the given percentage isn't
+// between 0 and 100.
+func ValidateLogErrorPercentage(percentage int) error {
+	if percentage < 0 || percentage > 100 {
+		return errors.Errorf("log error percentage %d must be between 0 and 100", percentage)
+	}
+
+	return nil
+}
+
+// NewLoggerWithOptions returns a new Logger like NewLogger configured with the
+// given options.
+func NewLoggerWithOptions(ctx context.Context, opts LoggerOptions) *Logger {
 	l := &Logger{
-		ids:          make(chan int, chanBufferSize),
-		newResponses: make(chan routeResponse, chanBufferSize),
-		statsByRoute: make(map[string]routeStats),
-		lastReset:    time.Now(),
+		ids:                make(chan int, chanBufferSize),
+		newResponses:       make(chan routeResponse, chanBufferSize),
+		statsByRoute:       make(map[string]routeStats),
+		lastReset:          time.Now(),
+		lastRequestTime:    make(map[string]time.Time),
+		redactedHeaders:    make(map[string]bool, len(opts.RedactedHeaders)),
+		logErrorPercentage: opts.LogErrorPercentage,
+	}
+	for _, header := range opts.RedactedHeaders {
+		l.redactedHeaders[http.CanonicalHeaderKey(strings.TrimSpace(header))] = true
 	}
 
 	go l.incrementIDLoop(ctx)
@@ -108,6 +187,7 @@ func (l *Logger) Middleware(next http.Handler) http.Handler {
 					"span":     time.Since(start).String(),
 					"remote":   remote,
 					"path":     r.URL.Path,
+					"headers":  l.loggableHeaders(r.Header),
 				})
 			}
 		}()
@@ -115,7 +195,7 @@ func (l *Logger) Middleware(next http.Handler) http.Handler {
 		next.ServeHTTP(rw, r)
 
 		grip.ErrorWhen(
-			sometimes.Percent(logErrorPercentage),
+			sometimes.Percent(l.logErrorPercentage),
 			message.WrapError(
 				l.addToResponseBuffer(rw, r),
 				message.Fields{
@@ -127,6 +207,24 @@ func (l *Logger) Middleware(next http.Handler) http.Handler {
 	})
 }
 
+// loggableHeaders returns the request headers that may be logged, with the
+// values of redacted headers replaced. Headers that are neither logged nor
+// redacted are left out.
+func (l *Logger) loggableHeaders(header http.Header) map[string]string {
+	headers := map[string]string{}
+	for name, values := range header {
+		canonicalName := http.CanonicalHeaderKey(name)
+		switch {
+		case l.redactedHeaders[canonicalName]:
+			headers[name] = redactedHeaderValue
+		case loggedHeaders[canonicalName]:
+			headers[name] = strings.Join(values, ", ")
+		}
+	}
+
+	return headers
+}
+
 func (l *Logger) responseLoggerLoop(ctx context.Context, tickerInterval time.Duration) {
 	defer recovery.LogStackTraceAndContinue("logger loop")
 
@@ -178,10 +276,12 @@ func (l *Logger) addToResponseBuffer(rw http.ResponseWriter, r *http.Request) er
 	}
 
 	writer := negroni.NewResponseWriter(rw)
+	start := getRequestStartAt(r.Context())
 	select {
 	case l.newResponses <- routeResponse{
 		route:        fmt.Sprintf("[%s] %s", strings.Join(methods, ", "), path),
-		duration:     time.Since(getRequestStartAt(r.Context())),
+		start:        start,
+		duration:     time.Since(start),
 		status:       writer.Status(),
 		responseSize: writer.Size(),
 		requestSize:  int(r.ContentLength),
@@ -204,6 +304,20 @@ func (l *Logger) recordResponse(response routeResponse) {
 	}
 	stats.statusCounts[response.status]++
 
+	if l.lastRequestTime == nil {
+		l.lastRequestTime = make(map[string]time.Time)
+	}
+	// Responses can be recorded out of the order their requests arrived
+	// in, so a request that started before the latest one is counted as
+	// arriving concurrently with it.
+	last, ok := l.lastRequestTime[response.route]
+	if ok {
+		stats.interarrivalMS = append(stats.interarrivalMS, math.Max(0, float64(response.start.Sub(last).Milliseconds())))
+	}
+	if !ok || response.start.After(last) {
+		l.lastRequestTime[response.route] = response.start
+	}
+
 	l.statsByRoute[response.route] = stats
 
 	if len(stats.durationMS) == statsLimit {
@@ -241,6 +355,7 @@ func (s *routeStats) makeMessage() message.Fields {
 	msg["service_time_ms"] = sliceStats(s.durationMS, durationBins)
 	msg["response_size_mb"] = sliceStats(s.responseMB, sizeBins)
 	msg["request_size_mb"] = sliceStats(s.requestMB, sizeBins)
+	msg["interarrival_time_ms"] = sliceStats(s.interarrivalMS, interarrivalBins)
 
 	return msg
 }
@@ -280,6 +395,7 @@ func (s *routeStats) reset() {
 	s.durationMS = s.durationMS[:0]
 	s.requestMB = s.requestMB[:0]
 	s.responseMB = s.responseMB[:0]
+	s.interarrivalMS = s.interarrivalMS[:0]
 	s.statusCounts = make(map[int]int)
 }
 
@@ -3,9 +3,11 @@ package logkeeper
 import (
 	"context"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/mongodb/grip"
 	"github.com/mongodb/grip/message"
 	"github.com/mongodb/grip/send"
@@ -95,6 +97,128 @@ func TestCacheIsFull(t *testing.T) {
 	assert.Equal(t, statsLimit, sender.Messages[0].Raw().(message.Fields)["count"])
 }
 
+func TestMiddlewareRedactsHeaders(t *testing.T) {
+	defer func(s send.Sender) { assert.NoError(t, grip.SetSender(s)) }(grip.GetSender())
+
+	panicking := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		panic("handler failed")
+	})
+	for _, test := range []struct {
+		name            string
+		redactedHeaders []string
+		expectedHeaders map[string]string
+		redactedValues  []string
+	}{
+		{
+			name:            "DefaultHeaders",
+			redactedHeaders: DefaultRedactedHeaders,
+			expectedHeaders: map[string]string{
+				"Authorization": redactedHeaderValue,
+				"Api-Key":       redactedHeaderValue,
+				"Cookie":        redactedHeaderValue,
+				"Accept":        "text/plain",
+			},
+			redactedValues: []string{"Bearer token", "secret-api-key", "session=secret", "some-api-user", "proxy-secret", "other-secret"},
+		},
+		{
+			name:            "CustomHeaders",
+			redactedHeaders: []string{"api-user", " accept"},
+			expectedHeaders: map[string]string{
+				"Api-User": redactedHeaderValue,
+				"Accept":   redactedHeaderValue,
+			},
+			redactedValues: []string{"Bearer token", "secret-api-key", "session=secret", "some-api-user", "text/plain", "proxy-secret", "other-secret"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sender := send.NewMockSender("")
+			require.NoError(t, grip.SetSender(sender))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			logger := NewLoggerWithRedactedHeaders(ctx, test.redactedHeaders)
+
+			req := httptest.NewRequest(http.MethodGet, "/build/b", nil)
+			req.Header.Set("Authorization", "Bearer token")
+			req.Header.Set("Api-Key", "secret-api-key")
+			req.Header.Set("Cookie", "session=secret")
+			req.Header.Set("Api-User", "some-api-user")
+			req.Header.Set("Accept", "text/plain")
+			req.Header.Set("Proxy-Authorization", "proxy-secret")
+			req.Header.Set("X-Api-Key", "other-secret")
+			resp := httptest.NewRecorder()
+			logger.Middleware(panicking).ServeHTTP(resp, req)
+			require.Equal(t, http.StatusInternalServerError, resp.Code)
+
+			require.Len(t, sender.Messages, 1)
+			msg := sender.Messages[0].Raw().(message.Fields)
+			assert.Equal(t, test.expectedHeaders, msg["headers"])
+			for _, value := range test.redactedValues {
+				assert.NotContains(t, sender.Messages[0].String(), value)
+			}
+		})
+	}
+}
+
+func TestValidateLogErrorPercentage(t *testing.T) {
+	for _, percentage := range []int{0, 1, DefaultLogErrorPercentage, 100} {
+		assert.NoError(t, ValidateLogErrorPercentage(percentage), "percentage %d", percentage)
+	}
+	for _, percentage := range []int{-1, 101} {
+		assert.Error(t, ValidateLogErrorPercentage(percentage), "percentage %d", percentage)
+	}
+}
+
+func TestLoggerLogErrorPercentage(t *testing.T) {
+	defer func(s send.Sender) { assert.NoError(t, grip.SetSender(s)) }(grip.GetSender())
+
+	const numRequests = 2000
+	for _, test := range []struct {
+		name       string
+		percentage int
+		min        int
+		max        int
+	}{
+		{name: "Never", percentage: 0, min: 0, max: 0},
+		// About a quarter of the errors, allowing for more than five
+		// standard deviations of sampling noise.
+		{name: "Quarter", percentage: 25, min: 400, max: 600},
+		{name: "Always", percentage: 100, min: numRequests, max: numRequests},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sender := send.NewMockSender("")
+			require.NoError(t, grip.SetSender(sender))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			logger := NewLoggerWithOptions(ctx, LoggerOptions{LogErrorPercentage: test.percentage})
+
+			// Recording the response of a route without methods
+			// always fails.
+			router := mux.NewRouter()
+			router.Use(logger.Middleware)
+			router.Path("/no-methods").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+			for i := 0; i < numRequests; i++ {
+				resp := httptest.NewRecorder()
+				router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/no-methods", nil))
+				require.Equal(t, http.StatusOK, resp.Code)
+			}
+
+			// The mock sender receives every message, including those
+			// that weren't sampled.
+			var logged int
+			for _, msg := range sender.Messages {
+				if fields, ok := msg.Raw().(message.Fields); ok && msg.Loggable() && fields["message"] == "adding response to buffer" {
+					logged++
+				}
+			}
+			assert.GreaterOrEqual(t, logged, test.min)
+			assert.LessOrEqual(t, logged, test.max)
+		})
+	}
+}
+
 func TestRecordResponse(t *testing.T) {
 	logger := Logger{statsByRoute: make(map[string]routeStats)}
 	for i := 0; i < statsLimit; i++ {
@@ -105,6 +229,49 @@ func TestRecordResponse(t *testing.T) {
 	assert.True(t, logger.cacheIsFull)
 }
 
+func TestRecordResponseInterarrival(t *testing.T) {
+	start := time.Now()
+
+	t.Run("SequentialRequests", func(t *testing.T) {
+		logger := Logger{statsByRoute: make(map[string]routeStats)}
+		logger.recordResponse(routeResponse{route: "r0", start: start})
+		logger.recordResponse(routeResponse{route: "r0", start: start.Add(5 * time.Millisecond)})
+		logger.recordResponse(routeResponse{route: "r0", start: start.Add(2 * time.Second)})
+
+		assert.Equal(t, []float64{5, 1995}, logger.statsByRoute["r0"].interarrivalMS)
+		assert.Equal(t, start.Add(2*time.Second), logger.lastRequestTime["r0"])
+	})
+	t.Run("OutOfOrderResponses", func(t *testing.T) {
+		logger := Logger{statsByRoute: make(map[string]routeStats)}
+		logger.recordResponse(routeResponse{route: "r0", start: start.Add(time.Second)})
+		logger.recordResponse(routeResponse{route: "r0", start: start})
+
+		assert.Equal(t, []float64{0}, logger.statsByRoute["r0"].interarrivalMS)
+		assert.Equal(t, start.Add(time.Second), logger.lastRequestTime["r0"])
+	})
+	t.Run("SeparateRoutes", func(t *testing.T) {
+		logger := Logger{statsByRoute: make(map[string]routeStats)}
+		logger.recordResponse(routeResponse{route: "r0", start: start})
+		logger.recordResponse(routeResponse{route: "r1", start: start.Add(time.Second)})
+
+		assert.Empty(t, logger.statsByRoute["r0"].interarrivalMS)
+		assert.Empty(t, logger.statsByRoute["r1"].interarrivalMS)
+	})
+	t.Run("PersistsAcrossFlushes", func(t *testing.T) {
+		defer func(s send.Sender) { assert.NoError(t, grip.SetSender(s)) }(grip.GetSender())
+		require.NoError(t, grip.SetSender(send.NewMockSender("")))
+
+		logger := Logger{statsByRoute: make(map[string]routeStats)}
+		logger.recordResponse(routeResponse{route: "r0", start: start})
+		logger.recordResponse(routeResponse{route: "r0", start: start.Add(time.Millisecond)})
+		logger.flushStats()
+		assert.Empty(t, logger.statsByRoute["r0"].interarrivalMS)
+
+		logger.recordResponse(routeResponse{route: "r0", start: start.Add(time.Second)})
+		assert.Equal(t, []float64{999}, logger.statsByRoute["r0"].interarrivalMS)
+	})
+}
+
 func TestFlushStats(t *testing.T) {
 	t.Run("WithStats", func(t *testing.T) {
 		defer func(s send.Sender) { assert.NoError(t, grip.SetSender(s)) }(grip.GetSender())
@@ -236,10 +403,11 @@ func TestSliceStats(t *testing.T) {
 
 func TestMakeMessage(t *testing.T) {
 	stats := routeStats{
-		durationMS:   []float64{1, 2, 3},
-		responseMB:   []float64{1, 2, 3},
-		requestMB:    []float64{1, 2, 3},
-		statusCounts: map[int]int{http.StatusOK: 3},
+		durationMS:     []float64{1, 2, 3},
+		responseMB:     []float64{1, 2, 3},
+		requestMB:      []float64{1, 2, 3},
+		interarrivalMS: []float64{5, 50, 500},
+		statusCounts:   map[int]int{http.StatusOK: 3},
 	}
 
 	msg := stats.makeMessage()
@@ -256,6 +424,11 @@ func TestMakeMessage(t *testing.T) {
 	require.True(t, ok)
 	assert.EqualValues(t, 6, requestSizesMap["sum"])
 
+	interarrivalMap, ok := msg["interarrival_time_ms"].(message.Fields)
+	require.True(t, ok)
+	assert.EqualValues(t, 555, interarrivalMap["sum"])
+	assert.EqualValues(t, []float64{1, 1, 1, 0, 0, 0}, interarrivalMap["histogram"])
+
 	statusCountMap, ok := msg["statuses"].(map[int]int)
 	require.True(t, ok)
 	assert.Equal(t, 3, statusCountMap[http.StatusOK])
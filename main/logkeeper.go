@@ -1,13 +1,16 @@
 package main
 
 import (
+	"compress/gzip"
 	"context"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -30,8 +33,55 @@ func main() {
 	logPath := flag.String("logpath", "logkeeperapp.log", "path to log file")
 	maxRequestSize := flag.Int("maxRequestSize", 1024*1024*32,
 		"maximum size for a request in bytes, defaults to 32 MB (in bytes)")
+	pprofAddr := flag.String("pprofAddr", "127.0.0.1:2285",
+		"address the pprof service listens on. Set LK_PPROF_TOKEN to require it as a bearer token")
+	maxProfileSeconds := flag.Int("maxProfileSeconds", 120,
+		"maximum duration in seconds of a requested CPU profile or execution trace, defaults to 2 minutes")
+	maxSymbolRequestSize := flag.Int64("maxSymbolRequestSize", 1024*1024,
+		"maximum size of a pprof symbol lookup request body, defaults to 1 MB (in bytes)")
+	rawBufferSize := flag.Int("rawBufferSize", 64*1024,
+		"size of the buffer raw log lines are written through, defaults to 64 KB (in bytes)")
+	disableLobsterRedirect := flag.Bool("disableLobsterRedirect", false,
+		"serve the built-in HTML log view instead of redirecting browsers to lobster")
+	redactedHeaders := flag.String("redactedHeaders", strings.Join(logkeeper.DefaultRedactedHeaders, ","),
+		"comma-separated names of request headers whose values are redacted from request logs")
+	logErrorPercentage := flag.Int("logErrorPercentage", logkeeper.DefaultLogErrorPercentage,
+		"percentage (0-100) of errors recording response statistics that are logged")
+	shardBuildKeys := flag.Bool("shardBuildKeys", false,
+		"write new build keys under a sub-prefix derived from the build ID, still reading builds written without one")
+	sseHeartbeatInterval := flag.Duration("sseHeartbeatInterval", 15*time.Second,
+		"how long a server-sent event stream may be idle before a heartbeat is sent")
+	maxStreamDuration := flag.Duration("maxStreamDuration", 0,
+		"how long a server-sent event stream may last before it's ended, 0 for no limit besides the server's write timeout")
+	serveOrphanedTestLogs := flag.Bool("serveOrphanedTestLogs", false,
+		"serve the lines of a test that has log chunks but no metadata, without the build's lines, instead of responding that it wasn't found")
+	compressionLevel := flag.Int("compressionLevel", gzip.DefaultCompression,
+		"gzip level (1-9, or -1 for the default) log downloads are compressed with")
+	testWindowTolerance := flag.Duration("testWindowTolerance", 0,
+		"how much to extend the time range of build lines returned with a test's lines on either side, to tolerate clock skew at test boundaries")
+	chunkManifests := flag.Bool("chunkManifests", false,
+		"keep a manifest of each new build's keys so that reads don't list them. Builds created while this is disabled are listed, and manifests go stale if it's disabled and re-enabled")
+	fallbackOrder := flag.String("fallbackOrder", "",
+		"comma-separated order of storage locations ('s3', 'local') to read from, falling back to the next on failure; writes go to the first. 'local' uses -localPath")
+	securityHeaders := securityHeaderFlag{}
+	for name, value := range logkeeper.DefaultSecurityHeaders {
+		securityHeaders[name] = value
+	}
+	flag.Var(securityHeaders, "securityHeader",
+		"'Name: value' of a header set on every response, overriding the default for that header; an empty value removes it. May be repeated")
+	maxMergeIterators := flag.Int("maxMergeIterators", env.DefaultMaxMergeIterators,
+		"maximum number of logs a single merge reads at once, each build's own and test logs counting separately, 0 for no limit")
+	templateDirectory := flag.String("templateDirectory", logkeeper.DefaultTemplateDirectory,
+		"directory the HTML views' templates are read from")
+	maxConcurrentRequests := flag.Int("maxConcurrentRequests", 0,
+		"maximum number of requests handled at once, besides health checks, with more rejected with a 503. 0 for no limit")
+	concurrencyRetryAfter := flag.Duration("concurrencyRetryAfter", logkeeper.DefaultConcurrencyRetryAfter,
+		"how long clients rejected by -maxConcurrentRequests are told to wait before retrying")
 	_ = flag.String("dbhost", "", "LEGACY: this option is ignored")
 	flag.Parse()
+	grip.EmergencyFatal(errors.Wrap(logkeeper.ValidateCompressionLevel(*compressionLevel), "validating compression level"))
+	grip.EmergencyFatal(errors.Wrap(logkeeper.ValidateLogErrorPercentage(*logErrorPercentage), "validating log error percentage"))
+	grip.EmergencyFatal(errors.Wrap(logkeeper.ValidateTemplates(*templateDirectory), "validating templates"))
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -57,16 +107,27 @@ func main() {
 	defer sender.Close()
 	grip.EmergencyFatal(grip.SetSender(sender))
 
-	bucket, err := makeBucket(localPath)
+	bucket, err := makeBucket(localPath, fallbackOrder)
 	grip.EmergencyFatal(errors.Wrap(err, "getting bucket"))
 	grip.EmergencyFatal(errors.Wrap(env.SetBucket(&bucket), "setting bucket in env"))
+	env.SetShardBuildKeys(*shardBuildKeys)
+	env.SetTestWindowTolerance(*testWindowTolerance)
+	env.SetChunkManifests(*chunkManifests)
+	env.SetMaxMergeIterators(*maxMergeIterators)
 	if err = logkeeper.LoadTraceProvider(ctx, traceCollectorEndpoint, sampleRatio); err != nil {
 		grip.Warning(err)
 	}
 	lk := logkeeper.NewLogkeeper(
 		logkeeper.LogkeeperOptions{
-			URL:            fmt.Sprintf("http://localhost:%v", *httpPort),
-			MaxRequestSize: *maxRequestSize,
+			URL:                    fmt.Sprintf("http://localhost:%v", *httpPort),
+			MaxRequestSize:         *maxRequestSize,
+			RawBufferSize:          *rawBufferSize,
+			DisableLobsterRedirect: *disableLobsterRedirect,
+			CompressionLevel:       *compressionLevel,
+			SSEHeartbeatInterval:   *sseHeartbeatInterval,
+			MaxStreamDuration:      *maxStreamDuration,
+			ServeOrphanedTestLogs:  *serveOrphanedTestLogs,
+			TemplateDirectory:      *templateDirectory,
 		},
 	)
 	go logkeeper.BackgroundLogging(ctx)
@@ -74,13 +135,17 @@ func main() {
 
 	catcher := grip.NewBasicCatcher()
 	router := lk.NewRouter()
-	router.Use(logkeeper.NewLogger(ctx).Middleware)
+	router.Use(logkeeper.NewLoggerWithOptions(ctx, logkeeper.LoggerOptions{
+		RedactedHeaders:    strings.Split(*redactedHeaders, ","),
+		LogErrorPercentage: *logErrorPercentage,
+	}).Middleware)
 	n := negroni.New()
 	n.Use(negroni.NewStatic(http.Dir("public"))) // part of negroni Classic settings
 	n.UseHandler(router)
 
 	serviceWait := &sync.WaitGroup{}
-	lkService := getService(fmt.Sprintf(":%v", *httpPort), n)
+	limiter := logkeeper.NewConcurrencyLimiter(*maxConcurrentRequests, *concurrencyRetryAfter)
+	lkService := getService(fmt.Sprintf(":%v", *httpPort), logkeeper.NewSecurityHeaders(securityHeaders).Middleware(limiter.Middleware(n)))
 	serviceWait.Add(1)
 	go func() {
 		defer recovery.LogStackTraceAndContinue("logkeeper service")
@@ -88,9 +153,15 @@ func main() {
 		catcher.Add(listenServeAndHandleErrs(lkService))
 	}()
 
-	pprofsvc := logkeeper.NewPProfSvc()
+	pprofsvc := logkeeper.NewPProfSvc(
+		logkeeper.PProfOptions{
+			MaxProfileDuration:   time.Duration(*maxProfileSeconds) * time.Second,
+			Token:                os.Getenv("LK_PPROF_TOKEN"),
+			MaxSymbolRequestSize: *maxSymbolRequestSize,
+		},
+	)
 
-	pprofService := getService("127.0.0.1:2285", pprofsvc.GetHandlerPprof(ctx))
+	pprofService := getService(*pprofAddr, pprofsvc.GetHandlerPprof(ctx))
 	serviceWait.Add(1)
 	go func() {
 		defer recovery.LogStackTraceAndContinue("pprof service")
@@ -162,7 +233,26 @@ func gracefulShutdownForSIGTERM(ctx context.Context, servers []*http.Server, gra
 	wg.Wait()
 }
 
-func makeBucket(localPath *string) (storage.Bucket, error) {
+func makeBucket(localPath, fallbackOrder *string) (storage.Bucket, error) {
+	if *fallbackOrder != "" {
+		var opts []storage.BucketOpts
+		for _, location := range strings.Split(*fallbackOrder, ",") {
+			switch strings.TrimSpace(location) {
+			case "s3":
+				opts = append(opts, storage.BucketOpts{Location: storage.PailS3})
+			case "local":
+				opts = append(opts, storage.BucketOpts{
+					Location: storage.PailLocal,
+					Path:     *localPath,
+				})
+			default:
+				return storage.Bucket{}, errors.Errorf("unknown storage location '%s' in fallback order", location)
+			}
+		}
+
+		return storage.NewFallbackBucket(opts...)
+	}
+
 	if *localPath != "" {
 		return storage.NewBucket(storage.BucketOpts{
 			Location: storage.PailLocal,
@@ -172,3 +262,28 @@ func makeBucket(localPath *string) (storage.Bucket, error) {
 
 	return storage.NewBucket(storage.BucketOpts{Location: storage.PailS3})
 }
+
+// securityHeaderFlag is a repeatable flag of 'Name: value' headers set on
+// every response.
+type securityHeaderFlag map[string]string
+
+func (f securityHeaderFlag) String() string {
+	headers := make([]string, 0, len(f))
+	for name, value := range f {
+		headers = append(headers, fmt.Sprintf("%s: %s", name, value))
+	}
+	sort.Strings(headers)
+
+	return strings.Join(headers, ", ")
+}
+
+func (f securityHeaderFlag) Set(value string) error {
+	name, headerValue, ok := strings.Cut(value, ":")
+	name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+	if !ok || name == "" {
+		return errors.Errorf("header '%s' must be of the form 'Name: value'", value)
+	}
+	f[name] = strings.TrimSpace(headerValue)
+
+	return nil
+}
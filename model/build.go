@@ -4,16 +4,31 @@ import (
 	"bytes"
 	"context"
 	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
 	"github.com/evergreen-ci/logkeeper/env"
 	"github.com/evergreen-ci/pail"
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
 	"github.com/pkg/errors"
 	otelTrace "go.opentelemetry.io/otel/trace"
 )
 
-const metadataFilename = "metadata.json"
+const (
+	metadataFilename = "metadata.json"
+
+	buildsPrefix       = "builds/"
+	buildsByTaskPrefix = "builds-by-task/"
+	testsSubPrefix     = "tests/"
+)
 
 // Build contains metadata about a build.
 type Build struct {
@@ -22,18 +37,111 @@ type Build struct {
 	BuildNum      int    `json:"buildnum"`
 	TaskID        string `json:"task_id"`
 	TaskExecution int    `json:"execution"`
+	// Labels are arbitrary key/value pairs attached by integrators, e.g.
+	// the git branch the build ran against.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Scrubbed is whether the build's logs were removed by DeleteBuildLogs.
+	Scrubbed bool `json:"scrubbed,omitempty"`
+}
+
+// buildMetadata is used to decode stored build metadata along with the
+// recorded size of the build's own log chunks, which is nil for builds
+// created before it was recorded.
+type buildMetadata struct {
+	Build
+	LogBytes *int64 `json:"log_bytes,omitempty"`
+}
+
+const (
+	// MaxBuildLabels is the maximum number of labels a build may have.
+	MaxBuildLabels = 64
+	// MaxLabelKeySize is the maximum size of a label's key in bytes.
+	MaxLabelKeySize = 128
+	// MaxLabelValueSize is the maximum size of a label's value in bytes.
+	MaxLabelValueSize = 1024
+)
+
+type invalidLabelsError struct {
+	error
+}
+
+// IsInvalidLabelsError returns whether the error is due to labels that are
+// too many or too large.
+func IsInvalidLabelsError(err error) bool {
+	_, ok := errors.Cause(err).(invalidLabelsError)
+	return ok
+}
+
+// ValidateLabels returns an error if there are more than MaxBuildLabels labels
+// or any label's key is empty or its key or value is too large.
+func ValidateLabels(labels map[string]string) error {
+	if len(labels) > MaxBuildLabels {
+		return invalidLabelsError{errors.Errorf("%d labels exceeds the maximum of %d", len(labels), MaxBuildLabels)}
+	}
+
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if key == "" {
+			return invalidLabelsError{errors.New("label keys must not be empty")}
+		}
+		if len(key) > MaxLabelKeySize {
+			return invalidLabelsError{errors.Errorf("label key of %d bytes exceeds the maximum size of %d bytes", len(key), MaxLabelKeySize)}
+		}
+		if len(labels[key]) > MaxLabelValueSize {
+			return invalidLabelsError{errors.Errorf("value of label '%s' exceeds the maximum size of %d bytes", key, MaxLabelValueSize)}
+		}
+	}
+
+	return nil
 }
 
 // UploadMetadata uploads metadata for a new build to the pail-backed
-// offline storage.
+// offline storage. Concurrent calls for the same build ID are serialized by
+// the build lock so that each one's metadata is written in turn rather than
+// racing to write the same keys.
 func (b *Build) UploadMetadata(ctx context.Context, tracer otelTrace.Tracer) error {
-	_, span := tracer.Start(ctx, "UploadMetadata")
+	ctx, span := tracer.Start(ctx, "UploadMetadata")
 	defer span.End()
-	data, err := b.toJSON()
+
+	unlock, err := lockBuild(ctx, b.ID)
+	if err != nil {
+		return err
+	}
+	defer logUnlockError(unlock, b.ID)
+
+	return b.uploadMetadata(ctx)
+}
+
+func (b *Build) uploadMetadata(ctx context.Context) error {
+	if err := ValidateLabels(b.Labels); err != nil {
+		return errors.Wrapf(err, "validating labels for build '%s'", b.ID)
+	}
+	existing, _, err := findBuild(ctx, b.ID)
 	if err != nil {
+		return errors.Wrapf(err, "checking for existing metadata for build '%s'", b.ID)
+	}
+	// The size of the build's own log chunks is recorded by appends, so
+	// it's kept when an existing build's metadata is uploaded again.
+	var logBytes int64
+	metadata := &buildMetadata{Build: *b, LogBytes: &logBytes}
+	if existing != nil {
+		metadata.LogBytes = existing.LogBytes
+	}
+	if err = putBuild(ctx, metadata, b.key()); err != nil {
 		return err
 	}
-	return errors.Wrapf(env.Bucket().Put(ctx, b.key(), bytes.NewReader(data)), "uploading metadata for build '%s'", b.ID)
+	if existing == nil {
+		addStorageUsage(1, 0)
+		if err = createChunkManifest(ctx, b.ID, b.key()); err != nil {
+			return errors.Wrapf(err, "creating chunk manifest for build '%s'", b.ID)
+		}
+	}
+
+	return errors.Wrapf(addBuildToTaskIndex(ctx, b.TaskID, b.ID), "indexing build '%s' by task", b.ID)
 }
 
 func (b *Build) key() string {
@@ -53,23 +161,122 @@ func metadataKeyForBuild(id string) string {
 	return fmt.Sprintf("%s%s", buildPrefix(id), metadataFilename)
 }
 
+// buildPrefix returns the prefix of the given build's keys in the layout new
+// keys are written to.
 func buildPrefix(buildID string) string {
-	return fmt.Sprintf("builds/%s/", buildID)
+	return buildPrefixForLayout(buildID, env.ShardBuildKeys())
+}
+
+// buildPrefixForLayout returns the prefix of the given build's keys, either
+// directly under the builds prefix or, if sharded, under the build's shard.
+func buildPrefixForLayout(buildID string, sharded bool) string {
+	if sharded {
+		return fmt.Sprintf("%s%s/%s/", buildsPrefix, buildShard(buildID), buildID)
+	}
+	return fmt.Sprintf("%s%s/", buildsPrefix, buildID)
+}
+
+// buildPrefixes returns the prefixes the given build's keys may be under. If
+// sharding is enabled, builds uploaded before it was enabled are still read,
+// so both layouts are returned, sharded first. Otherwise only the unsharded
+// layout is returned so that reads cost no more than before sharding existed.
+func buildPrefixes(buildID string) []string {
+	if env.ShardBuildKeys() {
+		return []string{buildPrefixForLayout(buildID, true), buildPrefixForLayout(buildID, false)}
+	}
+	return []string{buildPrefixForLayout(buildID, false)}
+}
+
+// buildShard returns the sub-prefix the given build's keys are sharded under,
+// the first byte of the MD5 hash of the build ID in hex. Build IDs are often
+// already hashes, but hashing again spreads arbitrary IDs evenly as well.
+func buildShard(buildID string) string {
+	hash := md5.Sum([]byte(buildID))
+	return hex.EncodeToString(hash[:1])
+}
+
+// splitBuildKey returns the build ID of the given key under the builds prefix
+// and the parts of the key that follow it, in either layout. A key is taken
+// to be sharded if the part after the builds prefix is the shard of the part
+// following it.
+func splitBuildKey(key string) (string, []string, bool) {
+	keyParts := strings.Split(strings.TrimPrefix(key, "/"), "/")
+	if len(keyParts) < 3 || keyParts[0]+"/" != buildsPrefix {
+		return "", nil, false
+	}
+	if len(keyParts) >= 4 && keyParts[1] == buildShard(keyParts[2]) {
+		return keyParts[2], keyParts[3:], true
+	}
+
+	return keyParts[1], keyParts[2:], true
+}
+
+// isShardedBuildKey returns whether the given key under the builds prefix is
+// in the sharded layout.
+func isShardedBuildKey(key string) bool {
+	buildID, _, ok := splitBuildKey(key)
+	return ok && strings.HasPrefix(strings.TrimPrefix(key, "/"), buildPrefixForLayout(buildID, true))
+}
+
+// BuildIDMode is how NewBuildIDWithOptions derives build IDs.
+type BuildIDMode int
+
+const (
+	// BuildIDDeterministic derives the ID from the builder and build
+	// number alone, so retrying a creation yields the same build.
+	BuildIDDeterministic BuildIDMode = iota
+	// BuildIDTaskExecution also derives the ID from the task execution,
+	// so each execution of a task gets its own build while retries within
+	// an execution still yield the same build.
+	BuildIDTaskExecution
+	// BuildIDUnique also derives the ID from a random nonce, so every
+	// creation yields a distinct build.
+	BuildIDUnique
+)
+
+// BuildIDOptions are the options for deriving a build ID.
+type BuildIDOptions struct {
+	Mode BuildIDMode
+	// TaskExecution is the task execution included in the ID in
+	// BuildIDTaskExecution mode.
+	TaskExecution int
 }
 
 // NewBuildID generates a new build ID based on the hash of the given builder
 // and build number.
 func NewBuildID(ctx context.Context, tracer otelTrace.Tracer, builder string, buildNum int) (string, error) {
-	ctx, span := tracer.Start(ctx, "DownloadLogLines")
+	return NewBuildIDWithOptions(ctx, tracer, builder, buildNum, BuildIDOptions{})
+}
+
+// NewBuildIDWithOptions generates a new build ID like NewBuildID, also
+// hashing in the task execution or a random nonce according to the mode in
+// opts so that builds with the same builder and build number don't collide.
+func NewBuildIDWithOptions(ctx context.Context, tracer otelTrace.Tracer, builder string, buildNum int, opts BuildIDOptions) (string, error) {
+	_, span := tracer.Start(ctx, "NewBuildID")
 	defer span.End()
 
 	hasher := md5.New()
 
 	// This depends on the fact that Go's JSON implementation sorts JSON
 	// keys lexicographically for maps, which ensures consistent encoding.
+	// Deterministic IDs must only hash the builder and build number so
+	// that they match the IDs of existing builds.
 	jsonMap := make(map[string]interface{})
 	jsonMap["builder"] = builder
 	jsonMap["buildNum"] = buildNum
+	switch opts.Mode {
+	case BuildIDDeterministic:
+	case BuildIDTaskExecution:
+		jsonMap["taskExecution"] = opts.TaskExecution
+	case BuildIDUnique:
+		nonce := make([]byte, 16)
+		if _, err := rand.Read(nonce); err != nil {
+			return "", errors.Wrap(err, "generating nonce for the build ID")
+		}
+		jsonMap["nonce"] = hex.EncodeToString(nonce)
+	default:
+		return "", errors.Errorf("unknown build ID mode %d", opts.Mode)
+	}
 	hashstring, err := json.Marshal(jsonMap)
 	if err != nil {
 		return "", errors.Wrap(err, "marshalling build ID data to JSON")
@@ -87,22 +294,435 @@ func NewBuildID(ctx context.Context, tracer otelTrace.Tracer, builder string, bu
 func FindBuildByID(ctx context.Context, tracer otelTrace.Tracer, id string) (*Build, error) {
 	_, span := tracer.Start(ctx, "FindBuildByID")
 	defer span.End()
-	reader, err := env.Bucket().Get(ctx, metadataKeyForBuild(id))
+
+	metadata, _, err := findBuild(ctx, id)
+	if err != nil || metadata == nil {
+		return nil, err
+	}
+
+	return &metadata.Build, nil
+}
+
+// findBuild returns the build metadata for the given ID along with the key it
+// was read from, so that updates are written back to the same layout rather
+// than duplicating the metadata. If the build doesn't exist, nil is returned.
+func findBuild(ctx context.Context, id string) (*buildMetadata, string, error) {
+	reader, key, err := getFromBuildPrefixes(ctx, id, metadataFilename)
 	if pail.IsKeyNotFoundError(err) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "getting build metadata for build '%s'", id)
+	}
+	defer reader.Close()
+
+	metadata := &buildMetadata{}
+	if err = json.NewDecoder(reader).Decode(metadata); err != nil {
+		return nil, "", errors.Wrapf(err, "parsing build metadata for build '%s'", id)
+	}
+
+	return metadata, key, nil
+}
+
+// putBuild uploads the given build metadata to the given key.
+func putBuild(ctx context.Context, metadata *buildMetadata, key string) error {
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return errors.Wrap(err, "marshalling build metadata")
+	}
+
+	return errors.Wrapf(env.Bucket().Put(ctx, key, bytes.NewReader(data)), "uploading metadata for build '%s'", metadata.ID)
+}
+
+// addBuildBytes increments the recorded size of the given build's own log
+// chunks by numBytes. If the build has no metadata, or its size was never
+// recorded, nothing is updated; RepairLineCounts records it instead.
+func addBuildBytes(ctx context.Context, buildID string, numBytes int64) error {
+	unlock, err := lockBuild(ctx, buildID)
+	if err != nil {
+		return err
+	}
+	defer logUnlockError(unlock, buildID)
+
+	metadata, key, err := findBuild(ctx, buildID)
+	if err != nil || metadata == nil || metadata.LogBytes == nil {
+		return err
+	}
+	logBytes := *metadata.LogBytes + numBytes
+	metadata.LogBytes = &logBytes
+
+	return putBuild(ctx, metadata, key)
+}
+
+// FindBuildByTaskID returns the metadata of all builds associated with the
+// given Evergreen task ID from the pail-backed offline storage. The builds are
+// looked up via the task index. If it holds none of the task's builds, all
+// build metadata in the bucket is scanned and the builds found are indexed.
+func FindBuildByTaskID(ctx context.Context, tracer otelTrace.Tracer, taskID string) ([]*Build, error) {
+	ctx, span := tracer.Start(ctx, "FindBuildByTaskID")
+	defer span.End()
+
+	if taskID == "" {
+		return nil, errors.New("task ID must not be empty")
+	}
+
+	buildIDs, err := getTaskIndex(ctx, taskID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting build index for task '%s'", taskID)
+	}
+
+	var builds []*Build
+	for _, id := range buildIDs {
+		build, err := FindBuildByID(ctx, tracer, id)
+		if err != nil {
+			return nil, errors.Wrapf(err, "finding indexed build for task '%s'", taskID)
+		}
+		if build == nil || build.TaskID != taskID {
+			continue
+		}
+		builds = append(builds, build)
+	}
+	if len(builds) > 0 {
+		return builds, nil
+	}
+
+	// Builds uploaded before the index existed, or whose index entry
+	// failed to be written, are only found by scanning, and are indexed
+	// so that the next lookup needn't scan.
+	builds, err = scanBuildsForTaskID(ctx, tracer, taskID)
+	if err != nil {
+		return nil, err
+	}
+	for _, build := range builds {
+		grip.Warning(message.WrapError(addBuildToTaskIndex(ctx, taskID, build.ID), message.Fields{
+			"message":  "repairing task index",
+			"task_id":  taskID,
+			"build_id": build.ID,
+		}))
+	}
+
+	return builds, nil
+}
+
+// AddBuildLabels merges the labels into the given build's labels, replacing
+// the values of labels that already exist and removing labels whose new value
+// is empty, and returns the updated build. If the build doesn't exist, nil is
+// returned.
+func AddBuildLabels(ctx context.Context, tracer otelTrace.Tracer, buildID string, labels map[string]string) (*Build, error) {
+	ctx, span := tracer.Start(ctx, "AddBuildLabels")
+	defer span.End()
+
+	unlock, err := lockBuild(ctx, buildID)
+	if err != nil {
+		return nil, err
+	}
+	defer logUnlockError(unlock, buildID)
+
+	metadata, key, err := findBuild(ctx, buildID)
+	if err != nil {
+		return nil, err
+	}
+	if metadata == nil {
 		return nil, nil
 	}
+	build := &metadata.Build
+
+	if build.Labels == nil {
+		build.Labels = map[string]string{}
+	}
+	for key, value := range labels {
+		if value == "" {
+			delete(build.Labels, key)
+			continue
+		}
+		build.Labels[key] = value
+	}
+	if err = ValidateLabels(build.Labels); err != nil {
+		return nil, errors.Wrapf(err, "validating labels for build '%s'", buildID)
+	}
+	if err = putBuild(ctx, metadata, key); err != nil {
+		return nil, err
+	}
+
+	return build, nil
+}
+
+// SetBuildTaskExecution sets the given build's task execution, for example
+// when its task is restarted, and returns the updated build. The build's logs
+// and tests are left as they are. If the build doesn't exist, nil is
+// returned.
+func SetBuildTaskExecution(ctx context.Context, tracer otelTrace.Tracer, buildID string, execution int) (*Build, error) {
+	ctx, span := tracer.Start(ctx, "SetBuildTaskExecution")
+	defer span.End()
+
+	if execution < 0 {
+		return nil, errors.Errorf("task execution %d must not be negative", execution)
+	}
+
+	unlock, err := lockBuild(ctx, buildID)
+	if err != nil {
+		return nil, err
+	}
+	defer logUnlockError(unlock, buildID)
+
+	metadata, key, err := findBuild(ctx, buildID)
 	if err != nil {
-		return nil, errors.Wrapf(err, "getting build metadata for build '%s'", id)
+		return nil, err
+	}
+	if metadata == nil {
+		return nil, nil
 	}
+	build := &metadata.Build
 
-	build := &Build{}
-	if err = json.NewDecoder(reader).Decode(build); err != nil {
-		return nil, errors.Wrapf(err, "parsing build metadata for build '%s'", id)
+	build.TaskExecution = execution
+	if err = putBuild(ctx, metadata, key); err != nil {
+		return nil, err
 	}
 
 	return build, nil
 }
 
+// scanBuildsForTaskID returns the metadata of all builds with the given task
+// ID by listing every build metadata file in the bucket. This is expensive and
+// should only be used for builds that predate the task index.
+func scanBuildsForTaskID(ctx context.Context, tracer otelTrace.Tracer, taskID string) ([]*Build, error) {
+	iter, err := env.Bucket().List(ctx, buildsPrefix)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing build keys")
+	}
+
+	var builds []*Build
+	for iter.Next(ctx) {
+		buildID, ok := buildIDFromMetadataKey(iter.Item().Name())
+		if !ok {
+			continue
+		}
+
+		build, err := FindBuildByID(ctx, tracer, buildID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "finding build '%s'", buildID)
+		}
+		if build == nil || build.TaskID != taskID {
+			continue
+		}
+		builds = append(builds, build)
+	}
+	if err = iter.Err(); err != nil {
+		return nil, errors.Wrap(err, "iterating build keys")
+	}
+
+	return builds, nil
+}
+
+const (
+	// DefaultListBuildsLimit is the number of build IDs listed per page
+	// when no limit is given.
+	DefaultListBuildsLimit = 100
+	// MaxListBuildsLimit is the largest number of build IDs listed per
+	// page.
+	MaxListBuildsLimit = 1000
+)
+
+// ListBuildsOptions are the options for listing build IDs.
+type ListBuildsOptions struct {
+	// Prefix restricts the builds to those whose ID starts with it.
+	Prefix string
+	// Limit is the maximum number of build IDs returned. Zero or less uses
+	// DefaultListBuildsLimit, and it's capped at MaxListBuildsLimit.
+	Limit int
+	// Token is the continuation token returned with the previous page.
+	// Empty lists the first page.
+	Token string
+}
+
+type invalidTokenError struct {
+	error
+}
+
+// IsInvalidTokenError returns whether the error is due to a continuation token
+// that couldn't be decoded.
+func IsInvalidTokenError(err error) bool {
+	_, ok := errors.Cause(err).(invalidTokenError)
+	return ok
+}
+
+// ListBuildIDs returns a page of the IDs of the builds in the bucket, found by
+// streaming the build metadata keys, and the token to pass to get the next
+// page. The token is empty when there are no more builds. Builds are returned
+// in the order of the listings from buildListings and, within each, in the
+// bucket's lexicographic key order, so pages stay consistent as long as the
+// bucket lists keys in that order. Listing stops as soon as the page is full,
+// and each page resumes from the listing the token's key is in. Since the
+// bucket can't list from a given key, that listing is streamed from its start
+// up to the token's key.
+func ListBuildIDs(ctx context.Context, tracer otelTrace.Tracer, opts ListBuildsOptions) ([]string, string, error) {
+	ctx, span := tracer.Start(ctx, "ListBuildIDs")
+	defer span.End()
+
+	if opts.Limit <= 0 {
+		opts.Limit = DefaultListBuildsLimit
+	}
+	if opts.Limit > MaxListBuildsLimit {
+		opts.Limit = MaxListBuildsLimit
+	}
+	var after string
+	if opts.Token != "" {
+		key, err := base64.RawURLEncoding.DecodeString(opts.Token)
+		if err != nil {
+			return nil, "", invalidTokenError{errors.Wrap(err, "decoding continuation token")}
+		}
+		after = string(key)
+	}
+
+	listings := buildListings(opts.Prefix)
+	start := 0
+	if after != "" {
+		for start < len(listings) && !listings[start].contains(after) {
+			start++
+		}
+		if start == len(listings) {
+			return nil, "", invalidTokenError{errors.Errorf("continuation token is not for builds with prefix '%s'", opts.Prefix)}
+		}
+	}
+
+	var buildIDs []string
+	var lastKey string
+	for i, listing := range listings[start:] {
+		iter, err := env.Bucket().List(ctx, listing.prefix)
+		if err != nil {
+			return nil, "", errors.Wrap(err, "listing build keys")
+		}
+
+		for iter.Next(ctx) {
+			key := iter.Item().Name()
+			if (i == 0 && key <= after) || !listing.contains(key) {
+				continue
+			}
+			buildID, ok := buildIDFromMetadataKey(key)
+			if !ok || !strings.HasPrefix(buildID, opts.Prefix) {
+				continue
+			}
+			if len(buildIDs) == opts.Limit {
+				return buildIDs, base64.RawURLEncoding.EncodeToString([]byte(lastKey)), nil
+			}
+
+			buildIDs = append(buildIDs, buildID)
+			lastKey = key
+		}
+		if err = iter.Err(); err != nil {
+			return nil, "", errors.Wrap(err, "iterating build keys")
+		}
+	}
+
+	return buildIDs, "", nil
+}
+
+// buildListing is a listing of build keys under a prefix.
+type buildListing struct {
+	prefix string
+	// layout restricts the listing to the keys in one layout, since a
+	// prefix in the unsharded layout can also match shards.
+	layout buildLayout
+}
+
+// buildLayout is a layout of build keys.
+type buildLayout int
+
+const (
+	layoutAny buildLayout = iota
+	layoutUnsharded
+	layoutSharded
+)
+
+// contains returns whether the given key belongs to the listing.
+func (l buildListing) contains(key string) bool {
+	if !strings.HasPrefix(key, l.prefix) {
+		return false
+	}
+	switch l.layout {
+	case layoutUnsharded:
+		return !isShardedBuildKey(key)
+	case layoutSharded:
+		return isShardedBuildKey(key)
+	default:
+		return true
+	}
+}
+
+// buildListings returns the listings that together hold the metadata of every
+// build whose ID starts with the given prefix. Without a prefix, or if the
+// bucket only lists whole directories, the builds prefix is listed as a whole
+// since it holds both layouts. Otherwise the unsharded layout is listed under
+// the ID prefix directly, and the sharded layout under the ID prefix in each
+// shard, so that only the matching builds' keys are listed.
+func buildListings(prefix string) []buildListing {
+	if prefix == "" || !env.Bucket().ListsKeyPrefixes() {
+		return []buildListing{{prefix: buildsPrefix}}
+	}
+
+	listings := []buildListing{{prefix: buildsPrefix + prefix, layout: layoutUnsharded}}
+	// Each shard is a byte in hex, as returned by buildShard.
+	for shard := 0; shard < 256; shard++ {
+		listings = append(listings, buildListing{
+			prefix: fmt.Sprintf("%s%02x/%s", buildsPrefix, shard, prefix),
+			layout: layoutSharded,
+		})
+	}
+
+	return listings
+}
+
+// buildIDFromMetadataKey returns the build ID from the given key if it is the
+// key of a build's metadata file.
+func buildIDFromMetadataKey(key string) (string, bool) {
+	buildID, rest, ok := splitBuildKey(key)
+	if !ok || len(rest) != 1 || rest[0] != metadataFilename {
+		return "", false
+	}
+
+	return buildID, true
+}
+
+// getTaskIndex returns the IDs of the builds indexed for the given task ID,
+// in lexicographic order. If the task has no index, nil is returned.
+func getTaskIndex(ctx context.Context, taskID string) ([]string, error) {
+	prefix := taskIndexPrefix(taskID)
+	iter, err := env.Bucket().List(ctx, prefix)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing task index")
+	}
+
+	var buildIDs []string
+	for iter.Next(ctx) {
+		buildID := strings.TrimPrefix(strings.TrimPrefix(iter.Item().Name(), "/"), prefix)
+		if buildID != "" && !strings.Contains(buildID, "/") {
+			buildIDs = append(buildIDs, buildID)
+		}
+	}
+	if err = iter.Err(); err != nil {
+		return nil, errors.Wrap(err, "iterating task index")
+	}
+	sort.Strings(buildIDs)
+
+	return buildIDs, nil
+}
+
+// addBuildToTaskIndex adds the given build ID to the index of builds for the
+// given task ID. Builds without a task ID are not indexed. Each indexed build
+// is its own empty object under the task's prefix, so concurrent uploads of
+// different builds for the same task never overwrite each other's entries.
+func addBuildToTaskIndex(ctx context.Context, taskID string, buildID string) error {
+	if taskID == "" {
+		return nil
+	}
+
+	return errors.Wrap(env.Bucket().Put(ctx, taskIndexPrefix(taskID)+buildID, bytes.NewReader(nil)), "uploading task index entry")
+}
+
+func taskIndexPrefix(taskID string) string {
+	return fmt.Sprintf("%s%s/", buildsByTaskPrefix, taskID)
+}
+
 // CheckBuildMetadata returns whether the metadata file exists for the given build.
 func CheckBuildMetadata(ctx context.Context, tracer otelTrace.Tracer, id string) (bool, error) {
 	spanCtx, span := tracer.Start(ctx, "CheckBuildMetadata")
@@ -110,42 +730,263 @@ func CheckBuildMetadata(ctx context.Context, tracer otelTrace.Tracer, id string)
 	return checkMetadata(spanCtx, id, "")
 }
 
+// BuildHasLogs returns whether any log chunks, either the build's own or its
+// tests', have been uploaded for the given build. A build that doesn't exist
+// has no logs.
+func BuildHasLogs(ctx context.Context, tracer otelTrace.Tracer, buildID string) (bool, error) {
+	ctx, span := tracer.Start(ctx, "BuildHasLogs")
+	defer span.End()
+
+	for _, prefix := range buildPrefixes(buildID) {
+		iter, err := env.Bucket().List(ctx, prefix)
+		if err != nil {
+			return false, errors.Wrapf(err, "listing keys for build '%s'", buildID)
+		}
+
+		// Stop at the first chunk rather than listing every key.
+		for iter.Next(ctx) {
+			key := iter.Item().Name()
+			if keyBuildID, _, _ := splitBuildKey(key); keyBuildID == buildID && !strings.HasSuffix(key, metadataFilename) {
+				return true, nil
+			}
+		}
+		if err = iter.Err(); err != nil {
+			return false, errors.Wrap(err, "iterating build keys")
+		}
+	}
+
+	return false, nil
+}
+
+// DeleteBuild removes all of the given build's keys, its metadata as well as
+// the build's and its tests' log chunks, from the bucket, removing up to
+// concurrency keys at once. Keys that fail to be removed don't stop the rest
+// from being removed and are named in the returned error.
+func DeleteBuild(ctx context.Context, tracer otelTrace.Tracer, buildID string, concurrency int) error {
+	ctx, span := tracer.Start(ctx, "DeleteBuild")
+	defer span.End()
+
+	keys, err := listBuildKeys(ctx, buildID, "")
+	if err != nil {
+		return err
+	}
+	// The manifest is removed first so that reads never follow it to keys
+	// that have been removed.
+	if err = env.Bucket().Remove(ctx, chunkManifestKey(buildID)); err != nil && !pail.IsKeyNotFoundError(err) {
+		return errors.Wrapf(err, "removing chunk manifest of build '%s'", buildID)
+	}
+
+	if err = env.Bucket().RemoveConcurrently(ctx, keys, concurrency); err != nil {
+		return errors.Wrapf(err, "deleting build '%s'", buildID)
+	}
+	usage := storageUsageOfKeys(keys)
+	addStorageUsage(-usage.Builds, -usage.Chunks)
+
+	return nil
+}
+
+// DeleteBuilds removes the given builds like DeleteBuild, deleting up to
+// concurrency builds at once, or one at a time if concurrency is not
+// positive. A build that fails to be deleted doesn't stop the rest from being
+// deleted; the returned error names every build that couldn't be.
+func DeleteBuilds(ctx context.Context, tracer otelTrace.Tracer, buildIDs []string, concurrency int) error {
+	ctx, span := tracer.Start(ctx, "DeleteBuilds")
+	defer span.End()
+
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	if concurrency > len(buildIDs) {
+		concurrency = len(buildIDs)
+	}
+
+	catcher := grip.NewBasicCatcher()
+	toDelete := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for buildID := range toDelete {
+				catcher.Wrapf(DeleteBuild(ctx, tracer, buildID, 0), "build '%s'", buildID)
+			}
+		}()
+	}
+
+	for i, buildID := range buildIDs {
+		if err := ctx.Err(); err != nil {
+			catcher.Wrapf(err, "deleting remaining %d builds", len(buildIDs)-i)
+			break
+		}
+		toDelete <- buildID
+	}
+	close(toDelete)
+	wg.Wait()
+
+	return catcher.Resolve()
+}
+
+// DeleteBuildLogs removes the log chunks of the given build and its tests
+// from the bucket, removing up to concurrency keys at once, while keeping the
+// build's and its tests' metadata. The build is marked as scrubbed before any
+// chunk is removed, so a build whose chunks were only partially removed is
+// still reported as scrubbed and the removal can be retried. It returns the
+// updated build, or nil if the build doesn't exist.
+func DeleteBuildLogs(ctx context.Context, tracer otelTrace.Tracer, buildID string, concurrency int) (*Build, error) {
+	ctx, span := tracer.Start(ctx, "DeleteBuildLogs")
+	defer span.End()
+
+	unlock, err := lockBuild(ctx, buildID)
+	if err != nil {
+		return nil, err
+	}
+	defer logUnlockError(unlock, buildID)
+
+	metadata, key, err := findBuild(ctx, buildID)
+	if err != nil {
+		return nil, err
+	}
+	if metadata == nil {
+		return nil, nil
+	}
+	build := &metadata.Build
+
+	if !build.Scrubbed {
+		build.Scrubbed = true
+		if err = putBuild(ctx, metadata, key); err != nil {
+			return nil, err
+		}
+	}
+
+	keys, err := listBuildKeys(ctx, buildID, "")
+	if err != nil {
+		return nil, err
+	}
+	var chunkKeys []string
+	for _, key := range keys {
+		if !strings.HasSuffix(key, metadataFilename) {
+			chunkKeys = append(chunkKeys, key)
+		}
+	}
+	// The manifest is removed first so that reads never follow it to keys
+	// that have been removed, and rebuilt once the chunks are gone.
+	if err = env.Bucket().Remove(ctx, chunkManifestKey(buildID)); err != nil && !pail.IsKeyNotFoundError(err) {
+		return nil, errors.Wrapf(err, "removing chunk manifest of build '%s'", buildID)
+	}
+
+	if err = env.Bucket().RemoveConcurrently(ctx, chunkKeys, concurrency); err != nil {
+		return nil, errors.Wrapf(err, "deleting logs of build '%s'", buildID)
+	}
+	addStorageUsage(0, -len(chunkKeys))
+
+	if err = rebuildChunkManifest(ctx, buildID); err != nil {
+		return nil, errors.Wrapf(err, "rebuilding chunk manifest for build '%s'", buildID)
+	}
+
+	return build, nil
+}
+
 // checkMetadata returns whether the metadata file exists for the given build
 // or test. If the test ID is not empty, the metadata of the test for the given
 // build is checked, otherwise the top-level build metadata is checked. A build
 // ID is required in both cases.
 func checkMetadata(ctx context.Context, buildID string, testID string) (bool, error) {
-	var key string
-	if testID == "" {
-		key = metadataKeyForBuild(buildID)
-	} else {
-		key = metadataKeyForTest(buildID, testID)
+	name := metadataFilename
+	if testID != "" {
+		name = testSubPrefix(testID) + metadataFilename
 	}
 
-	exists, err := env.Bucket().Exists(ctx, key)
-	if err != nil {
-		return false, errors.Wrap(err, "checking if metadata file exists")
+	for _, prefix := range buildPrefixes(buildID) {
+		exists, err := env.Bucket().Exists(ctx, prefix+name)
+		if err != nil {
+			return false, errors.Wrap(err, "checking if metadata file exists")
+		}
+		if exists {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// getFromBuildPrefixes returns a reader for the key with the given name under
+// the first of the given build's prefixes it exists under, and that key. If it
+// exists under none of them, the key not found error of the last prefix tried
+// is returned.
+func getFromBuildPrefixes(ctx context.Context, buildID string, name string) (io.ReadCloser, string, error) {
+	var err error
+	for _, prefix := range buildPrefixes(buildID) {
+		var reader io.ReadCloser
+		reader, err = env.Bucket().Get(ctx, prefix+name)
+		if !pail.IsKeyNotFoundError(err) {
+			return reader, prefix + name, err
+		}
 	}
 
-	return exists, nil
+	return nil, "", err
 }
 
-// getBuildKeys returns the all the keys contained within the build prefix.
+// getBuildKeys returns the all the keys contained within the build prefix. If
+// chunk manifests are enabled and the build has one without pending keys, the
+// keys are read from it rather than listed.
 func getBuildKeys(ctx context.Context, tracer otelTrace.Tracer, buildID string) ([]string, error) {
-	_, span := tracer.Start(ctx, "GetBuildKeys")
+	ctx, span := tracer.Start(ctx, "GetBuildKeys")
 	defer span.End()
-	iter, err := env.Bucket().List(ctx, buildPrefix(buildID))
-	if err != nil {
-		return nil, errors.Wrapf(err, "listing keys for build '%s'", buildID)
+
+	if env.ChunkManifests() {
+		manifest, err := getChunkManifest(ctx, buildID)
+		if err == nil && manifest != nil && manifest.complete() {
+			return manifest.Keys, nil
+		}
+		grip.Warning(message.WrapError(err, message.Fields{
+			"message":  "reading chunk manifest, listing build keys instead",
+			"build_id": buildID,
+		}))
 	}
 
+	return listBuildKeys(ctx, buildID, "")
+}
+
+var (
+	// ErrNoBuildKeys is returned, possibly wrapped, when a build has no
+	// keys in the bucket.
+	ErrNoBuildKeys = errors.New("no keys found for build")
+	// ErrListFailed is matched, using errors.Is, by errors returned when
+	// listing a build's keys fails.
+	ErrListFailed = errors.New("listing keys failed")
+)
+
+// listFailedError wraps an error from listing keys in the bucket so that it
+// matches ErrListFailed while keeping its cause.
+type listFailedError struct {
+	error
+}
+
+func (e listFailedError) Is(target error) bool { return target == ErrListFailed }
+
+func (e listFailedError) Unwrap() error { return e.error }
+
+// listBuildKeys returns the keys of the given build that start with the given
+// sub-prefix under each of the build's prefixes. Keys belonging to other
+// builds whose prefix happens to share the listed prefix are skipped. Listing
+// failures match ErrListFailed.
+func listBuildKeys(ctx context.Context, buildID string, subPrefix string) ([]string, error) {
 	var keys []string
-	for iter.Next(ctx) {
-		keys = append(keys, iter.Item().Name())
-	}
+	for _, prefix := range buildPrefixes(buildID) {
+		iter, err := env.Bucket().List(ctx, prefix+subPrefix)
+		if err != nil {
+			return nil, listFailedError{errors.Wrapf(err, "listing keys for build '%s'", buildID)}
+		}
 
-	if err := iter.Err(); err != nil {
-		return nil, errors.Wrap(err, "iterating build keys")
+		for iter.Next(ctx) {
+			key := iter.Item().Name()
+			if keyBuildID, _, _ := splitBuildKey(key); keyBuildID == buildID {
+				keys = append(keys, key)
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return nil, listFailedError{errors.Wrap(err, "iterating build keys")}
+		}
 	}
 
 	return keys, nil
@@ -2,12 +2,20 @@ package model
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"go.opentelemetry.io/otel"
 	"io"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/evergreen-ci/logkeeper/env"
+	"github.com/evergreen-ci/logkeeper/storage"
 	"github.com/evergreen-ci/logkeeper/testutil"
+	"github.com/evergreen-ci/pail"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -38,6 +46,44 @@ func TestNewBuildID(t *testing.T) {
 	assert.Equal(t, "b2f7b29a7f76e38abe38fc8145c0cf98", result)
 }
 
+func TestNewBuildIDWithOptions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+
+	t.Run("Deterministic", func(t *testing.T) {
+		result, err := NewBuildIDWithOptions(ctx, tracer, "A", 123, BuildIDOptions{Mode: BuildIDDeterministic, TaskExecution: 1})
+		require.NoError(t, err)
+		assert.Equal(t, "1e7747b3e13274f0bee0de868c8314c9", result)
+	})
+	t.Run("TaskExecution", func(t *testing.T) {
+		execution0, err := NewBuildIDWithOptions(ctx, tracer, "A", 123, BuildIDOptions{Mode: BuildIDTaskExecution})
+		require.NoError(t, err)
+		execution1, err := NewBuildIDWithOptions(ctx, tracer, "A", 123, BuildIDOptions{Mode: BuildIDTaskExecution, TaskExecution: 1})
+		require.NoError(t, err)
+		retry, err := NewBuildIDWithOptions(ctx, tracer, "A", 123, BuildIDOptions{Mode: BuildIDTaskExecution, TaskExecution: 1})
+		require.NoError(t, err)
+
+		assert.NotEqual(t, "1e7747b3e13274f0bee0de868c8314c9", execution0)
+		assert.NotEqual(t, execution0, execution1)
+		assert.Equal(t, execution1, retry)
+	})
+	t.Run("Unique", func(t *testing.T) {
+		seen := map[string]bool{"1e7747b3e13274f0bee0de868c8314c9": true}
+		for i := 0; i < 10; i++ {
+			result, err := NewBuildIDWithOptions(ctx, tracer, "A", 123, BuildIDOptions{Mode: BuildIDUnique})
+			require.NoError(t, err)
+			assert.Len(t, result, 32)
+			assert.False(t, seen[result])
+			seen[result] = true
+		}
+	})
+	t.Run("UnknownMode", func(t *testing.T) {
+		_, err := NewBuildIDWithOptions(ctx, tracer, "A", 123, BuildIDOptions{Mode: BuildIDUnique + 1})
+		assert.Error(t, err)
+	})
+}
+
 func TestUploadBuildMetadata(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -50,7 +96,9 @@ func TestUploadBuildMetadata(t *testing.T) {
 		BuildNum: 1,
 		TaskID:   "t0",
 	}
-	expectedData, err := build.toJSON()
+	// A new build's own log chunks are recorded as empty.
+	var logBytes int64
+	expectedData, err := json.Marshal(buildMetadata{Build: build, LogBytes: &logBytes})
 	require.NoError(t, err)
 	require.NoError(t, build.UploadMetadata(ctx, tracer))
 
@@ -62,6 +110,72 @@ func TestUploadBuildMetadata(t *testing.T) {
 	assert.Equal(t, expectedData, data)
 }
 
+func TestUploadBuildMetadataConcurrent(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+
+	defer testutil.SetBucket(t, "")()
+	build := Build{
+		ID:       "5a75f537726934e4b62833ab6d5dca41",
+		Builder:  "builder0",
+		BuildNum: 1,
+		TaskID:   "t0",
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b := build
+			errs <- b.UploadMetadata(ctx, tracer)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+
+	found, err := FindBuildByID(ctx, tracer, build.ID)
+	require.NoError(t, err)
+	assert.Equal(t, &build, found)
+
+	builds, err := FindBuildByTaskID(ctx, tracer, build.TaskID)
+	require.NoError(t, err)
+	require.Len(t, builds, 1)
+	assert.Equal(t, &build, builds[0])
+
+	t.Run("DifferentContent", func(t *testing.T) {
+		// Uploads whose content differs are all written rather than
+		// sharing the result of whichever is in flight.
+		var wg sync.WaitGroup
+		errs := make(chan error, 10)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				b := build
+				b.TaskID = fmt.Sprintf("task%d", i)
+				errs <- b.UploadMetadata(ctx, tracer)
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			assert.NoError(t, err)
+		}
+
+		for i := 0; i < 10; i++ {
+			buildIDs, err := getTaskIndex(ctx, fmt.Sprintf("task%d", i))
+			require.NoError(t, err)
+			assert.Equal(t, []string{build.ID}, buildIDs)
+		}
+	})
+}
+
 func TestBuildKey(t *testing.T) {
 	build := Build{
 		ID:            "b0",
@@ -73,6 +187,368 @@ func TestBuildKey(t *testing.T) {
 	assert.Equal(t, "builds/b0/metadata.json", build.key())
 }
 
+func TestShardedBuildKeys(t *testing.T) {
+	env.SetShardBuildKeys(true)
+	defer env.SetShardBuildKeys(false)
+
+	shard := buildShard("b0")
+	assert.Len(t, shard, 2)
+	assert.Equal(t, shard, buildShard("b0"))
+	assert.Equal(t, "builds/"+shard+"/b0/metadata.json", (&Build{ID: "b0"}).key())
+	assert.Equal(t, "builds/"+shard+"/b0/tests/t0/metadata.json", (&Test{ID: "t0", BuildID: "b0"}).key())
+
+	for _, key := range []string{"builds/b0/metadata.json", "builds/" + shard + "/b0/metadata.json"} {
+		buildID, ok := buildIDFromMetadataKey(key)
+		assert.True(t, ok, key)
+		assert.Equal(t, "b0", buildID, key)
+		assert.True(t, isBuildMetadataKey(key), key)
+	}
+	for _, key := range []string{"builds/b0/tests/t0/metadata.json", "builds/" + shard + "/b0/tests/t0/metadata.json"} {
+		_, ok := buildIDFromMetadataKey(key)
+		assert.False(t, ok, key)
+		testID, err := testIDFromKey(key)
+		require.NoError(t, err)
+		assert.Equal(t, "t0", testID)
+	}
+	assert.True(t, isShardedBuildKey("builds/"+shard+"/b0/metadata.json"))
+	assert.False(t, isShardedBuildKey("builds/b0/metadata.json"))
+}
+
+func TestShardedBuildLookups(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	defer testutil.SetBucket(t, "../testdata/simple")()
+	env.SetShardBuildKeys(true)
+	defer env.SetShardBuildKeys(false)
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+
+	start := time.Unix(1000000000, 0).UTC()
+	lines := []LogLineItem{
+		{Timestamp: start, Data: "line0"},
+		{Timestamp: start.Add(time.Second), Data: "line1"},
+	}
+	downloadLines := func(t *testing.T, buildID string, testID string) []string {
+		logLines, err := DownloadLogLines(ctx, tracer, buildID, testID)
+		require.NoError(t, err)
+		var data []string
+		for line := range logLines {
+			data = append(data, line.Data)
+		}
+		return data
+	}
+
+	t.Run("Unsharded", func(t *testing.T) {
+		buildID := "5a75f537726934e4b62833ab6d5dca41"
+		testID := "17046404de18d0000000000000000000"
+
+		build, err := FindBuildByID(ctx, tracer, buildID)
+		require.NoError(t, err)
+		require.NotNil(t, build)
+		exists, err := CheckTestMetadata(ctx, tracer, buildID, testID)
+		require.NoError(t, err)
+		assert.True(t, exists)
+
+		numDownloaded := len(downloadLines(t, buildID, testID))
+
+		// Appending to an unsharded test writes sharded keys, but the
+		// test is still read as a whole.
+		_, err = InsertLogLines(ctx, tracer, buildID, testID, lines, 4*1024*1024)
+		require.NoError(t, err)
+		exists, err = env.Bucket().Exists(ctx, metadataKeyForTest(buildID, testID))
+		require.NoError(t, err)
+		assert.True(t, exists)
+
+		test, err := FindTestByID(ctx, tracer, buildID, testID)
+		require.NoError(t, err)
+		require.NotNil(t, test)
+		assert.Equal(t, 13, test.NumLines)
+		testIDs, err := ListTestIDs(ctx, tracer, buildID)
+		require.NoError(t, err)
+		assert.Equal(t, []string{testID}, testIDs)
+		assert.Len(t, downloadLines(t, buildID, testID), numDownloaded+len(lines))
+	})
+	t.Run("Sharded", func(t *testing.T) {
+		buildID := "sharded"
+		require.NoError(t, (&Build{ID: buildID, TaskID: "sharded_task"}).UploadMetadata(ctx, tracer))
+		test := &Test{ID: NewTestID(start), BuildID: buildID}
+		require.NoError(t, test.UploadTestMetadata(ctx, tracer))
+		_, err := InsertLogLines(ctx, tracer, buildID, "", lines, 4*1024*1024)
+		require.NoError(t, err)
+		_, err = InsertLogLines(ctx, tracer, buildID, test.ID, lines, 4*1024*1024)
+		require.NoError(t, err)
+
+		keys, err := getBuildKeys(ctx, tracer, buildID)
+		require.NoError(t, err)
+		require.Len(t, keys, 4)
+		for _, key := range keys {
+			assert.True(t, isShardedBuildKey(key), key)
+		}
+
+		builds, err := FindBuildByTaskID(ctx, tracer, "sharded_task")
+		require.NoError(t, err)
+		require.Len(t, builds, 1)
+		assert.Equal(t, buildID, builds[0].ID)
+		hasLogs, err := BuildHasLogs(ctx, tracer, buildID)
+		require.NoError(t, err)
+		assert.True(t, hasLogs)
+		tests, err := FindTestsForBuild(ctx, tracer, buildID)
+		require.NoError(t, err)
+		require.Len(t, tests, 1)
+		assert.Equal(t, 2, tests[0].NumLines)
+		assert.Equal(t, []string{"line0", "line0", "line1", "line1"}, downloadLines(t, buildID, ""))
+
+		require.NoError(t, DeleteBuild(ctx, tracer, buildID, 2))
+		exists, err := CheckBuildMetadata(ctx, tracer, buildID)
+		require.NoError(t, err)
+		assert.False(t, exists)
+	})
+}
+
+func TestValidateLabels(t *testing.T) {
+	manyLabels := map[string]string{}
+	for i := 0; i < MaxBuildLabels; i++ {
+		manyLabels[fmt.Sprintf("key%d", i)] = "value"
+	}
+	assert.NoError(t, ValidateLabels(nil))
+	assert.NoError(t, ValidateLabels(manyLabels))
+	assert.NoError(t, ValidateLabels(map[string]string{strings.Repeat("k", MaxLabelKeySize): strings.Repeat("v", MaxLabelValueSize)}))
+
+	manyLabels["one_more"] = "value"
+	for name, labels := range map[string]map[string]string{
+		"TooMany":       manyLabels,
+		"EmptyKey":      {"": "value"},
+		"KeyTooLarge":   {strings.Repeat("k", MaxLabelKeySize+1): "value"},
+		"ValueTooLarge": {"key": strings.Repeat("v", MaxLabelValueSize+1)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := ValidateLabels(labels)
+			require.Error(t, err)
+			assert.True(t, IsInvalidLabelsError(err))
+		})
+	}
+}
+
+func TestListBuildIDs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	defer testutil.SetBucket(t, "")()
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+
+	buildIDs := []string{"aa01", "aa02", "aa03", "ab01", "ba01"}
+	for _, buildID := range buildIDs {
+		require.NoError(t, (&Build{ID: buildID}).UploadMetadata(ctx, tracer))
+		require.NoError(t, (&Test{ID: "test0", BuildID: buildID}).UploadTestMetadata(ctx, tracer))
+	}
+
+	listAll := func(t *testing.T, opts ListBuildsOptions) ([]string, int) {
+		var all []string
+		pages := 0
+		for {
+			ids, token, err := ListBuildIDs(ctx, tracer, opts)
+			require.NoError(t, err)
+			pages++
+			all = append(all, ids...)
+			if token == "" {
+				return all, pages
+			}
+			require.NotEmpty(t, ids)
+			opts.Token = token
+		}
+	}
+
+	t.Run("SinglePage", func(t *testing.T) {
+		ids, token, err := ListBuildIDs(ctx, tracer, ListBuildsOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, buildIDs, ids)
+		assert.Empty(t, token)
+	})
+	t.Run("Paginated", func(t *testing.T) {
+		ids, token, err := ListBuildIDs(ctx, tracer, ListBuildsOptions{Limit: 2})
+		require.NoError(t, err)
+		assert.Equal(t, buildIDs[:2], ids)
+		require.NotEmpty(t, token)
+
+		ids, token, err = ListBuildIDs(ctx, tracer, ListBuildsOptions{Limit: 2, Token: token})
+		require.NoError(t, err)
+		assert.Equal(t, buildIDs[2:4], ids)
+		require.NotEmpty(t, token)
+
+		ids, token, err = ListBuildIDs(ctx, tracer, ListBuildsOptions{Limit: 2, Token: token})
+		require.NoError(t, err)
+		assert.Equal(t, buildIDs[4:], ids)
+		assert.Empty(t, token)
+	})
+	t.Run("ExactPages", func(t *testing.T) {
+		ids, pages := listAll(t, ListBuildsOptions{Prefix: "aa", Limit: 3})
+		assert.Equal(t, buildIDs[:3], ids)
+		assert.Equal(t, 1, pages)
+	})
+	t.Run("Prefix", func(t *testing.T) {
+		ids, pages := listAll(t, ListBuildsOptions{Prefix: "a", Limit: 1})
+		assert.Equal(t, buildIDs[:4], ids)
+		assert.Equal(t, 4, pages)
+
+		ids, _ = listAll(t, ListBuildsOptions{Prefix: "c"})
+		assert.Empty(t, ids)
+	})
+	t.Run("Sharded", func(t *testing.T) {
+		env.SetShardBuildKeys(true)
+		defer env.SetShardBuildKeys(false)
+		require.NoError(t, (&Build{ID: "aa04"}).UploadMetadata(ctx, tracer))
+
+		ids, _ := listAll(t, ListBuildsOptions{Prefix: "aa", Limit: 2})
+		assert.ElementsMatch(t, []string{"aa01", "aa02", "aa03", "aa04"}, ids)
+	})
+	t.Run("InvalidToken", func(t *testing.T) {
+		_, _, err := ListBuildIDs(ctx, tracer, ListBuildsOptions{Token: "not a token!"})
+		require.Error(t, err)
+		assert.True(t, IsInvalidTokenError(err))
+	})
+}
+
+func TestBuildLabels(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	defer testutil.SetBucket(t, "")()
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+
+	t.Run("SetAtCreation", func(t *testing.T) {
+		build := &Build{ID: "labeled", Labels: map[string]string{"branch": "main"}}
+		require.NoError(t, build.UploadMetadata(ctx, tracer))
+
+		found, err := FindBuildByID(ctx, tracer, build.ID)
+		require.NoError(t, err)
+		require.NotNil(t, found)
+		assert.Equal(t, build.Labels, found.Labels)
+	})
+	t.Run("InvalidAtCreation", func(t *testing.T) {
+		build := &Build{ID: "invalid", Labels: map[string]string{"": "value"}}
+		err := build.UploadMetadata(ctx, tracer)
+		require.Error(t, err)
+		assert.True(t, IsInvalidLabelsError(err))
+
+		exists, err := CheckBuildMetadata(ctx, tracer, build.ID)
+		require.NoError(t, err)
+		assert.False(t, exists)
+	})
+	t.Run("Merge", func(t *testing.T) {
+		build := &Build{ID: "merged", Builder: "builder", Labels: map[string]string{"branch": "main", "pr": "1"}}
+		require.NoError(t, build.UploadMetadata(ctx, tracer))
+
+		updated, err := AddBuildLabels(ctx, tracer, build.ID, map[string]string{"pr": "2", "author": "someone", "branch": ""})
+		require.NoError(t, err)
+		expected := map[string]string{"pr": "2", "author": "someone"}
+		require.NotNil(t, updated)
+		assert.Equal(t, expected, updated.Labels)
+		assert.Equal(t, "builder", updated.Builder)
+
+		found, err := FindBuildByID(ctx, tracer, build.ID)
+		require.NoError(t, err)
+		assert.Equal(t, expected, found.Labels)
+	})
+	t.Run("MergeExceedsLimit", func(t *testing.T) {
+		labels := map[string]string{}
+		for i := 0; i < MaxBuildLabels; i++ {
+			labels[fmt.Sprintf("key%d", i)] = "value"
+		}
+		build := &Build{ID: "full", Labels: labels}
+		require.NoError(t, build.UploadMetadata(ctx, tracer))
+
+		_, err := AddBuildLabels(ctx, tracer, build.ID, map[string]string{"one_more": "value"})
+		require.Error(t, err)
+		assert.True(t, IsInvalidLabelsError(err))
+
+		found, err := FindBuildByID(ctx, tracer, build.ID)
+		require.NoError(t, err)
+		assert.Equal(t, labels, found.Labels)
+	})
+	t.Run("NonexistentBuild", func(t *testing.T) {
+		build, err := AddBuildLabels(ctx, tracer, "DNE", map[string]string{"branch": "main"})
+		require.NoError(t, err)
+		assert.Nil(t, build)
+	})
+	t.Run("UnshardedWithShardingEnabled", func(t *testing.T) {
+		build := &Build{ID: "unsharded"}
+		require.NoError(t, build.UploadMetadata(ctx, tracer))
+		env.SetShardBuildKeys(true)
+		defer env.SetShardBuildKeys(false)
+
+		_, err := AddBuildLabels(ctx, tracer, build.ID, map[string]string{"branch": "main"})
+		require.NoError(t, err)
+
+		exists, err := env.Bucket().Exists(ctx, buildPrefixForLayout(build.ID, true)+metadataFilename)
+		require.NoError(t, err)
+		assert.False(t, exists)
+		found, err := FindBuildByID(ctx, tracer, build.ID)
+		require.NoError(t, err)
+		require.NotNil(t, found)
+		assert.Equal(t, map[string]string{"branch": "main"}, found.Labels)
+	})
+}
+
+func TestSetBuildTaskExecution(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	defer testutil.SetBucket(t, "../testdata/simple")()
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+
+	original, err := FindBuildByID(ctx, tracer, buildID)
+	require.NoError(t, err)
+	require.NotNil(t, original)
+	count, err := CountLogLines(ctx, tracer, buildID, "")
+	require.NoError(t, err)
+
+	t.Run("Update", func(t *testing.T) {
+		updated, err := SetBuildTaskExecution(ctx, tracer, buildID, original.TaskExecution+1)
+		require.NoError(t, err)
+		require.NotNil(t, updated)
+		assert.Equal(t, original.TaskExecution+1, updated.TaskExecution)
+
+		found, err := FindBuildByID(ctx, tracer, buildID)
+		require.NoError(t, err)
+		expected := *original
+		expected.TaskExecution++
+		assert.Equal(t, &expected, found)
+
+		newCount, err := CountLogLines(ctx, tracer, buildID, "")
+		require.NoError(t, err)
+		assert.Equal(t, count, newCount)
+	})
+	t.Run("Negative", func(t *testing.T) {
+		_, err := SetBuildTaskExecution(ctx, tracer, buildID, -1)
+		assert.Error(t, err)
+
+		found, err := FindBuildByID(ctx, tracer, buildID)
+		require.NoError(t, err)
+		assert.Equal(t, original.TaskExecution+1, found.TaskExecution)
+	})
+	t.Run("NonexistentBuild", func(t *testing.T) {
+		build, err := SetBuildTaskExecution(ctx, tracer, "DNE", 1)
+		require.NoError(t, err)
+		assert.Nil(t, build)
+	})
+	t.Run("UnshardedWithShardingEnabled", func(t *testing.T) {
+		env.SetShardBuildKeys(true)
+		defer env.SetShardBuildKeys(false)
+
+		updated, err := SetBuildTaskExecution(ctx, tracer, buildID, original.TaskExecution+2)
+		require.NoError(t, err)
+		require.NotNil(t, updated)
+
+		exists, err := env.Bucket().Exists(ctx, buildPrefixForLayout(buildID, true)+metadataFilename)
+		require.NoError(t, err)
+		assert.False(t, exists)
+		found, err := FindBuildByID(ctx, tracer, buildID)
+		require.NoError(t, err)
+		assert.Equal(t, original.TaskExecution+2, found.TaskExecution)
+	})
+}
+
 func TestBuildToJSON(t *testing.T) {
 	build := Build{
 		ID:            "b0",
@@ -105,6 +581,226 @@ func TestCheckBuildMetadata(t *testing.T) {
 	})
 }
 
+func TestBuildHasLogs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	defer testutil.SetBucket(t, "../testdata/simple")()
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+
+	t.Run("BuildWithLogs", func(t *testing.T) {
+		hasLogs, err := BuildHasLogs(ctx, tracer, "5a75f537726934e4b62833ab6d5dca41")
+		require.NoError(t, err)
+		assert.True(t, hasLogs)
+	})
+	t.Run("MetadataOnly", func(t *testing.T) {
+		buildID := "metadata-only"
+		require.NoError(t, (&Build{ID: buildID}).UploadMetadata(ctx, tracer))
+		require.NoError(t, (&Test{ID: NewTestID(time.Now()), BuildID: buildID}).UploadTestMetadata(ctx, tracer))
+
+		hasLogs, err := BuildHasLogs(ctx, tracer, buildID)
+		require.NoError(t, err)
+		assert.False(t, hasLogs)
+	})
+	t.Run("NonexistentBuild", func(t *testing.T) {
+		hasLogs, err := BuildHasLogs(ctx, tracer, "DOA")
+		require.NoError(t, err)
+		assert.False(t, hasLogs)
+	})
+}
+
+func TestDeleteBuild(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	defer testutil.SetBucket(t, "")()
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+
+	start := time.Unix(1000000000, 0).UTC()
+	uploadBuild := func(t *testing.T, buildID string) {
+		require.NoError(t, (&Build{ID: buildID}).UploadMetadata(ctx, tracer))
+		test := &Test{ID: NewTestID(start), BuildID: buildID}
+		require.NoError(t, test.UploadTestMetadata(ctx, tracer))
+
+		lines := make([]LogLineItem, 100)
+		for i := range lines {
+			lines[i] = LogLineItem{Timestamp: start.Add(time.Duration(i) * time.Millisecond), Data: "line"}
+		}
+		_, err := InsertLogLinesWithLineLimit(ctx, tracer, buildID, "", lines, 1024, 1)
+		require.NoError(t, err)
+		_, err = InsertLogLinesWithLineLimit(ctx, tracer, buildID, test.ID, lines, 1024, 1)
+		require.NoError(t, err)
+	}
+
+	uploadBuild(t, "deleted")
+	uploadBuild(t, "kept")
+	keys, err := getBuildKeys(ctx, tracer, "deleted")
+	require.NoError(t, err)
+	require.Len(t, keys, 202)
+
+	require.NoError(t, DeleteBuild(ctx, tracer, "deleted", 8))
+
+	keys, err = getBuildKeys(ctx, tracer, "deleted")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+	keys, err = getBuildKeys(ctx, tracer, "kept")
+	require.NoError(t, err)
+	assert.Len(t, keys, 202)
+
+	require.NoError(t, DeleteBuild(ctx, tracer, "DNE", 8))
+}
+
+func TestDeleteBuilds(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	defer testutil.SetBucket(t, "")()
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+
+	start := time.Unix(1000000000, 0).UTC()
+	uploadBuild := func(t *testing.T, buildID string) {
+		require.NoError(t, (&Build{ID: buildID}).UploadMetadata(ctx, tracer))
+		lines := make([]LogLineItem, 10)
+		for i := range lines {
+			lines[i] = LogLineItem{Timestamp: start.Add(time.Duration(i) * time.Millisecond), Data: "line"}
+		}
+		_, err := InsertLogLinesWithLineLimit(ctx, tracer, buildID, "", lines, 1024, 1)
+		require.NoError(t, err)
+	}
+
+	deleted := []string{"deleted0", "deleted1", "deleted2", "deleted3", "deleted4"}
+	for _, buildID := range append(deleted, "kept", "failed0", "failed1") {
+		uploadBuild(t, buildID)
+	}
+
+	bucket := env.Bucket().Bucket
+	require.NoError(t, env.SetBucket(&storage.Bucket{Bucket: failingRemoveBucket{Bucket: bucket, failPrefixes: []string{"builds/failed0/", "builds/failed1/"}}}))
+
+	err := DeleteBuilds(ctx, tracer, append(deleted, "failed0", "failed1", "DNE"), 3)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "build 'failed0'")
+	assert.Contains(t, err.Error(), "build 'failed1'")
+	assert.NotContains(t, err.Error(), "DNE")
+
+	for _, buildID := range deleted {
+		keys, err := getBuildKeys(ctx, tracer, buildID)
+		require.NoError(t, err)
+		assert.Empty(t, keys, buildID)
+	}
+	for _, buildID := range []string{"kept", "failed0", "failed1"} {
+		exists, err := CheckBuildMetadata(ctx, tracer, buildID)
+		require.NoError(t, err)
+		assert.True(t, exists, buildID)
+	}
+
+	assert.NoError(t, DeleteBuilds(ctx, tracer, nil, 3))
+}
+
+// failingRemoveBucket fails to remove any key under the given prefixes.
+type failingRemoveBucket struct {
+	pail.Bucket
+	failPrefixes []string
+}
+
+func (b failingRemoveBucket) Remove(ctx context.Context, key string) error {
+	for _, prefix := range b.failPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return errors.New("injected remove failure")
+		}
+	}
+	return b.Bucket.Remove(ctx, key)
+}
+
+func TestDeleteBuildLogs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	defer testutil.SetBucket(t, "")()
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+
+	start := time.Unix(1000000000, 0).UTC()
+	buildID := "scrubbed"
+	require.NoError(t, (&Build{ID: buildID, Builder: "builder"}).UploadMetadata(ctx, tracer))
+	test := &Test{ID: NewTestID(start), BuildID: buildID, Name: "test"}
+	require.NoError(t, test.UploadTestMetadata(ctx, tracer))
+	lines := make([]LogLineItem, 10)
+	for i := range lines {
+		lines[i] = LogLineItem{Timestamp: start.Add(time.Duration(i) * time.Millisecond), Data: "line"}
+	}
+	_, err := InsertLogLinesWithLineLimit(ctx, tracer, buildID, "", lines, 1024, 1)
+	require.NoError(t, err)
+	_, err = InsertLogLinesWithLineLimit(ctx, tracer, buildID, test.ID, lines, 1024, 1)
+	require.NoError(t, err)
+	keys, err := getBuildKeys(ctx, tracer, buildID)
+	require.NoError(t, err)
+	require.Len(t, keys, 22)
+
+	build, err := DeleteBuildLogs(ctx, tracer, buildID, 8)
+	require.NoError(t, err)
+	require.NotNil(t, build)
+	assert.True(t, build.Scrubbed)
+
+	t.Run("ChunksRemoved", func(t *testing.T) {
+		keys, err := getBuildKeys(ctx, tracer, buildID)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{metadataKeyForBuild(buildID), metadataKeyForTest(buildID, test.ID)}, keys)
+
+		hasLogs, err := BuildHasLogs(ctx, tracer, buildID)
+		require.NoError(t, err)
+		assert.False(t, hasLogs)
+	})
+	t.Run("MetadataKept", func(t *testing.T) {
+		build, err := FindBuildByID(ctx, tracer, buildID)
+		require.NoError(t, err)
+		require.NotNil(t, build)
+		assert.Equal(t, "builder", build.Builder)
+		assert.True(t, build.Scrubbed)
+
+		foundTest, err := FindTestByID(ctx, tracer, buildID, test.ID)
+		require.NoError(t, err)
+		require.NotNil(t, foundTest)
+		assert.Equal(t, "test", foundTest.Name)
+	})
+	t.Run("DownloadsAreEmpty", func(t *testing.T) {
+		for _, testID := range []string{"", test.ID} {
+			logLines, err := DownloadLogLines(ctx, tracer, buildID, testID)
+			require.NoError(t, err)
+			for line := range logLines {
+				t.Errorf("unexpected line '%s'", line.Data)
+			}
+		}
+	})
+	t.Run("Idempotent", func(t *testing.T) {
+		build, err := DeleteBuildLogs(ctx, tracer, buildID, 8)
+		require.NoError(t, err)
+		require.NotNil(t, build)
+		assert.True(t, build.Scrubbed)
+	})
+	t.Run("UnshardedWithShardingEnabled", func(t *testing.T) {
+		unshardedID := "scrubbed-unsharded"
+		require.NoError(t, (&Build{ID: unshardedID}).UploadMetadata(ctx, tracer))
+		env.SetShardBuildKeys(true)
+		defer env.SetShardBuildKeys(false)
+
+		build, err := DeleteBuildLogs(ctx, tracer, unshardedID, 8)
+		require.NoError(t, err)
+		require.NotNil(t, build)
+
+		exists, err := env.Bucket().Exists(ctx, buildPrefixForLayout(unshardedID, true)+metadataFilename)
+		require.NoError(t, err)
+		assert.False(t, exists)
+		found, err := FindBuildByID(ctx, tracer, unshardedID)
+		require.NoError(t, err)
+		require.NotNil(t, found)
+		assert.True(t, found.Scrubbed)
+	})
+	t.Run("BuildDNE", func(t *testing.T) {
+		build, err := DeleteBuildLogs(ctx, tracer, "DNE", 8)
+		require.NoError(t, err)
+		assert.Nil(t, build)
+	})
+}
+
 func TestFindBuildByID(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -129,3 +825,94 @@ func TestFindBuildByID(t *testing.T) {
 		assert.Nil(t, build)
 	})
 }
+
+func TestFindBuildByTaskID(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	t.Run("Indexed", func(t *testing.T) {
+		defer testutil.SetBucket(t, "")()
+
+		builds := []Build{
+			{ID: "b0", Builder: "builder0", BuildNum: 1, TaskID: "t0"},
+			{ID: "b1", Builder: "builder0", BuildNum: 2, TaskID: "t0", TaskExecution: 1},
+			{ID: "b2", Builder: "builder1", BuildNum: 1, TaskID: "t1"},
+		}
+		for _, build := range builds {
+			require.NoError(t, build.UploadMetadata(ctx, tracer))
+		}
+		// Re-uploading should not duplicate the index entry.
+		require.NoError(t, builds[0].UploadMetadata(ctx, tracer))
+
+		indexed, err := getTaskIndex(ctx, "t0")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"b0", "b1"}, indexed)
+
+		found, err := FindBuildByTaskID(ctx, tracer, "t0")
+		require.NoError(t, err)
+		require.Len(t, found, 2)
+		assert.Equal(t, builds[0], *found[0])
+		assert.Equal(t, builds[1], *found[1])
+
+		found, err = FindBuildByTaskID(ctx, tracer, "t1")
+		require.NoError(t, err)
+		require.Len(t, found, 1)
+		assert.Equal(t, builds[2], *found[0])
+	})
+	t.Run("ConcurrentUploads", func(t *testing.T) {
+		defer testutil.SetBucket(t, "")()
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 10)
+		var buildIDs []string
+		for i := 0; i < 10; i++ {
+			buildIDs = append(buildIDs, fmt.Sprintf("b%d", i))
+			wg.Add(1)
+			go func(buildID string) {
+				defer wg.Done()
+				errs <- (&Build{ID: buildID, TaskID: "t0"}).UploadMetadata(ctx, tracer)
+			}(buildIDs[i])
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			require.NoError(t, err)
+		}
+
+		indexed, err := getTaskIndex(ctx, "t0")
+		require.NoError(t, err)
+		assert.Equal(t, buildIDs, indexed)
+	})
+	t.Run("Unindexed", func(t *testing.T) {
+		defer testutil.SetBucket(t, "../testdata/simple")()
+
+		taskID := "mongodb_mongo_master_enterprise_f98b3361fbab4e02683325cc0e6ebaa69d6af1df_22_07_22_11_24_37"
+		indexed, err := getTaskIndex(ctx, taskID)
+		require.NoError(t, err)
+		assert.Empty(t, indexed)
+
+		found, err := FindBuildByTaskID(ctx, tracer, taskID)
+		require.NoError(t, err)
+		require.Len(t, found, 1)
+		assert.Equal(t, "5a75f537726934e4b62833ab6d5dca41", found[0].ID)
+
+		// The scan repairs the index.
+		indexed, err = getTaskIndex(ctx, taskID)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"5a75f537726934e4b62833ab6d5dca41"}, indexed)
+	})
+	t.Run("DNE", func(t *testing.T) {
+		defer testutil.SetBucket(t, "../testdata/simple")()
+
+		found, err := FindBuildByTaskID(ctx, tracer, "DNE")
+		require.NoError(t, err)
+		assert.Empty(t, found)
+	})
+	t.Run("EmptyTaskID", func(t *testing.T) {
+		defer testutil.SetBucket(t, "")()
+
+		_, err := FindBuildByTaskID(ctx, tracer, "")
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,325 @@
+package model
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/evergreen-ci/logkeeper/env"
+	"github.com/evergreen-ci/pail"
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
+	"github.com/pkg/errors"
+)
+
+// Chunk manifests let reads find a build's keys by getting a single object
+// rather than listing the build's prefix, which costs a request per page of
+// keys. A build's manifest is created along with the build and updated under
+// the build lock whenever a key is added. It's kept outside of the builds
+// prefix so that it's never mistaken for one of the build's log chunks.
+//
+// A manifest is never allowed to knowingly go stale: if it can't be updated it
+// is removed, and reads of a build without a manifest fall back to listing.
+// Keys are reserved in the manifest as pending before they're uploaded and
+// only added once they have been, so a writer that dies between the two
+// leaves the manifest with pending keys rather than silently missing a key.
+// Reads fall back to listing while any key is pending. Every update is read
+// back, and a manifest that doesn't hold what was written, e.g. because
+// writers in different processes raced past the best-effort build lock, is
+// removed.
+const chunkManifestsPrefix = "chunk-manifests/"
+
+// chunkManifest enumerates the keys of a build's metadata and log chunks. A
+// chunk's key encodes its test, time range and line count, so the keys are
+// all that's needed to plan a download.
+type chunkManifest struct {
+	Keys []string `json:"keys"`
+	// Pending are keys that are being uploaded, or whose upload was
+	// interrupted, so the manifest can't be trusted while there are any.
+	Pending []string `json:"pending,omitempty"`
+}
+
+// complete returns whether the manifest has no pending keys and so can be
+// read instead of listing the build's keys.
+func (m *chunkManifest) complete() bool {
+	return len(m.Pending) == 0
+}
+
+// hasPending returns whether any of the given keys are pending.
+func (m *chunkManifest) hasPending(keys []string) bool {
+	for _, key := range keys {
+		for _, pending := range m.Pending {
+			if key == pending {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// setPending marks the given keys as pending, or, if pending is false, no
+// longer pending.
+func (m *chunkManifest) setPending(keys []string, pending bool) {
+	remaining := m.Pending[:0]
+	for _, key := range m.Pending {
+		if !containsString(keys, key) {
+			remaining = append(remaining, key)
+		}
+	}
+	m.Pending = remaining
+	if pending {
+		m.Pending = append(m.Pending, keys...)
+		sort.Strings(m.Pending)
+	}
+	if len(m.Pending) == 0 {
+		m.Pending = nil
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func chunkManifestKey(buildID string) string {
+	return fmt.Sprintf("%s%s.json", chunkManifestsPrefix, buildID)
+}
+
+// hasKeys returns whether the manifest already contains all of the given keys.
+func (m *chunkManifest) hasKeys(keys []string) bool {
+	for _, key := range keys {
+		i := sort.SearchStrings(m.Keys, key)
+		if i == len(m.Keys) || m.Keys[i] != key {
+			return false
+		}
+	}
+
+	return true
+}
+
+// addKeys adds the given keys to the manifest, keeping its keys sorted like a
+// listing's.
+func (m *chunkManifest) addKeys(keys []string) {
+	for _, key := range keys {
+		if !m.hasKeys([]string{key}) {
+			m.Keys = append(m.Keys, key)
+		}
+	}
+	sort.Strings(m.Keys)
+}
+
+// getChunkManifest returns the manifest of the given build, or nil if the
+// build has none.
+func getChunkManifest(ctx context.Context, buildID string) (*chunkManifest, error) {
+	reader, err := env.Bucket().Get(ctx, chunkManifestKey(buildID))
+	if pail.IsKeyNotFoundError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "getting chunk manifest")
+	}
+	defer reader.Close()
+
+	manifest := &chunkManifest{}
+	if err = json.NewDecoder(reader).Decode(manifest); err != nil {
+		return nil, errors.Wrap(err, "parsing chunk manifest")
+	}
+
+	return manifest, nil
+}
+
+// putChunkManifest writes the given build's manifest.
+func putChunkManifest(ctx context.Context, buildID string, manifest *chunkManifest) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return errors.Wrap(err, "marshalling chunk manifest")
+	}
+
+	return errors.Wrap(env.Bucket().Put(ctx, chunkManifestKey(buildID), bytes.NewReader(data)), "uploading chunk manifest")
+}
+
+// createChunkManifest writes a manifest for a new build whose only key is
+// its metadata. Nothing is written if chunk manifests are disabled.
+func createChunkManifest(ctx context.Context, buildID string, metadataKey string) error {
+	if !env.ChunkManifests() {
+		return nil
+	}
+
+	return putChunkManifest(ctx, buildID, &chunkManifest{Keys: []string{metadataKey}})
+}
+
+// reserveChunkManifestKeys marks the given keys, which are about to be
+// uploaded, as pending in the build's manifest so that reads don't trust the
+// manifest until the keys are added with addToChunkManifest or released with
+// releaseChunkManifestKeys. Builds without a manifest are left without one.
+func reserveChunkManifestKeys(ctx context.Context, buildID string, keys ...string) error {
+	if !env.ChunkManifests() || len(keys) == 0 {
+		return nil
+	}
+
+	unlock, err := lockBuild(ctx, buildID)
+	if err != nil {
+		return removeChunkManifest(ctx, buildID, err)
+	}
+	defer logUnlockError(unlock, buildID)
+
+	return reserveLockedChunkManifestKeys(ctx, buildID, keys...)
+}
+
+// reserveLockedChunkManifestKeys is the same as reserveChunkManifestKeys for
+// callers that already hold the build lock.
+func reserveLockedChunkManifestKeys(ctx context.Context, buildID string, keys ...string) error {
+	return updateLockedChunkManifest(ctx, buildID, func(manifest *chunkManifest) bool {
+		if manifest.hasKeys(keys) {
+			return false
+		}
+		manifest.setPending(keys, true)
+		return true
+	})
+}
+
+// releaseChunkManifestKeys marks the given keys, which were reserved but
+// failed to be uploaded, as no longer pending without adding them.
+func releaseChunkManifestKeys(ctx context.Context, buildID string, keys ...string) error {
+	if !env.ChunkManifests() || len(keys) == 0 {
+		return nil
+	}
+
+	unlock, err := lockBuild(ctx, buildID)
+	if err != nil {
+		return removeChunkManifest(ctx, buildID, err)
+	}
+	defer logUnlockError(unlock, buildID)
+
+	return updateLockedChunkManifest(ctx, buildID, func(manifest *chunkManifest) bool {
+		if !manifest.hasPending(keys) {
+			return false
+		}
+		manifest.setPending(keys, false)
+		return true
+	})
+}
+
+// addToChunkManifest adds the given keys, which must already be uploaded, to
+// the build's manifest, marking them as no longer pending. Builds without a
+// manifest are left without one. The build lock is only taken if the
+// manifest is missing any of the keys or has any of them pending, so
+// rewriting existing keys, e.g. metadata, doesn't contend for it. If the
+// manifest can't be updated it's removed so that reads list the build's keys
+// instead.
+func addToChunkManifest(ctx context.Context, buildID string, keys ...string) error {
+	if !env.ChunkManifests() || len(keys) == 0 {
+		return nil
+	}
+
+	// A failure to read the manifest here is retried under the lock, since
+	// removing the manifest without holding the lock could race with
+	// another writer rewriting it.
+	manifest, err := getChunkManifest(ctx, buildID)
+	if err == nil && (manifest == nil || (manifest.hasKeys(keys) && !manifest.hasPending(keys))) {
+		return nil
+	}
+
+	unlock, err := lockBuild(ctx, buildID)
+	if err != nil {
+		return removeChunkManifest(ctx, buildID, err)
+	}
+	defer logUnlockError(unlock, buildID)
+
+	// The manifest may have changed while waiting for the lock.
+	return addToLockedChunkManifest(ctx, buildID, keys...)
+}
+
+// addToLockedChunkManifest is the same as addToChunkManifest for callers that
+// already hold the build lock.
+func addToLockedChunkManifest(ctx context.Context, buildID string, keys ...string) error {
+	return updateLockedChunkManifest(ctx, buildID, func(manifest *chunkManifest) bool {
+		if manifest.hasKeys(keys) && !manifest.hasPending(keys) {
+			return false
+		}
+		manifest.addKeys(keys)
+		manifest.setPending(keys, false)
+		return true
+	})
+}
+
+// updateLockedChunkManifest applies update to the build's manifest, if it has
+// one, and writes the manifest back if update returns true. The caller must
+// hold the build lock. The written manifest is read back, and if it can't be
+// written or doesn't hold what was written, it's removed so that reads list
+// the build's keys instead.
+func updateLockedChunkManifest(ctx context.Context, buildID string, update func(*chunkManifest) bool) error {
+	if !env.ChunkManifests() {
+		return nil
+	}
+
+	manifest, err := getChunkManifest(ctx, buildID)
+	if err != nil {
+		return removeChunkManifest(ctx, buildID, err)
+	}
+	if manifest == nil || !update(manifest) {
+		return nil
+	}
+
+	if err = putChunkManifest(ctx, buildID, manifest); err != nil {
+		return removeChunkManifest(ctx, buildID, err)
+	}
+	written, err := getChunkManifest(ctx, buildID)
+	if err != nil {
+		return removeChunkManifest(ctx, buildID, err)
+	}
+	if !reflect.DeepEqual(manifest, written) {
+		return removeChunkManifest(ctx, buildID, errors.New("chunk manifest was overwritten concurrently"))
+	}
+
+	return nil
+}
+
+// rebuildChunkManifest replaces the given build's manifest with one listing
+// the build's current keys. The caller must hold the build lock. Nothing is
+// written if chunk manifests are disabled.
+func rebuildChunkManifest(ctx context.Context, buildID string) error {
+	if !env.ChunkManifests() {
+		return nil
+	}
+
+	keys, err := listBuildKeys(ctx, buildID, "")
+	if err != nil {
+		return errors.Wrap(err, "listing build keys")
+	}
+	manifest := &chunkManifest{}
+	manifest.addKeys(keys)
+
+	return putChunkManifest(ctx, buildID, manifest)
+}
+
+// removeChunkManifest removes the given build's manifest after it failed to
+// be updated with cause. Since the build's keys are listed once its manifest
+// is gone, the update failing is only logged unless the manifest can't be
+// removed either.
+func removeChunkManifest(ctx context.Context, buildID string, cause error) error {
+	// The context may already be canceled, but a stale manifest still
+	// needs to be removed.
+	err := env.Bucket().Remove(context.WithoutCancel(ctx), chunkManifestKey(buildID))
+	if err != nil && !pail.IsKeyNotFoundError(err) {
+		catcher := grip.NewBasicCatcher()
+		catcher.Wrap(cause, "updating chunk manifest")
+		catcher.Wrap(err, "removing stale chunk manifest")
+		return catcher.Resolve()
+	}
+
+	grip.Warning(message.WrapError(cause, message.Fields{
+		"message":  "removed chunk manifest that couldn't be updated",
+		"build_id": buildID,
+	}))
+	return nil
+}
@@ -0,0 +1,212 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evergreen-ci/logkeeper/env"
+	"github.com/evergreen-ci/logkeeper/storage"
+	"github.com/evergreen-ci/logkeeper/testutil"
+	"github.com/evergreen-ci/pail"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+)
+
+func TestChunkManifest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	defer testutil.SetBucket(t, "")()
+	bucket := &countingListBucket{Bucket: env.Bucket().Bucket}
+	require.NoError(t, env.SetBucket(&storage.Bucket{Bucket: bucket}))
+
+	env.SetChunkManifests(true)
+	defer env.SetChunkManifests(false)
+
+	start := time.Unix(1000000000, 0).UTC()
+	firstTestID := NewTestID(start.Add(time.Second))
+	secondTestID := NewTestID(start.Add(2 * time.Second))
+	insertLogs := func(t *testing.T, buildID string) {
+		for _, testID := range []string{firstTestID, secondTestID} {
+			require.NoError(t, (&Test{ID: testID, BuildID: buildID}).UploadTestMetadata(ctx, tracer))
+		}
+
+		var buildLines, firstTestLines, secondTestLines []LogLineItem
+		for i := 0; i < 30; i++ {
+			ts := start.Add(time.Duration(i) * 100 * time.Millisecond)
+			buildLines = append(buildLines, LogLineItem{Timestamp: ts, Data: fmt.Sprintf("build %d", i), Global: true})
+			firstTestLines = append(firstTestLines, LogLineItem{Timestamp: ts, Data: fmt.Sprintf("first test %d", i)})
+			secondTestLines = append(secondTestLines, LogLineItem{Timestamp: ts, Data: fmt.Sprintf("second test %d", i)})
+		}
+		// Each call uploads several small chunks, and the build's lines
+		// are appended twice.
+		_, err := InsertLogLines(ctx, tracer, buildID, "", buildLines[:15], 40)
+		require.NoError(t, err)
+		_, err = InsertLogLines(ctx, tracer, buildID, "", buildLines[15:], 40)
+		require.NoError(t, err)
+		_, err = InsertLogLines(ctx, tracer, buildID, firstTestID, firstTestLines, 40)
+		require.NoError(t, err)
+		_, err = InsertLogLines(ctx, tracer, buildID, secondTestID, secondTestLines, 40)
+		require.NoError(t, err)
+	}
+	createBuild := func(t *testing.T, buildID string) {
+		require.NoError(t, (&Build{ID: buildID}).UploadMetadata(ctx, tracer))
+		insertLogs(t, buildID)
+	}
+	download := func(t *testing.T, buildID string, testID string) []LogLineItem {
+		logLines, err := DownloadLogLines(ctx, tracer, buildID, testID)
+		require.NoError(t, err)
+		var lines []LogLineItem
+		for line := range logLines {
+			lines = append(lines, *line)
+		}
+		require.NotEmpty(t, lines)
+		return lines
+	}
+	// downloadAll returns the build's lines and each test's lines, as well
+	// as how many times the bucket was listed downloading them.
+	downloadAll := func(t *testing.T, buildID string) ([][]LogLineItem, int) {
+		bucket.lists = 0
+		var downloads [][]LogLineItem
+		for _, testID := range []string{"", firstTestID, secondTestID} {
+			downloads = append(downloads, download(t, buildID, testID))
+		}
+		return downloads, bucket.lists
+	}
+	downloadListed := func(t *testing.T, buildID string) [][]LogLineItem {
+		env.SetChunkManifests(false)
+		defer env.SetChunkManifests(true)
+
+		downloads, lists := downloadAll(t, buildID)
+		assert.NotZero(t, lists)
+		return downloads
+	}
+	checkManifest := func(t *testing.T, buildID string) {
+		manifest, err := getChunkManifest(ctx, buildID)
+		require.NoError(t, err)
+		require.NotNil(t, manifest)
+
+		keys, err := listBuildKeys(ctx, buildID, "")
+		require.NoError(t, err)
+		sort.Strings(keys)
+		assert.Equal(t, keys, manifest.Keys)
+		assert.Empty(t, manifest.Pending)
+	}
+
+	t.Run("MatchesListing", func(t *testing.T) {
+		buildID := "manifest-matches-listing"
+		createBuild(t, buildID)
+		checkManifest(t, buildID)
+
+		downloads, lists := downloadAll(t, buildID)
+		assert.Zero(t, lists)
+		assert.Equal(t, downloadListed(t, buildID), downloads)
+	})
+	t.Run("MissingManifest", func(t *testing.T) {
+		buildID := "manifest-missing"
+		createBuild(t, buildID)
+		require.NoError(t, env.Bucket().Remove(ctx, chunkManifestKey(buildID)))
+
+		downloads, lists := downloadAll(t, buildID)
+		assert.NotZero(t, lists)
+		assert.Equal(t, downloadListed(t, buildID), downloads)
+
+		// Appending to a build without a manifest doesn't create one,
+		// since it would be missing the earlier keys.
+		insertLogs(t, buildID)
+		manifest, err := getChunkManifest(ctx, buildID)
+		require.NoError(t, err)
+		assert.Nil(t, manifest)
+	})
+	t.Run("BuildCreatedWhileDisabled", func(t *testing.T) {
+		buildID := "manifest-disabled"
+		env.SetChunkManifests(false)
+		require.NoError(t, (&Build{ID: buildID}).UploadMetadata(ctx, tracer))
+		env.SetChunkManifests(true)
+		insertLogs(t, buildID)
+
+		manifest, err := getChunkManifest(ctx, buildID)
+		require.NoError(t, err)
+		assert.Nil(t, manifest)
+
+		downloads, _ := downloadAll(t, buildID)
+		assert.Equal(t, downloadListed(t, buildID), downloads)
+	})
+	t.Run("RepairRebuildsManifest", func(t *testing.T) {
+		buildID := "manifest-repaired"
+		createBuild(t, buildID)
+		require.NoError(t, env.Bucket().Remove(ctx, chunkManifestKey(buildID)))
+
+		_, err := RepairLineCounts(ctx, tracer, buildID)
+		require.NoError(t, err)
+		checkManifest(t, buildID)
+
+		downloads, lists := downloadAll(t, buildID)
+		assert.Zero(t, lists)
+		assert.Equal(t, downloadListed(t, buildID), downloads)
+	})
+	t.Run("PendingKeysFallBackToListing", func(t *testing.T) {
+		buildID := "manifest-pending"
+		createBuild(t, buildID)
+		manifest, err := getChunkManifest(ctx, buildID)
+		require.NoError(t, err)
+		require.NotNil(t, manifest)
+		manifest.Pending = []string{manifest.Keys[len(manifest.Keys)-1]}
+		require.NoError(t, putChunkManifest(ctx, buildID, manifest))
+
+		downloads, lists := downloadAll(t, buildID)
+		assert.NotZero(t, lists)
+		assert.Equal(t, downloadListed(t, buildID), downloads)
+	})
+	t.Run("FailedUploadReleasesReservation", func(t *testing.T) {
+		buildID := "manifest-failed-upload"
+		createBuild(t, buildID)
+
+		bucket.failChunkPuts = true
+		_, err := InsertLogLines(ctx, tracer, buildID, firstTestID, []LogLineItem{{Timestamp: start.Add(time.Hour), Data: "failed"}}, 40)
+		bucket.failChunkPuts = false
+		require.Error(t, err)
+
+		checkManifest(t, buildID)
+		downloads, lists := downloadAll(t, buildID)
+		assert.Zero(t, lists)
+		assert.Equal(t, downloadListed(t, buildID), downloads)
+	})
+	t.Run("DeleteBuildRemovesManifest", func(t *testing.T) {
+		buildID := "manifest-deleted"
+		createBuild(t, buildID)
+		require.NoError(t, DeleteBuild(ctx, tracer, buildID, 1))
+
+		exists, err := env.Bucket().Exists(ctx, chunkManifestKey(buildID))
+		require.NoError(t, err)
+		assert.False(t, exists)
+	})
+}
+
+// countingListBucket counts how many times it's listed, and fails to put
+// chunks while failChunkPuts is set.
+type countingListBucket struct {
+	pail.Bucket
+	lists         int
+	failChunkPuts bool
+}
+
+func (b *countingListBucket) Put(ctx context.Context, key string, r io.Reader) error {
+	if b.failChunkPuts && strings.HasPrefix(key, buildsPrefix) && !strings.HasSuffix(key, metadataFilename) {
+		return errors.New("putting chunk")
+	}
+	return b.Bucket.Put(ctx, key, r)
+}
+
+func (b *countingListBucket) List(ctx context.Context, prefix string) (pail.BucketIterator, error) {
+	b.lists++
+	return b.Bucket.List(ctx, prefix)
+}
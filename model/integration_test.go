@@ -0,0 +1,342 @@
+//go:build integration || s3integration
+
+package model
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/evergreen-ci/logkeeper/env"
+	"github.com/evergreen-ci/logkeeper/testutil"
+	"github.com/evergreen-ci/pail"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+)
+
+func TestIntegrationLocalBucket(t *testing.T) {
+	defer testutil.SetBucket(t, "")()
+
+	testIngestionToRetrieval(t)
+	testFixtureParity(t)
+}
+
+// testIngestionToRetrieval exercises the whole path from uploading build and
+// test metadata and log lines to finding, downloading and deleting them again
+// against the bucket currently set in the environment. Every backend runs the
+// same cases, so they must behave identically.
+func testIngestionToRetrieval(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	start := time.Now().Truncate(time.Millisecond).UTC()
+
+	// setup uploads the metadata for a new build with a single test and
+	// returns their IDs. Each case uses its own build so that runs against a
+	// shared bucket don't interfere with each other.
+	setup := func(t *testing.T) (string, string) {
+		buildID, err := NewBuildID(ctx, tracer, t.Name(), int(start.UnixNano()%1000000000))
+		require.NoError(t, err)
+		build := &Build{ID: buildID, Builder: t.Name(), BuildNum: 1}
+		require.NoError(t, build.UploadMetadata(ctx, tracer))
+		t.Cleanup(func() {
+			assert.NoError(t, env.Bucket().RemovePrefix(context.Background(), buildPrefix(buildID)))
+		})
+
+		test := &Test{ID: NewTestID(start), BuildID: buildID, Name: "integration"}
+		require.NoError(t, test.UploadTestMetadata(ctx, tracer))
+
+		return buildID, test.ID
+	}
+
+	t.Run("OverlappingTimestamps", func(t *testing.T) {
+		buildID, testID := setup(t)
+		globalLines := makeIntegrationLines(start, 10, true)
+		testLines := makeIntegrationLines(start, 10, false)
+		_, err := InsertLogLines(ctx, tracer, buildID, "", globalLines, 4*1024*1024)
+		require.NoError(t, err)
+		_, err = InsertLogLines(ctx, tracer, buildID, testID, testLines, 4*1024*1024)
+		require.NoError(t, err)
+
+		logLines, err := DownloadLogLines(ctx, tracer, buildID, "")
+		require.NoError(t, err)
+		assertMergedLines(t, globalLines, testLines, drainLogLines(logLines), false)
+
+		logLines, err = DownloadLogLines(ctx, tracer, buildID, testID)
+		require.NoError(t, err)
+		assertMergedLines(t, globalLines, testLines, drainLogLines(logLines), false)
+	})
+	t.Run("MultipleChunks", func(t *testing.T) {
+		buildID, testID := setup(t)
+		globalLines := makeIntegrationLines(start, 30, true)
+		testLines := makeIntegrationLines(start.Add(time.Second), 30, false)
+		_, err := InsertLogLinesWithLineLimit(ctx, tracer, buildID, "", globalLines, 4*1024*1024, 10)
+		require.NoError(t, err)
+		_, err = InsertLogLinesWithLineLimit(ctx, tracer, buildID, testID, testLines, 4*1024*1024, 10)
+		require.NoError(t, err)
+
+		buildChunks, testChunks := getIntegrationChunks(ctx, t, buildID)
+		assert.Len(t, buildChunks, 3)
+		assert.Len(t, testChunks, 3)
+
+		logLines, err := DownloadLogLines(ctx, tracer, buildID, "")
+		require.NoError(t, err)
+		assertMergedLines(t, globalLines, testLines, drainLogLines(logLines), false)
+
+		test, err := FindTestByID(ctx, tracer, buildID, testID)
+		require.NoError(t, err)
+		assert.Equal(t, len(testLines), test.NumLines)
+	})
+	t.Run("ReverseIteration", func(t *testing.T) {
+		buildID, testID := setup(t)
+		globalLines := makeIntegrationLines(start, 30, true)
+		testLines := makeIntegrationLines(start, 30, false)
+		_, err := InsertLogLinesWithLineLimit(ctx, tracer, buildID, "", globalLines, 4*1024*1024, 10)
+		require.NoError(t, err)
+		_, err = InsertLogLinesWithLineLimit(ctx, tracer, buildID, testID, testLines, 4*1024*1024, 10)
+		require.NoError(t, err)
+
+		buildChunks, testChunks := getIntegrationChunks(ctx, t, buildID)
+		it := NewMergingIterator(NewBatchedLogIterator(testChunks, 2, AllTime), NewBatchedLogIterator(buildChunks, 2, AllTime)).Reverse()
+		var lines []LogLineItem
+		for it.Next(ctx) {
+			lines = append(lines, it.Item())
+		}
+		require.NoError(t, it.Err())
+		require.NoError(t, it.Close())
+
+		assertMergedLines(t, globalLines, testLines, lines, true)
+	})
+	t.Run("Find", func(t *testing.T) {
+		buildID, testID := setup(t)
+		_, err := InsertLogLines(ctx, tracer, buildID, testID, makeIntegrationLines(start, 10, false), 4*1024*1024)
+		require.NoError(t, err)
+
+		build, err := FindBuildByID(ctx, tracer, buildID)
+		require.NoError(t, err)
+		require.NotNil(t, build)
+		assert.Equal(t, buildID, build.ID)
+		assert.Equal(t, t.Name(), build.Builder)
+
+		test, err := FindTestByID(ctx, tracer, buildID, testID)
+		require.NoError(t, err)
+		require.NotNil(t, test)
+		assert.Equal(t, "integration", test.Name)
+		assert.Equal(t, 10, test.NumLines)
+
+		tests, err := FindTestsForBuild(ctx, tracer, buildID)
+		require.NoError(t, err)
+		require.Len(t, tests, 1)
+		assert.Equal(t, testID, tests[0].ID)
+
+		test, err = FindTestByID(ctx, tracer, buildID, NewTestID(start.Add(time.Hour)))
+		require.NoError(t, err)
+		assert.Nil(t, test)
+	})
+	t.Run("Delete", func(t *testing.T) {
+		buildID, testID := setup(t)
+		_, err := InsertLogLines(ctx, tracer, buildID, "", makeIntegrationLines(start, 10, true), 4*1024*1024)
+		require.NoError(t, err)
+		_, err = InsertLogLines(ctx, tracer, buildID, testID, makeIntegrationLines(start, 10, false), 4*1024*1024)
+		require.NoError(t, err)
+
+		require.NoError(t, DeleteBuild(ctx, tracer, buildID, 0))
+
+		build, err := FindBuildByID(ctx, tracer, buildID)
+		require.NoError(t, err)
+		assert.Nil(t, build)
+		keys, err := listBuildKeys(ctx, buildID, "")
+		require.NoError(t, err)
+		assert.Empty(t, keys)
+	})
+	t.Run("Corruption", func(t *testing.T) {
+		buildID, _ := setup(t)
+		_, err := InsertLogLines(ctx, tracer, buildID, "", makeIntegrationLines(start, 10, true), 4*1024*1024)
+		require.NoError(t, err)
+
+		// Move the chunk to a key claiming more lines than it has.
+		buildChunks, _ := getIntegrationChunks(ctx, t, buildID)
+		require.Len(t, buildChunks, 1)
+		chunk := buildChunks[0]
+		r, err := env.Bucket().Get(ctx, chunk.key())
+		require.NoError(t, err)
+		data, err := io.ReadAll(r)
+		require.NoError(t, r.Close())
+		require.NoError(t, err)
+		require.NoError(t, env.Bucket().Remove(ctx, chunk.key()))
+		chunk.NumLines++
+		require.NoError(t, env.Bucket().Put(ctx, chunk.key(), bytes.NewReader(data)))
+
+		buildChunks, _ = getIntegrationChunks(ctx, t, buildID)
+		it := NewBatchedLogIterator(buildChunks, 2, AllTime)
+		var numLines int
+		for it.Next(ctx) {
+			numLines++
+		}
+		assert.Equal(t, 10, numLines)
+		assert.Error(t, it.Err())
+		require.NoError(t, it.Close())
+	})
+}
+
+// fixtureBuildID is the ID of the build in each of the testdata directories.
+const fixtureBuildID = "5a75f537726934e4b62833ab6d5dca41"
+
+// fixtureContents is what's read back from a testdata build.
+type fixtureContents struct {
+	Build     *Build
+	Tests     []Test
+	Lines     map[string][]LogLineItem
+	Counts    map[string]int
+	HasErrors map[string]bool
+}
+
+// testFixtureParity uploads each testdata directory to the bucket currently
+// set in the environment and checks that its build reads back exactly as it
+// does from a local bucket. The fixtures share a build ID, so they're
+// uploaded one at a time and removed afterwards, and runs against a shared
+// bucket must not overlap.
+func testFixtureParity(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fixtures, err := filepath.Glob("../testdata/*")
+	require.NoError(t, err)
+	require.NotEmpty(t, fixtures)
+	for _, dir := range fixtures {
+		t.Run("Fixture"+filepath.Base(dir), func(t *testing.T) {
+			restore := testutil.SetBucket(t, dir)
+			expected := readFixture(ctx, t)
+			restore()
+
+			t.Cleanup(func() {
+				assert.NoError(t, env.Bucket().RemovePrefix(context.Background(), buildPrefix(fixtureBuildID)))
+			})
+			require.NoError(t, env.Bucket().Push(ctx, pail.SyncOptions{Local: dir}))
+
+			assert.Equal(t, expected, readFixture(ctx, t))
+		})
+	}
+}
+
+// readFixture returns the metadata of the testdata build in the bucket
+// currently set in the environment along with the lines and line counts of
+// the build and of each of its tests.
+func readFixture(ctx context.Context, t *testing.T) fixtureContents {
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	build, err := FindBuildByID(ctx, tracer, fixtureBuildID)
+	require.NoError(t, err)
+	tests, err := FindTestsForBuild(ctx, tracer, fixtureBuildID)
+	require.NoError(t, err)
+
+	contents := fixtureContents{
+		Build:     build,
+		Tests:     tests,
+		Lines:     map[string][]LogLineItem{},
+		Counts:    map[string]int{},
+		HasErrors: map[string]bool{},
+	}
+	testIDs := []string{""}
+	for _, test := range tests {
+		testIDs = append(testIDs, test.ID)
+	}
+	for _, testID := range testIDs {
+		// Some fixtures have no lines to download, which is an error
+		// every backend must agree on.
+		logLines, err := DownloadLogLines(ctx, tracer, fixtureBuildID, testID)
+		if err != nil {
+			contents.HasErrors[testID] = true
+			continue
+		}
+		contents.Lines[testID] = drainLogLines(logLines)
+		contents.Counts[testID], err = CountLogLines(ctx, tracer, fixtureBuildID, testID)
+		require.NoError(t, err)
+	}
+
+	return contents
+}
+
+// makeIntegrationLines returns numLines lines 100ms apart from start, so
+// lines made with the same start share their timestamps.
+func makeIntegrationLines(start time.Time, numLines int, global bool) []LogLineItem {
+	prefix := "Test Log"
+	if global {
+		prefix = "Log"
+	}
+
+	lines := make([]LogLineItem, 0, numLines)
+	for i := 0; i < numLines; i++ {
+		lines = append(lines, LogLineItem{
+			Timestamp: start.Add(time.Duration(i) * 100 * time.Millisecond),
+			Data:      fmt.Sprintf("%s%d", prefix, i),
+			Global:    global,
+		})
+	}
+
+	return lines
+}
+
+func getIntegrationChunks(ctx context.Context, t *testing.T, buildID string) ([]LogChunkInfo, []LogChunkInfo) {
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	buildKeys, err := getBuildKeys(ctx, tracer, buildID)
+	require.NoError(t, err)
+	buildChunks, testChunks, err := parseLogChunks(buildKeys)
+	require.NoError(t, err)
+
+	return buildChunks, testChunks
+}
+
+func drainLogLines(logLines chan *LogLineItem) []LogLineItem {
+	var lines []LogLineItem
+	for item := range logLines {
+		lines = append(lines, *item)
+	}
+
+	return lines
+}
+
+// assertMergedLines asserts that lines interleaves globalLines and testLines
+// in timestamp order, or reverse timestamp order if reverse is true. Lines
+// with the same timestamp may come from either input in any order, but each
+// input's own order must be kept.
+func assertMergedLines(t *testing.T, globalLines, testLines, lines []LogLineItem, reverse bool) {
+	require.Len(t, lines, len(globalLines)+len(testLines))
+
+	var actualGlobal, actualTest []LogLineItem
+	for i, line := range lines {
+		if i > 0 {
+			if reverse {
+				assert.False(t, line.Timestamp.After(lines[i-1].Timestamp), "line %d is out of order", i)
+			} else {
+				assert.False(t, line.Timestamp.Before(lines[i-1].Timestamp), "line %d is out of order", i)
+			}
+		}
+		if line.Global {
+			actualGlobal = append(actualGlobal, line)
+		} else {
+			actualTest = append(actualTest, line)
+		}
+	}
+
+	if reverse {
+		globalLines = reversedLines(globalLines)
+		testLines = reversedLines(testLines)
+	}
+	assertLogLinesEqual(t, globalLines, actualGlobal)
+	assertLogLinesEqual(t, testLines, actualTest)
+}
+
+func reversedLines(lines []LogLineItem) []LogLineItem {
+	reversed := make([]LogLineItem, 0, len(lines))
+	for i := len(lines) - 1; i >= 0; i-- {
+		reversed = append(reversed, lines[i])
+	}
+
+	return reversed
+}
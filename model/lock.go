@@ -0,0 +1,255 @@
+package model
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/evergreen-ci/logkeeper/env"
+	"github.com/evergreen-ci/pail"
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
+	"github.com/mongodb/grip/recovery"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Build locks are advisory locks held around operations that read and rewrite
+// a build's or its tests' metadata, such as uploading either or updating a
+// test's line count or the build's labels or task execution, so that
+// concurrent rewrites don't lose each other's updates.
+//
+// Within a single process a build lock is exclusive. Across processes it is
+// best effort: the lock is an object in the bucket that a holder writes and
+// then reads back to check that it won, which two writers racing on a bucket
+// without read-after-write consistency can both pass. A lock whose holder
+// never releases it, e.g. because the process died, expires after
+// buildLockTTL. While a lock is held its expiration is pushed back every
+// buildLockRenewInterval, so operations that take longer than the TTL, such
+// as repairing or scrubbing every chunk of a large build, keep it.
+const (
+	buildLockTTL          = 30 * time.Second
+	buildLockPollInterval = 50 * time.Millisecond
+)
+
+// buildLockRenewInterval is how often a held build lock's expiration is
+// renewed. It's a variable so that tests can shorten it.
+var buildLockRenewInterval = buildLockTTL / 3
+
+type buildLockObject struct {
+	Owner     string    `json:"owner"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type localBuildLock struct {
+	held    chan struct{}
+	waiters int
+}
+
+var (
+	localBuildLocksMu sync.Mutex
+	localBuildLocks   = map[string]*localBuildLock{}
+)
+
+// lockBuild acquires the build lock for the given build, waiting until it is
+// free or the context is done. The returned function releases the lock.
+func lockBuild(ctx context.Context, buildID string) (func() error, error) {
+	local := acquireLocalBuildLock(buildID)
+	select {
+	case local.held <- struct{}{}:
+	case <-ctx.Done():
+		releaseLocalBuildLock(buildID, local)
+		return nil, errors.Wrapf(ctx.Err(), "waiting for lock on build '%s'", buildID)
+	}
+
+	owner := bson.NewObjectId().Hex()
+	if err := acquireBucketBuildLock(ctx, buildID, owner); err != nil {
+		<-local.held
+		releaseLocalBuildLock(buildID, local)
+		return nil, errors.Wrapf(err, "acquiring lock on build '%s'", buildID)
+	}
+
+	// The lock is renewed, and released, even if the operation's context
+	// is done, since the operation may still be finishing up.
+	ctx = context.WithoutCancel(ctx)
+	stopRenewing := make(chan struct{})
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		renewBucketBuildLock(ctx, buildID, owner, stopRenewing)
+	}()
+
+	return func() error {
+		defer func() {
+			<-local.held
+			releaseLocalBuildLock(buildID, local)
+		}()
+
+		close(stopRenewing)
+		<-renewed
+		return errors.Wrapf(releaseBucketBuildLock(ctx, buildID, owner), "releasing lock on build '%s'", buildID)
+	}, nil
+}
+
+// renewBucketBuildLock pushes back the expiration of the given owner's lock
+// every buildLockRenewInterval until stop is closed or the lock is lost.
+func renewBucketBuildLock(ctx context.Context, buildID string, owner string, stop <-chan struct{}) {
+	defer recovery.LogStackTraceAndContinue("renewing build lock")
+
+	ticker := time.NewTicker(buildLockRenewInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		held, err := extendBucketBuildLock(ctx, buildID, owner)
+		grip.Warning(message.WrapError(err, message.Fields{
+			"message":  "renewing build lock",
+			"build_id": buildID,
+		}))
+		if err == nil && !held {
+			grip.Warning(message.Fields{
+				"message":  "build lock expired and was taken over while held",
+				"build_id": buildID,
+			})
+			return
+		}
+	}
+}
+
+// extendBucketBuildLock resets the expiration of the given owner's lock and
+// returns whether the owner still holds it.
+func extendBucketBuildLock(ctx context.Context, buildID string, owner string) (bool, error) {
+	key := lockKeyForBuild(buildID)
+	current, err := getBuildLockObject(ctx, key)
+	if err != nil {
+		return true, err
+	}
+	if current == nil || current.Owner != owner {
+		return false, nil
+	}
+
+	data, err := json.Marshal(buildLockObject{Owner: owner, ExpiresAt: time.Now().Add(buildLockTTL)})
+	if err != nil {
+		return true, errors.Wrap(err, "marshalling lock")
+	}
+
+	return true, errors.Wrap(env.Bucket().Put(ctx, key, bytes.NewReader(data)), "uploading lock")
+}
+
+// logUnlockError releases a build lock, logging rather than returning any
+// error since an unreleased lock only delays other writers until it expires.
+func logUnlockError(unlock func() error, buildID string) {
+	grip.Warning(message.WrapError(unlock(), message.Fields{
+		"message":  "releasing build lock",
+		"build_id": buildID,
+	}))
+}
+
+func acquireLocalBuildLock(buildID string) *localBuildLock {
+	localBuildLocksMu.Lock()
+	defer localBuildLocksMu.Unlock()
+
+	local, ok := localBuildLocks[buildID]
+	if !ok {
+		local = &localBuildLock{held: make(chan struct{}, 1)}
+		localBuildLocks[buildID] = local
+	}
+	local.waiters++
+
+	return local
+}
+
+func releaseLocalBuildLock(buildID string, local *localBuildLock) {
+	localBuildLocksMu.Lock()
+	defer localBuildLocksMu.Unlock()
+
+	local.waiters--
+	if local.waiters == 0 {
+		delete(localBuildLocks, buildID)
+	}
+}
+
+func acquireBucketBuildLock(ctx context.Context, buildID string, owner string) error {
+	key := lockKeyForBuild(buildID)
+	for {
+		current, err := getBuildLockObject(ctx, key)
+		if err != nil {
+			return err
+		}
+		if current == nil || time.Now().After(current.ExpiresAt) {
+			data, err := json.Marshal(buildLockObject{Owner: owner, ExpiresAt: time.Now().Add(buildLockTTL)})
+			if err != nil {
+				return errors.Wrap(err, "marshalling lock")
+			}
+			if err = env.Bucket().Put(ctx, key, bytes.NewReader(data)); err != nil {
+				return errors.Wrap(err, "uploading lock")
+			}
+
+			// Another writer may have replaced the lock between
+			// reading and writing it, so only the writer whose lock
+			// is read back holds it.
+			current, err = getBuildLockObject(ctx, key)
+			if err != nil {
+				return err
+			}
+			if current != nil && current.Owner == owner {
+				return nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(buildLockPollInterval):
+		}
+	}
+}
+
+func releaseBucketBuildLock(ctx context.Context, buildID string, owner string) error {
+	key := lockKeyForBuild(buildID)
+	current, err := getBuildLockObject(ctx, key)
+	if err != nil {
+		return err
+	}
+	if current == nil || current.Owner != owner {
+		// The lock expired and was taken over by another writer.
+		return nil
+	}
+
+	return errors.Wrap(env.Bucket().Remove(ctx, key), "removing lock")
+}
+
+// getBuildLockObject returns the lock stored under the given key, or nil if
+// there is none. A lock that can't be parsed, e.g. because it is being
+// written, is treated as expired.
+func getBuildLockObject(ctx context.Context, key string) (*buildLockObject, error) {
+	reader, err := env.Bucket().Get(ctx, key)
+	if pail.IsKeyNotFoundError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "getting lock")
+	}
+	defer reader.Close()
+
+	lock := &buildLockObject{}
+	if err = json.NewDecoder(reader).Decode(lock); err != nil {
+		return &buildLockObject{}, nil
+	}
+
+	return lock, nil
+}
+
+// lockKeyForBuild returns the key of the given build's lock. Locks are kept
+// outside of the build's prefix so they are never mistaken for log chunks.
+func lockKeyForBuild(buildID string) string {
+	return fmt.Sprintf("locks/builds/%s", buildID)
+}
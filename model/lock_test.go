@@ -0,0 +1,248 @@
+package model
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/evergreen-ci/logkeeper/env"
+	"github.com/evergreen-ci/logkeeper/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+)
+
+func TestLockBuild(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	defer testutil.SetBucket(t, "")()
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+
+	putLock := func(t *testing.T, lock buildLockObject) {
+		data, err := json.Marshal(lock)
+		require.NoError(t, err)
+		require.NoError(t, env.Bucket().Put(ctx, lockKeyForBuild(buildID), bytes.NewReader(data)))
+	}
+
+	t.Run("Exclusive", func(t *testing.T) {
+		unlock, err := lockBuild(ctx, buildID)
+		require.NoError(t, err)
+		exists, err := env.Bucket().Exists(ctx, lockKeyForBuild(buildID))
+		require.NoError(t, err)
+		assert.True(t, exists)
+
+		tctx, tcancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer tcancel()
+		_, err = lockBuild(tctx, buildID)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+		require.NoError(t, unlock())
+		exists, err = env.Bucket().Exists(ctx, lockKeyForBuild(buildID))
+		require.NoError(t, err)
+		assert.False(t, exists)
+
+		unlock, err = lockBuild(ctx, buildID)
+		require.NoError(t, err)
+		require.NoError(t, unlock())
+	})
+	t.Run("HeldByAnotherProcess", func(t *testing.T) {
+		putLock(t, buildLockObject{Owner: "other", ExpiresAt: time.Now().Add(time.Minute)})
+		defer func() {
+			require.NoError(t, env.Bucket().Remove(ctx, lockKeyForBuild(buildID)))
+		}()
+
+		tctx, tcancel := context.WithTimeout(ctx, 4*buildLockPollInterval)
+		defer tcancel()
+		_, err := lockBuild(tctx, buildID)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+	t.Run("ExpiredLockIsTakenOver", func(t *testing.T) {
+		putLock(t, buildLockObject{Owner: "other", ExpiresAt: time.Now().Add(-time.Minute)})
+
+		unlock, err := lockBuild(ctx, buildID)
+		require.NoError(t, err)
+		lock, err := getBuildLockObject(ctx, lockKeyForBuild(buildID))
+		require.NoError(t, err)
+		require.NotNil(t, lock)
+		assert.NotEqual(t, "other", lock.Owner)
+		require.NoError(t, unlock())
+	})
+	t.Run("UnlockAfterTakeover", func(t *testing.T) {
+		unlock, err := lockBuild(ctx, buildID)
+		require.NoError(t, err)
+		putLock(t, buildLockObject{Owner: "other", ExpiresAt: time.Now().Add(time.Minute)})
+		defer func() {
+			require.NoError(t, env.Bucket().Remove(ctx, lockKeyForBuild(buildID)))
+		}()
+
+		require.NoError(t, unlock())
+		lock, err := getBuildLockObject(ctx, lockKeyForBuild(buildID))
+		require.NoError(t, err)
+		require.NotNil(t, lock)
+		assert.Equal(t, "other", lock.Owner)
+	})
+	t.Run("RenewedWhileHeld", func(t *testing.T) {
+		defer func(interval time.Duration) { buildLockRenewInterval = interval }(buildLockRenewInterval)
+		buildLockRenewInterval = 10 * time.Millisecond
+
+		unlock, err := lockBuild(ctx, buildID)
+		require.NoError(t, err)
+		acquired, err := getBuildLockObject(ctx, lockKeyForBuild(buildID))
+		require.NoError(t, err)
+		require.NotNil(t, acquired)
+
+		assert.Eventually(t, func() bool {
+			lock, err := getBuildLockObject(ctx, lockKeyForBuild(buildID))
+			return err == nil && lock != nil && lock.Owner == acquired.Owner && lock.ExpiresAt.After(acquired.ExpiresAt)
+		}, time.Second, 10*time.Millisecond)
+
+		require.NoError(t, unlock())
+		exists, err := env.Bucket().Exists(ctx, lockKeyForBuild(buildID))
+		require.NoError(t, err)
+		assert.False(t, exists)
+	})
+}
+
+func TestConcurrentTestLineUpdates(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	defer testutil.SetBucket(t, "")()
+
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	start := time.Unix(1000000000, 0).UTC()
+	test := &Test{ID: NewTestID(start), BuildID: buildID}
+	require.NoError(t, test.UploadTestMetadata(ctx, tracer))
+
+	const (
+		numWriters = 8
+		numUploads = 25
+	)
+	var wg sync.WaitGroup
+	errs := make(chan error, numWriters*numUploads)
+	for writer := 0; writer < numWriters; writer++ {
+		wg.Add(1)
+		go func(writer int) {
+			defer wg.Done()
+			for upload := 0; upload < numUploads; upload++ {
+				_, err := InsertLogLines(ctx, tracer, buildID, test.ID, []LogLineItem{
+					{
+						Timestamp: start.Add(time.Duration(writer*numUploads+upload) * time.Second),
+						Data:      fmt.Sprintf("writer%d upload%d\nsecond line", writer, upload),
+					},
+				}, 4*1024*1024)
+				errs <- err
+			}
+		}(writer)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	found, err := FindTestByID(ctx, tracer, buildID, test.ID)
+	require.NoError(t, err)
+	require.NotNil(t, found)
+	assert.Equal(t, numWriters*numUploads*2, found.NumLines)
+}
+
+func TestConcurrentBuildMetadataUpdates(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	defer testutil.SetBucket(t, "")()
+
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	require.NoError(t, (&Build{ID: buildID, Builder: "builder", Labels: map[string]string{"original": "label"}}).UploadMetadata(ctx, tracer))
+
+	// Each writer rewrites the build's metadata to add its own label,
+	// while others rewrite it to update the task execution.
+	const numWriters = 16
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*numWriters)
+	for writer := 0; writer < numWriters; writer++ {
+		wg.Add(2)
+		go func(writer int) {
+			defer wg.Done()
+			_, err := AddBuildLabels(ctx, tracer, buildID, map[string]string{fmt.Sprintf("writer%d", writer): "label"})
+			errs <- err
+		}(writer)
+		go func(writer int) {
+			defer wg.Done()
+			_, err := SetBuildTaskExecution(ctx, tracer, buildID, writer+1)
+			errs <- err
+		}(writer)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	build, err := FindBuildByID(ctx, tracer, buildID)
+	require.NoError(t, err)
+	require.NotNil(t, build)
+	assert.Equal(t, "builder", build.Builder)
+	assert.Len(t, build.Labels, numWriters+1)
+	assert.Equal(t, "label", build.Labels["original"])
+	for writer := 0; writer < numWriters; writer++ {
+		assert.Equal(t, "label", build.Labels[fmt.Sprintf("writer%d", writer)])
+	}
+	assert.Positive(t, build.TaskExecution)
+}
+
+func TestConcurrentTestMetadataUploads(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	defer testutil.SetBucket(t, "")()
+	env.SetChunkManifests(true)
+	defer env.SetChunkManifests(false)
+
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	require.NoError(t, (&Build{ID: buildID}).UploadMetadata(ctx, tracer))
+
+	// Each writer uploads its own test while rewriting the build's
+	// metadata, so every test must end up in the manifest.
+	const numWriters = 16
+	start := time.Unix(1000000000, 0).UTC()
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*numWriters)
+	testIDs := make([]string, numWriters)
+	for writer := 0; writer < numWriters; writer++ {
+		testIDs[writer] = NewTestID(start.Add(time.Duration(writer) * time.Second))
+		wg.Add(2)
+		go func(writer int) {
+			defer wg.Done()
+			errs <- (&Test{ID: testIDs[writer], BuildID: buildID}).UploadTestMetadata(ctx, tracer)
+		}(writer)
+		go func(writer int) {
+			defer wg.Done()
+			errs <- (&Build{ID: buildID, TaskExecution: writer}).UploadMetadata(ctx, tracer)
+		}(writer)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	manifest, err := getChunkManifest(ctx, buildID)
+	require.NoError(t, err)
+	require.NotNil(t, manifest)
+	for _, testID := range testIDs {
+		assert.True(t, manifest.hasKeys([]string{metadataKeyForTest(buildID, testID)}), testID)
+	}
+	listed, err := ListTestIDs(ctx, tracer, buildID)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, testIDs, listed)
+}
@@ -1,8 +1,11 @@
 package model
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	otelTrace "go.opentelemetry.io/otel/trace"
@@ -15,20 +18,37 @@ import (
 	"time"
 
 	"github.com/evergreen-ci/logkeeper/env"
+	"github.com/evergreen-ci/pail"
 	"github.com/evergreen-ci/utility"
+	"github.com/mongodb/grip"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var loggerRegex *regexp.Regexp = regexp.MustCompile(`([ \w]{2}\d{1,5}\|)`)
 
+// DefaultMaxBuildChunks is the maximum number of log chunks, the build's own
+// and its tests', that InsertLogLines allows a build to have.
+const DefaultMaxBuildChunks = 100000
+
+// DefaultMaxBuildAge is a maximum build age high enough that only appends
+// backfilling builds long past their cleanup are rejected, for callers that
+// opt into InsertOptions.MaxBuildAge.
+const DefaultMaxBuildAge = 365 * 24 * time.Hour
+
 // LogLineItem represents a single line in a log.
 type LogLineItem struct {
 	Timestamp time.Time
 	Data      string
 	Global    bool
+	// Sequence, if set, is the line's position as tracked by the agent
+	// that uploaded it, which orders lines with equal timestamps.
+	Sequence *int64
 }
 
 // UnmarshalLogJSON unmarshals log lines from JSON into a slice of LogLineItem.
+// Each line is either a [timestamp, data] pair or a [timestamp, data,
+// sequence] triple, where the sequence is a non-negative integer.
 // Unmarshalling directly is more efficient than implementing the Unmarshaller interface.
 func UnmarshalLogJSON(ctx context.Context, tracer otelTrace.Tracer, r io.Reader) ([]LogLineItem, error) {
 	ctx, span := tracer.Start(ctx, "UnmarshalLogJSON")
@@ -36,61 +56,113 @@ func UnmarshalLogJSON(ctx context.Context, tracer otelTrace.Tracer, r io.Reader)
 
 	var lines []LogLineItem
 
+	dec, err := newLogLineDecoder(r)
+	if err != nil {
+		return lines, err
+	}
+	for {
+		line, ok, err := dec.next(ctx)
+		if err != nil {
+			return lines, err
+		}
+		if !ok {
+			break
+		}
+		lines = append(lines, line)
+	}
+
+	return lines, dec.finish()
+}
+
+// logLineDecoder decodes the lines of a JSON array of log lines one at a time,
+// so that they can be handled before the whole array is read.
+type logLineDecoder struct {
+	dec *json.Decoder
+}
+
+// newLogLineDecoder returns a decoder for the JSON array of log lines read
+// from r, reading the array's opening bracket.
+func newLogLineDecoder(r io.Reader) (*logLineDecoder, error) {
 	dec := json.NewDecoder(r)
 	firstToken, err := dec.Token()
 	if err != nil {
-		return lines, errors.New("reading opening bracket")
+		return nil, errors.New("reading opening bracket")
 	}
 	if delim, ok := firstToken.(json.Delim); !ok || delim != '[' {
-		return lines, errors.Errorf("unexpected first token '%v' of type '%T'", firstToken, firstToken)
+		return nil, errors.Errorf("unexpected first token '%v' of type '%T'", firstToken, firstToken)
 	}
 
-	for dec.More() {
-		var line []interface{}
-		if err := dec.Decode(&line); err != nil {
-			return nil, errors.Wrap(err, "decoding line")
-		}
-		if len(line) != 2 {
-			return lines, errors.Errorf("line had unexpected number of elements %d", len(line))
-		}
+	return &logLineDecoder{dec: dec}, nil
+}
 
-		timestamp, ok := line[0].(float64)
-		if !ok {
-			return lines, errors.Errorf("unexpected timestamp token '%v' of type '%v'", line[0], line[0])
-		}
-		data, ok := line[1].(string)
-		if !ok {
-			return lines, errors.Errorf("unexpected data token '%v' of type '%v'", line[1], line[1])
-		}
+// next decodes the array's next line. It returns false once every line has
+// been decoded.
+func (d *logLineDecoder) next(ctx context.Context) (LogLineItem, bool, error) {
+	if !d.dec.More() {
+		return LogLineItem{}, false, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return LogLineItem{}, false, errors.Wrap(err, "parsing log lines")
+	}
 
-		// Extract fractional seconds from the total time and convert to
-		// nanoseconds.
-		fractionalPart := timestamp - math.Floor(timestamp)
-		nSecPart := int64(fractionalPart * float64(int64(time.Second)/int64(time.Nanosecond)))
+	var line []interface{}
+	if err := d.dec.Decode(&line); err != nil {
+		return LogLineItem{}, false, errors.Wrap(err, "decoding line")
+	}
+	if len(line) != 2 && len(line) != 3 {
+		return LogLineItem{}, false, errors.Errorf("line had unexpected number of elements %d", len(line))
+	}
 
-		lines = append(lines, LogLineItem{
-			Timestamp: time.Unix(int64(timestamp), nSecPart),
-			Data:      data,
-		})
+	timestamp, ok := line[0].(float64)
+	if !ok {
+		return LogLineItem{}, false, errors.Errorf("unexpected timestamp token '%v' of type '%v'", line[0], line[0])
+	}
+	data, ok := line[1].(string)
+	if !ok {
+		return LogLineItem{}, false, errors.Errorf("unexpected data token '%v' of type '%v'", line[1], line[1])
+	}
+
+	// Extract fractional seconds from the total time and convert to
+	// nanoseconds.
+	fractionalPart := timestamp - math.Floor(timestamp)
+	nSecPart := int64(fractionalPart * float64(int64(time.Second)/int64(time.Nanosecond)))
+
+	item := LogLineItem{
+		Timestamp: time.Unix(int64(timestamp), nSecPart),
+		Data:      data,
+	}
+	if len(line) == 3 {
+		seq, ok := line[2].(float64)
+		if !ok || seq < 0 || seq != math.Trunc(seq) || seq > maxSequence {
+			return LogLineItem{}, false, errors.Errorf("unexpected sequence token '%v' of type '%T'", line[2], line[2])
+		}
+		sequence := int64(seq)
+		item.Sequence = &sequence
 	}
 
-	lastToken, err := dec.Token()
+	return item, true, nil
+}
+
+// finish reads the array's closing bracket and checks that nothing follows
+// it. It must only be called once next has returned every line.
+func (d *logLineDecoder) finish() error {
+	lastToken, err := d.dec.Token()
 	if err != nil {
-		return lines, errors.New("reading closing bracket")
+		return errors.New("reading closing bracket")
 	}
 	if delim, ok := lastToken.(json.Delim); !ok || delim != ']' {
-		return lines, errors.Errorf("unexpected last token '%v' of type '%T'", lastToken, lastToken)
+		return errors.Errorf("unexpected last token '%v' of type '%T'", lastToken, lastToken)
 	}
 
-	nextToken, err := dec.Token()
+	nextToken, err := d.dec.Token()
 	if err != io.EOF {
 		if err != nil {
-			return lines, errors.Wrap(err, "getting EOF")
+			return errors.Wrap(err, "getting EOF")
 		}
-		return lines, errors.Errorf("expected end of file, got '%v', type '%T'", nextToken, nextToken)
+		return errors.Errorf("expected end of file, got '%v', type '%T'", nextToken, nextToken)
 	}
 
-	return lines, nil
+	return nil
 }
 
 // LoggerName returns the logger name for this line so it can be assigned a
@@ -123,8 +195,84 @@ func (item *LogLineItem) OneSecondNewer(previousItem interface{}) bool {
 }
 
 // DownloadLogLines returns log lines for a given build ID and test ID. If the
-// test ID is empty, this will return all logs lines in the build.
+// test ID is empty, this will return all logs lines in the build. The returned
+// error matches ErrNoBuildKeys if the build has no keys, ErrListFailed if
+// they couldn't be listed and ErrTestNotFound if the test has no metadata.
 func DownloadLogLines(ctx context.Context, tracer otelTrace.Tracer, buildID string, testID string) (chan *LogLineItem, error) {
+	return DownloadLogLinesWithByteLimit(ctx, tracer, buildID, testID, 0)
+}
+
+// DownloadLogLinesWithByteLimit returns log lines for a given build ID and
+// test ID like DownloadLogLines, stopping with a truncation marker line once
+// the lines' data would exceed maxBytes. A maxBytes of zero or less disables
+// the limit.
+func DownloadLogLinesWithByteLimit(ctx context.Context, tracer otelTrace.Tracer, buildID string, testID string, maxBytes int) (chan *LogLineItem, error) {
+	return DownloadLogLinesWithOptions(ctx, tracer, buildID, testID, DownloadOptions{MaxBytes: maxBytes})
+}
+
+// DownloadOptions are the optional parameters for DownloadLogLinesWithOptions.
+type DownloadOptions struct {
+	// MaxBytes is the byte limit for the lines' data, after which a
+	// truncation marker line is returned. Zero or less disables the limit.
+	MaxBytes int
+	// TaskExecution, if set, restricts test lines to the tests from this
+	// execution of the task and build lines to the period in which those
+	// tests ran.
+	TaskExecution *int
+	// Reverse returns the lines newest first. Reversing a chunk reads it
+	// into memory whole rather than streaming it line by line, so reversed
+	// downloads hold every chunk currently being read in memory.
+	Reverse bool
+	// BestEffort skips chunks that fail to download or read rather than
+	// stopping, and ends the lines with a warning line with the number of
+	// chunks skipped.
+	BestEffort bool
+	// After, if set, restricts the lines to those with a timestamp strictly
+	// after it, so that clients polling for new lines only download chunks
+	// they haven't seen.
+	After *time.Time
+	// StripANSI removes ANSI escape sequences, such as color codes, from
+	// the lines' data. It's applied before the byte limit.
+	StripANSI bool
+	// MissingTest is how a test ID without test metadata is handled.
+	// Defaults to MissingTestNotFound.
+	MissingTest MissingTestPolicy
+	// Prefetch, if set, downloads the next batch of chunks in the
+	// background according to its options, rather than only once the
+	// current batch is exhausted.
+	Prefetch *PrefetchOptions
+	// StrictWindow restricts a test's own lines to its execution window,
+	// from the test's start to the next test's start, like the build's
+	// lines returned with them. By default all of a test's lines are
+	// returned, so lines logged by a test after the next test started,
+	// e.g. while it was shutting down, aren't lost. Strict windows instead
+	// leave them out so that each test's lines end where the next test's
+	// begin.
+	StrictWindow bool
+}
+
+// MissingTestPolicy is how DownloadLogLinesWithOptions handles a test ID that
+// has no test metadata, for example because the test's chunks were uploaded
+// but its metadata never was. Without metadata there's no execution window
+// to select the build's lines by.
+type MissingTestPolicy int
+
+const (
+	// MissingTestNotFound returns an error matching ErrTestNotFound.
+	MissingTestNotFound MissingTestPolicy = iota
+	// MissingTestOrphanedChunks returns only the lines of the test's own
+	// chunks, without any of the build's lines. An error matching
+	// ErrTestNotFound is still returned if the test has no chunks.
+	MissingTestOrphanedChunks
+)
+
+// ErrTestNotFound is returned, possibly wrapped, when the lines of a test
+// without test metadata are downloaded.
+var ErrTestNotFound = errors.New("test not found")
+
+// DownloadLogLinesWithOptions returns log lines for a given build ID and test
+// ID like DownloadLogLines, filtered and limited according to opts.
+func DownloadLogLinesWithOptions(ctx context.Context, tracer otelTrace.Tracer, buildID string, testID string, opts DownloadOptions) (chan *LogLineItem, error) {
 	ctx, span := tracer.Start(ctx, "DownloadLogLines")
 	defer span.End()
 	buildKeys, err := getBuildKeys(ctx, tracer, buildID)
@@ -133,7 +281,7 @@ func DownloadLogLines(ctx context.Context, tracer otelTrace.Tracer, buildID stri
 	}
 
 	if len(buildKeys) == 0 {
-		return nil, errors.Errorf("no keys found for build '%s", buildID)
+		return nil, errors.Wrapf(ErrNoBuildKeys, "build '%s'", buildID)
 	}
 
 	buildChunks, testChunks, err := parseLogChunks(buildKeys)
@@ -146,39 +294,175 @@ func DownloadLogLines(ctx context.Context, tracer otelTrace.Tracer, buildID stri
 	if err != nil {
 		return nil, errors.Wrapf(err, "parsing test IDs from keys for build '%s'", buildID)
 	}
+	tr := AllTime
+	if testID != "" && !utility.StringSliceContains(testIDs, testID) {
+		if opts.MissingTest != MissingTestOrphanedChunks || len(testChunks) == 0 {
+			return nil, errors.Wrapf(ErrTestNotFound, "test '%s' of build '%s'", testID, buildID)
+		}
+		buildChunks = nil
+	} else {
+		tr, err = testExecutionWindow(testIDs, testID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "getting execution window for test '%s'", testID)
+		}
+	}
+
+	if opts.TaskExecution != nil {
+		tests, err := findStoredTestsForBuild(ctx, tracer, buildID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "finding tests for build '%s'", buildID)
+		}
+		executionTR, executionTestIDs := taskExecutionWindow(tests, *opts.TaskExecution)
+
+		switch {
+		case len(executionTestIDs) == 0, testID != "" && !executionTestIDs[testID]:
+			buildChunks, testChunks = nil, nil
+		case testID == "":
+			tr = executionTR
+			testChunks = filterLogChunksByTestIDs(testChunks, executionTestIDs)
+		}
+	}
+
+	// Tests should never be filtered by a time range other than AllTime,
+	// apart from skipping lines already seen by a polling client, since we
+	// always want to capture all the lines of either a single test or all
+	// tests, unless strict windows are requested.
+	testTR := AllTime
+	if opts.StrictWindow {
+		testTR = tr
+	}
+	if opts.After != nil {
+		after := opts.After.Add(time.Nanosecond)
+		if after.After(testTR.StartAt) {
+			testTR.StartAt = after
+		}
+		if after.After(tr.StartAt) {
+			tr.StartAt = after
+		}
+	}
+
+	var failures *chunkFailures
+	if opts.BestEffort {
+		failures = &chunkFailures{}
+	}
+	it := NewMergingIterator(newBatchedLogIterator(testChunks, 4, testTR, failures, opts.Prefetch), newBatchedLogIterator(buildChunks, 4, tr, failures, opts.Prefetch))
+	if opts.Reverse {
+		it = it.Reverse()
+	}
+	if opts.StripANSI {
+		it = newANSIStripIterator(it)
+	}
+	if opts.MaxBytes > 0 {
+		it = NewByteLimitIterator(it, opts.MaxBytes)
+	}
+	if opts.BestEffort {
+		// The warning follows any truncation marker so that it's never
+		// cut off by the byte limit.
+		it = newChunkFailureWarningIterator(it, failures)
+	}
+	if opts.Prefetch != nil {
+		return streamFromLogIteratorWithBuffer(ctx, it, opts.Prefetch.StreamBuffer), nil
+	}
+
+	return it.Stream(ctx), nil
+}
+
+// CountLogLines returns the number of lines DownloadLogLines returns for the
+// given build ID and test ID. The count is summed from the line counts in the
+// chunks' keys, so chunks are only read when they're build chunks that
+// straddle the test's execution window, since only some of their lines are
+// returned.
+func CountLogLines(ctx context.Context, tracer otelTrace.Tracer, buildID string, testID string) (int, error) {
+	ctx, span := tracer.Start(ctx, "CountLogLines")
+	defer span.End()
+
+	buildKeys, err := getBuildKeys(ctx, tracer, buildID)
+	if err != nil {
+		return 0, errors.Wrapf(err, "getting keys for build '%s'", buildID)
+	}
+	if len(buildKeys) == 0 {
+		return 0, errors.Wrapf(ErrNoBuildKeys, "build '%s'", buildID)
+	}
+
+	buildChunks, testChunks, err := parseLogChunks(buildKeys)
+	if err != nil {
+		return 0, errors.Wrapf(err, "parsing log chunks from keys for build '%s'", buildID)
+	}
+	testChunks = filterLogChunksByTestID(testChunks, testID)
+
+	testIDs, err := parseTestIDs(buildKeys)
+	if err != nil {
+		return 0, errors.Wrapf(err, "parsing test IDs from keys for build '%s'", buildID)
+	}
 	tr, err := testExecutionWindow(testIDs, testID)
 	if err != nil {
-		return nil, errors.Wrapf(err, "getting execution window for test '%s'", testID)
+		return 0, errors.Wrapf(err, "getting execution window for test '%s'", testID)
+	}
+
+	count := 0
+	for _, chunk := range testChunks {
+		count += chunk.NumLines
 	}
 
-	// Tests should never be filtered by a time range other than AllTime
-	// since we always want to capture all the lines of either a single
-	// test or all tests.
-	return NewMergingIterator(NewBatchedLogIterator(testChunks, 4, AllTime), NewBatchedLogIterator(buildChunks, 4, tr)).Stream(ctx), nil
+	var straddling []LogChunkInfo
+	for _, chunk := range filterChunksByTimeRange(tr, buildChunks) {
+		// Lines are stored with millisecond precision, so a line may
+		// be before the chunk's start time.
+		if !chunk.Start.Truncate(time.Millisecond).Before(tr.StartAt) && !chunk.End.After(tr.EndAt) {
+			count += chunk.NumLines
+			continue
+		}
+		straddling = append(straddling, chunk)
+	}
+	if len(straddling) == 0 {
+		return count, nil
+	}
+
+	it := NewBatchedLogIterator(straddling, 4, tr)
+	for it.Next(ctx) {
+		count++
+	}
+	catcher := grip.NewBasicCatcher()
+	catcher.Wrap(it.Err(), "counting lines of chunks straddling the execution window")
+	catcher.Wrap(it.Close(), "closing iterator")
+
+	return count, catcher.Resolve()
 }
 
 // LogChunk is a grouping of lines.
 type LogChunk []LogLineItem
 
 // groupLines breaks up a slice of LogLineItems into chunks. The sum of the sizes of lines' Data in each chunk is
-// less than or equal to maxSize.
-func groupLines(lines []LogLineItem, maxSize int) ([]LogChunk, error) {
+// less than or equal to maxSize. If maxLines is positive each chunk also holds at most maxLines lines, counting
+// each line of a multi-line LogLineItem separately unless preserveNewlines is set, since only then are they
+// stored as a single line.
+func groupLines(lines []LogLineItem, maxSize int, maxLines int, preserveNewlines bool) ([]LogChunk, error) {
 	var chunks []LogChunk
 	var currentChunk LogChunk
 
 	logChars := 0
+	lineCount := 0
 	for _, line := range lines {
 		if len(line.Data) > maxSize {
 			return nil, errors.Errorf("Log line exceeded %d bytes", maxSize)
 		}
+		numLines := 1
+		if !preserveNewlines {
+			numLines += strings.Count(line.Data, "\n")
+		}
+		if maxLines > 0 && numLines > maxLines {
+			return nil, errors.Errorf("Log line exceeded %d lines", maxLines)
+		}
 
-		if len(line.Data)+logChars > maxSize {
+		if len(line.Data)+logChars > maxSize || (maxLines > 0 && numLines+lineCount > maxLines) {
 			logChars = 0
+			lineCount = 0
 			chunks = append(chunks, currentChunk)
 			currentChunk = LogChunk{}
 		}
 
 		logChars += len(line.Data)
+		lineCount += numLines
 		currentChunk = append(currentChunk, line)
 	}
 
@@ -189,31 +473,401 @@ func groupLines(lines []LogLineItem, maxSize int) ([]LogChunk, error) {
 	return chunks, nil
 }
 
+// InsertResult describes the log chunks stored by an insert.
+type InsertResult struct {
+	// Chunks is the number of chunks stored.
+	Chunks int `json:"chunks"`
+	// Lines is the number of lines stored, counting each line of a
+	// multi-line LogLineItem separately unless newlines are preserved.
+	Lines int `json:"lines"`
+	// Bytes is the total size of the chunks stored.
+	Bytes int64 `json:"bytes"`
+	// Keys are the keys of the chunks stored, in the order they were
+	// stored.
+	Keys []string `json:"keys"`
+}
+
+// add adds the chunks stored by another insert to the result.
+func (r *InsertResult) add(other InsertResult) {
+	r.Chunks += other.Chunks
+	r.Lines += other.Lines
+	r.Bytes += other.Bytes
+	r.Keys = append(r.Keys, other.Keys...)
+}
+
 // InsertLogLines uploads log lines for a given build or test to the
-// pail-backed offline storage. If the test ID is not empty, the logs are
-// appended to the test for the given build, otherwise the logs are appended to
-// the top-level build. A build ID is required in both cases.
-func InsertLogLines(ctx context.Context, tracer otelTrace.Tracer, buildID string, testID string, lines []LogLineItem, maxSize int) error {
+// pail-backed offline storage and returns what was stored. If the test ID is
+// not empty, the logs are appended to the test for the given build, otherwise
+// the logs are appended to the top-level build. A build ID is required in both
+// cases.
+func InsertLogLines(ctx context.Context, tracer otelTrace.Tracer, buildID string, testID string, lines []LogLineItem, maxSize int) (InsertResult, error) {
+	return InsertLogLinesWithLineLimit(ctx, tracer, buildID, testID, lines, maxSize, 0)
+}
+
+// InsertLogLinesWithLineLimit is like InsertLogLines, but also starts a new
+// chunk whenever a chunk would otherwise hold more than maxLines lines. A
+// maxLines of zero or less means chunks are only bounded by maxSize.
+func InsertLogLinesWithLineLimit(ctx context.Context, tracer otelTrace.Tracer, buildID string, testID string, lines []LogLineItem, maxSize int, maxLines int) (InsertResult, error) {
+	return InsertLogLinesWithOptions(ctx, tracer, buildID, testID, lines, InsertOptions{
+		MaxSize:        maxSize,
+		MaxLines:       maxLines,
+		MaxBuildChunks: DefaultMaxBuildChunks,
+	})
+}
+
+// InsertOptions are the parameters for InsertLogLinesWithOptions.
+type InsertOptions struct {
+	// MaxSize is the maximum size of the lines' data in each chunk.
+	MaxSize int
+	// MaxLines is the maximum number of lines in each chunk. Zero or less
+	// means chunks are only bounded by MaxSize.
+	MaxLines int
+	// PreserveNewlines stores each LogLineItem as a single line with its
+	// embedded newlines escaped, rather than splitting it into a line per
+	// newline, so that downloads return the items exactly as inserted.
+	PreserveNewlines bool
+	// OutOfOrder is how lines whose timestamps decrease are handled.
+	OutOfOrder OutOfOrderPolicy
+	// MaxBuildChunks is the maximum number of log chunks, the build's own
+	// and its tests', the build may have after the insert. An insert that
+	// would exceed it stores nothing and returns an error. The existing
+	// chunks are counted by listing the build's keys, so concurrent
+	// inserts into the same build may together exceed it. Zero or less
+	// disables the limit.
+	MaxBuildChunks int
+	// MaxBuildAge is the maximum age of a build that an insert may append
+	// to. A build's age is measured from the earliest start time of its
+	// existing log chunks, and an insert into an older build stores nothing
+	// and returns an error for which IsBuildTooOldError is true. Builds
+	// without log chunks are always accepted. Zero or less disables the
+	// limit.
+	MaxBuildAge time.Duration
+	// DropEmptyLines drops lines whose data is empty or only whitespace
+	// before storing the rest. The number dropped is recorded on the
+	// insert's span.
+	DropEmptyLines bool
+}
+
+// droppedLinesAttribute is the span attribute with the number of empty lines
+// dropped by an insert.
+const droppedLinesAttribute = "logkeeper.dropped_empty_lines"
+
+// dropEmptyLines returns the lines whose data isn't empty or only whitespace
+// and the number of lines dropped. The given slice is never modified.
+func dropEmptyLines(lines []LogLineItem) ([]LogLineItem, int) {
+	kept := make([]LogLineItem, 0, len(lines))
+	for _, line := range lines {
+		if strings.TrimSpace(line.Data) != "" {
+			kept = append(kept, line)
+		}
+	}
+
+	return kept, len(lines) - len(kept)
+}
+
+// OutOfOrderPolicy is how InsertLogLinesWithOptions handles lines that are
+// out of chronological order. Lines within a chunk are downloaded in the order
+// they were stored, so out of order lines are downloaded out of order.
+type OutOfOrderPolicy int
+
+const (
+	// OutOfOrderAllow stores the lines in the order given.
+	OutOfOrderAllow OutOfOrderPolicy = iota
+	// OutOfOrderSort stably sorts the lines by timestamp before storing
+	// them.
+	OutOfOrderSort
+	// OutOfOrderReject stores nothing and returns an error if any line's
+	// timestamp is before the previous line's.
+	OutOfOrderReject
+)
+
+// orderLines returns the lines ordered according to the policy. The given
+// slice is never modified.
+func orderLines(lines []LogLineItem, policy OutOfOrderPolicy) ([]LogLineItem, error) {
+	switch policy {
+	case OutOfOrderSort:
+		sorted := make([]LogLineItem, len(lines))
+		copy(sorted, lines)
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return sorted[i].Timestamp.Before(sorted[j].Timestamp)
+		})
+		return sorted, nil
+	case OutOfOrderReject:
+		for i := 1; i < len(lines); i++ {
+			if lines[i].Timestamp.Before(lines[i-1].Timestamp) {
+				return nil, errors.Errorf("line %d has timestamp %s, which is before the previous line's timestamp %s", i, lines[i].Timestamp.UTC().Format(time.RFC3339Nano), lines[i-1].Timestamp.UTC().Format(time.RFC3339Nano))
+			}
+		}
+	}
+
+	return lines, nil
+}
+
+// InsertLogLinesWithOptions is like InsertLogLines, but chunks and stores the
+// lines according to opts. If the chunks are stored but the test's line count,
+// or the build's size, can't be updated, what was stored is returned along
+// with the error.
+func InsertLogLinesWithOptions(ctx context.Context, tracer otelTrace.Tracer, buildID string, testID string, lines []LogLineItem, opts InsertOptions) (InsertResult, error) {
 	_, span := tracer.Start(ctx, "InsertLogLines")
 	defer span.End()
 	if len(lines) == 0 {
-		return nil
+		return InsertResult{}, nil
+	}
+
+	if opts.DropEmptyLines {
+		var dropped int
+		lines, dropped = dropEmptyLines(lines)
+		span.SetAttributes(attribute.Int(droppedLinesAttribute, dropped))
+		if len(lines) == 0 {
+			return InsertResult{}, nil
+		}
+	}
+
+	lines, err := orderLines(lines, opts.OutOfOrder)
+	if err != nil {
+		return InsertResult{}, errors.Wrapf(err, "ordering lines for build '%s' test '%s'", buildID, testID)
+	}
+
+	chunks, err := groupLines(lines, opts.MaxSize, opts.MaxLines, opts.PreserveNewlines)
+	if err != nil {
+		return InsertResult{}, errors.Wrapf(err, "grouping lines for build '%s' test '%s'", buildID, testID)
+	}
+
+	if opts.MaxBuildAge > 0 {
+		if err = checkBuildAge(ctx, buildID, opts.MaxBuildAge); err != nil {
+			return InsertResult{}, errors.Wrapf(err, "checking age of build '%s'", buildID)
+		}
+	}
+	if opts.MaxBuildChunks > 0 {
+		if err = checkBuildChunkLimit(ctx, buildID, len(chunks), opts.MaxBuildChunks); err != nil {
+			return InsertResult{}, errors.Wrapf(err, "checking chunk limit for build '%s' test '%s'", buildID, testID)
+		}
+	}
+
+	result, err := uploadChunks(ctx, buildID, testID, chunks, opts.PreserveNewlines)
+	if err != nil {
+		return InsertResult{}, errors.Wrapf(err, "uploading chunks for build '%s' test '%s'", buildID, testID)
+	}
+
+	if testID != "" {
+		return result, errors.Wrapf(addTestLines(ctx, tracer, buildID, testID, result.Lines, result.Bytes), "updating line count for build '%s' test '%s'", buildID, testID)
+	}
+
+	return result, errors.Wrapf(addBuildBytes(ctx, buildID, result.Bytes), "updating size of build '%s'", buildID)
+}
+
+// checkBuildChunkLimit returns an error if adding numChunks log chunks to the
+// given build would leave it with more than maxChunks.
+func checkBuildChunkLimit(ctx context.Context, buildID string, numChunks int, maxChunks int) error {
+	existing, err := countBuildChunks(ctx, buildID)
+	if err != nil {
+		return err
+	}
+	if existing+numChunks > maxChunks {
+		return errors.Errorf("build has %d log chunks and adding %d more would exceed the maximum of %d", existing, numChunks, maxChunks)
 	}
 
-	chunks, err := groupLines(lines, maxSize)
+	return nil
+}
+
+type buildTooOldError struct {
+	error
+}
+
+// IsBuildTooOldError returns whether the error is due to appending to a build
+// older than InsertOptions.MaxBuildAge.
+func IsBuildTooOldError(err error) bool {
+	_, ok := errors.Cause(err).(buildTooOldError)
+	return ok
+}
+
+// checkBuildAge returns an error if the earliest of the given build's log
+// chunks started more than maxAge ago.
+func checkBuildAge(ctx context.Context, buildID string, maxAge time.Duration) error {
+	keys, err := listBuildKeys(ctx, buildID, "")
+	if err != nil {
+		return errors.Wrap(err, "listing build keys")
+	}
+	buildChunks, testChunks, err := parseLogChunks(keys)
 	if err != nil {
-		return errors.Wrapf(err, "grouping lines for build '%s' test '%s'", buildID, testID)
+		return errors.Wrap(err, "parsing log chunks")
+	}
+
+	var earliest time.Time
+	for _, chunks := range [][]LogChunkInfo{buildChunks, testChunks} {
+		if len(chunks) > 0 && (earliest.IsZero() || chunks[0].Start.Before(earliest)) {
+			earliest = chunks[0].Start
+		}
 	}
+	if !earliest.IsZero() && time.Since(earliest) > maxAge {
+		return buildTooOldError{errors.Errorf("build started at %s, which is more than the maximum age of %s ago", earliest.UTC().Format(time.RFC3339), maxAge)}
+	}
+
+	return nil
+}
 
+// countBuildChunks returns the number of log chunks, the build's own and its
+// tests', the given build has.
+func countBuildChunks(ctx context.Context, buildID string) (int, error) {
+	keys, err := listBuildKeys(ctx, buildID, "")
+	if err != nil {
+		return 0, errors.Wrap(err, "listing build keys")
+	}
+
+	var existing int
+	for _, key := range keys {
+		if !strings.HasSuffix(key, metadataFilename) {
+			existing++
+		}
+	}
+
+	return existing, nil
+}
+
+// InsertLogLinesFromReader decodes log lines from the JSON array read from r,
+// in the format UnmarshalLogJSON accepts, and stores them according to opts
+// as they're decoded. Each chunk is uploaded as soon as it's full, so at most
+// one chunk's lines are held in memory however large the array is. Unlike
+// InsertLogLinesWithOptions, chunks already uploaded are kept if a later line
+// fails to decode or be stored, so what was stored is returned along with any
+// error. Lines can't be sorted before they're all read, so
+// OutOfOrderSort isn't supported, and OutOfOrderReject only rejects the lines
+// from the first out of order line on.
+func InsertLogLinesFromReader(ctx context.Context, tracer otelTrace.Tracer, buildID string, testID string, r io.Reader, opts InsertOptions) (InsertResult, error) {
+	ctx, span := tracer.Start(ctx, "InsertLogLinesFromReader")
+	defer span.End()
+
+	if opts.OutOfOrder == OutOfOrderSort {
+		return InsertResult{}, errors.New("streamed lines can't be sorted")
+	}
+
+	if opts.MaxBuildAge > 0 {
+		if err := checkBuildAge(ctx, buildID, opts.MaxBuildAge); err != nil {
+			return InsertResult{}, errors.Wrapf(err, "checking age of build '%s'", buildID)
+		}
+	}
+	var existingChunks int
+	if opts.MaxBuildChunks > 0 {
+		var err error
+		if existingChunks, err = countBuildChunks(ctx, buildID); err != nil {
+			return InsertResult{}, errors.Wrapf(err, "counting chunks for build '%s'", buildID)
+		}
+	}
+
+	var (
+		chunk      LogChunk
+		chunkBytes int
+		chunkLines int
+		result     InsertResult
+		dropped    int
+	)
+	flush := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		if opts.MaxBuildChunks > 0 && existingChunks+result.Chunks+1 > opts.MaxBuildChunks {
+			return errors.Errorf("build has %d log chunks and adding more would exceed the maximum of %d", existingChunks+result.Chunks, opts.MaxBuildChunks)
+		}
+
+		uploaded, err := uploadChunks(ctx, buildID, testID, []LogChunk{chunk}, opts.PreserveNewlines)
+		if err != nil {
+			return errors.Wrap(err, "uploading chunk")
+		}
+		result.add(uploaded)
+		chunk, chunkBytes, chunkLines = nil, 0, 0
+
+		return nil
+	}
+	insert := func() error {
+		dec, err := newLogLineDecoder(r)
+		if err != nil {
+			return err
+		}
+
+		var prev *LogLineItem
+		for {
+			line, ok, err := dec.next(ctx)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				break
+			}
+			if opts.DropEmptyLines && strings.TrimSpace(line.Data) == "" {
+				dropped++
+				continue
+			}
+			if opts.OutOfOrder == OutOfOrderReject && prev != nil && line.Timestamp.Before(prev.Timestamp) {
+				return errors.Errorf("line has timestamp %s, which is before the previous line's timestamp %s", line.Timestamp.UTC().Format(time.RFC3339Nano), prev.Timestamp.UTC().Format(time.RFC3339Nano))
+			}
+			prev = &line
+
+			if len(line.Data) > opts.MaxSize {
+				return errors.Errorf("Log line exceeded %d bytes", opts.MaxSize)
+			}
+			numLines := 1
+			if !opts.PreserveNewlines {
+				numLines += strings.Count(line.Data, "\n")
+			}
+			if opts.MaxLines > 0 && numLines > opts.MaxLines {
+				return errors.Errorf("Log line exceeded %d lines", opts.MaxLines)
+			}
+			if len(line.Data)+chunkBytes > opts.MaxSize || (opts.MaxLines > 0 && numLines+chunkLines > opts.MaxLines) {
+				if err = flush(); err != nil {
+					return err
+				}
+			}
+			chunk = append(chunk, line)
+			chunkBytes += len(line.Data)
+			chunkLines += numLines
+		}
+		if err = dec.finish(); err != nil {
+			return err
+		}
+
+		return flush()
+	}
+
+	err := insert()
+	span.SetAttributes(attribute.Int(droppedLinesAttribute, dropped))
+	catcher := grip.NewBasicCatcher()
+	catcher.Wrapf(err, "streaming lines for build '%s' test '%s' after storing %d chunks", buildID, testID, result.Chunks)
+	if testID != "" && result.Lines > 0 {
+		catcher.Wrapf(addTestLines(ctx, tracer, buildID, testID, result.Lines, result.Bytes), "updating line count for build '%s' test '%s'", buildID, testID)
+	}
+	if testID == "" && result.Chunks > 0 {
+		catcher.Wrapf(addBuildBytes(ctx, buildID, result.Bytes), "updating size of build '%s'", buildID)
+	}
+
+	return result, catcher.Resolve()
+}
+
+// uploadChunks uploads the chunks and returns what was stored. If
+// preserveNewlines is set, each line is stored as a single line with its
+// newlines escaped. The chunks' keys are reserved in the build's chunk
+// manifest before any is uploaded and added to it once all are. Uploading
+// stops if the context is canceled, and if any chunk fails to upload the
+// chunks already uploaded are removed so that no partial logs are left
+// behind.
+func uploadChunks(ctx context.Context, buildID string, testID string, chunks []LogChunk, preserveNewlines bool) (InsertResult, error) {
+	infos := make([]LogChunkInfo, 0, len(chunks))
+	buffers := make([]*bytes.Buffer, 0, len(chunks))
+	keys := make([]string, 0, len(chunks))
 	for _, chunk := range chunks {
 		logChunkInfo := LogChunkInfo{}
 		if err := logChunkInfo.fromLogChunk(buildID, testID, chunk); err != nil {
-			return errors.Wrap(err, "parsing log chunk info")
+			return InsertResult{}, errors.Wrap(err, "parsing log chunk info")
 		}
 
 		var buffer bytes.Buffer
 		numLines := 0
 		for _, line := range chunk {
+			if preserveNewlines {
+				buffer.WriteString(makeEscapedLogLineString(line))
+				numLines += 1
+				continue
+			}
+
 			// We are sometimes passed in a single log line that is
 			// actually multiple lines, so we parse it into
 			// separate lines and keep track of the count to make
@@ -225,12 +879,199 @@ func InsertLogLines(ctx context.Context, tracer otelTrace.Tracer, buildID string
 		}
 		logChunkInfo.NumLines = numLines
 
-		if err := env.Bucket().Put(ctx, logChunkInfo.key(), &buffer); err != nil {
+		infos = append(infos, logChunkInfo)
+		buffers = append(buffers, &buffer)
+		keys = append(keys, logChunkInfo.key())
+	}
+
+	if err := ctx.Err(); err != nil {
+		return InsertResult{}, err
+	}
+	if err := reserveChunkManifestKeys(ctx, buildID, keys...); err != nil {
+		return InsertResult{}, errors.Wrap(err, "reserving chunks in chunk manifest")
+	}
+
+	var result InsertResult
+	upload := func(i int) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		size := int64(buffers[i].Len())
+		if err := env.Bucket().Put(ctx, keys[i], buffers[i]); err != nil {
 			return errors.Wrap(err, "uploading log chunk")
 		}
+		result.Chunks++
+		result.Lines += infos[i].NumLines
+		result.Bytes += size
+		result.Keys = append(result.Keys, keys[i])
+
+		return nil
 	}
 
-	return nil
+	for i := range keys {
+		if err := upload(i); err != nil {
+			// The context may already be canceled, but the partial
+			// upload still needs to be removed. The reserved keys are
+			// only released once nothing is left behind, otherwise
+			// they stay pending so that reads list what's left.
+			ctx = context.WithoutCancel(ctx)
+			var cleanupErr error
+			if len(result.Keys) > 0 {
+				cleanupErr = errors.Wrap(env.Bucket().RemoveMany(ctx, result.Keys...), "removing partially uploaded chunks")
+			}
+			if cleanupErr == nil {
+				cleanupErr = errors.Wrap(releaseChunkManifestKeys(ctx, buildID, keys...), "releasing chunks reserved in chunk manifest")
+			}
+			if cleanupErr != nil {
+				catcher := grip.NewBasicCatcher()
+				catcher.Add(err)
+				catcher.Add(cleanupErr)
+				return InsertResult{}, catcher.Resolve()
+			}
+			return InsertResult{}, err
+		}
+	}
+	addStorageUsage(0, result.Chunks)
+	if err := addToChunkManifest(ctx, buildID, result.Keys...); err != nil {
+		return InsertResult{}, errors.Wrap(err, "adding uploaded chunks to chunk manifest")
+	}
+
+	return result, nil
+}
+
+// LineCountRepair describes the changes made by RepairLineCounts.
+type LineCountRepair struct {
+	Chunks int `json:"chunks"`
+	Tests  int `json:"tests"`
+}
+
+// RepairLineCounts re-derives the line counts of the given build's log chunks
+// from their contents, rewriting any chunk whose key disagrees, and then
+// corrects the line counts and total sizes recorded in the build's and its
+// tests' metadata, recording the size of legacy builds and tests that predate
+// it. Running it
+// against a build whose metadata is already correct changes nothing.
+func RepairLineCounts(ctx context.Context, tracer otelTrace.Tracer, buildID string) (LineCountRepair, error) {
+	ctx, span := tracer.Start(ctx, "RepairLineCounts")
+	defer span.End()
+
+	var repair LineCountRepair
+	unlock, err := lockBuild(ctx, buildID)
+	if err != nil {
+		return repair, err
+	}
+	defer logUnlockError(unlock, buildID)
+
+	buildKeys, err := listBuildKeys(ctx, buildID, "")
+	if err != nil {
+		return repair, errors.Wrapf(err, "listing keys for build '%s'", buildID)
+	}
+	buildChunks, testChunks, err := parseLogChunks(buildKeys)
+	if err != nil {
+		return repair, errors.Wrapf(err, "parsing log chunks for build '%s'", buildID)
+	}
+
+	testBytes := map[string]int64{}
+	for _, info := range append(buildChunks, testChunks...) {
+		repaired, size, err := repairChunkLineCount(ctx, info)
+		if err != nil {
+			return repair, errors.Wrapf(err, "repairing log chunk '%s'", info.key())
+		}
+		if repaired {
+			repair.Chunks++
+		}
+		testBytes[info.TestID] += size
+	}
+
+	testIDs, err := parseTestIDs(buildKeys)
+	if err != nil {
+		return repair, errors.Wrapf(err, "parsing test IDs for build '%s'", buildID)
+	}
+	for _, testID := range testIDs {
+		metadata, key, err := findTestMetadata(ctx, buildID, testID)
+		if err != nil {
+			return repair, err
+		}
+		if metadata == nil {
+			continue
+		}
+		numLines, err := countTestLines(ctx, buildID, testID)
+		if err != nil {
+			return repair, errors.Wrapf(err, "counting lines for test '%s'", testID)
+		}
+		// Missing line counts are counted the same way, so only missing
+		// sizes of tests with chunks need recording.
+		totalBytes := testBytes[testID]
+		linesRecorded := metadata.NumLines == nil || *metadata.NumLines == numLines
+		bytesRecorded := (metadata.TotalBytes == nil && totalBytes == 0) || (metadata.TotalBytes != nil && *metadata.TotalBytes == totalBytes)
+		if linesRecorded && bytesRecorded {
+			continue
+		}
+
+		// The metadata is written back to the key it was read from so
+		// that a test stored in the unsharded layout isn't copied into
+		// the sharded one.
+		metadata.NumLines = &numLines
+		metadata.TotalBytes = &totalBytes
+		if err = putTestMetadata(ctx, metadata, key); err != nil {
+			return repair, err
+		}
+		repair.Tests++
+	}
+
+	// The size of the build's own chunks is recorded the same way. It
+	// isn't counted as a repaired test.
+	metadata, key, err := findBuild(ctx, buildID)
+	if err != nil {
+		return repair, err
+	}
+	if logBytes := testBytes[""]; metadata != nil && (metadata.LogBytes == nil || *metadata.LogBytes != logBytes) {
+		metadata.LogBytes = &logBytes
+		if err = putBuild(ctx, metadata, key); err != nil {
+			return repair, err
+		}
+	}
+
+	// Repaired chunks are moved to new keys, so the manifest is rebuilt
+	// from the keys now stored. This also restores the manifest of a build
+	// whose manifest was removed after failing to be updated.
+	if err = rebuildChunkManifest(ctx, buildID); err != nil {
+		return repair, errors.Wrapf(err, "rebuilding chunk manifest for build '%s'", buildID)
+	}
+
+	return repair, nil
+}
+
+// repairChunkLineCount moves the given chunk to a key reflecting the number of
+// lines it actually contains, returning whether the chunk was moved and the
+// chunk's size. The corrected chunk is written before the original is removed
+// so that an interrupted repair never loses lines.
+func repairChunkLineCount(ctx context.Context, info LogChunkInfo) (bool, int64, error) {
+	oldKey := info.key()
+	reader, err := env.Bucket().Get(ctx, oldKey)
+	if err != nil {
+		return false, 0, errors.Wrap(err, "getting log chunk")
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return false, 0, errors.Wrap(err, "reading log chunk")
+	}
+	size := int64(len(data))
+
+	numLines := bytes.Count(data, []byte{'\n'})
+	if numLines == info.NumLines {
+		return false, size, nil
+	}
+
+	info.NumLines = numLines
+	if err = env.Bucket().Put(ctx, info.key(), bytes.NewReader(data)); err != nil {
+		return false, size, errors.Wrap(err, "uploading repaired log chunk")
+	}
+
+	return true, size, errors.Wrap(env.Bucket().Remove(ctx, oldKey), "removing original log chunk")
 }
 
 // LogChunkInfo describes a chunk of log lines stored in pail-backed offline
@@ -241,37 +1082,42 @@ type LogChunkInfo struct {
 	NumLines int
 	Start    time.Time
 	End      time.Time
+
+	// sharded is whether the chunk's key is in the sharded build key
+	// layout.
+	sharded bool
 }
 
 func (info *LogChunkInfo) key() string {
-	var prefix string
+	prefix := buildPrefixForLayout(info.BuildID, info.sharded)
 	if info.TestID != "" {
-		prefix = testPrefix(info.BuildID, info.TestID)
-	} else {
-		prefix = buildPrefix(info.BuildID)
+		prefix += testSubPrefix(info.TestID)
 	}
 	return fmt.Sprintf("%s%d_%d_%d", prefix, info.Start.UnixNano(), info.End.UnixNano(), info.NumLines)
 }
 
 func (info *LogChunkInfo) fromKey(path string) error {
 	var keyName string
-	keyParts := strings.Split(path, "/")
-	if strings.Contains(path, "/tests/") {
-		if len(keyParts) < 5 {
-			return errors.Errorf("invalid chunk key '%s'", path)
-		}
-		info.BuildID = keyParts[1]
-		info.TestID = keyParts[3]
-		keyName = keyParts[4]
-	} else {
+	buildID, keyParts, ok := splitBuildKey(path)
+	if !ok {
+		return errors.Errorf("invalid chunk key '%s'", path)
+	}
+	if keyParts[0]+"/" == testsSubPrefix {
 		if len(keyParts) < 3 {
 			return errors.Errorf("invalid chunk key '%s'", path)
 		}
-		info.BuildID = keyParts[1]
+		info.TestID = keyParts[1]
 		keyName = keyParts[2]
+	} else {
+		keyName = keyParts[0]
 	}
+	info.BuildID = buildID
+	info.sharded = isShardedBuildKey(path)
 
 	nameParts := strings.Split(keyName, "_")
+	if len(nameParts) != 3 {
+		return errors.Errorf("invalid chunk key '%s'", path)
+	}
 	startNanos, err := strconv.ParseInt(nameParts[0], 10, 64)
 	if err != nil {
 		return errors.Wrap(err, "parsing start time")
@@ -310,8 +1156,9 @@ func (info *LogChunkInfo) fromLogChunk(buildID string, testID string, logChunk L
 	info.BuildID = buildID
 	info.TestID = testID
 	info.NumLines = len(logChunk)
-	info.Start = minTime
-	info.End = maxTime
+	info.sharded = env.ShardBuildKeys()
+	info.Start = minTime.UTC()
+	info.End = maxTime.UTC()
 	return nil
 }
 
@@ -321,14 +1168,446 @@ func parseLogLineString(data string) (LogLineItem, error) {
 		return LogLineItem{}, errors.Wrap(err, "parsing log line timestamp")
 	}
 
+	// We need to Trim the newline here because Logkeeper doesn't
+	// expect newlines to be included in the LogLineItem.
+	lineData := strings.TrimRight(data[23:], "\n")
+	var sequence *int64
+	if data[2] == sequencedLineFlag || data[2] == sequencedEscapedLineFlag {
+		if len(lineData) < 20 {
+			return LogLineItem{}, errors.New("log line is missing its sequence number")
+		}
+		seq, err := strconv.ParseInt(strings.TrimSpace(lineData[:20]), 10, 64)
+		if err != nil {
+			return LogLineItem{}, errors.Wrap(err, "parsing log line sequence number")
+		}
+		sequence = &seq
+		lineData = lineData[20:]
+	}
+	if data[2] == escapedLineFlag || data[2] == sequencedEscapedLineFlag {
+		lineData = newlineUnescaper.Replace(lineData)
+	}
+
 	return LogLineItem{
 		Timestamp: time.Unix(0, ts*1e6).UTC(),
-		// We need to Trim the newline here because Logkeeper doesn't
-		// expect newlines to be included in the LogLineItem.
-		Data: strings.TrimRight(data[23:], "\n"),
+		Data:      lineData,
+		Sequence:  sequence,
 	}, nil
 }
 
+// ManifestChunk describes a single log chunk of a build's manifest.
+type ManifestChunk struct {
+	Key      string    `json:"key"`
+	TestID   string    `json:"test_id,omitempty"`
+	NumLines int       `json:"num_lines"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	// Offset is the position of the chunk's first byte in the
+	// concatenation of all of the manifest's chunks, in order.
+	Offset int64 `json:"offset"`
+	Size   int64 `json:"size"`
+	// Hash is the hex-encoded SHA-256 hash of the chunk's contents.
+	Hash string `json:"hash"`
+}
+
+// BuildManifest returns every log chunk of the given build, the build's own
+// as well as its tests', sorted by start time. Every chunk is read to find its
+// size and hash.
+func BuildManifest(ctx context.Context, tracer otelTrace.Tracer, buildID string) ([]ManifestChunk, error) {
+	ctx, span := tracer.Start(ctx, "BuildManifest")
+	defer span.End()
+
+	buildKeys, err := getBuildKeys(ctx, tracer, buildID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting keys for build '%s'", buildID)
+	}
+	buildChunks, testChunks, err := parseLogChunks(buildKeys)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing log chunks from keys for build '%s'", buildID)
+	}
+	chunks := append(buildChunks, testChunks...)
+	sortLogChunksByStartTime(chunks)
+
+	manifest := make([]ManifestChunk, 0, len(chunks))
+	var offset int64
+	for _, info := range chunks {
+		size, hash, err := chunkSizeAndHash(ctx, info.key())
+		if err != nil {
+			return nil, err
+		}
+		manifest = append(manifest, ManifestChunk{
+			Key:      info.key(),
+			TestID:   info.TestID,
+			NumLines: info.NumLines,
+			Start:    info.Start,
+			End:      info.End,
+			Offset:   offset,
+			Size:     size,
+			Hash:     hash,
+		})
+		offset += size
+	}
+
+	return manifest, nil
+}
+
+// chunkSizeAndHash returns the size of the log chunk with the given key and
+// the hex-encoded SHA-256 hash of its contents.
+func chunkSizeAndHash(ctx context.Context, key string) (int64, string, error) {
+	reader, err := env.Bucket().Get(ctx, key)
+	if err != nil {
+		return 0, "", errors.Wrapf(err, "getting log chunk '%s'", key)
+	}
+	defer reader.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, reader)
+	if err != nil {
+		return 0, "", errors.Wrapf(err, "reading log chunk '%s'", key)
+	}
+
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// LogChunkContent is a single log chunk exactly as it's stored.
+type LogChunkContent struct {
+	Key  string
+	Data []byte
+	// Hash is the hex-encoded SHA-256 hash of Data, the same as the
+	// chunk's hash in its build's manifest.
+	Hash string
+}
+
+// GetLogChunk returns the log chunk of the given build with the given key, as
+// listed in the build's manifest. It returns nil if the key isn't one of the
+// build's log chunks or the chunk doesn't exist.
+func GetLogChunk(ctx context.Context, tracer otelTrace.Tracer, buildID string, key string) (*LogChunkContent, error) {
+	ctx, span := tracer.Start(ctx, "GetLogChunk")
+	defer span.End()
+
+	var info LogChunkInfo
+	if err := info.fromKey(key); err != nil || info.BuildID != buildID || info.key() != key {
+		return nil, nil
+	}
+
+	reader, err := env.Bucket().Get(ctx, key)
+	if pail.IsKeyNotFoundError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting log chunk '%s'", key)
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading log chunk '%s'", key)
+	}
+	hash := sha256.Sum256(data)
+
+	return &LogChunkContent{
+		Key:  key,
+		Data: data,
+		Hash: hex.EncodeToString(hash[:]),
+	}, nil
+}
+
+// BuildSummary aggregates a build's metadata with statistics about its logs.
+type BuildSummary struct {
+	Build      *Build `json:"build"`
+	NumTests   int    `json:"num_tests"`
+	NumLines   int    `json:"num_lines"`
+	TotalBytes int64  `json:"total_bytes"`
+	// UnsizedChunks is the number of log chunks left out of TotalBytes
+	// because their build or test predates sizes being recorded.
+	UnsizedChunks int       `json:"unsized_chunks"`
+	TimeRange     TimeRange `json:"time_range"`
+}
+
+// SummarizeBuild returns the given build's metadata along with its number of
+// tests and the total number of lines, total size and time range of all of
+// its log chunks, the build's own as well as its tests'. Line counts and time
+// ranges come from the chunks' keys and sizes from the build's and tests'
+// metadata, so no chunk is read. Chunks of legacy builds and tests without a
+// recorded size are counted in UnsizedChunks instead of TotalBytes until
+// RepairLineCounts records it. It returns nil if the build doesn't exist.
+func SummarizeBuild(ctx context.Context, tracer otelTrace.Tracer, buildID string) (*BuildSummary, error) {
+	ctx, span := tracer.Start(ctx, "SummarizeBuild")
+	defer span.End()
+
+	metadata, _, err := findBuild(ctx, buildID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "finding build '%s'", buildID)
+	}
+	if metadata == nil {
+		return nil, nil
+	}
+
+	buildKeys, err := getBuildKeys(ctx, tracer, buildID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting keys for build '%s'", buildID)
+	}
+	buildChunks, testChunks, err := parseLogChunks(buildKeys)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing log chunks from keys for build '%s'", buildID)
+	}
+	testIDs, err := parseTestIDs(buildKeys)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing test IDs from keys for build '%s'", buildID)
+	}
+
+	summary := &BuildSummary{Build: &metadata.Build, NumTests: len(testIDs)}
+	sized := map[string]bool{}
+	if metadata.LogBytes != nil {
+		summary.TotalBytes += *metadata.LogBytes
+		sized[""] = true
+	}
+	for _, testID := range testIDs {
+		test, _, err := findTestMetadata(ctx, buildID, testID)
+		if err != nil {
+			return nil, err
+		}
+		if test == nil || test.TotalBytes == nil {
+			continue
+		}
+		summary.TotalBytes += *test.TotalBytes
+		sized[testID] = true
+	}
+
+	for _, chunk := range append(buildChunks, testChunks...) {
+		summary.NumLines += chunk.NumLines
+		if summary.TimeRange.IsZero() || chunk.Start.Before(summary.TimeRange.StartAt) {
+			summary.TimeRange.StartAt = chunk.Start
+		}
+		if chunk.End.After(summary.TimeRange.EndAt) {
+			summary.TimeRange.EndAt = chunk.End
+		}
+		if !sized[chunk.TestID] {
+			summary.UnsizedChunks++
+		}
+	}
+
+	return summary, nil
+}
+
+// SequenceRange is an inclusive range of line sequence numbers.
+type SequenceRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// SequenceReport describes the line sequence numbers stored for a build.
+type SequenceReport struct {
+	// NumSequenced is the number of lines with a sequence number, and
+	// NumUnsequenced the number without one.
+	NumSequenced   int `json:"num_sequenced"`
+	NumUnsequenced int `json:"num_unsequenced"`
+	// Gaps are the ranges of sequence numbers missing between the
+	// smallest and largest stored, which indicate lost uploads.
+	Gaps []SequenceRange `json:"gaps"`
+	// Duplicates are the ranges of sequence numbers stored more than
+	// once.
+	Duplicates []SequenceRange `json:"duplicates"`
+}
+
+// CheckLineSequence reads every log chunk of the given build, the build's own
+// as well as its tests', and reports any gaps or duplicates in the sequence
+// numbers of its lines. The build's lines are expected to share a single
+// sequence, as they do when an agent numbers every line it uploads. A line
+// split across stored lines is counted once. It returns nil if the build
+// doesn't exist.
+func CheckLineSequence(ctx context.Context, tracer otelTrace.Tracer, buildID string) (*SequenceReport, error) {
+	ctx, span := tracer.Start(ctx, "CheckLineSequence")
+	defer span.End()
+
+	build, err := FindBuildByID(ctx, tracer, buildID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "finding build '%s'", buildID)
+	}
+	if build == nil {
+		return nil, nil
+	}
+
+	buildKeys, err := getBuildKeys(ctx, tracer, buildID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting keys for build '%s'", buildID)
+	}
+	buildChunks, testChunks, err := parseLogChunks(buildKeys)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing log chunks from keys for build '%s'", buildID)
+	}
+	chunks := append(buildChunks, testChunks...)
+	sortLogChunksByStartTime(chunks)
+
+	report := &SequenceReport{}
+	var sequences []int64
+	for _, chunk := range chunks {
+		chunkSequences, numUnsequenced, err := readChunkSequences(ctx, chunk)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading sequence numbers of chunk '%s'", chunk.key())
+		}
+		sequences = append(sequences, chunkSequences...)
+		report.NumUnsequenced += numUnsequenced
+	}
+	report.NumSequenced = len(sequences)
+
+	sort.Slice(sequences, func(i, j int) bool { return sequences[i] < sequences[j] })
+	for i := 1; i < len(sequences); i++ {
+		prev, cur := sequences[i-1], sequences[i]
+		switch {
+		case cur > prev+1:
+			report.Gaps = append(report.Gaps, SequenceRange{Start: prev + 1, End: cur - 1})
+		case cur == prev:
+			// Consecutive duplicate numbers extend the last range.
+			if n := len(report.Duplicates); n > 0 && report.Duplicates[n-1].End >= cur-1 {
+				report.Duplicates[n-1].End = cur
+				continue
+			}
+			report.Duplicates = append(report.Duplicates, SequenceRange{Start: cur, End: cur})
+		}
+	}
+
+	return report, nil
+}
+
+// readChunkSequences returns the sequence numbers of the given chunk's lines
+// and the number of its lines without one. Consecutive stored lines split
+// from the same line share its sequence number, so only the first is
+// returned.
+func readChunkSequences(ctx context.Context, chunk LogChunkInfo) ([]int64, int, error) {
+	r, err := getChunk(ctx, chunk)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "getting chunk")
+	}
+	defer r.Close()
+
+	var (
+		sequences      []int64
+		numUnsequenced int
+		prev           *LogLineItem
+	)
+	reader := bufio.NewReader(r)
+	for {
+		data, err := reader.ReadString('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "reading line")
+		}
+
+		item, err := parseLogLineString(data)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "parsing line")
+		}
+		if item.Sequence == nil {
+			numUnsequenced++
+			prev = nil
+			continue
+		}
+
+		split := data[2] == sequencedLineFlag
+		if split && prev != nil && *prev.Sequence == *item.Sequence && prev.Timestamp.Equal(item.Timestamp) {
+			continue
+		}
+		sequences = append(sequences, *item.Sequence)
+		prev = nil
+		if split {
+			prev = &item
+		}
+	}
+
+	return sequences, numUnsequenced, nil
+}
+
+// FindLogLine returns the nth line, counting from 1, of the given build's
+// global log, that is the lines that don't belong to any test, sorted by
+// chunk start time. The chunk containing the line is located using the line
+// counts in the chunks' keys so that it's the only one read. It returns nil if
+// the build's global log has fewer than n lines.
+func FindLogLine(ctx context.Context, tracer otelTrace.Tracer, buildID string, n int) (*LogLineItem, error) {
+	return FindLogLineWithOptions(ctx, tracer, buildID, n, FindLogLineOptions{})
+}
+
+// FindLogLineOptions configures how a single log line is read.
+type FindLogLineOptions struct {
+	// RawPrefix returns the line exactly as stored, including its
+	// timestamp prefix and trailing newline, in the line's Data rather
+	// than stripping the prefix. This is only meant for diagnosing the
+	// stored encoding.
+	RawPrefix bool
+}
+
+// FindLogLineWithOptions is the same as FindLogLine but reads the line
+// according to opts.
+func FindLogLineWithOptions(ctx context.Context, tracer otelTrace.Tracer, buildID string, n int, opts FindLogLineOptions) (*LogLineItem, error) {
+	ctx, span := tracer.Start(ctx, "FindLogLine")
+	defer span.End()
+
+	if n < 1 {
+		return nil, nil
+	}
+
+	buildKeys, err := getBuildKeys(ctx, tracer, buildID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting keys for build '%s'", buildID)
+	}
+	buildChunks, _, err := parseLogChunks(buildKeys)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing log chunks from keys for build '%s'", buildID)
+	}
+
+	offset := 0
+	for _, chunk := range buildChunks {
+		if n > offset+chunk.NumLines {
+			offset += chunk.NumLines
+			continue
+		}
+
+		line, err := readChunkLine(ctx, chunk, n-offset, opts.RawPrefix)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading line %d of chunk '%s'", n-offset, chunk.key())
+		}
+		return line, nil
+	}
+
+	return nil, nil
+}
+
+// readChunkLine returns the nth line, counting from 1, of the given chunk. If
+// rawPrefix is true the line's Data is the line as stored.
+func readChunkLine(ctx context.Context, chunk LogChunkInfo, n int, rawPrefix bool) (*LogLineItem, error) {
+	r, err := getChunk(ctx, chunk)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting chunk")
+	}
+	defer r.Close()
+
+	reader := bufio.NewReader(r)
+	var data string
+	for i := 0; i < n; i++ {
+		// Every stored line ends with a newline, so reaching the end
+		// means the chunk has fewer lines than its key claims.
+		data, err = reader.ReadString('\n')
+		if err == io.EOF {
+			return nil, errors.Errorf("chunk has fewer than %d lines", n)
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "reading line")
+		}
+	}
+
+	item, err := parseLogLineString(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing line")
+	}
+	if rawPrefix {
+		item.Data = data
+	}
+	item.Global = chunk.TestID == ""
+
+	return &item, nil
+}
+
 // parseLogChunks parses build and test log chunks from the buildKeys that correspond to log chunks
 // and sorts them by start time.
 func parseLogChunks(buildKeys []string) ([]LogChunkInfo, []LogChunkInfo, error) {
@@ -371,16 +1650,59 @@ func filterLogChunksByTestID(chunks []LogChunkInfo, testID string) []LogChunkInf
 	return filteredChunks
 }
 
+func filterLogChunksByTestIDs(chunks []LogChunkInfo, testIDs map[string]bool) []LogChunkInfo {
+	var filteredChunks []LogChunkInfo
+	for _, chunk := range chunks {
+		if testIDs[chunk.TestID] {
+			filteredChunks = append(filteredChunks, chunk)
+		}
+	}
+	return filteredChunks
+}
+
 func sortLogChunksByStartTime(chunks []LogChunkInfo) {
 	sort.Slice(chunks, func(i, j int) bool {
 		return chunks[i].Start.Before(chunks[j].Start)
 	})
 }
 
+// escapedLineFlag marks a stored line whose newlines and backslashes were
+// escaped by makeEscapedLogLineString. Lines split by makeLogLineStrings are
+// marked with '0'. Lines with a sequence number are marked with
+// sequencedLineFlag or sequencedEscapedLineFlag instead, and have the
+// sequence number padded to 20 digits between the timestamp and the data.
+const (
+	escapedLineFlag          = '1'
+	sequencedLineFlag        = '2'
+	sequencedEscapedLineFlag = '3'
+)
+
+// maxSequence is the largest sequence number accepted from uploads, the
+// largest integer a JSON number holds exactly.
+const maxSequence = 1 << 53
+
+var (
+	newlineEscaper   = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	newlineUnescaper = strings.NewReplacer(`\\`, `\`, `\n`, "\n")
+)
+
+// makeEscapedLogLineString returns the log line as a single stored line,
+// escaping its embedded newlines so they survive the round trip.
+func makeEscapedLogLineString(logLine LogLineItem) string {
+	if logLine.Sequence != nil {
+		return fmt.Sprintf("  %c%20d%20d%s\n", sequencedEscapedLineFlag, utility.UnixMilli(logLine.Timestamp), *logLine.Sequence, newlineEscaper.Replace(logLine.Data))
+	}
+	return fmt.Sprintf("  %c%20d%s\n", escapedLineFlag, utility.UnixMilli(logLine.Timestamp), newlineEscaper.Replace(logLine.Data))
+}
+
 func makeLogLineStrings(logLine LogLineItem) []string {
 	singleLines := strings.Split(logLine.Data, "\n")
 	logLines := make([]string, 0, len(singleLines))
 	for _, line := range singleLines {
+		if logLine.Sequence != nil {
+			logLines = append(logLines, fmt.Sprintf("  %c%20d%20d%s\n", sequencedLineFlag, utility.UnixMilli(logLine.Timestamp), *logLine.Sequence, line))
+			continue
+		}
 		logLines = append(logLines, fmt.Sprintf("  0%20d%s\n", utility.UnixMilli(logLine.Timestamp), line))
 	}
 	return logLines
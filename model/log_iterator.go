@@ -4,15 +4,28 @@ import (
 	"bufio"
 	"container/heap"
 	"context"
+	"fmt"
 	"io"
+	"math"
+	"regexp"
 	"runtime"
 	"sync"
+	"sync/atomic"
 
 	"github.com/evergreen-ci/logkeeper/env"
 	"github.com/mongodb/grip"
 	"github.com/mongodb/grip/message"
 	"github.com/mongodb/grip/recovery"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	otelTrace "go.opentelemetry.io/otel/trace"
+)
+
+const (
+	chunkTracerName     = "github.com/evergreen-ci/logkeeper/model"
+	chunkKeyAttribute   = "logkeeper.chunk_key"
+	chunkBytesAttribute = "logkeeper.chunk_bytes"
 )
 
 // LogIterator is an interface that enables iterating over lines of buildlogger
@@ -26,7 +39,9 @@ type LogIterator interface {
 	// IsReversed returns true if the iterator is in reverse order and
 	// false otherwise.
 	IsReversed() bool
-	// Stream returns a chan of log lines from the iterator.
+	// Stream returns a chan of log lines from the iterator. The chan is
+	// closed once the iterator is exhausted or the context is done, so
+	// callers that stop reading early must cancel the context.
 	Stream(context.Context) chan *LogLineItem
 }
 
@@ -38,8 +53,11 @@ type serializedIterator struct {
 	chunks               []LogChunkInfo
 	timeRange            TimeRange
 	reverse              bool
+	mergeAdjacent        bool
 	lineCount            int
 	keyIndex             int
+	streamEnd            int
+	numStreams           int
 	currentReadCloser    io.ReadCloser
 	currentReverseReader *reverseLineReader
 	currentReader        *bufio.Reader
@@ -52,12 +70,34 @@ type serializedIterator struct {
 // NewSerializedLogIterator returns a LogIterator that serially fetches chunks
 // from blob storage while iterating over lines of a buildlogger log.
 func NewSerializedLogIterator(chunks []LogChunkInfo, timeRange TimeRange) LogIterator {
+	return NewSerializedLogIteratorWithOptions(chunks, timeRange, SerializedIteratorOptions{})
+}
+
+// SerializedIteratorOptions configure how a serialized iterator reads chunks.
+type SerializedIteratorOptions struct {
+	// MergeAdjacentChunks reads consecutive chunks of the same log, the
+	// build's own or a single test's, whose time ranges don't overlap as
+	// a single stream of lines. Each chunk is still fetched separately,
+	// once the previous one has been read, but only one line reader is
+	// set up for the stream, which saves the per-chunk overhead of builds
+	// with many tiny chunks. Lines are returned in the same order either
+	// way, but a chunk whose key has the wrong line count is only
+	// detected if the stream as a whole has the wrong count. Reversed
+	// iterators don't merge chunks, since a reversed stream is read into
+	// memory whole.
+	MergeAdjacentChunks bool
+}
+
+// NewSerializedLogIteratorWithOptions is the same as NewSerializedLogIterator
+// but reads chunks according to opts.
+func NewSerializedLogIteratorWithOptions(chunks []LogChunkInfo, timeRange TimeRange, opts SerializedIteratorOptions) LogIterator {
 	chunks = filterChunksByTimeRange(timeRange, chunks)
 
 	return &serializedIterator{
-		chunks:    chunks,
-		timeRange: timeRange,
-		catcher:   grip.NewBasicCatcher(),
+		chunks:        chunks,
+		timeRange:     timeRange,
+		mergeAdjacent: opts.MergeAdjacentChunks,
+		catcher:       grip.NewBasicCatcher(),
 	}
 }
 
@@ -67,10 +107,11 @@ func (i *serializedIterator) Reverse() LogIterator {
 	reverseChunks(chunks)
 
 	return &serializedIterator{
-		chunks:    chunks,
-		timeRange: i.timeRange,
-		reverse:   !i.reverse,
-		catcher:   grip.NewBasicCatcher(),
+		chunks:        chunks,
+		timeRange:     i.timeRange,
+		reverse:       !i.reverse,
+		mergeAdjacent: i.mergeAdjacent,
+		catcher:       grip.NewBasicCatcher(),
 	}
 }
 
@@ -89,11 +130,12 @@ func (i *serializedIterator) Next(ctx context.Context) bool {
 			}
 
 			var err error
-			i.currentReadCloser, err = env.Bucket().Get(ctx, i.chunks[i.keyIndex].key())
+			i.currentReadCloser, err = i.openStream(ctx)
 			if err != nil {
 				i.catcher.Wrap(err, "downloading log artifact")
 				return false
 			}
+			i.numStreams++
 			if i.reverse {
 				i.currentReverseReader = newReverseLineReader(i.currentReadCloser)
 			} else {
@@ -109,7 +151,11 @@ func (i *serializedIterator) Next(ctx context.Context) bool {
 			data, err = i.currentReader.ReadString('\n')
 		}
 		if err == io.EOF {
-			if i.lineCount != i.chunks[i.keyIndex].NumLines {
+			var numLines int
+			for _, chunk := range i.chunks[i.keyIndex:i.streamEnd] {
+				numLines += chunk.NumLines
+			}
+			if i.lineCount != numLines {
 				i.catcher.Add(errors.New("corrupt data"))
 			}
 
@@ -118,7 +164,7 @@ func (i *serializedIterator) Next(ctx context.Context) bool {
 			i.currentReverseReader = nil
 			i.currentReader = nil
 			i.lineCount = 0
-			i.keyIndex++
+			i.keyIndex = i.streamEnd
 
 			return i.Next(ctx)
 		}
@@ -155,6 +201,78 @@ func (i *serializedIterator) Next(ctx context.Context) bool {
 	return true
 }
 
+// openStream returns a reader of the chunk at the iterator's key index and,
+// if the iterator merges adjacent chunks, the chunks following it that are
+// adjacent to it. The index after the last chunk read is stored as the
+// stream's end.
+func (i *serializedIterator) openStream(ctx context.Context) (io.ReadCloser, error) {
+	i.streamEnd = i.keyIndex + 1
+	for i.mergeAdjacent && !i.reverse && i.streamEnd < len(i.chunks) && adjacentChunks(i.chunks[i.streamEnd-1], i.chunks[i.streamEnd]) {
+		i.streamEnd++
+	}
+	if i.streamEnd == i.keyIndex+1 {
+		return getChunk(ctx, i.chunks[i.keyIndex])
+	}
+
+	return &chunkStream{ctx: ctx, chunks: i.chunks[i.keyIndex:i.streamEnd]}, nil
+}
+
+// adjacentChunks returns whether next directly follows prev in the same log,
+// so that reading them one after the other returns their lines in order.
+func adjacentChunks(prev, next LogChunkInfo) bool {
+	return prev.BuildID == next.BuildID && prev.TestID == next.TestID && !next.Start.Before(prev.End)
+}
+
+// chunkStream reads consecutive chunks as a single stream. Each chunk is only
+// fetched once the previous one has been read, and is closed once it's been
+// read.
+type chunkStream struct {
+	ctx     context.Context
+	chunks  []LogChunkInfo
+	current io.ReadCloser
+}
+
+func (s *chunkStream) Read(p []byte) (int, error) {
+	for {
+		if s.current == nil {
+			if len(s.chunks) == 0 {
+				return 0, io.EOF
+			}
+
+			r, err := getChunk(s.ctx, s.chunks[0])
+			if err != nil {
+				return 0, errors.Wrapf(err, "getting chunk '%s'", s.chunks[0].key())
+			}
+			s.current = r
+			s.chunks = s.chunks[1:]
+		}
+
+		n, err := s.current.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+
+		closeErr := s.current.Close()
+		s.current = nil
+		if closeErr != nil {
+			return n, errors.Wrap(closeErr, "closing chunk")
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (s *chunkStream) Close() error {
+	if s.current == nil {
+		return nil
+	}
+
+	current := s.current
+	s.current = nil
+	return current.Close()
+}
+
 func (i *serializedIterator) Exhausted() bool { return i.exhausted }
 
 func (i *serializedIterator) Err() error { return i.catcher.Resolve() }
@@ -164,7 +282,9 @@ func (i *serializedIterator) Item() LogLineItem { return i.currentItem }
 func (i *serializedIterator) Close() error {
 	i.closed = true
 	if i.currentReadCloser != nil {
-		return i.currentReadCloser.Close()
+		readCloser := i.currentReadCloser
+		i.currentReadCloser = nil
+		return readCloser.Close()
 	}
 
 	return nil
@@ -193,22 +313,83 @@ type batchedIterator struct {
 	catcher              grip.Catcher
 	exhausted            bool
 	closed               bool
+	// failures, if set, makes the iterator skip chunks that fail to load,
+	// counting them, rather than stopping.
+	failures     *chunkFailures
+	failedChunks map[string]bool
+	// prefetch, if set, makes the iterator download the next batch in the
+	// background before the current one is exhausted.
+	prefetch   *PrefetchOptions
+	batchStart int
+	prefetched chan chunkBatch
+}
+
+// PrefetchOptions tune how far ahead of its consumer a batched iterator
+// downloads chunks. At most one batch beyond the one being read is ever
+// downloaded.
+type PrefetchOptions struct {
+	// StreamBuffer is the number of lines the iterator's stream buffers
+	// ahead of the consumer.
+	StreamBuffer int
+	// DrainFraction is the fraction, from 0 to 1, of the current batch's
+	// chunks that must be read before the next batch is downloaded in the
+	// background. Zero downloads the next batch as soon as the current
+	// one is.
+	DrainFraction float64
+	// MaxStreamFill is the fraction, from 0 to 1, of the stream's buffer
+	// that may be full for the next batch to be downloaded in the
+	// background. A fuller buffer means the consumer is reading slower
+	// than the lines are downloaded, so prefetching would only hold more
+	// chunks open.
+	MaxStreamFill float64
+}
+
+// chunkBatch is the result of downloading a batch of chunks.
+type chunkBatch struct {
+	end     int
+	readers map[string]io.ReadCloser
+	skipped []skippedChunk
+	err     error
+}
+
+type skippedChunk struct {
+	chunk LogChunkInfo
+	err   error
 }
 
 // NewBatchedLog returns a LogIterator that fetches batches (size set by the
 // caller) of chunks from blob storage in parallel while iterating over lines
 // of a buildlogger log.
 func NewBatchedLogIterator(chunks []LogChunkInfo, batchSize int, timeRange TimeRange) LogIterator {
+	return newBatchedLogIterator(chunks, batchSize, timeRange, nil, nil)
+}
+
+// newBatchedLogIterator is like NewBatchedLogIterator, but if failures is not
+// nil, chunks that fail to download or read are skipped and counted in
+// failures rather than stopping the iterator, and if prefetch is not nil,
+// batches are prefetched like NewPrefetchingLogIterator.
+func newBatchedLogIterator(chunks []LogChunkInfo, batchSize int, timeRange TimeRange, failures *chunkFailures, prefetch *PrefetchOptions) LogIterator {
 	chunks = filterChunksByTimeRange(timeRange, chunks)
 
 	return &batchedIterator{
-		batchSize: batchSize,
-		chunks:    chunks,
-		timeRange: timeRange,
-		catcher:   grip.NewBasicCatcher(),
+		batchSize:    batchSize,
+		chunks:       chunks,
+		timeRange:    timeRange,
+		catcher:      grip.NewBasicCatcher(),
+		failures:     failures,
+		failedChunks: map[string]bool{},
+		prefetch:     prefetch,
 	}
 }
 
+// NewPrefetchingLogIterator returns a LogIterator that fetches batches of
+// chunks like NewBatchedLogIterator, but downloads the next batch in the
+// background, according to opts, once its consumer has read enough of the
+// current one.
+func NewPrefetchingLogIterator(chunks []LogChunkInfo, batchSize int, timeRange TimeRange, opts PrefetchOptions) LogIterator {
+	return newBatchedLogIterator(chunks, batchSize, timeRange, nil, &opts)
+}
+
 // NewParallelizedLogIterator returns a LogIterator that fetches all chunks
 // from blob storage in parallel while iterating over lines of a buildlogger
 // log.
@@ -216,10 +397,11 @@ func NewParallelizedLogIterator(chunks []LogChunkInfo, timeRange TimeRange) LogI
 	chunks = filterChunksByTimeRange(timeRange, chunks)
 
 	return &batchedIterator{
-		batchSize: len(chunks),
-		chunks:    chunks,
-		timeRange: timeRange,
-		catcher:   grip.NewBasicCatcher(),
+		batchSize:    len(chunks),
+		chunks:       chunks,
+		timeRange:    timeRange,
+		catcher:      grip.NewBasicCatcher(),
+		failedChunks: map[string]bool{},
 	}
 }
 
@@ -229,11 +411,14 @@ func (i *batchedIterator) Reverse() LogIterator {
 	reverseChunks(chunks)
 
 	return &batchedIterator{
-		batchSize: i.batchSize,
-		chunks:    chunks,
-		timeRange: i.timeRange,
-		reverse:   !i.reverse,
-		catcher:   grip.NewBasicCatcher(),
+		batchSize:    i.batchSize,
+		chunks:       chunks,
+		timeRange:    i.timeRange,
+		reverse:      !i.reverse,
+		catcher:      grip.NewBasicCatcher(),
+		failures:     i.failures,
+		failedChunks: map[string]bool{},
+		prefetch:     i.prefetch,
 	}
 }
 
@@ -244,23 +429,51 @@ func (i *batchedIterator) getNextBatch(ctx context.Context) error {
 	for _, r := range i.readers {
 		catcher.Add(r.Close())
 	}
+	i.readers = nil
 	if err := catcher.Resolve(); err != nil {
 		return errors.Wrap(err, "closing readers")
 	}
 
+	var batch chunkBatch
+	if i.prefetched != nil {
+		batch = <-i.prefetched
+		i.prefetched = nil
+	} else {
+		batch = i.fetchBatch(ctx, i.chunkIndex, i.batchEnd())
+	}
+	for _, skipped := range batch.skipped {
+		i.skipChunk(skipped.chunk, skipped.err)
+	}
+
+	i.batchStart = i.chunkIndex
+	i.chunkIndex = batch.end
+	i.readers = batch.readers
+	return errors.Wrap(batch.err, "downloading log artifacts")
+}
+
+// batchEnd returns the index after the last chunk of the batch starting at
+// the iterator's next chunk to download.
+func (i *batchedIterator) batchEnd() int {
 	end := i.chunkIndex + i.batchSize
 	if end > len(i.chunks) {
 		end = len(i.chunks)
 	}
-	work := make(chan LogChunkInfo, end-i.chunkIndex)
-	for _, chunk := range i.chunks[i.chunkIndex:end] {
+	return end
+}
+
+// fetchBatch downloads the chunks from start to end in parallel. It doesn't
+// modify the iterator, so it may run in the background while the iterator is
+// read.
+func (i *batchedIterator) fetchBatch(ctx context.Context, start int, end int) chunkBatch {
+	work := make(chan LogChunkInfo, end-start)
+	for _, chunk := range i.chunks[start:end] {
 		work <- chunk
 	}
 	close(work)
 	var wg sync.WaitGroup
 	var mux sync.Mutex
-	readers := map[string]io.ReadCloser{}
-	catcher = grip.NewBasicCatcher()
+	batch := chunkBatch{end: end, readers: map[string]io.ReadCloser{}}
+	catcher := grip.NewBasicCatcher()
 
 	for j := 0; j < runtime.NumCPU(); j++ {
 		wg.Add(1)
@@ -276,22 +489,58 @@ func (i *batchedIterator) getNextBatch(ctx context.Context) error {
 					return
 				}
 
-				r, err := env.Bucket().Get(ctx, chunk.key())
+				r, err := getChunk(ctx, chunk)
+				if err != nil && i.failures != nil {
+					mux.Lock()
+					batch.skipped = append(batch.skipped, skippedChunk{chunk: chunk, err: err})
+					mux.Unlock()
+					continue
+				}
 				if err != nil {
 					catcher.Add(err)
 					return
 				}
 				mux.Lock()
-				readers[chunk.key()] = r
+				batch.readers[chunk.key()] = r
 				mux.Unlock()
 			}
 		}()
 	}
 	wg.Wait()
 
-	i.chunkIndex = end
-	i.readers = readers
-	return errors.Wrap(catcher.Resolve(), "downloading log artifacts")
+	batch.err = catcher.Resolve()
+	return batch
+}
+
+// maybePrefetch starts downloading the next batch in the background if the
+// iterator prefetches, no batch is being prefetched already, enough of the
+// current batch has been read and the consumer of the stream, if any, is
+// keeping up.
+func (i *batchedIterator) maybePrefetch(ctx context.Context) {
+	if i.prefetch == nil || i.prefetched != nil || i.chunkIndex >= len(i.chunks) {
+		return
+	}
+	if float64(i.keyIndex-i.batchStart) < i.prefetch.DrainFraction*float64(i.chunkIndex-i.batchStart) {
+		return
+	}
+	if fill, ok := ctx.Value(streamFillKey{}).(func() float64); ok && fill() > i.prefetch.MaxStreamFill {
+		return
+	}
+
+	start, end := i.chunkIndex, i.batchEnd()
+	result := make(chan chunkBatch, 1)
+	i.prefetched = result
+	go func() {
+		batch := chunkBatch{end: end}
+		defer func() {
+			if err := recovery.HandlePanicWithError(recover(), nil, "prefetching log chunks"); err != nil {
+				batch.err = err
+			}
+			result <- batch
+		}()
+
+		batch = i.fetchBatch(ctx, start, end)
+	}()
 }
 
 func (i *batchedIterator) Next(ctx context.Context) bool {
@@ -300,12 +549,18 @@ func (i *batchedIterator) Next(ctx context.Context) bool {
 	}
 
 	for {
+		i.maybePrefetch(ctx)
 		if i.currentReader == nil && i.currentReverseReader == nil {
 			if i.keyIndex >= len(i.chunks) {
 				i.exhausted = true
 				return false
 			}
 
+			if i.failedChunks[i.chunks[i.keyIndex].key()] {
+				i.keyIndex++
+				continue
+			}
+
 			reader, ok := i.readers[i.chunks[i.keyIndex].key()]
 			if !ok {
 				if err := i.getNextBatch(ctx); err != nil {
@@ -340,6 +595,13 @@ func (i *batchedIterator) Next(ctx context.Context) bool {
 			i.keyIndex++
 
 			return i.Next(ctx)
+		} else if err != nil && i.failures != nil {
+			i.skipChunk(i.chunks[i.keyIndex], err)
+			i.currentReverseReader = nil
+			i.currentReader = nil
+			i.lineCount = 0
+			i.keyIndex++
+			continue
 		} else if err != nil {
 			i.catcher.Wrap(err, "getting line")
 			return false
@@ -372,6 +634,17 @@ func (i *batchedIterator) Next(ctx context.Context) bool {
 	return true
 }
 
+// skipChunk records that the chunk failed to load so that the rest of it is
+// skipped. Lines of the chunk that were already read are kept.
+func (i *batchedIterator) skipChunk(chunk LogChunkInfo, err error) {
+	i.failedChunks[chunk.key()] = true
+	i.failures.add()
+	grip.Warning(message.WrapError(err, message.Fields{
+		"message": "skipping log chunk that failed to load",
+		"chunk":   chunk.key(),
+	}))
+}
+
 func (i *batchedIterator) Exhausted() bool { return i.exhausted }
 
 func (i *batchedIterator) Err() error { return i.catcher.Resolve() }
@@ -385,12 +658,23 @@ func (i *batchedIterator) Close() error {
 	for _, r := range i.readers {
 		catcher.Add(r.Close())
 	}
+	i.readers = nil
+	if i.prefetched != nil {
+		for _, r := range (<-i.prefetched).readers {
+			catcher.Add(r.Close())
+		}
+		i.prefetched = nil
+	}
 
 	return catcher.Resolve()
 }
 
 func (i *batchedIterator) Stream(ctx context.Context) chan *LogLineItem {
-	return streamFromLogIterator(ctx, i)
+	var buffer int
+	if i.prefetch != nil {
+		buffer = i.prefetch.StreamBuffer
+	}
+	return streamFromLogIteratorWithBuffer(ctx, i, buffer)
 }
 
 ///////////////////
@@ -405,13 +689,33 @@ type mergingIterator struct {
 	started      bool
 }
 
+// ErrTooManyIterators is returned, possibly wrapped, when a merge is given
+// more iterators than the maximum set with env.SetMaxMergeIterators.
+var ErrTooManyIterators = errors.New("too many iterators to merge")
+
+// checkMergeIterators returns an error matching ErrTooManyIterators if a merge
+// of n iterators would exceed the maximum number of iterators a merge
+// accepts.
+func checkMergeIterators(n int) error {
+	if maxIterators := env.MaxMergeIterators(); maxIterators > 0 && n > maxIterators {
+		return errors.Wrapf(ErrTooManyIterators, "merging %d iterators exceeds the maximum of %d", n, maxIterators)
+	}
+
+	return nil
+}
+
 // NewMergeIterator returns a LogIterator that merges N buildlogger logs,
 // passed in as LogIterators, respecting the order of each line's timestamp.
+// If there are more iterators than a merge accepts, none of them are read and
+// the returned iterator's Err matches ErrTooManyIterators.
 func NewMergingIterator(iterators ...LogIterator) LogIterator {
+	catcher := grip.NewBasicCatcher()
+	catcher.Add(checkMergeIterators(len(iterators)))
+
 	return &mergingIterator{
 		iterators:    iterators,
 		iteratorHeap: &LogIteratorHeap{min: true},
-		catcher:      grip.NewBasicCatcher(),
+		catcher:      catcher,
 	}
 }
 
@@ -422,16 +726,22 @@ func (i *mergingIterator) Reverse() LogIterator {
 		}
 	}
 
+	catcher := grip.NewBasicCatcher()
+	catcher.Add(checkMergeIterators(len(i.iterators)))
+
 	return &mergingIterator{
 		iterators:    i.iterators,
 		iteratorHeap: &LogIteratorHeap{min: false},
-		catcher:      grip.NewBasicCatcher(),
+		catcher:      catcher,
 	}
 }
 
 func (i *mergingIterator) IsReversed() bool { return !i.iteratorHeap.min }
 
 func (i *mergingIterator) Next(ctx context.Context) bool {
+	if i.catcher.HasErrors() {
+		return false
+	}
 	if !i.started {
 		i.init(ctx)
 	}
@@ -469,6 +779,10 @@ func (i *mergingIterator) Exhausted() bool {
 func (i *mergingIterator) init(ctx context.Context) {
 	heap.Init(i.iteratorHeap)
 
+	i.iteratorHeap.ranks = make(map[LogIterator]int, len(i.iterators))
+	for j := range i.iterators {
+		i.iteratorHeap.ranks[i.iterators[j]] = j
+	}
 	for j := range i.iterators {
 		if i.iterators[j].Next(ctx) {
 			i.iteratorHeap.SafePush(i.iterators[j])
@@ -492,11 +806,12 @@ func (i *mergingIterator) Item() LogLineItem { return i.currentItem }
 func (i *mergingIterator) Close() error {
 	catcher := grip.NewBasicCatcher()
 
-	for {
-		it := i.iteratorHeap.SafePop()
-		if it == nil {
-			break
-		}
+	// Close every iterator rather than only those left in the heap, since
+	// iterators dropped from the heap while initializing may still hold
+	// open readers.
+	for i.iteratorHeap.SafePop() != nil {
+	}
+	for _, it := range i.iterators {
 		catcher.Add(it.Close())
 	}
 
@@ -507,6 +822,280 @@ func (i *mergingIterator) Stream(ctx context.Context) chan *LogLineItem {
 	return streamFromLogIterator(ctx, i)
 }
 
+//////////////////////
+// Byte Limit Iterator
+//////////////////////
+
+// byteLimitTruncationMarker is the data of the final line emitted by a
+// byteLimitIterator that stops before its underlying iterator is exhausted.
+const byteLimitTruncationMarker = "[logkeeper] output truncated after %d bytes"
+
+type byteLimitIterator struct {
+	iter         LogIterator
+	maxBytes     int
+	emittedBytes int
+	currentItem  LogLineItem
+	truncated    bool
+	exhausted    bool
+	catcher      grip.Catcher
+}
+
+// NewByteLimitIterator returns a LogIterator that stops once the cumulative
+// size of the emitted lines' data would exceed maxBytes. When lines are
+// dropped, a final truncation marker line is emitted and the underlying
+// iterator is closed.
+func NewByteLimitIterator(iter LogIterator, maxBytes int) LogIterator {
+	return &byteLimitIterator{
+		iter:     iter,
+		maxBytes: maxBytes,
+		catcher:  grip.NewBasicCatcher(),
+	}
+}
+
+func (i *byteLimitIterator) Reverse() LogIterator {
+	return NewByteLimitIterator(i.iter.Reverse(), i.maxBytes)
+}
+
+func (i *byteLimitIterator) IsReversed() bool { return i.iter.IsReversed() }
+
+func (i *byteLimitIterator) Next(ctx context.Context) bool {
+	if i.exhausted {
+		return false
+	}
+	if i.truncated || !i.iter.Next(ctx) {
+		i.exhausted = true
+		return false
+	}
+
+	item := i.iter.Item()
+	if i.emittedBytes+len(item.Data) > i.maxBytes {
+		i.catcher.Wrap(i.iter.Close(), "closing truncated iterator")
+		i.truncated = true
+		i.currentItem = LogLineItem{
+			Timestamp: item.Timestamp,
+			Data:      fmt.Sprintf(byteLimitTruncationMarker, i.emittedBytes),
+			Global:    true,
+		}
+
+		return true
+	}
+
+	i.emittedBytes += len(item.Data)
+	i.currentItem = item
+
+	return true
+}
+
+func (i *byteLimitIterator) Exhausted() bool { return i.exhausted }
+
+func (i *byteLimitIterator) Err() error {
+	catcher := grip.NewBasicCatcher()
+	catcher.Add(i.iter.Err())
+	catcher.Add(i.catcher.Resolve())
+
+	return catcher.Resolve()
+}
+
+func (i *byteLimitIterator) Item() LogLineItem { return i.currentItem }
+
+func (i *byteLimitIterator) Close() error {
+	if i.truncated {
+		return nil
+	}
+
+	return i.iter.Close()
+}
+
+func (i *byteLimitIterator) Stream(ctx context.Context) chan *LogLineItem {
+	return streamFromLogIterator(ctx, i)
+}
+
+/////////////////////////////////
+// Chunk Failure Warning Iterator
+/////////////////////////////////
+
+// chunkFailureWarning is the data of the final line emitted by a
+// chunkFailureWarningIterator when chunks failed to load.
+const chunkFailureWarning = "[WARNING: %d chunks failed to load]"
+
+// chunkFailures counts the chunks that failed to load across iterators.
+type chunkFailures struct {
+	count atomic.Int64
+}
+
+func (f *chunkFailures) add() { f.count.Add(1) }
+
+func (f *chunkFailures) get() int { return int(f.count.Load()) }
+
+type chunkFailureWarningIterator struct {
+	iter        LogIterator
+	failures    *chunkFailures
+	currentItem LogLineItem
+	warned      bool
+	exhausted   bool
+}
+
+// newChunkFailureWarningIterator returns a LogIterator that emits the lines of
+// iter followed, if any chunks were counted in failures, by a final warning
+// line with the number of chunks that failed to load.
+func newChunkFailureWarningIterator(iter LogIterator, failures *chunkFailures) LogIterator {
+	return &chunkFailureWarningIterator{
+		iter:     iter,
+		failures: failures,
+	}
+}
+
+func (i *chunkFailureWarningIterator) Reverse() LogIterator {
+	return newChunkFailureWarningIterator(i.iter.Reverse(), i.failures)
+}
+
+func (i *chunkFailureWarningIterator) IsReversed() bool { return i.iter.IsReversed() }
+
+func (i *chunkFailureWarningIterator) Next(ctx context.Context) bool {
+	if i.exhausted {
+		return false
+	}
+	if i.iter.Next(ctx) {
+		i.currentItem = i.iter.Item()
+		return true
+	}
+
+	i.exhausted = true
+	if i.warned || i.failures.get() == 0 {
+		return false
+	}
+	i.warned = true
+	i.currentItem = LogLineItem{
+		Timestamp: i.currentItem.Timestamp,
+		Data:      fmt.Sprintf(chunkFailureWarning, i.failures.get()),
+		Global:    true,
+	}
+
+	return true
+}
+
+func (i *chunkFailureWarningIterator) Exhausted() bool { return i.exhausted }
+
+func (i *chunkFailureWarningIterator) Err() error { return i.iter.Err() }
+
+func (i *chunkFailureWarningIterator) Item() LogLineItem { return i.currentItem }
+
+func (i *chunkFailureWarningIterator) Close() error { return i.iter.Close() }
+
+func (i *chunkFailureWarningIterator) Stream(ctx context.Context) chan *LogLineItem {
+	return streamFromLogIterator(ctx, i)
+}
+
+//////////////////////
+// ANSI Strip Iterator
+//////////////////////
+
+// ansiEscapeRegex matches ANSI escape sequences: control sequences, such as
+// color codes, operating system commands, such as window titles and links,
+// and the remaining two character escapes.
+var ansiEscapeRegex = regexp.MustCompile(`\x1b(?:\[[0-?]*[ -/]*[@-~]|\][^\x07\x1b]*(?:\x07|\x1b\\)|[@-_])`)
+
+type ansiStripIterator struct {
+	iter        LogIterator
+	currentItem LogLineItem
+}
+
+// newANSIStripIterator returns a LogIterator that emits the lines of iter with
+// any ANSI escape sequences removed from their data.
+func newANSIStripIterator(iter LogIterator) LogIterator {
+	return &ansiStripIterator{iter: iter}
+}
+
+func (i *ansiStripIterator) Reverse() LogIterator {
+	return newANSIStripIterator(i.iter.Reverse())
+}
+
+func (i *ansiStripIterator) IsReversed() bool { return i.iter.IsReversed() }
+
+func (i *ansiStripIterator) Next(ctx context.Context) bool {
+	if !i.iter.Next(ctx) {
+		return false
+	}
+
+	i.currentItem = i.iter.Item()
+	i.currentItem.Data = ansiEscapeRegex.ReplaceAllString(i.currentItem.Data, "")
+
+	return true
+}
+
+func (i *ansiStripIterator) Exhausted() bool { return i.iter.Exhausted() }
+
+func (i *ansiStripIterator) Err() error { return i.iter.Err() }
+
+func (i *ansiStripIterator) Item() LogLineItem { return i.currentItem }
+
+func (i *ansiStripIterator) Close() error { return i.iter.Close() }
+
+func (i *ansiStripIterator) Stream(ctx context.Context) chan *LogLineItem {
+	return streamFromLogIterator(ctx, i)
+}
+
+////////////////////////
+// Cross Build Iterator
+////////////////////////
+
+// NewCrossBuildIterator returns a LogIterator that merges the global and test
+// logs of all the given builds, respecting the order of each line's
+// timestamp. The keys of each build are listed in parallel. Builds that do not
+// exist are excluded from the merge. Each build is merged as two iterators, so
+// if there are more builds than half the iterators a merge accepts an error
+// matching ErrTooManyIterators is returned before any keys are listed.
+func NewCrossBuildIterator(ctx context.Context, tracer otelTrace.Tracer, buildIDs []string, timeRange TimeRange) (LogIterator, error) {
+	ctx, span := tracer.Start(ctx, "NewCrossBuildIterator")
+	defer span.End()
+
+	if err := checkMergeIterators(2 * len(buildIDs)); err != nil {
+		return nil, errors.Wrapf(err, "merging %d builds", len(buildIDs))
+	}
+
+	var wg sync.WaitGroup
+	catcher := grip.NewBasicCatcher()
+	iterators := make([][]LogIterator, len(buildIDs))
+	for i, id := range buildIDs {
+		wg.Add(1)
+		go func(buildID string, idx int) {
+			defer recovery.LogStackTraceAndContinue("listing build keys for cross build iterator")
+			defer wg.Done()
+
+			buildKeys, err := getBuildKeys(ctx, tracer, buildID)
+			if err != nil {
+				catcher.Wrapf(err, "getting keys for build '%s'", buildID)
+				return
+			}
+			if len(buildKeys) == 0 {
+				return
+			}
+
+			buildChunks, testChunks, err := parseLogChunks(buildKeys)
+			if err != nil {
+				catcher.Wrapf(err, "parsing log chunks from keys for build '%s'", buildID)
+				return
+			}
+			iterators[idx] = []LogIterator{
+				NewBatchedLogIterator(buildChunks, 4, timeRange),
+				NewBatchedLogIterator(testChunks, 4, timeRange),
+			}
+		}(id, i)
+	}
+	wg.Wait()
+
+	if catcher.HasErrors() {
+		return nil, catcher.Resolve()
+	}
+
+	var merged []LogIterator
+	for _, its := range iterators {
+		merged = append(merged, its...)
+	}
+
+	return NewMergingIterator(merged...), nil
+}
+
 ///////////////////
 // Helper functions
 ///////////////////
@@ -528,15 +1117,96 @@ func reverseChunks(chunks []LogChunkInfo) {
 	}
 }
 
+// getChunk fetches the chunk from storage in a child span of the span in ctx.
+// When the span is recording, it stays open until the chunk is read to the end
+// or closed so that it captures the chunk's size and full download time.
+func getChunk(ctx context.Context, chunk LogChunkInfo) (io.ReadCloser, error) {
+	ctx, span := otelTrace.SpanFromContext(ctx).TracerProvider().Tracer(chunkTracerName).Start(ctx, "GetLogChunk")
+	if !span.IsRecording() {
+		span.End()
+		return env.Bucket().Get(ctx, chunk.key())
+	}
+
+	span.SetAttributes(attribute.String(chunkKeyAttribute, chunk.key()))
+	r, err := env.Bucket().Get(ctx, chunk.key())
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "getting log chunk")
+		span.End()
+		return nil, err
+	}
+
+	return &chunkSpanReader{ReadCloser: r, span: span}, nil
+}
+
+// chunkSpanReader counts the bytes read from a chunk and ends the chunk's
+// span once the chunk is read to the end or closed.
+type chunkSpanReader struct {
+	io.ReadCloser
+	span  otelTrace.Span
+	bytes int
+	ended bool
+}
+
+func (r *chunkSpanReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.bytes += n
+	if err == io.EOF {
+		r.endSpan()
+	}
+
+	return n, err
+}
+
+func (r *chunkSpanReader) Close() error {
+	r.endSpan()
+	return r.ReadCloser.Close()
+}
+
+func (r *chunkSpanReader) endSpan() {
+	if r.ended {
+		return
+	}
+	r.ended = true
+	r.span.SetAttributes(attribute.Int(chunkBytesAttribute, r.bytes))
+	r.span.End()
+}
+
 func streamFromLogIterator(ctx context.Context, iter LogIterator) chan *LogLineItem {
-	logLines := make(chan *LogLineItem)
+	return streamFromLogIteratorWithBuffer(ctx, iter, 0)
+}
+
+// streamFillKey is the context key of a function returning the fraction of
+// the buffer of the stream being read from that's full, so that iterators can
+// tell whether the stream's consumer is keeping up.
+type streamFillKey struct{}
+
+// streamFromLogIteratorWithBuffer is like streamFromLogIterator, but buffers
+// up to size lines ahead of the reader.
+func streamFromLogIteratorWithBuffer(ctx context.Context, iter LogIterator, size int) chan *LogLineItem {
+	logLines := make(chan *LogLineItem, size)
+	ctx = context.WithValue(ctx, streamFillKey{}, func() float64 {
+		if cap(logLines) == 0 {
+			return 0
+		}
+		return float64(len(logLines)) / float64(cap(logLines))
+	})
 	go func() {
 		defer recovery.LogStackTraceAndContinue("streaming lines from log iterator")
 		defer close(logLines)
+		defer func() {
+			grip.Error(message.WrapError(iter.Close(), message.Fields{
+				"message": "closing log iterator",
+			}))
+		}()
 
 		for iter.Next(ctx) {
 			item := iter.Item()
-			logLines <- &item
+			select {
+			case logLines <- &item:
+			case <-ctx.Done():
+				return
+			}
 		}
 
 		if err := iter.Err(); err != nil {
@@ -557,6 +1227,10 @@ func streamFromLogIterator(ctx context.Context, iter LogIterator) chan *LogLineI
 type LogIteratorHeap struct {
 	its []LogIterator
 	min bool
+	// ranks orders iterators whose current items have equal timestamps and
+	// are both global or both test lines. Iterators without a rank sort
+	// after ranked ones.
+	ranks map[LogIterator]int
 }
 
 // Len returns the size of the heap.
@@ -565,12 +1239,36 @@ func (h LogIteratorHeap) Len() int { return len(h.its) }
 // Less returns true if the object at index i is less than the object at index
 // j in the heap, false otherwise, when min is true. When min is false, the
 // opposite is returned.
+//
+// Items with equal timestamps are ordered by their sequence numbers, lowest
+// first, if both have one, then so that global lines come before test lines,
+// then by the iterators' ranks, lowest first. Since the reverse
+// heap inverts this too, a reversed merge yields exactly the reverse of the
+// forward merge.
 func (h LogIteratorHeap) Less(i, j int) bool {
-	if h.min {
-		return h.its[i].Item().Timestamp.Before(h.its[j].Item().Timestamp)
-	} else {
-		return h.its[i].Item().Timestamp.After(h.its[j].Item().Timestamp)
+	itemI, itemJ := h.its[i].Item(), h.its[j].Item()
+	if !itemI.Timestamp.Equal(itemJ.Timestamp) {
+		return itemI.Timestamp.Before(itemJ.Timestamp) == h.min
+	}
+	if itemI.Sequence != nil && itemJ.Sequence != nil && *itemI.Sequence != *itemJ.Sequence {
+		return (*itemI.Sequence < *itemJ.Sequence) == h.min
+	}
+	if itemI.Global != itemJ.Global {
+		return itemI.Global == h.min
+	}
+
+	rankI, rankJ := h.rank(h.its[i]), h.rank(h.its[j])
+	if rankI == rankJ {
+		return false
+	}
+	return (rankI < rankJ) == h.min
+}
+
+func (h LogIteratorHeap) rank(it LogIterator) int {
+	if rank, ok := h.ranks[it]; ok {
+		return rank
 	}
+	return math.MaxInt
 }
 
 // Swap swaps the objects at indexes i and j.
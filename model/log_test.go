@@ -3,19 +3,33 @@ package model
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"go.opentelemetry.io/otel"
 	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/evergreen-ci/logkeeper/env"
+	"github.com/evergreen-ci/logkeeper/storage"
 	"github.com/evergreen-ci/logkeeper/testutil"
+	"github.com/evergreen-ci/pail"
 	"github.com/evergreen-ci/utility"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/goleak"
 )
 
 func TestUnmarshalLogJSON(t *testing.T) {
@@ -46,6 +60,37 @@ func TestUnmarshalLogJSON(t *testing.T) {
 		assert.True(t, lines[1].Timestamp.Equal(time.Date(2009, time.November, 10, 23, 0, 1, 0, time.UTC)))
 	})
 
+	t.Run("SequencedLines", func(t *testing.T) {
+		logLineJSON := "[[1257894000, \"message0\", 1],[1257894000, \"message1\", 0]]"
+		lines, err := UnmarshalLogJSON(ctx, tracer, strings.NewReader(logLineJSON))
+		assert.NoError(t, err)
+		require.Len(t, lines, 2)
+		assert.Equal(t, "message0", lines[0].Data)
+		require.NotNil(t, lines[0].Sequence)
+		assert.EqualValues(t, 1, *lines[0].Sequence)
+		assert.Equal(t, "message1", lines[1].Data)
+		require.NotNil(t, lines[1].Sequence)
+		assert.EqualValues(t, 0, *lines[1].Sequence)
+	})
+
+	t.Run("MixedLines", func(t *testing.T) {
+		logLineJSON := "[[1257894000, \"message0\"],[1257894001, \"message1\", 7]]"
+		lines, err := UnmarshalLogJSON(ctx, tracer, strings.NewReader(logLineJSON))
+		assert.NoError(t, err)
+		require.Len(t, lines, 2)
+		assert.Nil(t, lines[0].Sequence)
+		require.NotNil(t, lines[1].Sequence)
+		assert.EqualValues(t, 7, *lines[1].Sequence)
+	})
+
+	t.Run("InvalidSequence", func(t *testing.T) {
+		for _, seq := range []string{"-1", "1.5", "\"1\"", "null"} {
+			logLineJSON := fmt.Sprintf("[[1257894000, \"message0\", %s]]", seq)
+			_, err := UnmarshalLogJSON(ctx, tracer, strings.NewReader(logLineJSON))
+			assert.Error(t, err, seq)
+		}
+	})
+
 	t.Run("MalformedJSON", func(t *testing.T) {
 		logLineJSON := "[[1257894000, \"message0\"]}"
 		_, err := UnmarshalLogJSON(ctx, tracer, strings.NewReader(logLineJSON))
@@ -69,17 +114,19 @@ func TestUnmarshalLogJSON(t *testing.T) {
 		_, err := UnmarshalLogJSON(ctx, tracer, strings.NewReader(logLineJSON))
 		assert.Error(t, err)
 	})
+
+	t.Run("CanceledContext", func(t *testing.T) {
+		canceledCtx, cancel := context.WithCancel(ctx)
+		cancel()
+		logLineJSON := "[[1257894000, \"message0\"]]"
+		_, err := UnmarshalLogJSON(canceledCtx, tracer, strings.NewReader(logLineJSON))
+		assert.ErrorIs(t, err, context.Canceled)
+	})
 }
 
 func TestLogChunkInfoKey(t *testing.T) {
 	t.Run("WithTest", func(t *testing.T) {
-		info := LogChunkInfo{
-			BuildID:  "b0",
-			TestID:   "t0",
-			NumLines: 1,
-			Start:    time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC),
-			End:      time.Date(2009, time.November, 10, 23, 1, 0, 0, time.UTC),
-		}
+		info := makeLogChunkInfo("b0", "t0", time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC), 1, 1.0/60)
 		key := info.key()
 		require.Equal(t, "builds/b0/tests/t0/1257894000000000000_1257894060000000000_1", key)
 
@@ -92,12 +139,7 @@ func TestLogChunkInfoKey(t *testing.T) {
 		assert.Equal(t, info.TestID, parsedTestID)
 	})
 	t.Run("WithoutTest", func(t *testing.T) {
-		info := LogChunkInfo{
-			BuildID:  "b0",
-			NumLines: 1,
-			Start:    time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC),
-			End:      time.Date(2009, time.November, 10, 23, 1, 0, 0, time.UTC),
-		}
+		info := makeLogChunkInfo("b0", "", time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC), 1, 1.0/60)
 		key := info.key()
 		require.Equal(t, "builds/b0/1257894000000000000_1257894060000000000_1", key)
 
@@ -108,6 +150,43 @@ func TestLogChunkInfoKey(t *testing.T) {
 		_, err := testIDFromKey(key)
 		assert.Error(t, err)
 	})
+	t.Run("Sharded", func(t *testing.T) {
+		for _, testID := range []string{"t0", ""} {
+			info := makeLogChunkInfo("b0", testID, time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC), 1, 1.0/60)
+			info.sharded = true
+			key := info.key()
+			require.True(t, strings.HasPrefix(key, fmt.Sprintf("builds/%s/b0/", buildShard("b0"))), key)
+
+			newInfo := LogChunkInfo{}
+			require.NoError(t, newInfo.fromKey(key))
+			assert.Equal(t, info, newInfo)
+
+			parsedTestID, err := testIDFromKey(key)
+			if testID == "" {
+				assert.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, testID, parsedTestID)
+			}
+		}
+	})
+}
+
+func TestFromLogChunk(t *testing.T) {
+	loc := time.FixedZone("UTC-5", -5*60*60)
+	start := time.Date(2009, time.November, 10, 18, 0, 0, 0, loc)
+	chunk := LogChunk{
+		{Timestamp: start.Add(time.Minute), Data: "line1"},
+		{Timestamp: start, Data: "line0"},
+	}
+
+	info := LogChunkInfo{}
+	require.NoError(t, info.fromLogChunk("b0", "t0", chunk))
+	assert.Equal(t, makeLogChunkInfo("b0", "t0", start, 2, 2.0/60), info)
+	assert.Equal(t, time.UTC, info.Start.Location())
+	assert.Equal(t, time.UTC, info.End.Location())
+
+	assert.Error(t, info.fromLogChunk("b0", "t0", LogChunk{}))
 }
 
 func TestFromKey(t *testing.T) {
@@ -129,7 +208,149 @@ func TestMakeLogLineString(t *testing.T) {
 	assert.Equal(t, []string{"  0       1661354966000a\n", "  0       1661354966000b\n"}, result)
 }
 
+func TestMakeEscapedLogLineString(t *testing.T) {
+	line := LogLineItem{
+		Data:      "a\nb\\nc\n",
+		Timestamp: time.Unix(1661354966, 0).UTC(),
+	}
+	result := makeEscapedLogLineString(line)
+	assert.Equal(t, "  1       1661354966000a\\nb\\\\nc\\n\n", result)
+
+	parsed, err := parseLogLineString(result)
+	require.NoError(t, err)
+	assert.Equal(t, line, parsed)
+}
+
+func TestSequencedLogLineStrings(t *testing.T) {
+	seq := int64(42)
+	line := LogLineItem{
+		Data:      "a\nb",
+		Timestamp: time.Unix(1661354966, 0).UTC(),
+		Sequence:  &seq,
+	}
+
+	split := makeLogLineStrings(line)
+	assert.Equal(t, []string{
+		"  2       1661354966000                  42a\n",
+		"  2       1661354966000                  42b\n",
+	}, split)
+	for i, data := range []string{"a", "b"} {
+		parsed, err := parseLogLineString(split[i])
+		require.NoError(t, err)
+		assert.Equal(t, LogLineItem{Data: data, Timestamp: line.Timestamp, Sequence: &seq}, parsed)
+	}
+
+	escaped := makeEscapedLogLineString(line)
+	assert.Equal(t, "  3       1661354966000                  42a\\nb\n", escaped)
+	parsed, err := parseLogLineString(escaped)
+	require.NoError(t, err)
+	assert.Equal(t, line, parsed)
+
+	_, err = parseLogLineString("  2       1661354966000  42\n")
+	assert.Error(t, err)
+}
+
+func TestDownloadLogLinesSequenced(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	defer testutil.SetBucket(t, "")()
+
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	testID := NewTestID(time.Unix(1000000000, 0))
+	require.NoError(t, (&Build{ID: buildID}).UploadMetadata(ctx, tracer))
+	require.NoError(t, (&Test{ID: testID, BuildID: buildID}).UploadTestMetadata(ctx, tracer))
+
+	// The global lines are uploaded as the agent saw them, interleaved
+	// with the test's lines at the same millisecond, so only their
+	// sequence numbers order them.
+	testLines, err := UnmarshalLogJSON(ctx, tracer, strings.NewReader(`[[1000000000.5, "test0", 0], [1000000000.5, "test2", 2]]`))
+	require.NoError(t, err)
+	_, err = InsertLogLines(ctx, tracer, buildID, testID, testLines, 4*1024*1024)
+	require.NoError(t, err)
+	globalLines, err := UnmarshalLogJSON(ctx, tracer, strings.NewReader(`[[1000000000.5, "global1", 1], [1000000000.5, "global3", 3], [1000000000.6, "global"]]`))
+	require.NoError(t, err)
+	for i := range globalLines {
+		globalLines[i].Global = true
+	}
+	_, err = InsertLogLines(ctx, tracer, buildID, "", globalLines, 4*1024*1024)
+	require.NoError(t, err)
+
+	lines, err := DownloadLogLines(ctx, tracer, buildID, testID)
+	require.NoError(t, err)
+	var data []string
+	for line := range lines {
+		data = append(data, line.Data)
+	}
+	assert.Equal(t, []string{"test0", "global1", "test2", "global3", "global"}, data)
+}
+
+func TestDownloadLogLinesStrictWindow(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	download := func(t *testing.T, buildID, testID string, opts DownloadOptions) []string {
+		lines, err := DownloadLogLinesWithOptions(ctx, tracer, buildID, testID, opts)
+		require.NoError(t, err)
+		var data []string
+		for line := range lines {
+			data = append(data, line.Data)
+		}
+		return data
+	}
+
+	t.Run("Overlapping", func(t *testing.T) {
+		defer testutil.SetBucket(t, "../testdata/overlapping")()
+		buildID := "5a75f537726934e4b62833ab6d5dca41"
+		testID := "0de0b6b3bf3b84000000000000000000"
+
+		// The build's only test has no lines outside of its window,
+		// which runs to the end of the build.
+		expected := download(t, buildID, testID, DownloadOptions{})
+		require.NotEmpty(t, expected)
+		assert.Equal(t, expected, download(t, buildID, testID, DownloadOptions{StrictWindow: true}))
+		assert.Equal(t, download(t, buildID, "", DownloadOptions{}), download(t, buildID, "", DownloadOptions{StrictWindow: true}))
+	})
+	t.Run("TrailingTestLines", func(t *testing.T) {
+		defer testutil.SetBucket(t, "")()
+		buildID := "5a75f537726934e4b62833ab6d5dca41"
+		start := time.Unix(1000000000, 0).UTC()
+		firstTest := &Test{ID: NewTestID(start), BuildID: buildID}
+		secondTest := &Test{ID: NewTestID(start.Add(2 * time.Second)), BuildID: buildID}
+		require.NoError(t, (&Build{ID: buildID}).UploadMetadata(ctx, tracer))
+		require.NoError(t, firstTest.UploadTestMetadata(ctx, tracer))
+		require.NoError(t, secondTest.UploadTestMetadata(ctx, tracer))
+
+		// The first test keeps logging after the second test starts.
+		_, err := InsertLogLines(ctx, tracer, buildID, firstTest.ID, []LogLineItem{
+			{Timestamp: start.Add(time.Second), Data: "first test"},
+			{Timestamp: start.Add(3 * time.Second), Data: "first test trailing"},
+		}, 4*1024*1024)
+		require.NoError(t, err)
+		_, err = InsertLogLines(ctx, tracer, buildID, secondTest.ID, []LogLineItem{
+			{Timestamp: start.Add(4 * time.Second), Data: "second test"},
+		}, 4*1024*1024)
+		require.NoError(t, err)
+		_, err = InsertLogLines(ctx, tracer, buildID, "", []LogLineItem{
+			{Timestamp: start.Add(500 * time.Millisecond), Data: "global"},
+			{Timestamp: start.Add(2500 * time.Millisecond), Data: "global later"},
+		}, 4*1024*1024)
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{"global", "first test", "first test trailing"}, download(t, buildID, firstTest.ID, DownloadOptions{}))
+		assert.Equal(t, []string{"global", "first test"}, download(t, buildID, firstTest.ID, DownloadOptions{StrictWindow: true}))
+		assert.Equal(t, []string{"global later", "second test"}, download(t, buildID, secondTest.ID, DownloadOptions{StrictWindow: true}))
+
+		after := start.Add(time.Second)
+		assert.Empty(t, download(t, buildID, firstTest.ID, DownloadOptions{StrictWindow: true, After: &after}))
+	})
+}
+
 func TestDownloadLogLines(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -216,24 +437,24 @@ func TestDownloadLogLines(t *testing.T) {
 			buildID:     "5a75f537726934e4b62833ab6d5dca41",
 			testID:      "0de0b6b3bf3b84000000000000000000",
 			expectedLines: []string{
-				"Test Log400",
 				"Log400",
-				"Test Log420",
+				"Test Log400",
 				"Log420",
-				"Test Log440",
+				"Test Log420",
 				"Log440",
-				"Test Log460",
+				"Test Log440",
 				"Log460",
+				"Test Log460",
 				"Test Log480",
 				"Log500",
 				"Test Log500",
 				"Log501",
-				"Test Log520",
 				"Log520",
-				"Test Log540",
+				"Test Log520",
 				"Log540",
-				"Test Log560",
+				"Test Log540",
 				"Log560",
+				"Test Log560",
 				"Log580",
 				"Test Log600",
 				"Test Log601",
@@ -263,24 +484,24 @@ func TestDownloadLogLines(t *testing.T) {
 				"Log340",
 				"Log360",
 				"Log380",
-				"Test Log400",
 				"Log400",
-				"Test Log420",
+				"Test Log400",
 				"Log420",
-				"Test Log440",
+				"Test Log420",
 				"Log440",
-				"Test Log460",
+				"Test Log440",
 				"Log460",
+				"Test Log460",
 				"Test Log480",
 				"Log500",
 				"Test Log500",
 				"Log501",
-				"Test Log520",
 				"Log520",
-				"Test Log540",
+				"Test Log520",
 				"Log540",
-				"Test Log560",
+				"Test Log540",
 				"Log560",
+				"Test Log560",
 				"Log580",
 				"Test Log600",
 				"Test Log601",
@@ -318,8 +539,8 @@ func TestDownloadLogLines(t *testing.T) {
 			buildID:     "5a75f537726934e4b62833ab6d5dca41",
 			testID:      "17046404de28123f0000000000000000",
 			expectedLines: []string{
-				"First Test Log Line",
 				"Global log within the test start/stop ranges",
+				"First Test Log Line",
 				"Middle Test Log Line",
 				"Last Test Log Line",
 				"Global log after test logging ends",
@@ -335,17 +556,265 @@ func TestDownloadLogLines(t *testing.T) {
 			} else {
 				require.NoError(t, err)
 
-				var lines []string
+				fixtureLines := readFixtureLogLines(t, test.storagePath)
+				expectedLines := make([]LogLineItem, 0, len(test.expectedLines))
+				for _, data := range test.expectedLines {
+					require.Contains(t, fixtureLines, data)
+					expectedLines = append(expectedLines, fixtureLines[data])
+				}
+
+				var lines []LogLineItem
 				for item := range logLines {
-					lines = append(lines, item.Data)
+					lines = append(lines, *item)
+				}
+				assertLogLinesEqual(t, expectedLines, lines)
+			}
+		})
+	}
+	t.Run("AbandonedStream", func(t *testing.T) {
+		defer testutil.SetBucket(t, "../testdata/overlapping")()
+
+		streamCtx, streamCancel := context.WithCancel(ctx)
+		logLines, err := DownloadLogLines(streamCtx, tracer, "5a75f537726934e4b62833ab6d5dca41", "")
+		require.NoError(t, err)
+		require.NotNil(t, <-logLines)
+
+		// Cancelling the context must stop the streaming goroutine
+		// even though nothing reads the rest of the channel.
+		streamCancel()
+		goleak.VerifyNone(t)
+	})
+	t.Run("ReadersClosed", func(t *testing.T) {
+		for _, test := range []struct {
+			name  string
+			drain bool
+		}{
+			{name: "NeverDrained"},
+			{name: "Drained", drain: true},
+		} {
+			t.Run(test.name, func(t *testing.T) {
+				defer testutil.SetBucket(t, "../testdata/overlapping")()
+				bucket := &readerTrackingBucket{Bucket: env.Bucket().Bucket}
+				require.NoError(t, env.SetBucket(&storage.Bucket{Bucket: bucket}))
+
+				streamCtx, streamCancel := context.WithCancel(ctx)
+				defer streamCancel()
+				logLines, err := DownloadLogLines(streamCtx, tracer, "5a75f537726934e4b62833ab6d5dca41", "")
+				require.NoError(t, err)
+
+				if !test.drain {
+					// Wait for the stream to start reading chunks
+					// before abandoning it.
+					require.Eventually(t, func() bool { return bucket.opened() > 0 }, time.Second, time.Millisecond)
+					streamCancel()
+				}
+				for range logLines {
 				}
-				assert.Equal(t, test.expectedLines, lines)
+
+				assert.NotZero(t, bucket.opened())
+				assert.Zero(t, bucket.open(), "readers left open")
+			})
+		}
+	})
+}
+
+func TestPrefetchingLogIterator(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	defer testutil.SetBucket(t, "")()
+
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	start := time.Unix(1000000000, 0).UTC()
+	var lines []LogLineItem
+	for i := 0; i < 20; i++ {
+		lines = append(lines, LogLineItem{Timestamp: start.Add(time.Duration(i) * time.Second), Data: fmt.Sprintf("line%d", i)})
+	}
+	_, err := InsertLogLinesWithLineLimit(ctx, tracer, buildID, "", lines, 4*1024*1024, 1)
+	require.NoError(t, err)
+
+	keys, err := getBuildKeys(ctx, tracer, buildID)
+	require.NoError(t, err)
+	chunks, _, err := parseLogChunks(keys)
+	require.NoError(t, err)
+	require.Len(t, chunks, len(lines))
+
+	bucket := &readerTrackingBucket{Bucket: env.Bucket().Bucket}
+	require.NoError(t, env.SetBucket(&storage.Bucket{Bucket: bucket}))
+
+	const batchSize = 2
+	opts := PrefetchOptions{StreamBuffer: 4, DrainFraction: 0.5, MaxStreamFill: 0.5}
+	it := NewPrefetchingLogIterator(chunks, batchSize, AllTime, opts)
+
+	var consumed []string
+	for line := range it.Stream(ctx) {
+		consumed = append(consumed, line.Data)
+
+		// Each chunk has a single line, so the chunks downloaded
+		// ahead of consumption are bounded by the lines
+		// buffered in the stream, the line waiting to be sent,
+		// and the current and prefetched batches.
+		assert.LessOrEqual(t, bucket.opened(), len(consumed)+opts.StreamBuffer+1+2*batchSize)
+		assert.LessOrEqual(t, bucket.open(), 2*batchSize)
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	require.Len(t, consumed, len(lines))
+	for i, line := range lines {
+		assert.Equal(t, line.Data, consumed[i])
+	}
+	assert.Equal(t, len(chunks), bucket.opened())
+	assert.Zero(t, bucket.open(), "readers left open")
+}
+
+// readerTrackingBucket counts the readers it returns that have not been
+// closed yet.
+type readerTrackingBucket struct {
+	pail.Bucket
+	mu          sync.Mutex
+	openReaders int
+	numOpened   int
+}
+
+func (b *readerTrackingBucket) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	r, err := b.Bucket.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.openReaders++
+	b.numOpened++
+
+	return &trackedReader{ReadCloser: r, bucket: b}, nil
+}
+
+func (b *readerTrackingBucket) open() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.openReaders
+}
+
+func (b *readerTrackingBucket) opened() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.numOpened
+}
+
+type trackedReader struct {
+	io.ReadCloser
+	bucket *readerTrackingBucket
+	closed bool
+}
+
+func (r *trackedReader) Close() error {
+	if !r.closed {
+		r.closed = true
+		r.bucket.mu.Lock()
+		r.bucket.openReaders--
+		r.bucket.mu.Unlock()
+	}
+
+	return r.ReadCloser.Close()
+}
+
+func TestSerializedLogIteratorMergeAdjacentChunks(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	defer testutil.SetBucket(t, "")()
+
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	start := time.Unix(1000000000, 0).UTC()
+	testID := NewTestID(start.Add(30 * time.Second))
+	var globalLines, testLines []LogLineItem
+	for i := 0; i < 60; i++ {
+		line := LogLineItem{Timestamp: start.Add(time.Duration(i) * time.Second), Data: fmt.Sprintf("line%d", i)}
+		if i >= 30 && i < 40 {
+			testLines = append(testLines, line)
+		} else {
+			globalLines = append(globalLines, line)
+		}
+	}
+	_, err := InsertLogLinesWithLineLimit(ctx, tracer, buildID, "", globalLines, 4*1024*1024, 1)
+	require.NoError(t, err)
+	_, err = InsertLogLinesWithLineLimit(ctx, tracer, buildID, testID, testLines, 4*1024*1024, 1)
+	require.NoError(t, err)
+
+	keys, err := getBuildKeys(ctx, tracer, buildID)
+	require.NoError(t, err)
+	buildChunks, testChunks, err := parseLogChunks(keys)
+	require.NoError(t, err)
+	chunks := append(buildChunks, testChunks...)
+	sortLogChunksByStartTime(chunks)
+	require.Len(t, chunks, 60)
+
+	bucket := &readerTrackingBucket{Bucket: env.Bucket().Bucket}
+	require.NoError(t, env.SetBucket(&storage.Bucket{Bucket: bucket}))
+	read := func(t *testing.T, it LogIterator) []string {
+		var data []string
+		for it.Next(ctx) {
+			data = append(data, it.Item().Data)
+			assert.LessOrEqual(t, bucket.open(), 1)
+		}
+		require.NoError(t, it.Err())
+		require.NoError(t, it.Close())
+		assert.Zero(t, bucket.open(), "readers left open")
+		return data
+	}
+
+	for _, test := range []struct {
+		reverse    bool
+		numStreams int
+	}{
+		// The global lines before the test, the test's lines and
+		// the global lines after it are each read as a single
+		// stream.
+		{reverse: false, numStreams: 3},
+		// Reversed iterators don't merge chunks.
+		{reverse: true, numStreams: 60},
+	} {
+		t.Run(fmt.Sprintf("Reverse=%t", test.reverse), func(t *testing.T) {
+			it := NewSerializedLogIterator(chunks, AllTime)
+			merged := NewSerializedLogIteratorWithOptions(chunks, AllTime, SerializedIteratorOptions{MergeAdjacentChunks: true})
+			if test.reverse {
+				it = it.Reverse()
+				merged = merged.Reverse()
 			}
+
+			opened := bucket.opened()
+			expected := read(t, it)
+			require.Len(t, expected, 60)
+			assert.Equal(t, 60, bucket.opened()-opened)
+
+			opened = bucket.opened()
+			assert.Equal(t, expected, read(t, merged))
+			assert.Equal(t, 60, bucket.opened()-opened)
+
+			assert.Equal(t, 60, it.(*serializedIterator).numStreams)
+			assert.Equal(t, test.numStreams, merged.(*serializedIterator).numStreams)
 		})
 	}
+	t.Run("TimeRange", func(t *testing.T) {
+		tr := NewTimeRange(start.Add(5*time.Second), start.Add(45*time.Second))
+		expected := read(t, NewSerializedLogIterator(chunks, tr))
+		require.Len(t, expected, 41)
+		assert.Equal(t, expected, read(t, NewSerializedLogIteratorWithOptions(chunks, tr, SerializedIteratorOptions{MergeAdjacentChunks: true})))
+	})
 }
 
 func TestInsertLogLines(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -423,7 +892,8 @@ func TestInsertLogLines(t *testing.T) {
 
 	t.Run("Global", func(t *testing.T) {
 		defer testutil.SetBucket(t, "nolines")()
-		require.NoError(t, InsertLogLines(ctx, tracer, buildID, "", globalLines, 4*1024*1024))
+		_, err := InsertLogLines(ctx, tracer, buildID, "", globalLines, 4*1024*1024)
+		require.NoError(t, err)
 		verifyDataStorage(t, fmt.Sprintf("/builds/%s/", buildID), expectedStorage)
 
 		logsChannel, err := DownloadLogLines(ctx, tracer, buildID, "")
@@ -433,7 +903,7 @@ func TestInsertLogLines(t *testing.T) {
 			result = append(result, *item)
 		}
 
-		assert.Equal(t, globalLines, result)
+		assertLogLinesEqual(t, globalLines, result)
 	})
 	t.Run("Test", func(t *testing.T) {
 		defer testutil.SetBucket(t, "nolines")()
@@ -442,7 +912,8 @@ func TestInsertLogLines(t *testing.T) {
 			ID:      testID,
 			BuildID: "5a75f537726934e4b62833ab6d5dca41",
 		}).UploadTestMetadata(ctx, tracer))
-		require.NoError(t, InsertLogLines(ctx, tracer, buildID, testID, testLines, 4*1024*1024))
+		_, err := InsertLogLines(ctx, tracer, buildID, testID, testLines, 4*1024*1024)
+		require.NoError(t, err)
 
 		verifyDataStorage(t, fmt.Sprintf("/builds/%s/tests/%s/", buildID, testID), expectedStorage)
 
@@ -452,39 +923,590 @@ func TestInsertLogLines(t *testing.T) {
 		for item := range logsChannel {
 			result = append(result, *item)
 		}
-		assert.Equal(t, testLines, result)
+		assertLogLinesEqual(t, testLines, result)
 	})
-}
+	t.Run("LineLimit", func(t *testing.T) {
+		defer testutil.SetBucket(t, "nolines")()
+		_, err := InsertLogLinesWithLineLimit(ctx, tracer, buildID, "", globalLines, 4*1024*1024, 4)
+		require.NoError(t, err)
+		verifyDataStorage(t, fmt.Sprintf("/builds/%s/", buildID), newExpectedChunk("1000000000000000000_1000000003000000000_4", []string{
+			"  0       1000000000000line0\n",
+			"  0       1000000001000line1\n",
+			"  0       1000000002000line2\n",
+			"  0       1000000003000line3\n",
+		}))
+		verifyDataStorage(t, fmt.Sprintf("/builds/%s/", buildID), newExpectedChunk("1000000004000000000_1000000005000000000_2", []string{
+			"  0       1000000004000line4\n",
+			"  0       1000000005000line5\n",
+		}))
 
-type expectedChunk struct {
-	filename string
-	body     string
-}
+		logsChannel, err := DownloadLogLines(ctx, tracer, buildID, "")
+		require.NoError(t, err)
+		var result []LogLineItem
+		for item := range logsChannel {
+			result = append(result, *item)
+		}
+		assertLogLinesEqual(t, globalLines, result)
+	})
+	t.Run("PreserveNewlines", func(t *testing.T) {
+		defer testutil.SetBucket(t, "nolines")()
+		multiLines := []LogLineItem{
+			{Timestamp: time.Unix(1000000000, 0).UTC(), Data: "line0\nline1", Global: true},
+			{Timestamp: time.Unix(1000000001, 0).UTC(), Data: `C:\path\name`, Global: true},
+			{Timestamp: time.Unix(1000000002, 0).UTC(), Data: "line2\n", Global: true},
+		}
+		_, err := InsertLogLinesWithOptions(ctx, tracer, buildID, "", multiLines, InsertOptions{MaxSize: 4 * 1024 * 1024, PreserveNewlines: true})
+		require.NoError(t, err)
+		verifyDataStorage(t, fmt.Sprintf("/builds/%s/", buildID), newExpectedChunk("1000000000000000000_1000000002000000000_3", []string{
+			"  1       1000000000000line0\\nline1\n",
+			"  1       1000000001000C:\\\\path\\\\name\n",
+			"  1       1000000002000line2\\n\n",
+		}))
 
-func newExpectedChunk(filename string, lines []string) expectedChunk {
-	return expectedChunk{
-		filename: filename,
-		body:     strings.Join(lines, ""),
-	}
-}
+		logsChannel, err := DownloadLogLines(ctx, tracer, buildID, "")
+		require.NoError(t, err)
+		var result []LogLineItem
+		for item := range logsChannel {
+			result = append(result, *item)
+		}
+		assertLogLinesEqual(t, multiLines, result)
+	})
+	t.Run("OutOfOrderSort", func(t *testing.T) {
+		defer testutil.SetBucket(t, "nolines")()
+		outOfOrder := []LogLineItem{globalLines[2], globalLines[0], globalLines[5], globalLines[1], globalLines[4], globalLines[3]}
+		opts := InsertOptions{MaxSize: 4 * 1024 * 1024, MaxLines: 3, OutOfOrder: OutOfOrderSort}
+		_, err := InsertLogLinesWithOptions(ctx, tracer, buildID, "", outOfOrder, opts)
+		require.NoError(t, err)
+		assert.Equal(t, globalLines[2], outOfOrder[0], "the given lines should not be reordered")
+		verifyDataStorage(t, fmt.Sprintf("/builds/%s/", buildID), newExpectedChunk("1000000000000000000_1000000002000000000_3", []string{
+			"  0       1000000000000line0\n",
+			"  0       1000000001000line1\n",
+			"  0       1000000002000line2\n",
+		}))
+		verifyDataStorage(t, fmt.Sprintf("/builds/%s/", buildID), newExpectedChunk("1000000003000000000_1000000005000000000_3", []string{
+			"  0       1000000003000line3\n",
+			"  0       1000000004000line4\n",
+			"  0       1000000005000line5\n",
+		}))
 
-func verifyDataStorage(t *testing.T, prefix string, expectedStorage expectedChunk) {
-	actualChunkStream, err := env.Bucket().Get(context.Background(), fmt.Sprintf("%s%s", prefix, expectedStorage.filename))
-	require.NoError(t, err)
+		logsChannel, err := DownloadLogLines(ctx, tracer, buildID, "")
+		require.NoError(t, err)
+		var result []LogLineItem
+		for item := range logsChannel {
+			result = append(result, *item)
+		}
+		assertLogLinesEqual(t, globalLines, result)
+	})
+	t.Run("OutOfOrderReject", func(t *testing.T) {
+		defer testutil.SetBucket(t, "nolines")()
+		outOfOrder := []LogLineItem{globalLines[0], globalLines[2], globalLines[1]}
+		opts := InsertOptions{MaxSize: 4 * 1024 * 1024, OutOfOrder: OutOfOrderReject}
+		_, err := InsertLogLinesWithOptions(ctx, tracer, buildID, "", outOfOrder, opts)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "line 2 has timestamp")
 
-	actualChunkBody, err := io.ReadAll(actualChunkStream)
-	require.NoError(t, err)
-	assert.Equal(t, expectedStorage.body, string(actualChunkBody))
+		keys, err := getBuildKeys(ctx, tracer, buildID)
+		require.NoError(t, err)
+		assert.Empty(t, keys)
+
+		// Lines with equal timestamps are in order.
+		inOrder := []LogLineItem{globalLines[0], globalLines[0], globalLines[1]}
+		_, err = InsertLogLinesWithOptions(ctx, tracer, buildID, "", inOrder, opts)
+		require.NoError(t, err)
+	})
 }
 
-func benchmarkReadLogJSON(lineCount, lineSize int, b *testing.B) {
+func TestInsertLogLinesDropEmptyLines(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
-	sampleJSON := makeJSONSample(lineCount, lineSize)
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	var lines []LogLineItem
+	for i, data := range []string{"line0", "", "line1", "   ", "\t", "line2", ""} {
+		lines = append(lines, LogLineItem{Timestamp: time.Unix(1000000000+int64(i), 0).UTC(), Data: data, Global: true})
+	}
+	insert := func(t *testing.T, opts InsertOptions) ([]string, sdktrace.ReadOnlySpan) {
+		recorder := tracetest.NewSpanRecorder()
+		tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test_tracer")
+		_, err := InsertLogLinesWithOptions(ctx, tracer, buildID, "", lines, opts)
+		require.NoError(t, err)
+
+		logLines, err := DownloadLogLines(ctx, tracer, buildID, "")
+		require.NoError(t, err)
+		var data []string
+		for line := range logLines {
+			data = append(data, line.Data)
+		}
+
+		for _, span := range recorder.Ended() {
+			if span.Name() == "InsertLogLines" {
+				return data, span
+			}
+		}
+		require.FailNow(t, "missing insert span")
+		return nil, nil
+	}
+
+	t.Run("Dropped", func(t *testing.T) {
+		defer testutil.SetBucket(t, "nolines")()
+		originalLines := append([]LogLineItem{}, lines...)
+
+		data, span := insert(t, InsertOptions{MaxSize: 4 * 1024 * 1024, DropEmptyLines: true})
+		assert.Equal(t, []string{"line0", "line1", "line2"}, data)
+		assert.Contains(t, span.Attributes(), attribute.Int(droppedLinesAttribute, 4))
+		assert.Equal(t, originalLines, lines)
+	})
+	t.Run("KeptByDefault", func(t *testing.T) {
+		defer testutil.SetBucket(t, "nolines")()
+
+		data, span := insert(t, InsertOptions{MaxSize: 4 * 1024 * 1024})
+		assert.Equal(t, []string{"line0", "", "line1", "   ", "\t", "line2", ""}, data)
+		for _, attr := range span.Attributes() {
+			assert.NotEqual(t, droppedLinesAttribute, string(attr.Key))
+		}
+	})
+	t.Run("AllEmpty", func(t *testing.T) {
+		defer testutil.SetBucket(t, "nolines")()
+		tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+
+		empty := []LogLineItem{lines[1], lines[3]}
+		_, err := InsertLogLinesWithOptions(ctx, tracer, buildID, "", empty, InsertOptions{MaxSize: 4 * 1024 * 1024, DropEmptyLines: true})
+		require.NoError(t, err)
+		keys, err := getBuildKeys(ctx, tracer, buildID)
+		require.NoError(t, err)
+		assert.Empty(t, keys)
+	})
+}
+
+func TestInsertLogLinesResult(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	checkStored := func(t *testing.T, result InsertResult) {
+		keys, err := getBuildKeys(ctx, tracer, buildID)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, keys, result.Keys)
+		assert.Equal(t, len(keys), result.Chunks)
+
+		var size int64
+		for _, key := range keys {
+			r, err := env.Bucket().Get(ctx, key)
+			require.NoError(t, err)
+			n, err := io.Copy(io.Discard, r)
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+			size += n
+		}
+		assert.Equal(t, size, result.Bytes)
+	}
+
+	t.Run("MultipleChunks", func(t *testing.T) {
+		defer testutil.SetBucket(t, "")()
+
+		var lines []LogLineItem
+		for i := 0; i < 5; i++ {
+			lines = append(lines, LogLineItem{Timestamp: time.Unix(1000000000+int64(i), 0).UTC(), Data: fmt.Sprintf("line%d", i), Global: true})
+		}
+		result, err := InsertLogLinesWithLineLimit(ctx, tracer, buildID, "", lines, 4*1024*1024, 2)
+		require.NoError(t, err)
+		assert.Equal(t, 3, result.Chunks)
+		assert.Equal(t, 5, result.Lines)
+		checkStored(t, result)
+	})
+	t.Run("MultiLineItem", func(t *testing.T) {
+		defer testutil.SetBucket(t, "")()
+
+		lines := []LogLineItem{
+			{Timestamp: time.Unix(1000000000, 0).UTC(), Data: "first\nsecond", Global: true},
+			{Timestamp: time.Unix(1000000001, 0).UTC(), Data: "third", Global: true},
+		}
+		result, err := InsertLogLines(ctx, tracer, buildID, "", lines, 4*1024*1024)
+		require.NoError(t, err)
+		assert.Equal(t, 1, result.Chunks)
+		assert.Equal(t, 3, result.Lines)
+		checkStored(t, result)
+	})
+	t.Run("NoLines", func(t *testing.T) {
+		defer testutil.SetBucket(t, "")()
+
+		result, err := InsertLogLines(ctx, tracer, buildID, "", nil, 4*1024*1024)
+		require.NoError(t, err)
+		assert.Zero(t, result)
+	})
+}
+
+func TestInsertLogLinesEmptyArray(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	for _, test := range []struct {
+		name   string
+		testID string
+	}{
+		{name: "Global"},
+		{name: "Test", testID: "de0b6b3a764000000000000"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			defer testutil.SetBucket(t, "../testdata/nolines")()
+
+			lines, err := UnmarshalLogJSON(ctx, tracer, strings.NewReader("[]"))
+			require.NoError(t, err)
+			_, err = InsertLogLines(ctx, tracer, buildID, test.testID, lines, 4*1024*1024)
+			require.NoError(t, err)
+
+			keys, err := getBuildKeys(ctx, tracer, buildID)
+			require.NoError(t, err)
+			for _, key := range keys {
+				assert.True(t, strings.HasSuffix(key, metadataFilename), "unexpected chunk '%s'", key)
+			}
+
+			logLines, err := DownloadLogLines(ctx, tracer, buildID, test.testID)
+			require.NoError(t, err)
+			for line := range logLines {
+				assert.Fail(t, "unexpected line", line.Data)
+			}
+		})
+	}
+}
+
+func TestInsertLogLinesCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	defer testutil.SetBucket(t, "nolines")()
+	bucket := env.Bucket()
+	defer func() {
+		require.NoError(t, env.SetBucket(bucket))
+	}()
+	require.NoError(t, env.SetBucket(&storage.Bucket{Bucket: &cancelingBucket{Bucket: bucket.Bucket, cancelAfterPuts: 2, cancel: cancel}}))
+
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	var lines []LogLineItem
+	for i := 0; i < 5; i++ {
+		lines = append(lines, LogLineItem{Timestamp: time.Unix(1000000000+int64(i), 0).UTC(), Data: fmt.Sprintf("line%d", i), Global: true})
+	}
+	_, err := InsertLogLinesWithLineLimit(ctx, tracer, buildID, "", lines, 4*1024*1024, 1)
+	require.Error(t, err)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	keys, err := getBuildKeys(context.Background(), tracer, buildID)
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestInsertLogLinesMaxBuildChunks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	start := time.Unix(1000000000, 0).UTC()
+	// Lines are offset so that their chunks never share a key.
+	makeLines := func(offset int, n int) []LogLineItem {
+		lines := make([]LogLineItem, n)
+		for i := range lines {
+			lines[i] = LogLineItem{Timestamp: start.Add(time.Duration(offset+i) * time.Second), Data: fmt.Sprintf("line%d", offset+i)}
+		}
+		return lines
+	}
+
+	for _, test := range []struct {
+		name          string
+		appended      int
+		errorExpected bool
+	}{
+		{name: "UnderLimit", appended: 1},
+		{name: "AtLimit", appended: 2},
+		{name: "OverLimit", appended: 3, errorExpected: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			defer testutil.SetBucket(t, "")()
+			testID := NewTestID(start)
+			require.NoError(t, (&Build{ID: buildID}).UploadMetadata(ctx, tracer))
+			require.NoError(t, (&Test{ID: testID, BuildID: buildID}).UploadTestMetadata(ctx, tracer))
+
+			// Both the build's and its tests' chunks count toward
+			// the limit.
+			opts := InsertOptions{MaxSize: 1024, MaxLines: 1, MaxBuildChunks: 5}
+			_, err := InsertLogLinesWithOptions(ctx, tracer, buildID, "", makeLines(0, 2), opts)
+			require.NoError(t, err)
+			_, err = InsertLogLinesWithOptions(ctx, tracer, buildID, testID, makeLines(0, 1), opts)
+			require.NoError(t, err)
+
+			_, err = InsertLogLinesWithOptions(ctx, tracer, buildID, testID, makeLines(10, test.appended), opts)
+			keys, listErr := getBuildKeys(ctx, tracer, buildID)
+			require.NoError(t, listErr)
+			if test.errorExpected {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), "exceed the maximum of 5")
+				// Two metadata keys and three chunks.
+				assert.Len(t, keys, 5)
+				return
+			}
+			require.NoError(t, err)
+			assert.Len(t, keys, 5+test.appended)
+
+			opts.MaxBuildChunks = 0
+			_, err = InsertLogLinesWithOptions(ctx, tracer, buildID, testID, makeLines(20, 3), opts)
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestInsertLogLinesMaxBuildAge(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	now := time.Now().UTC().Truncate(time.Second)
+	setup := func(t *testing.T, start time.Time) string {
+		testID := NewTestID(start)
+		require.NoError(t, (&Build{ID: buildID}).UploadMetadata(ctx, tracer))
+		require.NoError(t, (&Test{ID: testID, BuildID: buildID}).UploadTestMetadata(ctx, tracer))
+		_, err := InsertLogLines(ctx, tracer, buildID, "", []LogLineItem{{Timestamp: start, Data: "first"}}, 1024)
+		require.NoError(t, err)
+		return testID
+	}
+	opts := InsertOptions{MaxSize: 1024, MaxBuildAge: 24 * time.Hour}
+
+	t.Run("FreshBuild", func(t *testing.T) {
+		defer testutil.SetBucket(t, "")()
+		testID := setup(t, now.Add(-time.Hour))
+
+		result, err := InsertLogLinesWithOptions(ctx, tracer, buildID, testID, []LogLineItem{{Timestamp: now, Data: "line"}}, opts)
+		require.NoError(t, err)
+		assert.Equal(t, 1, result.Lines)
+	})
+	t.Run("OldBuild", func(t *testing.T) {
+		defer testutil.SetBucket(t, "")()
+		testID := setup(t, now.Add(-48*time.Hour))
+
+		_, err := InsertLogLinesWithOptions(ctx, tracer, buildID, testID, []LogLineItem{{Timestamp: now, Data: "line"}}, opts)
+		require.Error(t, err)
+		assert.True(t, IsBuildTooOldError(err))
+		_, err = InsertLogLinesFromReader(ctx, tracer, buildID, testID, strings.NewReader(fmt.Sprintf(`[[%d, "line"]]`, now.Unix())), opts)
+		require.Error(t, err)
+		assert.True(t, IsBuildTooOldError(err))
+
+		keys, err := getBuildKeys(ctx, tracer, buildID)
+		require.NoError(t, err)
+		// Two metadata keys and the build's first chunk.
+		assert.Len(t, keys, 3)
+	})
+	t.Run("NoChunks", func(t *testing.T) {
+		defer testutil.SetBucket(t, "")()
+		testID := NewTestID(now)
+		require.NoError(t, (&Build{ID: buildID}).UploadMetadata(ctx, tracer))
+		require.NoError(t, (&Test{ID: testID, BuildID: buildID}).UploadTestMetadata(ctx, tracer))
+
+		_, err := InsertLogLinesWithOptions(ctx, tracer, buildID, testID, []LogLineItem{{Timestamp: now.Add(-48 * time.Hour), Data: "line"}}, opts)
+		require.NoError(t, err)
+	})
+	t.Run("Disabled", func(t *testing.T) {
+		defer testutil.SetBucket(t, "")()
+		testID := setup(t, now.Add(-48*time.Hour))
+
+		noAgeOpts := opts
+		noAgeOpts.MaxBuildAge = 0
+		_, err := InsertLogLinesWithOptions(ctx, tracer, buildID, testID, []LogLineItem{{Timestamp: now, Data: "line"}}, noAgeOpts)
+		require.NoError(t, err)
+	})
+}
+
+// cancelingBucket cancels a context once the given number of Puts succeed.
+type cancelingBucket struct {
+	pail.Bucket
+	puts            int
+	cancelAfterPuts int
+	cancel          context.CancelFunc
+}
+
+func (b *cancelingBucket) Put(ctx context.Context, key string, r io.Reader) error {
+	if err := b.Bucket.Put(ctx, key, r); err != nil {
+		return err
+	}
+	b.puts++
+	if b.puts == b.cancelAfterPuts {
+		b.cancel()
+	}
+
+	return nil
+}
+
+func TestGroupLines(t *testing.T) {
+	lines := []LogLineItem{
+		{Timestamp: time.Unix(1000000000, 0).UTC(), Data: "line0"},
+		{Timestamp: time.Unix(1000000001, 0).UTC(), Data: "line1\nline2"},
+		{Timestamp: time.Unix(1000000002, 0).UTC(), Data: "line3"},
+		{Timestamp: time.Unix(1000000003, 0).UTC(), Data: "line4"},
+		{Timestamp: time.Unix(1000000004, 0).UTC(), Data: "line5"},
+	}
+
+	for _, test := range []struct {
+		name             string
+		maxSize          int
+		maxLines         int
+		preserveNewlines bool
+		expectedChunks   []LogChunk
+		errorExpected    bool
+	}{
+		{
+			name:           "Unlimited",
+			maxSize:        1024,
+			expectedChunks: []LogChunk{lines},
+		},
+		{
+			name:           "ByteLimit",
+			maxSize:        len("line1\nline2"),
+			expectedChunks: []LogChunk{lines[0:1], lines[1:2], lines[2:4], lines[4:5]},
+		},
+		{
+			name:           "LineLimit",
+			maxSize:        1024,
+			maxLines:       4,
+			expectedChunks: []LogChunk{lines[0:3], lines[3:5]},
+		},
+		{
+			name:           "LineLimitCountsEmbeddedNewlines",
+			maxSize:        1024,
+			maxLines:       3,
+			expectedChunks: []LogChunk{lines[0:2], lines[2:5]},
+		},
+		{
+			name:             "LineLimitPreservesEmbeddedNewlines",
+			maxSize:          1024,
+			maxLines:         3,
+			preserveNewlines: true,
+			expectedChunks:   []LogChunk{lines[0:3], lines[3:5]},
+		},
+		{
+			name:           "ByteLimitReachedFirst",
+			maxSize:        len("line1\nline2"),
+			maxLines:       3,
+			expectedChunks: []LogChunk{lines[0:1], lines[1:2], lines[2:4], lines[4:5]},
+		},
+		{
+			name:           "LineLimitReachedFirst",
+			maxSize:        len("line1\nline2") + len("line3"),
+			maxLines:       2,
+			expectedChunks: []LogChunk{lines[0:1], lines[1:2], lines[2:4], lines[4:5]},
+		},
+		{
+			name:          "LineExceedsLineLimit",
+			maxSize:       1024,
+			maxLines:      1,
+			errorExpected: true,
+		},
+		{
+			name:          "LineExceedsByteLimit",
+			maxSize:       len("line0"),
+			errorExpected: true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			chunks, err := groupLines(lines, test.maxSize, test.maxLines, test.preserveNewlines)
+			if test.errorExpected {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedChunks, chunks)
+		})
+	}
+}
+
+type expectedChunk struct {
+	filename string
+	body     string
+}
+
+func newExpectedChunk(filename string, lines []string) expectedChunk {
+	return expectedChunk{
+		filename: filename,
+		body:     strings.Join(lines, ""),
+	}
+}
+
+// assertLogLinesEqual asserts that the actual log lines match the expected
+// ones, comparing timestamps as instants regardless of their location. On a
+// mismatch it reports the first differing line rather than both slices.
+func assertLogLinesEqual(t *testing.T, expected, actual []LogLineItem) bool {
+	for i := 0; i < len(expected) && i < len(actual); i++ {
+		expectedLine, actualLine := expected[i], actual[i]
+		expectedLine.Timestamp = expectedLine.Timestamp.UTC()
+		actualLine.Timestamp = actualLine.Timestamp.UTC()
+		if expectedLine != actualLine {
+			return assert.Fail(t, fmt.Sprintf("log lines differ at index %d", i), "expected: %s\nactual:   %s", formatLogLine(expectedLine), formatLogLine(actualLine))
+		}
+	}
+	if len(expected) != len(actual) {
+		return assert.Fail(t, fmt.Sprintf("expected %d log lines but got %d", len(expected), len(actual)))
+	}
+
+	return true
+}
+
+func formatLogLine(line LogLineItem) string {
+	return fmt.Sprintf("%s global=%t %q", line.Timestamp.Format(time.RFC3339Nano), line.Global, line.Data)
+}
+
+// readFixtureLogLines returns the log lines stored in the chunks under the
+// given testdata directory keyed by their data, which is unique within each
+// fixture.
+func readFixtureLogLines(t *testing.T, dir string) map[string]LogLineItem {
+	lines := map[string]LogLineItem{}
+	require.NoError(t, filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || d.Name() == metadataFilename {
+			return err
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for _, lineString := range strings.SplitAfter(string(data), "\n") {
+			// Some fixtures end with trailing whitespace after the
+			// last line.
+			if strings.TrimSpace(lineString) == "" {
+				continue
+			}
+			line, err := parseLogLineString(lineString)
+			if err != nil {
+				return err
+			}
+			line.Global = !strings.Contains(filepath.ToSlash(path), "/tests/")
+			lines[line.Data] = line
+		}
+
+		return nil
+	}))
+
+	return lines
+}
+
+func verifyDataStorage(t *testing.T, prefix string, expectedStorage expectedChunk) {
+	actualChunkStream, err := env.Bucket().Get(context.Background(), fmt.Sprintf("%s%s", prefix, expectedStorage.filename))
+	require.NoError(t, err)
+
+	actualChunkBody, err := io.ReadAll(actualChunkStream)
+	require.NoError(t, err)
+	assert.Equal(t, expectedStorage.body, string(actualChunkBody))
+}
+
+func benchmarkReadLogJSON(lineCount, lineSize int, b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	sampleJSON := makeJSONSample(lineCount, lineSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
 		_, err := UnmarshalLogJSON(ctx, tracer, bytes.NewReader(sampleJSON))
 		if err != nil {
 			b.Fatalf("unmarshal encountered error: '%s'", err)
@@ -514,3 +1536,1350 @@ func BenchmarkReadLogJSONMaxLogSizeAverageLines(b *testing.B) { benchmarkReadLog
 func BenchmarkReadLogJSONMaxLogSizeMaxLineSize(b *testing.B) {
 	benchmarkReadLogJSON(8, 4*1024*1024, b)
 }
+
+func TestNewCrossBuildIterator(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	defer testutil.SetBucket(t, "../testdata/delayed")()
+
+	otherBuildID := "b1"
+	_, err := InsertLogLines(ctx, tracer, otherBuildID, "", []LogLineItem{
+		{Timestamp: time.Unix(1000000000, 400000000).UTC(), Data: "Other Log400"},
+		{Timestamp: time.Unix(1000000000, 403000000).UTC(), Data: "Other Log403"},
+	}, 4*1024*1024)
+	require.NoError(t, err)
+
+	t.Run("MultipleBuilds", func(t *testing.T) {
+		it, err := NewCrossBuildIterator(ctx, tracer, []string{"5a75f537726934e4b62833ab6d5dca41", otherBuildID}, AllTime)
+		require.NoError(t, err)
+
+		var lines []string
+		for item := range it.Stream(ctx) {
+			lines = append(lines, item.Data)
+		}
+		require.Len(t, lines, 6)
+		assert.Equal(t, []string{"Other Log400", "Log401", "Log402"}, lines[:3])
+		assert.ElementsMatch(t, []string{"Test Log403", "Other Log403", "Test Log404"}, lines[3:])
+	})
+	t.Run("MissingBuildsAreExcluded", func(t *testing.T) {
+		it, err := NewCrossBuildIterator(ctx, tracer, []string{"DNE", otherBuildID}, AllTime)
+		require.NoError(t, err)
+
+		var lines []string
+		for item := range it.Stream(ctx) {
+			lines = append(lines, item.Data)
+		}
+		assert.Equal(t, []string{"Other Log400", "Other Log403"}, lines)
+	})
+	t.Run("NoBuildsExist", func(t *testing.T) {
+		it, err := NewCrossBuildIterator(ctx, tracer, []string{"DNE0", "DNE1"}, AllTime)
+		require.NoError(t, err)
+
+		var lines []string
+		for item := range it.Stream(ctx) {
+			lines = append(lines, item.Data)
+		}
+		assert.Empty(t, lines)
+	})
+	t.Run("TooManyBuilds", func(t *testing.T) {
+		env.SetMaxMergeIterators(3)
+		defer env.SetMaxMergeIterators(env.DefaultMaxMergeIterators)
+
+		it, err := NewCrossBuildIterator(ctx, tracer, []string{"5a75f537726934e4b62833ab6d5dca41", otherBuildID}, AllTime)
+		assert.ErrorIs(t, err, ErrTooManyIterators)
+		assert.Nil(t, it)
+	})
+}
+
+func TestRepairLineCounts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	testID := "17046404de18d0000000000000000000"
+	buildChunkKey := "builds/5a75f537726934e4b62833ab6d5dca41/1658560532739000000_1658560535740000000_4"
+	testChunkKey := "builds/5a75f537726934e4b62833ab6d5dca41/tests/17046404de18d0000000000000000000/1658560534848000000_1658560534869000000_11"
+
+	moveKey := func(t *testing.T, from, to string) {
+		r, err := env.Bucket().Get(ctx, from)
+		require.NoError(t, err)
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+		require.NoError(t, env.Bucket().Put(ctx, to, bytes.NewReader(data)))
+		require.NoError(t, env.Bucket().Remove(ctx, from))
+	}
+	streamBuild := func(t *testing.T) (int, error) {
+		it, err := NewCrossBuildIterator(ctx, tracer, []string{buildID}, AllTime)
+		require.NoError(t, err)
+
+		var count int
+		for range it.Stream(ctx) {
+			count++
+		}
+		return count, it.Err()
+	}
+
+	t.Run("CorruptedCounts", func(t *testing.T) {
+		defer testutil.SetBucket(t, "../testdata/simple")()
+
+		moveKey(t, buildChunkKey, strings.TrimSuffix(buildChunkKey, "_4")+"_7")
+		moveKey(t, testChunkKey, strings.TrimSuffix(testChunkKey, "_11")+"_2")
+		test, err := FindTestByID(ctx, tracer, buildID, testID)
+		require.NoError(t, err)
+		test.NumLines = 100
+		require.NoError(t, test.UploadTestMetadata(ctx, tracer))
+
+		_, err = streamBuild(t)
+		require.Error(t, err)
+
+		repair, err := RepairLineCounts(ctx, tracer, buildID)
+		require.NoError(t, err)
+		assert.Equal(t, LineCountRepair{Chunks: 2, Tests: 1}, repair)
+
+		keys, err := getBuildKeys(ctx, tracer, buildID)
+		require.NoError(t, err)
+		assert.Contains(t, keys, buildChunkKey)
+		assert.Contains(t, keys, testChunkKey)
+		assert.Len(t, keys, 4)
+
+		count, err := streamBuild(t)
+		require.NoError(t, err)
+		assert.Equal(t, 15, count)
+
+		test, err = FindTestByID(ctx, tracer, buildID, testID)
+		require.NoError(t, err)
+		assert.Equal(t, 11, test.NumLines)
+
+		repair, err = RepairLineCounts(ctx, tracer, buildID)
+		require.NoError(t, err)
+		assert.Zero(t, repair)
+	})
+	t.Run("CorrectCounts", func(t *testing.T) {
+		defer testutil.SetBucket(t, "../testdata/simple")()
+
+		// The legacy test's size is recorded the first time.
+		repair, err := RepairLineCounts(ctx, tracer, buildID)
+		require.NoError(t, err)
+		assert.Equal(t, LineCountRepair{Tests: 1}, repair)
+		repair, err = RepairLineCounts(ctx, tracer, buildID)
+		require.NoError(t, err)
+		assert.Zero(t, repair)
+
+		keys, err := getBuildKeys(ctx, tracer, buildID)
+		require.NoError(t, err)
+		assert.Contains(t, keys, buildChunkKey)
+		assert.Contains(t, keys, testChunkKey)
+	})
+	t.Run("BuildDNE", func(t *testing.T) {
+		defer testutil.SetBucket(t, "../testdata/simple")()
+
+		repair, err := RepairLineCounts(ctx, tracer, "DNE")
+		require.NoError(t, err)
+		assert.Zero(t, repair)
+	})
+}
+
+// makeLogChunkInfo returns the LogChunkInfo for a chunk of numLines lines
+// written at linesPerSecond, starting at start. Start and End are in UTC.
+func makeLogChunkInfo(buildID string, testID string, start time.Time, numLines int, linesPerSecond float64) LogChunkInfo {
+	start = start.UTC()
+	return LogChunkInfo{
+		BuildID:  buildID,
+		TestID:   testID,
+		NumLines: numLines,
+		Start:    start,
+		End:      start.Add(time.Duration(float64(numLines) / linesPerSecond * float64(time.Second))),
+	}
+}
+
+func TestDownloadLogLinesWithOptions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	defer testutil.SetBucket(t, "")()
+
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	start := time.Unix(1000000000, 0).UTC()
+	require.NoError(t, (&Build{ID: buildID, TaskExecution: 1}).UploadMetadata(ctx, tracer))
+	testIDs := make([]string, 3)
+	for i, execution := range []int{0, 0, 1} {
+		testIDs[i] = NewTestID(start.Add(time.Duration(i) * time.Second))
+		require.NoError(t, (&Test{ID: testIDs[i], BuildID: buildID, TaskExecution: execution}).UploadTestMetadata(ctx, tracer))
+		_, err := InsertLogLines(ctx, tracer, buildID, testIDs[i], []LogLineItem{
+			{Timestamp: start.Add(time.Duration(i)*time.Second + 100*time.Millisecond), Data: fmt.Sprintf("test%d", i)},
+		}, 4*1024*1024)
+		require.NoError(t, err)
+	}
+	_, err := InsertLogLines(ctx, tracer, buildID, "", []LogLineItem{
+		{Timestamp: start.Add(50 * time.Millisecond), Data: "global execution 0", Global: true},
+		{Timestamp: start.Add(2*time.Second + 50*time.Millisecond), Data: "global execution 1", Global: true},
+	}, 4*1024*1024)
+	require.NoError(t, err)
+
+	execution := func(execution int) *int { return &execution }
+	for _, test := range []struct {
+		name          string
+		testID        string
+		opts          DownloadOptions
+		expectedLines []string
+	}{
+		{
+			name:          "NoExecution",
+			expectedLines: []string{"global execution 0", "test0", "test1", "global execution 1", "test2"},
+		},
+		{
+			name:          "AllLogsForEarlierExecution",
+			opts:          DownloadOptions{TaskExecution: execution(0)},
+			expectedLines: []string{"global execution 0", "test0", "test1"},
+		},
+		{
+			name:          "AllLogsForLatestExecution",
+			opts:          DownloadOptions{TaskExecution: execution(1)},
+			expectedLines: []string{"global execution 1", "test2"},
+		},
+		{
+			name: "AllLogsForMissingExecution",
+			opts: DownloadOptions{TaskExecution: execution(2)},
+		},
+		{
+			name:          "TestLogsForMatchingExecution",
+			testID:        testIDs[1],
+			opts:          DownloadOptions{TaskExecution: execution(0)},
+			expectedLines: []string{"test1"},
+		},
+		{
+			name:   "TestLogsForOtherExecution",
+			testID: testIDs[2],
+			opts:   DownloadOptions{TaskExecution: execution(0)},
+		},
+		{
+			name:          "Reverse",
+			opts:          DownloadOptions{Reverse: true},
+			expectedLines: []string{"test2", "global execution 1", "test1", "test0", "global execution 0"},
+		},
+		{
+			name:          "ReverseForExecution",
+			opts:          DownloadOptions{TaskExecution: execution(0), Reverse: true},
+			expectedLines: []string{"test1", "test0", "global execution 0"},
+		},
+		{
+			name:          "ReverseTestLogs",
+			testID:        testIDs[2],
+			opts:          DownloadOptions{Reverse: true},
+			expectedLines: []string{"test2", "global execution 1"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			logLines, err := DownloadLogLinesWithOptions(ctx, tracer, buildID, test.testID, test.opts)
+			require.NoError(t, err)
+
+			var lines []string
+			for item := range logLines {
+				lines = append(lines, item.Data)
+			}
+			assert.Equal(t, test.expectedLines, lines)
+		})
+	}
+}
+
+func TestDownloadLogLinesMissingTest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	defer testutil.SetBucket(t, "../testdata/overlapping")()
+
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	orphanID := NewTestID(time.Unix(1000000000, 0))
+	_, err := InsertLogLines(ctx, tracer, buildID, orphanID, []LogLineItem{
+		{Timestamp: time.Unix(0, 1000000000450000000), Data: "Orphan Log450"},
+		{Timestamp: time.Unix(0, 1000000000650000000), Data: "Orphan Log650"},
+	}, 4*1024*1024)
+	require.NoError(t, err)
+
+	for _, test := range []struct {
+		name          string
+		testID        string
+		policy        MissingTestPolicy
+		expectedLines []string
+	}{
+		{
+			name:   "NotFoundWithoutChunks",
+			testID: "DNE",
+			policy: MissingTestNotFound,
+		},
+		{
+			name:   "NotFoundWithChunks",
+			testID: orphanID,
+			policy: MissingTestNotFound,
+		},
+		{
+			name:   "OrphanedChunksWithoutChunks",
+			testID: "DNE",
+			policy: MissingTestOrphanedChunks,
+		},
+		{
+			name:          "OrphanedChunksWithChunks",
+			testID:        orphanID,
+			policy:        MissingTestOrphanedChunks,
+			expectedLines: []string{"Orphan Log450", "Orphan Log650"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			lines, err := DownloadLogLinesWithOptions(ctx, tracer, buildID, test.testID, DownloadOptions{MissingTest: test.policy})
+			if test.expectedLines == nil {
+				assert.True(t, errors.Is(err, ErrTestNotFound))
+				return
+			}
+			require.NoError(t, err)
+
+			var data []string
+			for line := range lines {
+				data = append(data, line.Data)
+			}
+			assert.Equal(t, test.expectedLines, data)
+		})
+	}
+}
+
+func TestFindLogLine(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	defer testutil.SetBucket(t, "../testdata/overlapping")()
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	bucket := &recordingGetBucket{Bucket: env.Bucket().Bucket}
+	require.NoError(t, env.SetBucket(&storage.Bucket{Bucket: bucket}))
+
+	for _, test := range []struct {
+		name         string
+		n            int
+		expectedData string
+		expectedKey  string
+	}{
+		{name: "FirstLine", n: 1, expectedData: "Log300", expectedKey: "1000000000300000000_1000000000500000000_10"},
+		{name: "LastLineOfFirstChunk", n: 10, expectedData: "Log500", expectedKey: "1000000000300000000_1000000000500000000_10"},
+		{name: "FirstLineOfSecondChunk", n: 11, expectedData: "Log501", expectedKey: "1000000000501000000_1000000000900000000_10"},
+		{name: "LastLine", n: 20, expectedData: "Log900", expectedKey: "1000000000501000000_1000000000900000000_10"},
+		{name: "PastLastLine", n: 21},
+		{name: "Zero", n: 0},
+		{name: "Negative", n: -1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			bucket.keys = nil
+
+			line, err := FindLogLine(ctx, tracer, buildID, test.n)
+			require.NoError(t, err)
+			if test.expectedData == "" {
+				assert.Nil(t, line)
+				assert.Empty(t, bucket.keys)
+				return
+			}
+			require.NotNil(t, line)
+			assert.Equal(t, test.expectedData, line.Data)
+			assert.True(t, line.Global)
+			assert.Equal(t, []string{fmt.Sprintf("builds/%s/%s", buildID, test.expectedKey)}, bucket.keys)
+		})
+	}
+}
+
+func TestFindLogLineRawPrefix(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	defer testutil.SetBucket(t, "")()
+
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	lines := []LogLineItem{
+		{Timestamp: time.Unix(1000000000, 300000000).UTC(), Data: "first"},
+		{Timestamp: time.Unix(1000000000, 400000000).UTC(), Data: "second\nthird"},
+	}
+	_, err := InsertLogLines(ctx, tracer, buildID, "", lines, 4*1024*1024)
+	require.NoError(t, err)
+
+	var expected []string
+	for _, line := range lines {
+		expected = append(expected, makeLogLineStrings(line)...)
+	}
+	require.Len(t, expected, 3)
+
+	for i, stored := range expected {
+		line, err := FindLogLineWithOptions(ctx, tracer, buildID, i+1, FindLogLineOptions{RawPrefix: true})
+		require.NoError(t, err)
+		require.NotNil(t, line)
+		assert.Equal(t, stored, line.Data)
+
+		parsed, err := FindLogLine(ctx, tracer, buildID, i+1)
+		require.NoError(t, err)
+		require.NotNil(t, parsed)
+		assert.Equal(t, parsed.Timestamp, line.Timestamp)
+		assert.Equal(t, stored[23:len(stored)-1], parsed.Data)
+	}
+}
+
+// recordingGetBucket records the keys it gets.
+type recordingGetBucket struct {
+	pail.Bucket
+	keys []string
+}
+
+func (b *recordingGetBucket) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	b.keys = append(b.keys, key)
+	return b.Bucket.Get(ctx, key)
+}
+
+func TestDownloadLogLinesTestWindowTolerance(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	defer testutil.SetBucket(t, "")()
+
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	start := time.Unix(1000000000, 0).UTC()
+	require.NoError(t, (&Build{ID: buildID}).UploadMetadata(ctx, tracer))
+	// The second test's start is logged by a host whose clock is a few
+	// milliseconds ahead of the one logging the first test's last build
+	// line.
+	firstTestID := NewTestID(start)
+	secondTestID := NewTestID(start.Add(98 * time.Millisecond))
+	for _, testID := range []string{firstTestID, secondTestID} {
+		require.NoError(t, (&Test{ID: testID, BuildID: buildID}).UploadTestMetadata(ctx, tracer))
+	}
+	buildLines := []LogLineItem{
+		{Timestamp: start.Add(50 * time.Millisecond), Data: "first test running", Global: true},
+		{Timestamp: start.Add(100 * time.Millisecond), Data: "first test finished", Global: true},
+		{Timestamp: start.Add(200 * time.Millisecond), Data: "second test running", Global: true},
+	}
+	_, err := InsertLogLinesWithOptions(ctx, tracer, buildID, "", buildLines, InsertOptions{MaxSize: 4 * 1024 * 1024})
+	require.NoError(t, err)
+
+	download := func(t *testing.T, testID string) []string {
+		logLines, err := DownloadLogLines(ctx, tracer, buildID, testID)
+		require.NoError(t, err)
+		var data []string
+		for line := range logLines {
+			data = append(data, line.Data)
+		}
+
+		count, err := CountLogLines(ctx, tracer, buildID, testID)
+		require.NoError(t, err)
+		assert.Equal(t, len(data), count)
+
+		return data
+	}
+
+	t.Run("NoTolerance", func(t *testing.T) {
+		assert.Equal(t, []string{"first test running"}, download(t, firstTestID))
+	})
+	t.Run("Tolerance", func(t *testing.T) {
+		env.SetTestWindowTolerance(5 * time.Millisecond)
+		defer env.SetTestWindowTolerance(0)
+
+		assert.Equal(t, []string{"first test running", "first test finished"}, download(t, firstTestID))
+		assert.Equal(t, []string{"first test finished", "second test running"}, download(t, secondTestID))
+	})
+}
+
+func TestCountLogLines(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	for _, storagePath := range []string{"../testdata/simple", "../testdata/between", "../testdata/overlapping", "../testdata/delayed", "../testdata/precision", "../testdata/nolines"} {
+		t.Run(filepath.Base(storagePath), func(t *testing.T) {
+			defer testutil.SetBucket(t, storagePath)()
+			bucket := &recordingGetBucket{Bucket: env.Bucket().Bucket}
+			require.NoError(t, env.SetBucket(&storage.Bucket{Bucket: bucket}))
+
+			testIDs, err := ListTestIDs(ctx, tracer, buildID)
+			require.NoError(t, err)
+			for _, testID := range append([]string{""}, testIDs...) {
+				logLines, err := DownloadLogLines(ctx, tracer, buildID, testID)
+				require.NoError(t, err)
+				expected := 0
+				for range logLines {
+					expected++
+				}
+
+				bucket.keys = nil
+				count, err := CountLogLines(ctx, tracer, buildID, testID)
+				require.NoError(t, err)
+				assert.Equal(t, expected, count, "test '%s'", testID)
+				for _, key := range bucket.keys {
+					assert.NotContains(t, key, "/tests/", "test chunks should never be read")
+				}
+				if testID == "" {
+					assert.Empty(t, bucket.keys, "no chunks should be read for all logs")
+				}
+			}
+		})
+	}
+	t.Run("NonexistentBuild", func(t *testing.T) {
+		defer testutil.SetBucket(t, "../testdata/simple")()
+
+		_, err := CountLogLines(ctx, tracer, "DNE", "")
+		assert.True(t, errors.Is(err, ErrNoBuildKeys))
+	})
+}
+
+func TestBuildManifest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	defer testutil.SetBucket(t, "../testdata/overlapping")()
+
+	manifest, err := BuildManifest(ctx, tracer, "5a75f537726934e4b62833ab6d5dca41")
+	require.NoError(t, err)
+	require.Len(t, manifest, 4)
+
+	var offset int64
+	for i, chunk := range manifest {
+		if i > 0 {
+			assert.False(t, chunk.Start.Before(manifest[i-1].Start), "chunk %d is out of order", i)
+		}
+		assert.Equal(t, offset, chunk.Offset)
+		assert.Equal(t, strings.Contains(chunk.Key, "/tests/"), chunk.TestID != "")
+		assert.Equal(t, 10, chunk.NumLines)
+
+		r, err := env.Bucket().Get(ctx, chunk.Key)
+		require.NoError(t, err)
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+		assert.EqualValues(t, len(data), chunk.Size)
+		hash := sha256.Sum256(data)
+		assert.Equal(t, hex.EncodeToString(hash[:]), chunk.Hash)
+
+		offset += chunk.Size
+	}
+
+	manifest, err = BuildManifest(ctx, tracer, "DNE")
+	require.NoError(t, err)
+	assert.Empty(t, manifest)
+}
+
+func TestGetLogChunk(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	defer testutil.SetBucket(t, "../testdata/overlapping")()
+
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	manifest, err := BuildManifest(ctx, tracer, buildID)
+	require.NoError(t, err)
+	require.NotEmpty(t, manifest)
+
+	t.Run("ManifestChunks", func(t *testing.T) {
+		for _, manifestChunk := range manifest {
+			chunk, err := GetLogChunk(ctx, tracer, buildID, manifestChunk.Key)
+			require.NoError(t, err)
+			require.NotNil(t, chunk)
+			assert.Equal(t, manifestChunk.Key, chunk.Key)
+			assert.EqualValues(t, manifestChunk.Size, len(chunk.Data))
+			assert.Equal(t, manifestChunk.Hash, chunk.Hash)
+		}
+	})
+	t.Run("NotAChunk", func(t *testing.T) {
+		for _, key := range []string{
+			"",
+			metadataKeyForBuild(buildID),
+			strings.TrimSuffix(manifest[0].Key, "_10"),
+			strings.Replace(manifest[0].Key, buildID, "DNE", 1),
+			manifest[0].Key + "0",
+		} {
+			chunk, err := GetLogChunk(ctx, tracer, buildID, key)
+			require.NoError(t, err, key)
+			assert.Nil(t, chunk, key)
+		}
+	})
+	t.Run("WrongBuild", func(t *testing.T) {
+		chunk, err := GetLogChunk(ctx, tracer, "DNE", manifest[0].Key)
+		require.NoError(t, err)
+		assert.Nil(t, chunk)
+	})
+}
+
+func TestSummarizeBuild(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+
+	t.Run("Legacy", func(t *testing.T) {
+		defer testutil.SetBucket(t, "../testdata/overlapping")()
+
+		summary, err := SummarizeBuild(ctx, tracer, buildID)
+		require.NoError(t, err)
+		require.NotNil(t, summary)
+		assert.Equal(t, buildID, summary.Build.ID)
+		assert.Equal(t, 1, summary.NumTests)
+
+		count, err := CountLogLines(ctx, tracer, buildID, "")
+		require.NoError(t, err)
+		assert.Equal(t, count, summary.NumLines)
+		assert.Equal(t, time.Unix(0, 1000000000300000000).UTC(), summary.TimeRange.StartAt)
+		assert.Equal(t, time.Unix(0, 1000000000900000000).UTC(), summary.TimeRange.EndAt)
+
+		// Neither the build nor its test has a recorded size.
+		assert.Zero(t, summary.TotalBytes)
+		assert.Equal(t, 4, summary.UnsizedChunks)
+
+		_, err = RepairLineCounts(ctx, tracer, buildID)
+		require.NoError(t, err)
+		summary, err = SummarizeBuild(ctx, tracer, buildID)
+		require.NoError(t, err)
+		manifest, err := BuildManifest(ctx, tracer, buildID)
+		require.NoError(t, err)
+		var totalSize int64
+		for _, chunk := range manifest {
+			totalSize += chunk.Size
+		}
+		assert.Equal(t, totalSize, summary.TotalBytes)
+		assert.Zero(t, summary.UnsizedChunks)
+	})
+	t.Run("RecordedOnInsert", func(t *testing.T) {
+		defer testutil.SetBucket(t, "")()
+		start := time.Unix(1000000000, 0).UTC()
+		testID := NewTestID(start)
+		require.NoError(t, (&Build{ID: buildID}).UploadMetadata(ctx, tracer))
+		require.NoError(t, (&Test{ID: testID, BuildID: buildID}).UploadTestMetadata(ctx, tracer))
+
+		buildResult, err := InsertLogLinesWithLineLimit(ctx, tracer, buildID, "", []LogLineItem{{Timestamp: start, Data: "line0"}, {Timestamp: start.Add(time.Second), Data: "line1"}}, 1024, 1)
+		require.NoError(t, err)
+		testResult, err := InsertLogLines(ctx, tracer, buildID, testID, []LogLineItem{{Timestamp: start.Add(2 * time.Second), Data: "line2"}}, 1024)
+		require.NoError(t, err)
+
+		summary, err := SummarizeBuild(ctx, tracer, buildID)
+		require.NoError(t, err)
+		require.NotNil(t, summary)
+		assert.Equal(t, 3, summary.NumLines)
+		assert.Equal(t, buildResult.Bytes+testResult.Bytes, summary.TotalBytes)
+		assert.Zero(t, summary.UnsizedChunks)
+	})
+	t.Run("BuildDNE", func(t *testing.T) {
+		defer testutil.SetBucket(t, "")()
+
+		summary, err := SummarizeBuild(ctx, tracer, "DNE")
+		require.NoError(t, err)
+		assert.Nil(t, summary)
+	})
+}
+
+func TestInsertLogLinesFromReader(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	start := time.Unix(1000000000, 0).UTC()
+	writeLines := func(w io.Writer, first, last int) {
+		for i := first; i < last; i++ {
+			if i > 0 {
+				_, _ = io.WriteString(w, ",")
+			}
+			_, _ = fmt.Fprintf(w, `[%d.%03d, "line %d"]`, start.Unix()+int64(i/1000), i%1000, i)
+		}
+	}
+	setup := func(t *testing.T) (string, string) {
+		buildID := "5a75f537726934e4b62833ab6d5dca41"
+		testID := NewTestID(start)
+		require.NoError(t, (&Build{ID: buildID}).UploadMetadata(ctx, tracer))
+		require.NoError(t, (&Test{ID: testID, BuildID: buildID}).UploadTestMetadata(ctx, tracer))
+		return buildID, testID
+	}
+	downloadLines := func(t *testing.T, buildID, testID string) []string {
+		lines, err := DownloadLogLines(ctx, tracer, buildID, testID)
+		require.NoError(t, err)
+		var data []string
+		for line := range lines {
+			data = append(data, line.Data)
+		}
+		return data
+	}
+	opts := InsertOptions{MaxSize: 4 * 1024 * 1024, MaxLines: 100}
+
+	t.Run("MultipleChunks", func(t *testing.T) {
+		defer testutil.SetBucket(t, "")()
+		buildID, testID := setup(t)
+
+		// The chunks of the lines written so far are stored before
+		// the rest of the array is written.
+		r, w := io.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			_, _ = io.WriteString(w, "[")
+			writeLines(w, 0, 250)
+			assert.Eventually(t, func() bool {
+				// The test's metadata and two full chunks.
+				keys, err := listBuildKeys(ctx, buildID, testSubPrefix(testID))
+				return assert.NoError(t, err) && len(keys) == 3
+			}, 10*time.Second, 10*time.Millisecond)
+			writeLines(w, 250, 1000)
+			_, _ = io.WriteString(w, "]")
+			_ = w.Close()
+		}()
+
+		result, err := InsertLogLinesFromReader(ctx, tracer, buildID, testID, r, opts)
+		<-done
+		require.NoError(t, err)
+		assert.Equal(t, 10, result.Chunks)
+
+		data := downloadLines(t, buildID, testID)
+		require.Len(t, data, 1000)
+		for i, line := range data {
+			assert.Equal(t, fmt.Sprintf("line %d", i), line)
+		}
+		test, err := FindTestByID(ctx, tracer, buildID, testID)
+		require.NoError(t, err)
+		require.NotNil(t, test)
+		assert.Equal(t, 1000, test.NumLines)
+	})
+	t.Run("MidStreamError", func(t *testing.T) {
+		defer testutil.SetBucket(t, "")()
+		buildID, testID := setup(t)
+
+		var body bytes.Buffer
+		body.WriteString("[")
+		writeLines(&body, 0, 250)
+		body.WriteString(`, "not a line"]`)
+
+		result, err := InsertLogLinesFromReader(ctx, tracer, buildID, testID, &body, opts)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "after storing 2 chunks")
+		assert.Equal(t, 2, result.Chunks)
+
+		assert.Len(t, downloadLines(t, buildID, testID), 200)
+		test, err := FindTestByID(ctx, tracer, buildID, testID)
+		require.NoError(t, err)
+		require.NotNil(t, test)
+		assert.Equal(t, 200, test.NumLines)
+	})
+	t.Run("SortUnsupported", func(t *testing.T) {
+		defer testutil.SetBucket(t, "")()
+		buildID, testID := setup(t)
+
+		result, err := InsertLogLinesFromReader(ctx, tracer, buildID, testID, strings.NewReader(`[[1000000000, "line"]]`), InsertOptions{MaxSize: 1024, OutOfOrder: OutOfOrderSort})
+		assert.Error(t, err)
+		assert.Zero(t, result.Chunks)
+	})
+}
+
+func TestCheckLineSequence(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	defer testutil.SetBucket(t, "")()
+
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	start := time.Unix(1000000000, 0).UTC()
+	testID := NewTestID(start)
+	require.NoError(t, (&Build{ID: buildID}).UploadMetadata(ctx, tracer))
+	require.NoError(t, (&Test{ID: testID, BuildID: buildID}).UploadTestMetadata(ctx, tracer))
+	makeLines := func(first, last int64) []LogLineItem {
+		var lines []LogLineItem
+		for i := first; i <= last; i++ {
+			sequence := i
+			lines = append(lines, LogLineItem{
+				Timestamp: start.Add(time.Duration(i) * time.Second),
+				// Split lines are stored as several lines with
+				// the same sequence number.
+				Data:     fmt.Sprintf("line %d\nsplit", i),
+				Sequence: &sequence,
+			})
+		}
+		return lines
+	}
+	_, err := InsertLogLinesWithLineLimit(ctx, tracer, buildID, testID, makeLines(0, 4), 4*1024*1024, 4)
+	require.NoError(t, err)
+	_, err = InsertLogLinesWithLineLimit(ctx, tracer, buildID, "", makeLines(5, 9), 4*1024*1024, 4)
+	require.NoError(t, err)
+
+	t.Run("Contiguous", func(t *testing.T) {
+		report, err := CheckLineSequence(ctx, tracer, buildID)
+		require.NoError(t, err)
+		require.NotNil(t, report)
+		assert.Equal(t, 10, report.NumSequenced)
+		assert.Zero(t, report.NumUnsequenced)
+		assert.Empty(t, report.Gaps)
+		assert.Empty(t, report.Duplicates)
+	})
+	t.Run("MissingChunk", func(t *testing.T) {
+		buildKeys, err := listBuildKeys(ctx, buildID, "")
+		require.NoError(t, err)
+		buildChunks, _, err := parseLogChunks(buildKeys)
+		require.NoError(t, err)
+		require.Len(t, buildChunks, 3)
+		require.NoError(t, env.Bucket().Remove(ctx, buildChunks[1].key()))
+
+		report, err := CheckLineSequence(ctx, tracer, buildID)
+		require.NoError(t, err)
+		require.NotNil(t, report)
+		assert.Equal(t, 8, report.NumSequenced)
+		assert.Equal(t, []SequenceRange{{Start: 7, End: 8}}, report.Gaps)
+		assert.Empty(t, report.Duplicates)
+	})
+	t.Run("Duplicates", func(t *testing.T) {
+		lines := append(makeLines(2, 3), LogLineItem{Timestamp: start.Add(time.Minute), Data: "unsequenced"})
+		_, err := InsertLogLines(ctx, tracer, buildID, "", lines, 4*1024*1024)
+		require.NoError(t, err)
+
+		report, err := CheckLineSequence(ctx, tracer, buildID)
+		require.NoError(t, err)
+		require.NotNil(t, report)
+		assert.Equal(t, 10, report.NumSequenced)
+		assert.Equal(t, 1, report.NumUnsequenced)
+		assert.Equal(t, []SequenceRange{{Start: 7, End: 8}}, report.Gaps)
+		assert.Equal(t, []SequenceRange{{Start: 2, End: 3}}, report.Duplicates)
+	})
+	t.Run("BuildDNE", func(t *testing.T) {
+		report, err := CheckLineSequence(ctx, tracer, "DNE")
+		require.NoError(t, err)
+		assert.Nil(t, report)
+	})
+}
+
+func TestDownloadLogLinesOperationStats(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	defer testutil.SetBucket(t, "../testdata/overlapping")()
+	storage.FlushOperationStats()
+
+	lines, err := DownloadLogLines(ctx, tracer, "5a75f537726934e4b62833ab6d5dca41", "")
+	require.NoError(t, err)
+	for range lines {
+	}
+
+	stats := storage.FlushOperationStats()
+	assert.Equal(t, 1, stats[storage.OperationList].Count)
+	assert.Equal(t, 4, stats[storage.OperationGet].Count)
+	assert.Zero(t, stats[storage.OperationPut].Count)
+}
+
+func TestDownloadLogLinesChunkSpans(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test_tracer")
+	defer testutil.SetBucket(t, "../testdata/overlapping")()
+
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	lines, err := DownloadLogLines(ctx, tracer, buildID, "")
+	require.NoError(t, err)
+	for range lines {
+	}
+
+	var downloadSpan sdktrace.ReadOnlySpan
+	var chunkSpans []sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		switch span.Name() {
+		case "DownloadLogLines":
+			downloadSpan = span
+		case "GetLogChunk":
+			chunkSpans = append(chunkSpans, span)
+		}
+	}
+	require.NotNil(t, downloadSpan)
+	require.Len(t, chunkSpans, 4)
+
+	var keys []string
+	for _, span := range chunkSpans {
+		assert.Equal(t, downloadSpan.SpanContext().SpanID(), span.Parent().SpanID())
+
+		attrs := map[attribute.Key]attribute.Value{}
+		for _, attr := range span.Attributes() {
+			attrs[attr.Key] = attr.Value
+		}
+		require.Contains(t, attrs, attribute.Key(chunkKeyAttribute))
+		keys = append(keys, attrs[chunkKeyAttribute].AsString())
+
+		chunkBytes, err := env.Bucket().Get(ctx, attrs[chunkKeyAttribute].AsString())
+		require.NoError(t, err)
+		data, err := io.ReadAll(chunkBytes)
+		require.NoError(t, err)
+		require.NoError(t, chunkBytes.Close())
+		assert.EqualValues(t, len(data), attrs[chunkBytesAttribute].AsInt64())
+	}
+	assert.ElementsMatch(t, []string{
+		fmt.Sprintf("builds/%s/1000000000300000000_1000000000500000000_10", buildID),
+		fmt.Sprintf("builds/%s/1000000000501000000_1000000000900000000_10", buildID),
+		fmt.Sprintf("builds/%s/tests/0de0b6b3bf3b84000000000000000000/1000000000400000000_1000000000600000000_10", buildID),
+		fmt.Sprintf("builds/%s/tests/0de0b6b3bf3b84000000000000000000/1000000000601000000_1000000000800000000_10", buildID),
+	}, keys)
+}
+
+func TestDownloadLogLinesBestEffort(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	failedKey := fmt.Sprintf("builds/%s/1000000000501000000_1000000000900000000_10", buildID)
+
+	for _, test := range []struct {
+		name    string
+		failGet bool
+		reverse bool
+	}{
+		{name: "GetFails", failGet: true},
+		{name: "ReadFails"},
+		{name: "Reversed", failGet: true, reverse: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			defer testutil.SetBucket(t, "../testdata/overlapping")()
+			bucket := &failingGetBucket{Bucket: env.Bucket().Bucket, failKey: failedKey, failGet: test.failGet}
+			require.NoError(t, env.SetBucket(&storage.Bucket{Bucket: bucket}))
+
+			download := func(opts DownloadOptions) []LogLineItem {
+				opts.Reverse = test.reverse
+				logLines, err := DownloadLogLinesWithOptions(ctx, tracer, buildID, "", opts)
+				require.NoError(t, err)
+				var result []LogLineItem
+				for line := range logLines {
+					result = append(result, *line)
+				}
+				return result
+			}
+
+			lines := download(DownloadOptions{})
+			assert.Less(t, len(lines), 30)
+
+			lines = download(DownloadOptions{BestEffort: true})
+			expectedLines := 31
+			if !test.failGet {
+				// The line read before the failure is kept.
+				expectedLines++
+			}
+			require.Len(t, lines, expectedLines)
+			last := lines[len(lines)-1]
+			assert.Equal(t, "[WARNING: 1 chunks failed to load]", last.Data)
+			assert.True(t, last.Global)
+			for _, line := range lines[:len(lines)-1] {
+				assert.NotContains(t, line.Data, "WARNING")
+			}
+		})
+	}
+	t.Run("NoFailures", func(t *testing.T) {
+		defer testutil.SetBucket(t, "../testdata/overlapping")()
+
+		logLines, err := DownloadLogLinesWithOptions(ctx, tracer, buildID, "", DownloadOptions{BestEffort: true})
+		require.NoError(t, err)
+		var numLines int
+		for range logLines {
+			numLines++
+		}
+		assert.Equal(t, 40, numLines)
+	})
+}
+
+// failingGetBucket fails to load the given key, either when getting it or,
+// after the first line, when reading it.
+type failingGetBucket struct {
+	pail.Bucket
+	failKey string
+	failGet bool
+}
+
+func (b *failingGetBucket) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if key == b.failKey && b.failGet {
+		return nil, errors.New("injected get failure")
+	}
+	r, err := b.Bucket.Get(ctx, key)
+	if err != nil || key != b.failKey {
+		return r, err
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	firstLine := data[:bytes.IndexByte(data, '\n')+1]
+
+	return io.NopCloser(io.MultiReader(bytes.NewReader(firstLine), iotest.ErrReader(errors.New("injected read failure")))), r.Close()
+}
+
+func TestDownloadLogLinesKeyErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	defer testutil.SetBucket(t, "../testdata/simple")()
+
+	t.Run("NoKeys", func(t *testing.T) {
+		_, err := DownloadLogLines(ctx, tracer, "DNE", "")
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, ErrNoBuildKeys))
+		assert.False(t, errors.Is(err, ErrListFailed))
+	})
+	t.Run("ListFails", func(t *testing.T) {
+		bucket := env.Bucket()
+		defer func() { require.NoError(t, env.SetBucket(bucket)) }()
+		require.NoError(t, env.SetBucket(&storage.Bucket{Bucket: failingListBucket{bucket.Bucket}}))
+
+		_, err := DownloadLogLines(ctx, tracer, "5a75f537726934e4b62833ab6d5dca41", "")
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, ErrListFailed))
+		assert.False(t, errors.Is(err, ErrNoBuildKeys))
+	})
+}
+
+// failingListBucket fails to list any keys.
+type failingListBucket struct {
+	pail.Bucket
+}
+
+func (b failingListBucket) List(context.Context, string) (pail.BucketIterator, error) {
+	return nil, errors.New("injected list failure")
+}
+
+func TestDownloadLogLinesWithByteLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	defer testutil.SetBucket(t, "../testdata/delayed")()
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+
+	for _, test := range []struct {
+		name          string
+		maxBytes      int
+		expectedLines []string
+	}{
+		{
+			name:          "Unlimited",
+			maxBytes:      0,
+			expectedLines: []string{"Log401", "Log402", "Test Log403", "Test Log404"},
+		},
+		{
+			name:          "LargerThanContent",
+			maxBytes:      1024,
+			expectedLines: []string{"Log401", "Log402", "Test Log403", "Test Log404"},
+		},
+		{
+			name:          "EqualToContent",
+			maxBytes:      34,
+			expectedLines: []string{"Log401", "Log402", "Test Log403", "Test Log404"},
+		},
+		{
+			name:          "SmallerThanContent",
+			maxBytes:      20,
+			expectedLines: []string{"Log401", "Log402", fmt.Sprintf(byteLimitTruncationMarker, 12)},
+		},
+		{
+			name:          "SmallerThanFirstLine",
+			maxBytes:      1,
+			expectedLines: []string{fmt.Sprintf(byteLimitTruncationMarker, 0)},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			lines, err := DownloadLogLinesWithByteLimit(ctx, tracer, buildID, "", test.maxBytes)
+			require.NoError(t, err)
+
+			var data []string
+			for line := range lines {
+				data = append(data, line.Data)
+			}
+			assert.Equal(t, test.expectedLines, data)
+		})
+	}
+}
+
+func TestDownloadLogLinesAfter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	defer testutil.SetBucket(t, "../testdata/overlapping")()
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+
+	download := func(t *testing.T, testID string, after *time.Time) []LogLineItem {
+		logLines, err := DownloadLogLinesWithOptions(ctx, tracer, buildID, testID, DownloadOptions{After: after})
+		require.NoError(t, err)
+		var result []LogLineItem
+		for line := range logLines {
+			result = append(result, *line)
+		}
+		return result
+	}
+	allLines := download(t, "", nil)
+	require.Len(t, allLines, 40)
+	linesAfter := func(after time.Time) []LogLineItem {
+		var result []LogLineItem
+		for _, line := range allLines {
+			if line.Timestamp.After(after) {
+				result = append(result, line)
+			}
+		}
+		return result
+	}
+
+	t.Run("BeforeAllLines", func(t *testing.T) {
+		after := allLines[0].Timestamp.Add(-time.Nanosecond)
+		assert.Equal(t, allLines, download(t, "", &after))
+	})
+	t.Run("AtFirstLine", func(t *testing.T) {
+		after := allLines[0].Timestamp
+		assert.Equal(t, allLines[1:], download(t, "", &after))
+	})
+	t.Run("BetweenChunks", func(t *testing.T) {
+		after := allLines[20].Timestamp
+		lines := download(t, "", &after)
+		assert.Equal(t, linesAfter(after), lines)
+		require.NotEmpty(t, lines)
+		assert.True(t, lines[0].Timestamp.After(after))
+	})
+	t.Run("AtLastLine", func(t *testing.T) {
+		after := allLines[len(allLines)-1].Timestamp
+		assert.Empty(t, download(t, "", &after))
+	})
+	t.Run("InTheFuture", func(t *testing.T) {
+		after := time.Now().Add(time.Hour)
+		assert.Empty(t, download(t, "", &after))
+	})
+}
+
+func TestByteLimitIterator(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lines := []LogLineItem{
+		{Timestamp: time.Unix(1, 0), Data: "aaaa"},
+		{Timestamp: time.Unix(2, 0), Data: "bbbb"},
+		{Timestamp: time.Unix(3, 0), Data: "cccc"},
+	}
+
+	t.Run("ClosesUnderlyingIteratorOnTruncation", func(t *testing.T) {
+		underlying := &sliceLogIterator{lines: lines}
+		it := NewByteLimitIterator(underlying, 6)
+
+		require.True(t, it.Next(ctx))
+		assert.Equal(t, lines[0], it.Item())
+		require.True(t, it.Next(ctx))
+		assert.Equal(t, fmt.Sprintf(byteLimitTruncationMarker, 4), it.Item().Data)
+		assert.Equal(t, lines[1].Timestamp, it.Item().Timestamp)
+		assert.True(t, underlying.closed)
+
+		assert.False(t, it.Next(ctx))
+		assert.True(t, it.Exhausted())
+		assert.NoError(t, it.Err())
+		assert.NoError(t, it.Close())
+	})
+	t.Run("LeavesUnderlyingIteratorOpenWithinBudget", func(t *testing.T) {
+		underlying := &sliceLogIterator{lines: lines}
+		it := NewByteLimitIterator(underlying, 12)
+
+		var count int
+		for it.Next(ctx) {
+			assert.Equal(t, lines[count], it.Item())
+			count++
+		}
+		assert.Equal(t, len(lines), count)
+		assert.False(t, underlying.closed)
+		assert.NoError(t, it.Close())
+		assert.True(t, underlying.closed)
+	})
+}
+
+func TestANSIStripIterator(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, test := range []struct {
+		name     string
+		data     string
+		expected string
+	}{
+		{name: "Plain", data: "no escapes", expected: "no escapes"},
+		{name: "Color", data: "\x1b[31merror\x1b[0m: failed", expected: "error: failed"},
+		{name: "BoldColor", data: "\x1b[1;32mPASS\x1b[m test", expected: "PASS test"},
+		{name: "CursorMovement", data: "progress\x1b[2K\x1b[1Adone", expected: "progressdone"},
+		{name: "WindowTitle", data: "\x1b]0;title\x07text", expected: "text"},
+		{name: "Hyperlink", data: "\x1b]8;;https://example.com\x1b\\link\x1b]8;;\x1b\\", expected: "link"},
+		{name: "TwoCharacterEscape", data: "\x1bMline", expected: "line"},
+		{name: "OnlyEscapes", data: "\x1b[0m\x1b[K", expected: ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			line := LogLineItem{Timestamp: time.Unix(1, 0), Data: test.data, Global: true}
+			it := newANSIStripIterator(&sliceLogIterator{lines: []LogLineItem{line}})
+
+			require.True(t, it.Next(ctx))
+			assert.Equal(t, test.expected, it.Item().Data)
+			assert.Equal(t, line.Timestamp, it.Item().Timestamp)
+			assert.True(t, it.Item().Global)
+			assert.False(t, it.Next(ctx))
+			assert.NoError(t, it.Err())
+			assert.NoError(t, it.Close())
+		})
+	}
+}
+
+func TestMergingIteratorTieBreak(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	t0 := time.Unix(1000000000, 0).UTC()
+	t1 := t0.Add(time.Millisecond)
+	newIterators := func() []LogIterator {
+		return []LogIterator{
+			&sliceLogIterator{lines: []LogLineItem{
+				{Timestamp: t0, Data: "global0 t0", Global: true},
+				{Timestamp: t1, Data: "global0 t1", Global: true},
+			}},
+			&sliceLogIterator{lines: []LogLineItem{
+				{Timestamp: t0, Data: "test1 t0"},
+				{Timestamp: t1, Data: "test1 t1"},
+			}},
+			&sliceLogIterator{lines: []LogLineItem{
+				{Timestamp: t1, Data: "global2 t1", Global: true},
+			}},
+			&sliceLogIterator{lines: []LogLineItem{
+				{Timestamp: t0, Data: "test3 t0"},
+				{Timestamp: t1, Data: "test3 t1"},
+			}},
+		}
+	}
+	expected := []string{
+		"global0 t0",
+		"test1 t0",
+		"test3 t0",
+		"global0 t1",
+		"global2 t1",
+		"test1 t1",
+		"test3 t1",
+	}
+	readAll := func(t *testing.T, it LogIterator) []string {
+		var data []string
+		for it.Next(ctx) {
+			data = append(data, it.Item().Data)
+		}
+		require.NoError(t, it.Err())
+
+		return data
+	}
+
+	t.Run("Forward", func(t *testing.T) {
+		assert.Equal(t, expected, readAll(t, NewMergingIterator(newIterators()...)))
+	})
+	t.Run("Reverse", func(t *testing.T) {
+		var reversed []string
+		for i := len(expected) - 1; i >= 0; i-- {
+			reversed = append(reversed, expected[i])
+		}
+		assert.Equal(t, reversed, readAll(t, NewMergingIterator(newIterators()...).Reverse()))
+	})
+}
+
+func TestMergingIteratorLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	env.SetMaxMergeIterators(3)
+	defer env.SetMaxMergeIterators(env.DefaultMaxMergeIterators)
+
+	t0 := time.Unix(1000000000, 0).UTC()
+	newIterators := func(n int) []LogIterator {
+		var iterators []LogIterator
+		for i := 0; i < n; i++ {
+			iterators = append(iterators, &sliceLogIterator{lines: []LogLineItem{
+				{Timestamp: t0.Add(time.Duration(i) * time.Millisecond), Data: fmt.Sprintf("line%d", i)},
+			}})
+		}
+		return iterators
+	}
+	readAll := func(it LogIterator) []string {
+		var data []string
+		for it.Next(ctx) {
+			data = append(data, it.Item().Data)
+		}
+		return data
+	}
+
+	t.Run("UnderLimit", func(t *testing.T) {
+		it := NewMergingIterator(newIterators(2)...)
+		assert.Equal(t, []string{"line0", "line1"}, readAll(it))
+		assert.NoError(t, it.Err())
+		assert.NoError(t, it.Close())
+	})
+	t.Run("AtLimit", func(t *testing.T) {
+		it := NewMergingIterator(newIterators(3)...)
+		assert.Equal(t, []string{"line0", "line1", "line2"}, readAll(it))
+		assert.NoError(t, it.Err())
+		assert.NoError(t, it.Close())
+	})
+	t.Run("OverLimit", func(t *testing.T) {
+		iterators := newIterators(4)
+		it := NewMergingIterator(iterators...)
+		assert.Empty(t, readAll(it))
+		assert.ErrorIs(t, it.Err(), ErrTooManyIterators)
+		for _, iterator := range iterators {
+			assert.Zero(t, iterator.(*sliceLogIterator).index, "iterator was read")
+		}
+		assert.NoError(t, it.Close())
+	})
+	t.Run("OverLimitReversed", func(t *testing.T) {
+		it := NewMergingIterator(newIterators(4)...).Reverse()
+		assert.Empty(t, readAll(it))
+		assert.ErrorIs(t, it.Err(), ErrTooManyIterators)
+	})
+	t.Run("NoLimit", func(t *testing.T) {
+		env.SetMaxMergeIterators(0)
+		defer env.SetMaxMergeIterators(3)
+
+		it := NewMergingIterator(newIterators(10)...)
+		assert.Len(t, readAll(it), 10)
+		assert.NoError(t, it.Err())
+	})
+}
+
+// sliceLogIterator is a LogIterator over an in-memory slice of lines.
+type sliceLogIterator struct {
+	lines   []LogLineItem
+	index   int
+	current LogLineItem
+	closed  bool
+	reverse bool
+}
+
+func (i *sliceLogIterator) Next(_ context.Context) bool {
+	if i.closed || i.index >= len(i.lines) {
+		return false
+	}
+	i.current = i.lines[i.index]
+	i.index++
+
+	return true
+}
+
+func (i *sliceLogIterator) Exhausted() bool   { return i.index >= len(i.lines) }
+func (i *sliceLogIterator) Err() error        { return nil }
+func (i *sliceLogIterator) Close() error      { i.closed = true; return nil }
+func (i *sliceLogIterator) Item() LogLineItem { return i.current }
+func (i *sliceLogIterator) IsReversed() bool  { return i.reverse }
+func (i *sliceLogIterator) Reverse() LogIterator {
+	lines := make([]LogLineItem, 0, len(i.lines))
+	for j := len(i.lines) - 1; j >= 0; j-- {
+		lines = append(lines, i.lines[j])
+	}
+
+	return &sliceLogIterator{lines: lines, reverse: !i.reverse}
+}
+func (i *sliceLogIterator) Stream(ctx context.Context) chan *LogLineItem {
+	return streamFromLogIterator(ctx, i)
+}
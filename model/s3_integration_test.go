@@ -0,0 +1,34 @@
+//go:build s3integration
+
+package model
+
+import (
+	"os"
+	"testing"
+
+	"github.com/evergreen-ci/logkeeper/env"
+	"github.com/evergreen-ci/logkeeper/storage"
+	"github.com/stretchr/testify/require"
+)
+
+// TestIntegrationS3Bucket runs the ingestion to retrieval tests against the
+// real S3 bucket named by LK_S3_LOGS_BUCKET, using the same credentials as
+// the service.
+func TestIntegrationS3Bucket(t *testing.T) {
+	if os.Getenv("LK_S3_LOGS_BUCKET") == "" {
+		t.Skip("LK_S3_LOGS_BUCKET is not set")
+	}
+
+	originalBucket := env.Bucket()
+	bucket, err := storage.NewBucket(storage.BucketOpts{Location: storage.PailS3})
+	require.NoError(t, err)
+	require.NoError(t, env.SetBucket(&bucket))
+	defer func() {
+		if originalBucket != nil {
+			require.NoError(t, env.SetBucket(originalBucket))
+		}
+	}()
+
+	testIngestionToRetrieval(t)
+	testFixtureParity(t)
+}
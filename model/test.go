@@ -30,6 +30,21 @@ type Test struct {
 	TaskExecution int    `json:"execution"`
 	Phase         string `json:"phase"`
 	Command       string `json:"command"`
+	NumLines      int    `json:"num_lines"`
+	// TotalBytes is the total size of the test's log chunks. For legacy
+	// tests whose size was never recorded, it's summed from the chunks
+	// until RepairLineCounts records it.
+	TotalBytes int64 `json:"total_bytes"`
+}
+
+// testMetadata is used to decode stored test metadata while detecting whether
+// the line count and total size were ever recorded, since legacy metadata
+// predates them. An unknown total size is omitted when encoding so that it
+// stays unknown.
+type testMetadata struct {
+	Test
+	NumLines   *int   `json:"num_lines"`
+	TotalBytes *int64 `json:"total_bytes,omitempty"`
 }
 
 // NewTestID returns a new TestID with it's timestamp set to startTime.
@@ -60,13 +75,34 @@ func (t *Test) toJSON() ([]byte, error) {
 }
 
 // UploadTestMetadata uploads metadata for a new test to the pail-backed
-// offline storage.
+// offline storage. It holds the build lock so that it doesn't race with
+// appends rewriting the test's line count.
 func (t *Test) UploadTestMetadata(ctx context.Context, tracer otelTrace.Tracer) error {
-	_, span := tracer.Start(ctx, "UploadTestMetadata")
+	ctx, span := tracer.Start(ctx, "UploadTestMetadata")
 	defer span.End()
+
+	unlock, err := lockBuild(ctx, t.BuildID)
+	if err != nil {
+		return err
+	}
+	defer logUnlockError(unlock, t.BuildID)
+
+	if err = reserveLockedChunkManifestKeys(ctx, t.BuildID, t.key()); err != nil {
+		return errors.Wrapf(err, "reserving test '%s' in chunk manifest", t.ID)
+	}
+	if err = t.uploadTestMetadata(ctx); err != nil {
+		return err
+	}
+
+	return errors.Wrapf(addToLockedChunkManifest(ctx, t.BuildID, t.key()), "adding test '%s' to chunk manifest", t.ID)
+}
+
+// uploadTestMetadata uploads the test's metadata without adding it to the
+// build's chunk manifest, for callers that already hold the build lock.
+func (t *Test) uploadTestMetadata(ctx context.Context) error {
 	data, err := t.toJSON()
 	if err != nil {
-		return nil
+		return err
 	}
 
 	return errors.Wrapf(env.Bucket().Put(ctx, t.key(), bytes.NewReader(data)), "uploading metadata for test '%s'", t.ID)
@@ -77,20 +113,153 @@ func (t *Test) UploadTestMetadata(ctx context.Context, tracer otelTrace.Tracer)
 func FindTestByID(ctx context.Context, tracer otelTrace.Tracer, buildID string, testID string) (*Test, error) {
 	_, span := tracer.Start(ctx, "FindTestByID")
 	defer span.End()
-	reader, err := env.Bucket().Get(ctx, metadataKeyForTest(buildID, testID))
+	metadata, _, err := findTestMetadata(ctx, buildID, testID)
+	if err != nil || metadata == nil {
+		return nil, err
+	}
+
+	test := &metadata.Test
+	if metadata.NumLines != nil {
+		test.NumLines = *metadata.NumLines
+	} else {
+		test.NumLines, err = countTestLines(ctx, buildID, testID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "counting lines for build '%s' and test '%s'", buildID, testID)
+		}
+	}
+	if metadata.TotalBytes != nil {
+		test.TotalBytes = *metadata.TotalBytes
+	} else {
+		test.TotalBytes, err = countTestBytes(ctx, buildID, testID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "counting bytes for build '%s' and test '%s'", buildID, testID)
+		}
+	}
+
+	return test, nil
+}
+
+// countTestBytes returns the total size of the chunks stored for the given
+// test. Bucket listings don't include sizes, so every chunk is read to find
+// its size.
+func countTestBytes(ctx context.Context, buildID string, testID string) (int64, error) {
+	keys, err := listBuildKeys(ctx, buildID, testSubPrefix(testID))
+	if err != nil {
+		return 0, errors.Wrap(err, "listing test keys")
+	}
+
+	var totalBytes int64
+	for _, key := range keys {
+		if strings.HasSuffix(key, metadataFilename) {
+			continue
+		}
+
+		size, err := chunkSize(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		totalBytes += size
+	}
+
+	return totalBytes, nil
+}
+
+// findTestMetadata returns the stored metadata of the given test and the key
+// it was read from, in whichever layout the test's build is stored. It
+// returns nil if the test doesn't exist.
+func findTestMetadata(ctx context.Context, buildID string, testID string) (*testMetadata, string, error) {
+	reader, key, err := getFromBuildPrefixes(ctx, buildID, testSubPrefix(testID)+metadataFilename)
 	if pail.IsKeyNotFoundError(err) {
-		return nil, nil
+		return nil, "", nil
 	}
 	if err != nil {
-		return nil, errors.Wrapf(err, "getting test metadata for build '%s' and test '%s'", buildID, testID)
+		return nil, "", errors.Wrapf(err, "getting test metadata for build '%s' and test '%s'", buildID, testID)
 	}
+	defer reader.Close()
 
-	test := &Test{}
-	if err = json.NewDecoder(reader).Decode(test); err != nil {
-		return nil, errors.Wrapf(err, "parsing test metadata for build '%s' and test '%s'", buildID, testID)
+	metadata := &testMetadata{}
+	if err = json.NewDecoder(reader).Decode(metadata); err != nil {
+		return nil, "", errors.Wrapf(err, "parsing test metadata for build '%s' and test '%s'", buildID, testID)
 	}
 
-	return test, nil
+	return metadata, key, nil
+}
+
+// putTestMetadata uploads the given test metadata to the given key.
+func putTestMetadata(ctx context.Context, metadata *testMetadata, key string) error {
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return errors.Wrap(err, "marshalling test metadata")
+	}
+
+	return errors.Wrapf(env.Bucket().Put(ctx, key, bytes.NewReader(data)), "uploading metadata for test '%s'", metadata.ID)
+}
+
+// countTestLines returns the number of lines stored for the given test by
+// summing the line counts encoded in its chunk keys.
+func countTestLines(ctx context.Context, buildID string, testID string) (int, error) {
+	keys, err := listBuildKeys(ctx, buildID, testSubPrefix(testID))
+	if err != nil {
+		return 0, errors.Wrap(err, "listing test keys")
+	}
+
+	var numLines int
+	for _, key := range keys {
+		if strings.HasSuffix(key, metadataFilename) {
+			continue
+		}
+
+		var info LogChunkInfo
+		if err := info.fromKey(key); err != nil {
+			return 0, errors.Wrap(err, "getting log chunk info from key name")
+		}
+		numLines += info.NumLines
+	}
+
+	return numLines, nil
+}
+
+// addTestLines increments the line count and total size in the metadata of
+// the given test by numLines and numBytes. If the test has no metadata,
+// nothing is updated. Metadata without a line count is backfilled from the
+// test's chunk keys, which already include the new lines. Metadata without a
+// total size keeps it unknown, since finding it means reading every chunk;
+// RepairLineCounts records it instead.
+func addTestLines(ctx context.Context, tracer otelTrace.Tracer, buildID string, testID string, numLines int, numBytes int64) error {
+	unlock, err := lockBuild(ctx, buildID)
+	if err != nil {
+		return err
+	}
+	defer logUnlockError(unlock, buildID)
+
+	metadata, key, err := findTestMetadata(ctx, buildID, testID)
+	if err != nil || metadata == nil {
+		return err
+	}
+
+	test := &metadata.Test
+	if metadata.NumLines != nil {
+		test.NumLines = *metadata.NumLines + numLines
+	} else {
+		test.NumLines, err = countTestLines(ctx, buildID, testID)
+		if err != nil {
+			return errors.Wrap(err, "counting test lines")
+		}
+	}
+	metadata.NumLines = &test.NumLines
+	if metadata.TotalBytes != nil {
+		totalBytes := *metadata.TotalBytes + numBytes
+		metadata.TotalBytes = &totalBytes
+	}
+
+	// The metadata is written back to the key it was read from so that a
+	// test stored in the unsharded layout isn't copied into the sharded
+	// one.
+	if err = putTestMetadata(ctx, metadata, key); err != nil {
+		return err
+	}
+
+	return errors.Wrapf(addToLockedChunkManifest(ctx, buildID, key), "adding test '%s' to chunk manifest", testID)
 }
 
 // CheckTestMetadata returns whether the metadata file exists for the given test.
@@ -106,22 +275,30 @@ func FindTestsForBuild(ctx context.Context, tracer otelTrace.Tracer, buildID str
 	_, span := tracer.Start(ctx, "FindTestsForBuild")
 	defer span.End()
 
-	iterator, err := env.Bucket().List(ctx, buildTestsPrefix(buildID))
-	if err != nil {
-		return nil, errors.Wrapf(err, "listing test keys for build '%s'", buildID)
-	}
+	return findTestsForBuild(ctx, tracer, buildID, func(testID string) (*Test, error) {
+		return FindTestByID(ctx, tracer, buildID, testID)
+	})
+}
 
-	testIDs := []string{}
-	for iterator.Next(ctx) {
-		if !strings.HasSuffix(iterator.Item().Name(), metadataFilename) {
-			continue
+// findStoredTestsForBuild returns the metadata of all of the given build's
+// tests as stored, without counting the lines or summing the sizes missing
+// from legacy metadata, for callers that don't need them.
+func findStoredTestsForBuild(ctx context.Context, tracer otelTrace.Tracer, buildID string) ([]Test, error) {
+	return findTestsForBuild(ctx, tracer, buildID, func(testID string) (*Test, error) {
+		metadata, _, err := findTestMetadata(ctx, buildID, testID)
+		if err != nil || metadata == nil {
+			return nil, err
 		}
+		return &metadata.Test, nil
+	})
+}
 
-		testID, err := testIDFromKey(iterator.Item().Name())
-		if err != nil {
-			return nil, errors.Wrapf(err, "parsing test metadata key for build '%s'", buildID)
-		}
-		testIDs = append(testIDs, testID)
+// findTestsForBuild finds each of the given build's tests concurrently with
+// find.
+func findTestsForBuild(ctx context.Context, tracer otelTrace.Tracer, buildID string, find func(testID string) (*Test, error)) ([]Test, error) {
+	testIDs, err := ListTestIDs(ctx, tracer, buildID)
+	if err != nil {
+		return nil, err
 	}
 
 	var wg sync.WaitGroup
@@ -133,12 +310,14 @@ func FindTestsForBuild(ctx context.Context, tracer otelTrace.Tracer, buildID str
 			defer recovery.LogStackTraceAndContinue("finding test metadata for build from bucket")
 			defer wg.Done()
 
-			test, err := FindTestByID(ctx, tracer, buildID, testID)
+			test, err := find(testID)
 			if err != nil {
 				catcher.Add(err)
 				return
 			}
-			tests[idx] = *test
+			if test != nil {
+				tests[idx] = *test
+			}
 		}(id, i)
 	}
 	wg.Wait()
@@ -166,10 +345,49 @@ func testIDTimestamp(id string) time.Time {
 	return time.Unix(0, int64(nSecs))
 }
 
+// ListTestIDs returns the IDs of the given build's tests sorted by creation
+// time. Only the keys under the build's tests prefix are listed, so the
+// build's own log chunks are never fetched.
+func ListTestIDs(ctx context.Context, tracer otelTrace.Tracer, buildID string) ([]string, error) {
+	ctx, span := tracer.Start(ctx, "ListTestIDs")
+	defer span.End()
+
+	keys, err := listBuildKeys(ctx, buildID, testsSubPrefix)
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing test keys for build '%s'", buildID)
+	}
+
+	testIDs, err := parseTestIDs(keys)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing test metadata keys for build '%s'", buildID)
+	}
+
+	return testIDs, nil
+}
+
+// FindLatestTestID returns the ID of the given build's test with the latest
+// start time, or an empty string if the build has no tests.
+func FindLatestTestID(ctx context.Context, tracer otelTrace.Tracer, buildID string) (string, error) {
+	ctx, span := tracer.Start(ctx, "FindLatestTestID")
+	defer span.End()
+
+	testIDs, err := ListTestIDs(ctx, tracer, buildID)
+	if err != nil {
+		return "", err
+	}
+	if len(testIDs) == 0 {
+		return "", nil
+	}
+
+	return testIDs[len(testIDs)-1], nil
+}
+
 // parseTestIDs parses test IDs from the buildKeys that correspond to test metadata files
-// and sorts them by creation time.
+// and sorts them by creation time. A test whose metadata is stored in both
+// build key layouts is only returned once.
 func parseTestIDs(buildKeys []string) ([]string, error) {
 	var testIDs []string
+	seen := map[string]bool{}
 	for _, key := range buildKeys {
 		if !strings.HasSuffix(key, metadataFilename) {
 			continue
@@ -181,6 +399,10 @@ func parseTestIDs(buildKeys []string) ([]string, error) {
 		if err != nil {
 			return nil, errors.Wrap(err, "getting test ID from metadata key")
 		}
+		if seen[testID] {
+			continue
+		}
+		seen[testID] = true
 		testIDs = append(testIDs, testID)
 	}
 
@@ -204,6 +426,10 @@ func parseTestIDs(buildKeys []string) ([]string, error) {
 // with the logs the test may be filtered by a time range shorter than that of
 // the test itself—this behavior is okay since tests are expected to be run
 // serially.
+//
+// The time range is extended on either side by the environment's test window
+// tolerance, if any, so that build lines logged near the boundary between two
+// tests aren't dropped because of clock skew between the hosts logging them.
 func testExecutionWindow(allTestIDs []string, testID string) (TimeRange, error) {
 	tr := AllTime
 	if testID == "" {
@@ -222,19 +448,49 @@ func testExecutionWindow(allTestIDs []string, testID string) (TimeRange, error)
 		return tr, errors.Errorf("test '%s' was not found", testID)
 	}
 
-	tr.StartAt = testIDTimestamp(allTestIDs[testIndex]).Truncate(time.Millisecond)
+	tolerance := env.TestWindowTolerance()
+	tr.StartAt = testIDTimestamp(allTestIDs[testIndex]).Truncate(time.Millisecond).Add(-tolerance)
 
 	if testIndex < len(allTestIDs)-1 {
-		tr.EndAt = testIDTimestamp(allTestIDs[testIndex+1]).Truncate(time.Millisecond)
+		tr.EndAt = testIDTimestamp(allTestIDs[testIndex+1]).Truncate(time.Millisecond).Add(tolerance)
 	}
 
 	return tr, nil
 }
 
+// taskExecutionWindow returns the IDs of the given tests that are from the
+// given execution of their task, along with the time range from the creation
+// of the first of those tests to the creation of the next test from another
+// execution. If there is no such test then the end time is TimeRangeMax. As
+// with testExecutionWindow, executions are expected to run sequentially.
+func taskExecutionWindow(tests []Test, execution int) (TimeRange, map[string]bool) {
+	sorted := make([]Test, len(tests))
+	_ = copy(sorted, tests)
+	sort.Slice(sorted, func(i, j int) bool {
+		return testIDTimestamp(sorted[i].ID).Before(testIDTimestamp(sorted[j].ID))
+	})
+
+	tr := AllTime
+	testIDs := map[string]bool{}
+	for _, test := range sorted {
+		if test.TaskExecution == execution {
+			if len(testIDs) == 0 {
+				tr.StartAt = testIDTimestamp(test.ID).Truncate(time.Millisecond)
+			}
+			testIDs[test.ID] = true
+			tr.EndAt = TimeRangeMax
+		} else if len(testIDs) > 0 && tr.EndAt.Equal(TimeRangeMax) {
+			tr.EndAt = testIDTimestamp(test.ID).Truncate(time.Millisecond)
+		}
+	}
+
+	return tr, testIDs
+}
+
 func testIDFromKey(path string) (string, error) {
-	keyParts := strings.Split(path, "/")
-	if strings.Contains(path, "/tests/") && len(keyParts) >= 5 {
-		return keyParts[3], nil
+	_, rest, ok := splitBuildKey(path)
+	if ok && len(rest) >= 3 && rest[0]+"/" == testsSubPrefix {
+		return rest[1], nil
 	}
 	return "", errors.Errorf("programmatic error: unexpected test ID prefix in path '%s'", path)
 }
@@ -244,9 +500,11 @@ func metadataKeyForTest(buildID string, testID string) string {
 }
 
 func testPrefix(buildID, testID string) string {
-	return fmt.Sprintf("%s%s/", buildTestsPrefix(buildID), testID)
+	return buildPrefix(buildID) + testSubPrefix(testID)
 }
 
-func buildTestsPrefix(buildID string) string {
-	return fmt.Sprintf("%stests/", buildPrefix(buildID))
+// testSubPrefix returns the prefix of the given test's keys relative to its
+// build's prefix.
+func testSubPrefix(testID string) string {
+	return fmt.Sprintf("%s%s/", testsSubPrefix, testID)
 }
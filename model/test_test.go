@@ -4,6 +4,7 @@ import (
 	"context"
 	"go.opentelemetry.io/otel"
 	"io"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -86,7 +87,7 @@ func TestTestToJSON(t *testing.T) {
 	}
 	data, err := test.toJSON()
 	require.NoError(t, err)
-	assert.JSONEq(t, `{"id":"test0","name":"name","build_id":"build0","task_id":"t0","execution":1,"phase":"phase0","command":"command0"}`, string(data))
+	assert.JSONEq(t, `{"id":"test0","name":"name","build_id":"build0","task_id":"t0","execution":1,"phase":"phase0","command":"command0","num_lines":0,"total_bytes":0}`, string(data))
 }
 
 func TestCheckTestMetadata(t *testing.T) {
@@ -156,6 +157,8 @@ func TestFindTestByID(t *testing.T) {
 			TaskExecution: 1,
 			Phase:         "phase0",
 			Command:       "command0",
+			NumLines:      11,
+			TotalBytes:    896,
 		}
 		actual, err := FindTestByID(ctx, tracer, "5a75f537726934e4b62833ab6d5dca41", "17046404de18d0000000000000000000")
 		require.NoError(t, err)
@@ -189,6 +192,8 @@ func TestFindTestsForBuild(t *testing.T) {
 			TaskExecution: 1,
 			Command:       "command0",
 			Phase:         "phase0",
+			NumLines:      2,
+			TotalBytes:    70,
 		},
 		{
 			ID:            "0de0b6b3cb3688400000000000000000",
@@ -198,6 +203,8 @@ func TestFindTestsForBuild(t *testing.T) {
 			TaskExecution: 2,
 			Command:       "command1",
 			Phase:         "phase1",
+			NumLines:      2,
+			TotalBytes:    70,
 		},
 	}
 	testResponse, err := FindTestsForBuild(ctx, tracer, "5a75f537726934e4b62833ab6d5dca41")
@@ -205,6 +212,224 @@ func TestFindTestsForBuild(t *testing.T) {
 	assert.Equal(t, expected, testResponse)
 }
 
+func TestListTestIDs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	for _, storagePath := range []string{"../testdata/simple", "../testdata/between", "../testdata/overlapping", "../testdata/nolines"} {
+		t.Run(filepath.Base(storagePath), func(t *testing.T) {
+			defer testutil.SetBucket(t, storagePath)()
+
+			buildKeys, err := getBuildKeys(ctx, tracer, "5a75f537726934e4b62833ab6d5dca41")
+			require.NoError(t, err)
+			expected, err := parseTestIDs(buildKeys)
+			require.NoError(t, err)
+			require.NotEmpty(t, expected)
+
+			testIDs, err := ListTestIDs(ctx, tracer, "5a75f537726934e4b62833ab6d5dca41")
+			require.NoError(t, err)
+			assert.Equal(t, expected, testIDs)
+		})
+	}
+	t.Run("NonexistentBuild", func(t *testing.T) {
+		defer testutil.SetBucket(t, "../testdata/simple")()
+
+		testIDs, err := ListTestIDs(ctx, tracer, "DNE")
+		require.NoError(t, err)
+		assert.Empty(t, testIDs)
+	})
+}
+
+func TestFindLatestTestID(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	defer testutil.SetBucket(t, "")()
+
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	start := time.Unix(1000000000, 0).UTC()
+	latestID := NewTestID(start.Add(2 * time.Hour))
+	// Upload the tests out of start order to make sure the latest is
+	// chosen by start time rather than upload order.
+	for _, testID := range []string{NewTestID(start.Add(time.Hour)), latestID, NewTestID(start)} {
+		require.NoError(t, (&Test{ID: testID, BuildID: buildID}).UploadTestMetadata(ctx, tracer))
+	}
+
+	testID, err := FindLatestTestID(ctx, tracer, buildID)
+	require.NoError(t, err)
+	assert.Equal(t, latestID, testID)
+
+	testID, err = FindLatestTestID(ctx, tracer, "DNE")
+	require.NoError(t, err)
+	assert.Empty(t, testID)
+}
+
+func TestTestNumLines(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	lines := []LogLineItem{
+		{Timestamp: time.Unix(1000000000, 0).UTC(), Data: "line0"},
+		{Timestamp: time.Unix(1000000001, 0).UTC(), Data: "line1\nline2"},
+		{Timestamp: time.Unix(1000000002, 0).UTC(), Data: "line3"},
+	}
+
+	t.Run("Appends", func(t *testing.T) {
+		defer testutil.SetBucket(t, "")()
+
+		test := &Test{ID: NewTestID(time.Unix(1000000000, 0)), BuildID: buildID}
+		require.NoError(t, test.UploadTestMetadata(ctx, tracer))
+
+		_, err := InsertLogLines(ctx, tracer, buildID, test.ID, lines, 4*1024*1024)
+		require.NoError(t, err)
+		found, err := FindTestByID(ctx, tracer, buildID, test.ID)
+		require.NoError(t, err)
+		assert.Equal(t, 4, found.NumLines)
+
+		// Force multiple chunks in a single append.
+		_, err = InsertLogLines(ctx, tracer, buildID, test.ID, lines, len("line1\nline2"))
+		require.NoError(t, err)
+		found, err = FindTestByID(ctx, tracer, buildID, test.ID)
+		require.NoError(t, err)
+		assert.Equal(t, 8, found.NumLines)
+
+		tests, err := FindTestsForBuild(ctx, tracer, buildID)
+		require.NoError(t, err)
+		require.Len(t, tests, 1)
+		assert.Equal(t, 8, tests[0].NumLines)
+	})
+	t.Run("LegacyFallback", func(t *testing.T) {
+		defer testutil.SetBucket(t, "../testdata/simple")()
+
+		testID := "17046404de18d0000000000000000000"
+		found, err := FindTestByID(ctx, tracer, buildID, testID)
+		require.NoError(t, err)
+		assert.Equal(t, 11, found.NumLines)
+
+		// Appending to legacy metadata backfills the count from
+		// all of the test's chunks.
+		_, err = InsertLogLines(ctx, tracer, buildID, testID, lines, 4*1024*1024)
+		require.NoError(t, err)
+		found, err = FindTestByID(ctx, tracer, buildID, testID)
+		require.NoError(t, err)
+		assert.Equal(t, 15, found.NumLines)
+	})
+	t.Run("UnshardedWithShardingEnabled", func(t *testing.T) {
+		defer testutil.SetBucket(t, "../testdata/simple")()
+		env.SetShardBuildKeys(true)
+		defer env.SetShardBuildKeys(false)
+
+		testID := "17046404de18d0000000000000000000"
+		_, err := InsertLogLines(ctx, tracer, buildID, testID, lines, 4*1024*1024)
+		require.NoError(t, err)
+
+		exists, err := env.Bucket().Exists(ctx, buildPrefixForLayout(buildID, true)+testSubPrefix(testID)+metadataFilename)
+		require.NoError(t, err)
+		assert.False(t, exists)
+		found, err := FindTestByID(ctx, tracer, buildID, testID)
+		require.NoError(t, err)
+		require.NotNil(t, found)
+		assert.Equal(t, 15, found.NumLines)
+	})
+	t.Run("RecordedZero", func(t *testing.T) {
+		defer testutil.SetBucket(t, "../testdata/simple")()
+
+		// A recorded count is trusted even if it disagrees with the
+		// chunks.
+		test, err := FindTestByID(ctx, tracer, buildID, "17046404de18d0000000000000000000")
+		require.NoError(t, err)
+		test.NumLines = 0
+		require.NoError(t, test.UploadTestMetadata(ctx, tracer))
+
+		found, err := FindTestByID(ctx, tracer, buildID, test.ID)
+		require.NoError(t, err)
+		assert.Zero(t, found.NumLines)
+	})
+}
+
+func TestTestTotalBytes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	lines := []LogLineItem{
+		{Timestamp: time.Unix(1000000000, 0).UTC(), Data: "line0"},
+		{Timestamp: time.Unix(1000000001, 0).UTC(), Data: "line1\nline2"},
+		{Timestamp: time.Unix(1000000002, 0).UTC(), Data: "line3"},
+	}
+
+	t.Run("Appends", func(t *testing.T) {
+		defer testutil.SetBucket(t, "")()
+
+		test := &Test{ID: NewTestID(time.Unix(1000000000, 0)), BuildID: buildID}
+		require.NoError(t, test.UploadTestMetadata(ctx, tracer))
+		found, err := FindTestByID(ctx, tracer, buildID, test.ID)
+		require.NoError(t, err)
+		assert.Zero(t, found.TotalBytes)
+
+		result, err := InsertLogLines(ctx, tracer, buildID, test.ID, lines, 4*1024*1024)
+		require.NoError(t, err)
+		found, err = FindTestByID(ctx, tracer, buildID, test.ID)
+		require.NoError(t, err)
+		assert.Positive(t, found.TotalBytes)
+		assert.Equal(t, result.Bytes, found.TotalBytes)
+
+		// Force multiple chunks in a single append.
+		next, err := InsertLogLines(ctx, tracer, buildID, test.ID, lines, len("line1\nline2"))
+		require.NoError(t, err)
+		require.Greater(t, next.Chunks, 1)
+		found, err = FindTestByID(ctx, tracer, buildID, test.ID)
+		require.NoError(t, err)
+		assert.Equal(t, result.Bytes+next.Bytes, found.TotalBytes)
+
+		tests, err := FindTestsForBuild(ctx, tracer, buildID)
+		require.NoError(t, err)
+		require.Len(t, tests, 1)
+		assert.Equal(t, result.Bytes+next.Bytes, tests[0].TotalBytes)
+
+		repair, err := RepairLineCounts(ctx, tracer, buildID)
+		require.NoError(t, err)
+		assert.Zero(t, repair.Tests)
+	})
+	t.Run("Legacy", func(t *testing.T) {
+		defer testutil.SetBucket(t, "../testdata/simple")()
+
+		// The size of legacy metadata is summed from its chunks until
+		// it's repaired, even after appending.
+		testID := "17046404de18d0000000000000000000"
+		found, err := FindTestByID(ctx, tracer, buildID, testID)
+		require.NoError(t, err)
+		assert.EqualValues(t, 896, found.TotalBytes)
+
+		result, err := InsertLogLines(ctx, tracer, buildID, testID, lines, 4*1024*1024)
+		require.NoError(t, err)
+		found, err = FindTestByID(ctx, tracer, buildID, testID)
+		require.NoError(t, err)
+		assert.Equal(t, 896+result.Bytes, found.TotalBytes)
+		assert.Equal(t, 11+result.Lines, found.NumLines)
+		metadata, _, err := findTestMetadata(ctx, buildID, testID)
+		require.NoError(t, err)
+		assert.Nil(t, metadata.TotalBytes)
+
+		repair, err := RepairLineCounts(ctx, tracer, buildID)
+		require.NoError(t, err)
+		assert.Equal(t, 1, repair.Tests)
+		found, err = FindTestByID(ctx, tracer, buildID, testID)
+		require.NoError(t, err)
+		assert.Equal(t, 896+result.Bytes, found.TotalBytes)
+		assert.Equal(t, 11+result.Lines, found.NumLines)
+		metadata, _, err = findTestMetadata(ctx, buildID, testID)
+		require.NoError(t, err)
+		require.NotNil(t, metadata.TotalBytes)
+		assert.Equal(t, 896+result.Bytes, *metadata.TotalBytes)
+	})
+}
+
 func TestTestExecutionWindow(t *testing.T) {
 	t.Run("NoLaterTest", func(t *testing.T) {
 		startTime := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
@@ -240,6 +465,29 @@ func TestTestExecutionWindow(t *testing.T) {
 		assert.True(t, tr.EndAt.Equal(TimeRangeMax))
 	})
 
+	t.Run("Tolerance", func(t *testing.T) {
+		env.SetTestWindowTolerance(5 * time.Millisecond)
+		defer env.SetTestWindowTolerance(0)
+
+		startTime := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+		allTestIDs := []string{
+			NewTestID(startTime),
+			NewTestID(startTime.Add(time.Hour)),
+		}
+		tr, err := testExecutionWindow(allTestIDs, allTestIDs[0])
+		assert.NoError(t, err)
+		assert.True(t, tr.StartAt.Equal(startTime.Add(-5*time.Millisecond)))
+		assert.True(t, tr.EndAt.Equal(startTime.Add(time.Hour+5*time.Millisecond)))
+
+		tr, err = testExecutionWindow(allTestIDs, allTestIDs[1])
+		assert.NoError(t, err)
+		assert.True(t, tr.EndAt.Equal(TimeRangeMax))
+
+		tr, err = testExecutionWindow(allTestIDs, "")
+		assert.NoError(t, err)
+		assert.Equal(t, AllTime, tr)
+	})
+
 	t.Run("NoTestID", func(t *testing.T) {
 		allTestIDs := []string{
 			NewTestID(time.Time{}),
@@ -259,6 +507,33 @@ func TestTestExecutionWindow(t *testing.T) {
 	})
 }
 
+func TestTaskExecutionWindow(t *testing.T) {
+	startTime := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	tests := []Test{
+		{ID: NewTestID(startTime.Add(2 * time.Hour)), TaskExecution: 1},
+		{ID: NewTestID(startTime), TaskExecution: 0},
+		{ID: NewTestID(startTime.Add(time.Hour)), TaskExecution: 0},
+		{ID: NewTestID(startTime.Add(3 * time.Hour)), TaskExecution: 1},
+	}
+
+	t.Run("EarlierExecution", func(t *testing.T) {
+		tr, testIDs := taskExecutionWindow(tests, 0)
+		assert.Equal(t, map[string]bool{tests[1].ID: true, tests[2].ID: true}, testIDs)
+		assert.True(t, tr.StartAt.Equal(startTime))
+		assert.True(t, tr.EndAt.Equal(startTime.Add(2*time.Hour)))
+	})
+	t.Run("LatestExecution", func(t *testing.T) {
+		tr, testIDs := taskExecutionWindow(tests, 1)
+		assert.Equal(t, map[string]bool{tests[0].ID: true, tests[3].ID: true}, testIDs)
+		assert.True(t, tr.StartAt.Equal(startTime.Add(2*time.Hour)))
+		assert.True(t, tr.EndAt.Equal(TimeRangeMax))
+	})
+	t.Run("NoTestsFromExecution", func(t *testing.T) {
+		_, testIDs := taskExecutionWindow(tests, 2)
+		assert.Empty(t, testIDs)
+	})
+}
+
 func TestParseTestIDs(t *testing.T) {
 	for name, testCase := range map[string]struct {
 		keys          []string
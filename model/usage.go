@@ -0,0 +1,131 @@
+package model
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/evergreen-ci/logkeeper/env"
+	"github.com/pkg/errors"
+	otelTrace "go.opentelemetry.io/otel/trace"
+)
+
+// StorageUsage is the amount of log data held in the bucket. Only the
+// bucket's keys are listed to compute it, so the size of the log chunks isn't
+// included.
+type StorageUsage struct {
+	Builds int `json:"builds"`
+	Chunks int `json:"chunks"`
+	// ComputedAt is when the totals were last recomputed from the bucket.
+	// Builds and chunks uploaded or deleted by this process since then are
+	// included in the totals, but those uploaded or deleted by other
+	// processes are not.
+	ComputedAt time.Time `json:"computed_at"`
+}
+
+var storageUsage = struct {
+	sync.Mutex
+	usage    StorageUsage
+	computed bool
+}{}
+
+// GetStorageUsage returns the cached storage usage and whether it has been
+// computed by ComputeStorageUsage in this process. It never lists the bucket.
+func GetStorageUsage() (StorageUsage, bool) {
+	storageUsage.Lock()
+	defer storageUsage.Unlock()
+
+	return storageUsage.usage, storageUsage.computed
+}
+
+// ComputeStorageUsage recomputes the storage usage from the bucket and caches
+// it. Every key under the builds prefix is listed, so this is expensive for
+// large buckets, but no log chunk is read.
+func ComputeStorageUsage(ctx context.Context, tracer otelTrace.Tracer) (StorageUsage, error) {
+	ctx, span := tracer.Start(ctx, "ComputeStorageUsage")
+	defer span.End()
+
+	start := time.Now()
+	usage, err := computeStorageUsage(ctx, buildsPrefix)
+	if err != nil {
+		return StorageUsage{}, errors.Wrap(err, "computing storage usage")
+	}
+	usage.ComputedAt = start
+
+	storageUsage.Lock()
+	defer storageUsage.Unlock()
+	storageUsage.usage = usage
+	storageUsage.computed = true
+
+	return usage, nil
+}
+
+// computeStorageUsage returns the number of builds and log chunks among the
+// keys under the given prefix.
+func computeStorageUsage(ctx context.Context, prefix string) (StorageUsage, error) {
+	iter, err := env.Bucket().List(ctx, prefix)
+	if err != nil {
+		return StorageUsage{}, errors.Wrapf(err, "listing keys with prefix '%s'", prefix)
+	}
+
+	var usage StorageUsage
+	for iter.Next(ctx) {
+		usage.addKey(iter.Item().Name())
+	}
+	if err = iter.Err(); err != nil {
+		return StorageUsage{}, errors.Wrapf(err, "iterating keys with prefix '%s'", prefix)
+	}
+
+	return usage, nil
+}
+
+// storageUsageOfKeys returns the number of builds and log chunks among the
+// given build keys.
+func storageUsageOfKeys(keys []string) StorageUsage {
+	var usage StorageUsage
+	for _, key := range keys {
+		usage.addKey(key)
+	}
+
+	return usage
+}
+
+// addKey counts the given build key as a build if it's a build's metadata or
+// as a log chunk if it isn't metadata at all.
+func (u *StorageUsage) addKey(key string) {
+	if !strings.HasSuffix(key, metadataFilename) {
+		u.Chunks++
+	} else if isBuildMetadataKey(key) {
+		u.Builds++
+	}
+}
+
+// addStorageUsage adds the given builds and chunks, which may be negative, to
+// the cached storage usage.
+func addStorageUsage(builds int, chunks int) {
+	storageUsage.Lock()
+	defer storageUsage.Unlock()
+
+	storageUsage.usage.Builds += builds
+	storageUsage.usage.Chunks += chunks
+}
+
+func chunkSize(ctx context.Context, key string) (int64, error) {
+	reader, err := env.Bucket().Get(ctx, key)
+	if err != nil {
+		return 0, errors.Wrapf(err, "getting log chunk '%s'", key)
+	}
+	defer reader.Close()
+
+	size, err := io.Copy(io.Discard, reader)
+	return size, errors.Wrapf(err, "reading log chunk '%s'", key)
+}
+
+// isBuildMetadataKey returns whether the key is a build's, rather than a
+// test's, metadata key.
+func isBuildMetadataKey(key string) bool {
+	_, ok := buildIDFromMetadataKey(key)
+	return ok
+}
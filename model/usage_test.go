@@ -0,0 +1,81 @@
+package model
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/evergreen-ci/logkeeper/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+)
+
+func TestStorageUsage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+
+	t.Run("ComputeFromBucket", func(t *testing.T) {
+		defer testutil.SetBucket(t, "../testdata/overlapping")()
+
+		usage, err := ComputeStorageUsage(ctx, tracer)
+		require.NoError(t, err)
+		assert.Equal(t, 1, usage.Builds)
+		assert.Equal(t, 4, usage.Chunks)
+		assert.False(t, usage.ComputedAt.IsZero())
+
+		cached, computed := GetStorageUsage()
+		assert.True(t, computed)
+		assert.Equal(t, usage, cached)
+	})
+	t.Run("RunningTotals", func(t *testing.T) {
+		defer testutil.SetBucket(t, "")()
+
+		empty, err := ComputeStorageUsage(ctx, tracer)
+		require.NoError(t, err)
+		assert.Zero(t, empty.Builds)
+		assert.Zero(t, empty.Chunks)
+
+		start := time.Unix(1000000000, 0).UTC()
+		buildID := "5a75f537726934e4b62833ab6d5dca41"
+		build := &Build{ID: buildID}
+		require.NoError(t, build.UploadMetadata(ctx, tracer))
+		test := &Test{ID: NewTestID(start), BuildID: buildID}
+		require.NoError(t, test.UploadTestMetadata(ctx, tracer))
+		lines := []LogLineItem{
+			{Timestamp: start, Data: "line0"},
+			{Timestamp: start.Add(time.Millisecond), Data: "line1"},
+			{Timestamp: start.Add(2 * time.Millisecond), Data: "line2"},
+		}
+		_, err = InsertLogLinesWithLineLimit(ctx, tracer, buildID, "", lines, 1024, 2)
+		require.NoError(t, err)
+		_, err = InsertLogLinesWithLineLimit(ctx, tracer, buildID, test.ID, lines, 1024, 1)
+		require.NoError(t, err)
+		// Uploading the metadata of an existing build doesn't add a
+		// build.
+		require.NoError(t, build.UploadMetadata(ctx, tracer))
+
+		afterInsert, _ := GetStorageUsage()
+		assert.Equal(t, 1, afterInsert.Builds)
+		assert.Equal(t, 5, afterInsert.Chunks)
+		assert.Equal(t, empty.ComputedAt, afterInsert.ComputedAt)
+
+		recomputed, err := ComputeStorageUsage(ctx, tracer)
+		require.NoError(t, err)
+		assert.Equal(t, afterInsert.Builds, recomputed.Builds)
+		assert.Equal(t, afterInsert.Chunks, recomputed.Chunks)
+
+		require.NoError(t, DeleteBuild(ctx, tracer, buildID, 2))
+		afterDelete, _ := GetStorageUsage()
+		assert.Zero(t, afterDelete.Builds)
+		assert.Zero(t, afterDelete.Chunks)
+	})
+}
+
+func TestIsBuildMetadataKey(t *testing.T) {
+	assert.True(t, isBuildMetadataKey("builds/5a75f537726934e4b62833ab6d5dca41/metadata.json"))
+	assert.False(t, isBuildMetadataKey("builds/5a75f537726934e4b62833ab6d5dca41/tests/0de0b6b3bf3b84000000000000000000/metadata.json"))
+	assert.False(t, isBuildMetadataKey("builds-by-task/task/metadata.json"))
+}
@@ -4,12 +4,14 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/subtle"
 	"fmt"
 	"go.opentelemetry.io/otel"
 	otelTrace "go.opentelemetry.io/otel/trace"
 	"html/template"
 	"io"
 	"log"
+	"math"
 	"net/http"
 	"os"
 	"runtime"
@@ -20,18 +22,47 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
 	"github.com/urfave/negroni"
 	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
 )
 
+const (
+	defaultMaxProfileDuration   = 2 * time.Minute
+	defaultMaxSymbolRequestSize = 1024 * 1024
+)
+
 type pprofsvc struct {
 	tracer  otelTrace.Tracer
+	opts    PProfOptions
 	closers []closerOp
 }
 
-func NewPProfSvc() *pprofsvc {
+// PProfOptions represents the set of options for creating a new pprof
+// service.
+type PProfOptions struct {
+	// MaxProfileDuration is the longest CPU profile or execution trace a
+	// client may request. Longer requests are clamped to this duration.
+	// Defaults to 2 minutes.
+	MaxProfileDuration time.Duration
+	// Token, if set, is the bearer token requests must present in their
+	// Authorization header. Requests are unauthenticated by default.
+	Token string
+	// MaxSymbolRequestSize is the largest body in bytes a symbol lookup
+	// may POST. Larger requests are rejected. Defaults to 1 MB.
+	MaxSymbolRequestSize int64
+}
+
+// NewPProfSvc returns a new pprof service with the given options.
+func NewPProfSvc(opts PProfOptions) *pprofsvc {
+	if opts.MaxProfileDuration <= 0 {
+		opts.MaxProfileDuration = defaultMaxProfileDuration
+	}
+	if opts.MaxSymbolRequestSize <= 0 {
+		opts.MaxSymbolRequestSize = defaultMaxSymbolRequestSize
+	}
 	tracer := otel.GetTracerProvider().Tracer("github.com/evergreen-ci/logkeeper/pprof")
-	return &pprofsvc{tracer: tracer}
+	return &pprofsvc{tracer: tracer, opts: opts}
 }
 
 // GetHandlerPprof returns a handler for pprof endpoints.
@@ -39,6 +70,9 @@ func (p *pprofsvc) GetHandlerPprof(ctx context.Context) http.Handler {
 	router := mux.NewRouter()
 	router.Use(NewLogger(ctx).Middleware)
 	router.Use(otelmux.Middleware("logkeeper"))
+	if p.opts.Token != "" {
+		router.Use(p.authorize)
+	}
 
 	root := router.PathPrefix("/debug/pprof").Subrouter()
 	root.HandleFunc("/", p.index)
@@ -57,10 +91,25 @@ func (p *pprofsvc) GetHandlerPprof(ctx context.Context) http.Handler {
 	return n
 }
 
+// authorize rejects requests that don't carry the service's bearer token.
+func (p *pprofsvc) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+p.opts.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "not authorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 // ******************************************************************************
 // The below was copied from the standard library net/http/pprof because we want
 // to use our own router. This is identical with the exception of the init
-// function (which registered handlers), which has been deleted.
+// function (which registered handlers), which has been deleted, and the
+// profile and trace durations and symbol request size, which are bounded by
+// the service's options.
 // ******************************************************************************
 
 // cmdline responds with the running program's
@@ -80,14 +129,42 @@ func sleep(ctx context.Context, d time.Duration) {
 	}
 }
 
+// profileDuration returns the duration requested by the seconds form value,
+// or def if it is unset or zero. Durations longer than the service's maximum
+// are clamped to it.
+func (p *pprofsvc) profileDuration(r *http.Request, def time.Duration) (time.Duration, error) {
+	value := r.FormValue("seconds")
+	if value == "" {
+		return def, nil
+	}
+
+	sec, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(sec) || math.IsInf(sec, 0) || sec < 0 {
+		return 0, errors.Errorf("invalid seconds '%s'", value)
+	}
+	if sec == 0 {
+		return def, nil
+	}
+	if sec > p.opts.MaxProfileDuration.Seconds() {
+		return p.opts.MaxProfileDuration, nil
+	}
+
+	return time.Duration(sec * float64(time.Second)), nil
+}
+
 // profile responds with the pprof-formatted cpu profile.
+// Profiling lasts for duration specified in seconds GET parameter, or for 30 seconds if not specified,
+// up to the service's maximum profile duration.
 // The package initialization registers it as /debug/pprof/profile.
 func (p *pprofsvc) profile(w http.ResponseWriter, r *http.Request) {
 	ctx, span := p.tracer.Start(r.Context(), "index")
 	defer span.End()
-	sec, _ := strconv.ParseInt(r.FormValue("seconds"), 10, 64)
-	if sec == 0 {
-		sec = 30
+	duration, err := p.profileDuration(r, 30*time.Second)
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err)
+		return
 	}
 
 	// Set Content Type assuming StartCPUProfile will work,
@@ -102,19 +179,23 @@ func (p *pprofsvc) profile(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "Could not enable CPU profiling: %s\n", err)
 		return
 	}
-	sleep(ctx, time.Duration(sec)*time.Second)
+	sleep(ctx, duration)
 	pprof.StopCPUProfile()
 }
 
 // trace responds with the execution trace in binary form.
-// Tracing lasts for duration specified in seconds GET parameter, or for 1 second if not specified.
+// Tracing lasts for duration specified in seconds GET parameter, or for 1 second if not specified,
+// up to the service's maximum profile duration.
 // The package initialization registers it as /debug/pprof/trace.
 func (p *pprofsvc) trace(w http.ResponseWriter, r *http.Request) {
 	ctx, span := p.tracer.Start(r.Context(), "index")
 	defer span.End()
-	sec, err := strconv.ParseFloat(r.FormValue("seconds"), 64)
-	if sec <= 0 || err != nil {
-		sec = 1
+	duration, err := p.profileDuration(r, time.Second)
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err)
+		return
 	}
 
 	// Set Content Type assuming trace.Start will work,
@@ -128,7 +209,7 @@ func (p *pprofsvc) trace(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "Could not enable tracing: %s\n", err)
 		return
 	}
-	sleep(ctx, time.Duration(sec*float64(time.Second)))
+	sleep(ctx, duration)
 	runtimeTrace.Stop()
 }
 
@@ -151,7 +232,7 @@ func (p *pprofsvc) symbol(w http.ResponseWriter, r *http.Request) {
 
 	var b *bufio.Reader
 	if r.Method == "POST" {
-		b = bufio.NewReader(r.Body)
+		b = bufio.NewReader(http.MaxBytesReader(w, r.Body, p.opts.MaxSymbolRequestSize))
 	} else {
 		b = bufio.NewReader(strings.NewReader(r.URL.RawQuery))
 	}
@@ -172,6 +253,11 @@ func (p *pprofsvc) symbol(w http.ResponseWriter, r *http.Request) {
 		// Wait until here to check for err; the last
 		// symbol will have an err because it doesn't end in +.
 		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
 			if err != io.EOF {
 				fmt.Fprintf(&buf, "reading request: %v\n", err)
 			}
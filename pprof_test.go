@@ -0,0 +1,182 @@
+package logkeeper
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProfileDuration(t *testing.T) {
+	p := NewPProfSvc(PProfOptions{MaxProfileDuration: time.Minute})
+
+	for _, test := range []struct {
+		name             string
+		seconds          string
+		expectedDuration time.Duration
+		hasErr           bool
+	}{
+		{
+			name:             "Default",
+			expectedDuration: 30 * time.Second,
+		},
+		{
+			name:             "Zero",
+			seconds:          "0",
+			expectedDuration: 30 * time.Second,
+		},
+		{
+			name:             "WithinMax",
+			seconds:          "1.5",
+			expectedDuration: 1500 * time.Millisecond,
+		},
+		{
+			name:             "EqualToMax",
+			seconds:          "60",
+			expectedDuration: time.Minute,
+		},
+		{
+			name:             "ClampedToMax",
+			seconds:          "3600",
+			expectedDuration: time.Minute,
+		},
+		{
+			name:             "ClampedHugeValue",
+			seconds:          "1e300",
+			expectedDuration: time.Minute,
+		},
+		{
+			name:    "Negative",
+			seconds: "-1",
+			hasErr:  true,
+		},
+		{
+			name:    "NotANumber",
+			seconds: "abc",
+			hasErr:  true,
+		},
+		{
+			name:    "NaN",
+			seconds: "NaN",
+			hasErr:  true,
+		},
+		{
+			name:    "Inf",
+			seconds: "Inf",
+			hasErr:  true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/debug/pprof/profile", nil)
+			if test.seconds != "" {
+				r.URL.RawQuery = "seconds=" + test.seconds
+			}
+
+			duration, err := p.profileDuration(r, 30*time.Second)
+			if test.hasErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedDuration, duration)
+		})
+	}
+
+	t.Run("DefaultMax", func(t *testing.T) {
+		p := NewPProfSvc(PProfOptions{})
+		r := httptest.NewRequest(http.MethodGet, "/debug/pprof/profile?seconds=3600", nil)
+
+		duration, err := p.profileDuration(r, 30*time.Second)
+		require.NoError(t, err)
+		assert.Equal(t, defaultMaxProfileDuration, duration)
+	})
+}
+
+func TestProfileHandlers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler := NewPProfSvc(PProfOptions{MaxProfileDuration: 10 * time.Millisecond}).GetHandlerPprof(ctx)
+	for _, path := range []string{"/debug/pprof/profile", "/debug/pprof/trace"} {
+		t.Run(path, func(t *testing.T) {
+			t.Run("InvalidSeconds", func(t *testing.T) {
+				resp := doReq(t, handler, http.MethodGet, nil, path+"?seconds=-5", nil)
+				assert.Equal(t, http.StatusBadRequest, resp.Code)
+			})
+			t.Run("ClampedSeconds", func(t *testing.T) {
+				start := time.Now()
+				resp := doReq(t, handler, http.MethodGet, nil, path+"?seconds=3600", nil)
+				assert.Equal(t, http.StatusOK, resp.Code)
+				assert.Equal(t, "application/octet-stream", resp.Header().Get("Content-Type"))
+				assert.Less(t, time.Since(start), 10*time.Second)
+			})
+		})
+	}
+	t.Run("TraceDefault", func(t *testing.T) {
+		resp := doReq(t, handler, http.MethodGet, nil, "/debug/pprof/trace", nil)
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.NotEmpty(t, resp.Body.Bytes())
+	})
+}
+
+func TestPprofAuthorization(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	t.Run("NoToken", func(t *testing.T) {
+		handler := NewPProfSvc(PProfOptions{}).GetHandlerPprof(ctx)
+		resp := doReq(t, handler, http.MethodGet, nil, "/debug/pprof/cmdline", nil)
+		assert.Equal(t, http.StatusOK, resp.Code)
+	})
+
+	handler := NewPProfSvc(PProfOptions{Token: "token"}).GetHandlerPprof(ctx)
+	for _, test := range []struct {
+		name         string
+		headers      map[string]string
+		expectedCode int
+	}{
+		{name: "MissingToken", expectedCode: http.StatusUnauthorized},
+		{name: "WrongToken", headers: map[string]string{"Authorization": "Bearer nope"}, expectedCode: http.StatusUnauthorized},
+		{name: "NotBearer", headers: map[string]string{"Authorization": "token"}, expectedCode: http.StatusUnauthorized},
+		{name: "CorrectToken", headers: map[string]string{"Authorization": "Bearer token"}, expectedCode: http.StatusOK},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			for _, path := range []string{"/debug/pprof/", "/debug/pprof/cmdline", "/debug/pprof/heap"} {
+				resp := doReq(t, handler, http.MethodGet, test.headers, path, nil)
+				assert.Equal(t, test.expectedCode, resp.Code, path)
+				if test.expectedCode == http.StatusUnauthorized {
+					assert.Equal(t, "Bearer", resp.Header().Get("WWW-Authenticate"), path)
+				}
+			}
+		})
+	}
+}
+
+func TestSymbolRequestSize(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler := NewPProfSvc(PProfOptions{MaxSymbolRequestSize: 64}).GetHandlerPprof(ctx)
+	pc := reflect.ValueOf(NewPProfSvc).Pointer()
+
+	t.Run("WithinLimit", func(t *testing.T) {
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/debug/pprof/symbol", strings.NewReader(fmt.Sprintf("%#x", pc))))
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Contains(t, resp.Body.String(), fmt.Sprintf("%#x %s\n", pc, runtime.FuncForPC(pc).Name()))
+	})
+	t.Run("TooLarge", func(t *testing.T) {
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/debug/pprof/symbol", strings.NewReader(strings.Repeat(fmt.Sprintf("%#x+", pc), 100))))
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.Code)
+		assert.NotContains(t, resp.Body.String(), runtime.FuncForPC(pc).Name())
+	})
+}
@@ -0,0 +1,58 @@
+package logkeeper
+
+import (
+	"net/http"
+)
+
+// defaultContentSecurityPolicy allows the inline scripts and styles of the
+// HTML log views, the bootstrap stylesheet they load, and the origins the
+// lobster SPA fetches logs and task information from.
+const defaultContentSecurityPolicy = "default-src 'self'; " +
+	"script-src 'self' 'unsafe-inline'; " +
+	"style-src 'self' 'unsafe-inline' https://maxcdn.bootstrapcdn.com; " +
+	"font-src 'self' data: https://maxcdn.bootstrapcdn.com; " +
+	"img-src 'self' data:; " +
+	"connect-src 'self' https://logkeeper.mongodb.org https://evergreen.mongodb.com; " +
+	"frame-ancestors 'self'"
+
+// DefaultSecurityHeaders are the headers set on every response unless
+// configured otherwise.
+var DefaultSecurityHeaders = map[string]string{
+	"X-Content-Type-Options":  "nosniff",
+	"X-Frame-Options":         "SAMEORIGIN",
+	"Referrer-Policy":         "strict-origin-when-cross-origin",
+	"Content-Security-Policy": defaultContentSecurityPolicy,
+}
+
+// SecurityHeaders is a middleware that sets a fixed set of security headers
+// on every response.
+type SecurityHeaders struct {
+	headers http.Header
+}
+
+// NewSecurityHeaders returns a middleware that sets the given headers, keyed
+// by name, on every response. Headers with an empty value are skipped.
+func NewSecurityHeaders(headers map[string]string) *SecurityHeaders {
+	s := &SecurityHeaders{headers: http.Header{}}
+	for name, value := range headers {
+		if value != "" {
+			s.headers.Set(name, value)
+		}
+	}
+
+	return s
+}
+
+// Middleware sets the security headers before calling the next handler, which
+// may still override them. The response writer isn't wrapped, so streamed
+// responses are unaffected.
+func (s *SecurityHeaders) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header()
+		for name, values := range s.headers {
+			header[name] = append([]string(nil), values...)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
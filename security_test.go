@@ -0,0 +1,63 @@
+package logkeeper
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/evergreen-ci/logkeeper/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	defer testutil.SetBucket(t, "testdata/simple")()
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	lk := NewLogkeeper(LogkeeperOptions{URL: "https://logkeeper.com"})
+
+	t.Run("Defaults", func(t *testing.T) {
+		handler := NewSecurityHeaders(DefaultSecurityHeaders).Middleware(lk.NewRouter())
+		for _, url := range []string{
+			fmt.Sprintf("%s/build/%s", lk.opts.URL, buildID),
+			fmt.Sprintf("%s/build/%s/all?raw=true", lk.opts.URL, buildID),
+			fmt.Sprintf("%s/build/DNE", lk.opts.URL),
+		} {
+			resp := doReq(t, handler, http.MethodGet, nil, url, nil)
+			for name, value := range DefaultSecurityHeaders {
+				assert.Equal(t, value, resp.Header().Get(name), "header '%s' of '%s'", name, url)
+			}
+		}
+	})
+	t.Run("ContentSecurityPolicyAllowsAssets", func(t *testing.T) {
+		directives := map[string][]string{}
+		for _, directive := range strings.Split(DefaultSecurityHeaders["Content-Security-Policy"], ";") {
+			fields := strings.Fields(directive)
+			require.NotEmpty(t, fields)
+			directives[fields[0]] = fields[1:]
+		}
+
+		assert.Contains(t, directives["default-src"], "'self'")
+		assert.Contains(t, directives["script-src"], "'self'")
+		assert.Contains(t, directives["script-src"], "'unsafe-inline'")
+		assert.Contains(t, directives["style-src"], "'unsafe-inline'")
+		assert.Contains(t, directives["style-src"], "https://maxcdn.bootstrapcdn.com")
+		assert.Contains(t, directives["connect-src"], "'self'")
+		assert.Contains(t, directives["connect-src"], "https://logkeeper.mongodb.org")
+		assert.Contains(t, directives["connect-src"], "https://evergreen.mongodb.com")
+	})
+	t.Run("Configured", func(t *testing.T) {
+		handler := NewSecurityHeaders(map[string]string{
+			"x-content-type-options":    "nosniff",
+			"Strict-Transport-Security": "max-age=31536000",
+			"X-Frame-Options":           "",
+		}).Middleware(lk.NewRouter())
+
+		resp := doReq(t, handler, http.MethodGet, nil, fmt.Sprintf("%s/build/%s/all?raw=true", lk.opts.URL, buildID), nil)
+		require.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, "nosniff", resp.Header().Get("X-Content-Type-Options"))
+		assert.Equal(t, "max-age=31536000", resp.Header().Get("Strict-Transport-Security"))
+		assert.Empty(t, resp.Header().Values("X-Frame-Options"))
+		assert.Empty(t, resp.Header().Values("Content-Security-Policy"))
+	})
+}
@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"github.com/evergreen-ci/pail"
+	"github.com/mongodb/grip"
+	"github.com/pkg/errors"
+)
+
+// fallbackBucket is a bucket composed of an ordered list of buckets. Reads
+// try each bucket in order for as long as the key isn't found, while writes
+// only go to the primary, which is the first bucket. Any other error is
+// returned rather than hidden by an older copy in a later bucket. Removals
+// go to every bucket so that removed keys, such as released locks and deleted
+// logs, aren't read back from a later bucket.
+type fallbackBucket struct {
+	pail.Bucket
+	fallbacks []pail.Bucket
+}
+
+// NewFallbackBucket returns a bucket that reads from the buckets described by
+// opts in the given order, falling back to the next bucket when a key isn't
+// found, and writes only to the first. This is useful for reading logs that
+// haven't been migrated from a secondary location yet.
+func NewFallbackBucket(opts ...BucketOpts) (Bucket, error) {
+	if len(opts) == 0 {
+		return Bucket{}, errors.New("must specify at least one bucket")
+	}
+
+	buckets := make([]pail.Bucket, 0, len(opts))
+	listsKeyPrefixes := true
+	for i := range opts {
+		bucket, err := opts[i].getBucket()
+		if err != nil {
+			return Bucket{}, errors.Wrapf(err, "making bucket %d", i)
+		}
+		buckets = append(buckets, bucket)
+		listsKeyPrefixes = listsKeyPrefixes && opts[i].Location == PailS3
+	}
+	if len(buckets) == 1 {
+		return Bucket{Bucket: buckets[0], listsKeyPrefixes: listsKeyPrefixes}, nil
+	}
+
+	return Bucket{Bucket: newFallbackBucket(buckets[0], buckets[1:]...), listsKeyPrefixes: listsKeyPrefixes}, nil
+}
+
+func newFallbackBucket(primary pail.Bucket, fallbacks ...pail.Bucket) *fallbackBucket {
+	return &fallbackBucket{Bucket: primary, fallbacks: fallbacks}
+}
+
+func (b *fallbackBucket) buckets() []pail.Bucket {
+	return append([]pail.Bucket{b.Bucket}, b.fallbacks...)
+}
+
+// Get returns a reader for the given key from the first bucket that has it.
+// If no bucket has it, the primary's not found error is returned.
+func (b *fallbackBucket) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	var firstErr error
+	for _, bucket := range b.buckets() {
+		r, err := bucket.Get(ctx, key)
+		if err == nil {
+			return r, nil
+		}
+		if !isNotFoundError(err) {
+			return nil, err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return nil, firstErr
+}
+
+// Reader is the same as Get.
+func (b *fallbackBucket) Reader(ctx context.Context, key string) (io.ReadCloser, error) {
+	return b.Get(ctx, key)
+}
+
+// Download writes the contents of the given key from the first bucket that
+// has it to the local path.
+func (b *fallbackBucket) Download(ctx context.Context, key, path string) error {
+	var firstErr error
+	for _, bucket := range b.buckets() {
+		err := bucket.Download(ctx, key, path)
+		if err == nil {
+			return nil
+		}
+		if !isNotFoundError(err) {
+			return err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// Exists returns whether the given key exists in any of the buckets.
+func (b *fallbackBucket) Exists(ctx context.Context, key string) (bool, error) {
+	for _, bucket := range b.buckets() {
+		exists, err := bucket.Exists(ctx, key)
+		if err != nil {
+			return false, err
+		}
+		if exists {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// List returns an iterator over the keys with the given prefix in the first
+// bucket that has any. If no bucket has a key with the prefix, the primary's
+// empty listing is returned.
+func (b *fallbackBucket) List(ctx context.Context, prefix string) (pail.BucketIterator, error) {
+	for _, bucket := range b.buckets() {
+		it, err := bucket.List(ctx, prefix)
+		if isNotFoundError(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if it.Next(ctx) {
+			return &peekedIterator{BucketIterator: it, peeked: true}, nil
+		}
+		if err = it.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return b.Bucket.List(ctx, prefix)
+}
+
+// Remove removes the given key from every bucket.
+func (b *fallbackBucket) Remove(ctx context.Context, key string) error {
+	return b.removeFromAll(func(bucket pail.Bucket) error { return bucket.Remove(ctx, key) })
+}
+
+// RemoveMany removes the given keys from every bucket.
+func (b *fallbackBucket) RemoveMany(ctx context.Context, keys ...string) error {
+	return b.removeFromAll(func(bucket pail.Bucket) error { return bucket.RemoveMany(ctx, keys...) })
+}
+
+// RemovePrefix removes the keys with the given prefix from every bucket.
+func (b *fallbackBucket) RemovePrefix(ctx context.Context, prefix string) error {
+	return b.removeFromAll(func(bucket pail.Bucket) error { return bucket.RemovePrefix(ctx, prefix) })
+}
+
+// RemoveMatching removes the keys matching the given expression from every
+// bucket.
+func (b *fallbackBucket) RemoveMatching(ctx context.Context, expression string) error {
+	return b.removeFromAll(func(bucket pail.Bucket) error { return bucket.RemoveMatching(ctx, expression) })
+}
+
+// removeFromAll calls remove with every bucket, ignoring keys that a bucket
+// never had.
+func (b *fallbackBucket) removeFromAll(remove func(pail.Bucket) error) error {
+	catcher := grip.NewBasicCatcher()
+	for i, bucket := range b.buckets() {
+		if err := remove(bucket); err != nil && !isNotFoundError(err) {
+			catcher.Wrapf(err, "removing from bucket %d", i)
+		}
+	}
+
+	return catcher.Resolve()
+}
+
+// isNotFoundError returns whether the error is due to a key, or for local
+// buckets the directory listed, not existing.
+func isNotFoundError(err error) bool {
+	return err != nil && (pail.IsKeyNotFoundError(err) || os.IsNotExist(errors.Cause(err)))
+}
+
+// peekedIterator is an iterator whose first item has already been advanced
+// to.
+type peekedIterator struct {
+	pail.BucketIterator
+	peeked bool
+}
+
+func (it *peekedIterator) Next(ctx context.Context) bool {
+	if it.peeked {
+		it.peeked = false
+		return true
+	}
+
+	return it.BucketIterator.Next(ctx)
+}
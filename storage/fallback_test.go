@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/evergreen-ci/pail"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFallbackBucket(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	newBuckets := func(t *testing.T) (Bucket, Bucket, Bucket) {
+		primaryPath := t.TempDir()
+		secondaryPath := t.TempDir()
+		primary, err := NewBucket(BucketOpts{Location: PailLocal, Path: primaryPath})
+		require.NoError(t, err)
+		secondary, err := NewBucket(BucketOpts{Location: PailLocal, Path: secondaryPath})
+		require.NoError(t, err)
+		fallback, err := NewFallbackBucket(
+			BucketOpts{Location: PailLocal, Path: primaryPath},
+			BucketOpts{Location: PailLocal, Path: secondaryPath},
+		)
+		require.NoError(t, err)
+
+		return primary, secondary, fallback
+	}
+
+	t.Run("NoBuckets", func(t *testing.T) {
+		_, err := NewFallbackBucket()
+		assert.Error(t, err)
+	})
+	t.Run("GetFromSecondary", func(t *testing.T) {
+		_, secondary, fallback := newBuckets(t)
+		require.NoError(t, secondary.Put(ctx, "prefix/key", strings.NewReader("secondary")))
+
+		r, err := fallback.Get(ctx, "prefix/key")
+		require.NoError(t, err)
+		data, err := io.ReadAll(r)
+		require.NoError(t, r.Close())
+		require.NoError(t, err)
+		assert.Equal(t, "secondary", string(data))
+
+		exists, err := fallback.Exists(ctx, "prefix/key")
+		require.NoError(t, err)
+		assert.True(t, exists)
+	})
+	t.Run("PrimaryTakesPrecedence", func(t *testing.T) {
+		primary, secondary, fallback := newBuckets(t)
+		require.NoError(t, primary.Put(ctx, "key", strings.NewReader("primary")))
+		require.NoError(t, secondary.Put(ctx, "key", strings.NewReader("secondary")))
+
+		r, err := fallback.Get(ctx, "key")
+		require.NoError(t, err)
+		data, err := io.ReadAll(r)
+		require.NoError(t, r.Close())
+		require.NoError(t, err)
+		assert.Equal(t, "primary", string(data))
+	})
+	t.Run("MissingEverywhere", func(t *testing.T) {
+		_, _, fallback := newBuckets(t)
+
+		_, err := fallback.Get(ctx, "key")
+		require.Error(t, err)
+		assert.True(t, pail.IsKeyNotFoundError(err))
+
+		exists, err := fallback.Exists(ctx, "key")
+		require.NoError(t, err)
+		assert.False(t, exists)
+	})
+	t.Run("ListFromSecondary", func(t *testing.T) {
+		_, secondary, fallback := newBuckets(t)
+		require.NoError(t, secondary.Put(ctx, "prefix/k0", strings.NewReader("v0")))
+		require.NoError(t, secondary.Put(ctx, "prefix/k1", strings.NewReader("v1")))
+
+		it, err := fallback.List(ctx, "prefix")
+		require.NoError(t, err)
+		var keys []string
+		for it.Next(ctx) {
+			keys = append(keys, it.Item().Name())
+		}
+		require.NoError(t, it.Err())
+		assert.Equal(t, []string{"prefix/k0", "prefix/k1"}, keys)
+	})
+	t.Run("WritesGoToPrimary", func(t *testing.T) {
+		primary, secondary, fallback := newBuckets(t)
+		require.NoError(t, fallback.Put(ctx, "key", strings.NewReader("v")))
+
+		exists, err := primary.Exists(ctx, "key")
+		require.NoError(t, err)
+		assert.True(t, exists)
+		exists, err = secondary.Exists(ctx, "key")
+		require.NoError(t, err)
+		assert.False(t, exists)
+	})
+	t.Run("RemovalsReachSecondaries", func(t *testing.T) {
+		primary, secondary, fallback := newBuckets(t)
+		require.NoError(t, primary.Put(ctx, "prefix/k0", strings.NewReader("primary")))
+		require.NoError(t, secondary.Put(ctx, "prefix/k0", strings.NewReader("secondary")))
+		require.NoError(t, secondary.Put(ctx, "prefix/k1", strings.NewReader("secondary")))
+
+		require.NoError(t, fallback.Remove(ctx, "prefix/k0"))
+		_, err := fallback.Get(ctx, "prefix/k0")
+		require.Error(t, err)
+		assert.True(t, pail.IsKeyNotFoundError(err))
+
+		require.NoError(t, fallback.RemoveMany(ctx, "prefix/k1"))
+		exists, err := fallback.Exists(ctx, "prefix/k1")
+		require.NoError(t, err)
+		assert.False(t, exists)
+	})
+	t.Run("PrimaryErrorsAreReturned", func(t *testing.T) {
+		primary, secondary, _ := newBuckets(t)
+		require.NoError(t, secondary.Put(ctx, "key", strings.NewReader("secondary")))
+		fallback := newFallbackBucket(failingGetBucket{Bucket: primary.Bucket}, secondary.Bucket)
+
+		_, err := fallback.Get(ctx, "key")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "get failed")
+	})
+}
+
+type failingGetBucket struct {
+	pail.Bucket
+}
+
+func (b failingGetBucket) Get(context.Context, string) (io.ReadCloser, error) {
+	return nil, errors.New("get failed")
+}
@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/evergreen-ci/pail"
+)
+
+const (
+	OperationGet    = "get"
+	OperationPut    = "put"
+	OperationList   = "list"
+	OperationExists = "exists"
+
+	// maxLatencySamples bounds the number of latencies kept for each
+	// operation between flushes. Operations are still counted once the
+	// limit is reached.
+	maxLatencySamples = 100000
+)
+
+// OperationStats describes the bucket operations of a single type performed
+// since the stats were last flushed.
+type OperationStats struct {
+	Count     int
+	LatencyMS []float64
+}
+
+var operationStats = struct {
+	sync.Mutex
+	byOperation map[string]OperationStats
+}{byOperation: make(map[string]OperationStats)}
+
+func recordOperation(operation string, start time.Time) {
+	latency := float64(time.Since(start)) / float64(time.Millisecond)
+
+	operationStats.Lock()
+	defer operationStats.Unlock()
+
+	stats := operationStats.byOperation[operation]
+	stats.Count++
+	if len(stats.LatencyMS) < maxLatencySamples {
+		stats.LatencyMS = append(stats.LatencyMS, latency)
+	}
+	operationStats.byOperation[operation] = stats
+}
+
+// FlushOperationStats returns the stats, keyed by operation, of the bucket
+// operations performed since the last flush and resets them.
+func FlushOperationStats() map[string]OperationStats {
+	operationStats.Lock()
+	defer operationStats.Unlock()
+
+	stats := operationStats.byOperation
+	operationStats.byOperation = make(map[string]OperationStats)
+
+	return stats
+}
+
+// Get records the operation and returns a reader for the given key.
+func (b Bucket) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	defer recordOperation(OperationGet, time.Now())
+	return b.Bucket.Get(ctx, key)
+}
+
+// Put records the operation and uploads the contents of r to the given key.
+func (b Bucket) Put(ctx context.Context, key string, r io.Reader) error {
+	defer recordOperation(OperationPut, time.Now())
+	return b.Bucket.Put(ctx, key, r)
+}
+
+// List records the operation and returns an iterator over the keys with the
+// given prefix. The recorded latency does not include any requests made
+// while iterating.
+func (b Bucket) List(ctx context.Context, prefix string) (pail.BucketIterator, error) {
+	defer recordOperation(OperationList, time.Now())
+	return b.Bucket.List(ctx, prefix)
+}
+
+// Exists records the operation and returns whether the given key exists.
+func (b Bucket) Exists(ctx context.Context, key string) (bool, error) {
+	defer recordOperation(OperationExists, time.Now())
+	return b.Bucket.Exists(ctx, key)
+}
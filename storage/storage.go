@@ -1,21 +1,39 @@
 package storage
 
 import (
+	"context"
 	"os"
+	"strconv"
+	"sync"
 
 	"github.com/evergreen-ci/pail"
+	"github.com/mongodb/grip"
 	"github.com/pkg/errors"
 )
 
 const (
-	s3BucketEnvVariable = "LK_S3_LOGS_BUCKET"
-	defaultS3Region     = "us-east-1"
+	s3BucketEnvVariable             = "LK_S3_LOGS_BUCKET"
+	s3KeyEnvVariable                = "AWS_KEY"
+	s3SecretEnvVariable             = "AWS_SECRET"
+	s3DefaultCredentialsEnvVariable = "LK_S3_USE_DEFAULT_CREDENTIALS"
+	defaultS3Region                 = "us-east-1"
 
 	localBucketPermissions = 0750
+
+	// pingKey is the key checked for by Ping. It needn't exist.
+	pingKey = "ping"
+
+	// DefaultRemoveConcurrency is the number of keys removed at once when no
+	// concurrency is specified.
+	DefaultRemoveConcurrency = 16
 )
 
 type Bucket struct {
 	pail.Bucket
+
+	// listsKeyPrefixes is whether List returns every key starting with
+	// the given prefix.
+	listsKeyPrefixes bool
 }
 
 type PailType int
@@ -35,7 +53,14 @@ func NewBucket(opts BucketOpts) (Bucket, error) {
 	if err != nil {
 		return Bucket{}, errors.Wrap(err, "making bucket")
 	}
-	return Bucket{bucket}, nil
+	return Bucket{Bucket: bucket, listsKeyPrefixes: opts.Location == PailS3}, nil
+}
+
+// ListsKeyPrefixes returns whether listing the bucket returns every key that
+// starts with the given prefix, as S3 does, rather than only the keys under
+// the directory the prefix names, as local buckets do.
+func (b Bucket) ListsKeyPrefixes() bool {
+	return b.listsKeyPrefixes
 }
 
 func (opts *BucketOpts) getBucket() (pail.Bucket, error) {
@@ -55,7 +80,7 @@ func (opts *BucketOpts) getBucket() (pail.Bucket, error) {
 			return nil, errors.Wrapf(err, "creating local bucket at '%s'", opts.Path)
 		}
 
-		return Bucket{localBucket}, nil
+		return localBucket, nil
 	case PailS3:
 		s3Options, err := opts.getS3Options()
 		if err != nil {
@@ -66,7 +91,7 @@ func (opts *BucketOpts) getBucket() (pail.Bucket, error) {
 			return nil, errors.Wrap(err, "creating S3 bucket")
 		}
 
-		return Bucket{s3Bucket}, nil
+		return s3Bucket, nil
 	default:
 		return nil, errors.Errorf("unknown location '%d'", opts.Location)
 	}
@@ -81,9 +106,81 @@ func (opts *BucketOpts) getS3Options() (pail.S3Options, error) {
 		return pail.S3Options{}, errors.Errorf("path is specified neither in options nor in the environment variable '%s'", s3BucketEnvVariable)
 	}
 
-	return pail.S3Options{
+	s3Opts := pail.S3Options{
 		Name:     bucketName,
 		Region:   defaultS3Region,
 		Compress: true,
-	}, nil
+	}
+
+	// Explicit static credentials always take precedence. Otherwise, the
+	// default AWS credential chain (environment, shared config, instance
+	// profile, or web identity) is only used when it is explicitly opted
+	// into so that missing keys are not silently ignored.
+	key := os.Getenv(s3KeyEnvVariable)
+	secret := os.Getenv(s3SecretEnvVariable)
+	switch {
+	case key != "" && secret != "":
+		s3Opts.Credentials = pail.CreateAWSCredentials(key, secret, "")
+	case key != "" || secret != "":
+		return pail.S3Options{}, errors.Errorf("both '%s' and '%s' must be specified to use static credentials", s3KeyEnvVariable, s3SecretEnvVariable)
+	case useDefaultCredentials():
+		// Leaving the credentials unset defers to the default
+		// credential chain.
+	default:
+		return pail.S3Options{}, errors.Errorf("credentials are specified neither in the environment variables '%s' and '%s' nor by enabling the default credential chain with '%s'", s3KeyEnvVariable, s3SecretEnvVariable, s3DefaultCredentialsEnvVariable)
+	}
+
+	return s3Opts, nil
+}
+
+// useDefaultCredentials returns whether the environment opts into using the
+// default AWS credential chain.
+func useDefaultCredentials() bool {
+	useDefault, err := strconv.ParseBool(os.Getenv(s3DefaultCredentialsEnvVariable))
+	return err == nil && useDefault
+}
+
+// Ping returns an error if the bucket can't be reached. Unlike Exists, the
+// check is not recorded in the operation stats.
+func (b Bucket) Ping(ctx context.Context) error {
+	_, err := b.Bucket.Exists(ctx, pingKey)
+	return errors.Wrap(err, "pinging bucket")
+}
+
+// RemoveConcurrently removes the given keys using up to concurrency workers,
+// or DefaultRemoveConcurrency if concurrency is not positive. A failed removal
+// doesn't stop the remaining ones; the returned error names every key that
+// couldn't be removed.
+func (b Bucket) RemoveConcurrently(ctx context.Context, keys []string, concurrency int) error {
+	if concurrency <= 0 {
+		concurrency = DefaultRemoveConcurrency
+	}
+	if concurrency > len(keys) {
+		concurrency = len(keys)
+	}
+
+	catcher := grip.NewBasicCatcher()
+	toRemove := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range toRemove {
+				catcher.Wrapf(b.Remove(ctx, key), "removing key '%s'", key)
+			}
+		}()
+	}
+
+	for i, key := range keys {
+		if err := ctx.Err(); err != nil {
+			catcher.Wrapf(err, "removing remaining %d keys", len(keys)-i)
+			break
+		}
+		toRemove <- key
+	}
+	close(toRemove)
+	wg.Wait()
+
+	return catcher.Resolve()
 }
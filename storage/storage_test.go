@@ -1,9 +1,14 @@
 package storage
 
 import (
+	"context"
+	"fmt"
 	"os"
+	"strings"
 	"testing"
 
+	"github.com/evergreen-ci/pail"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -13,6 +18,7 @@ func TestGetS3Options(t *testing.T) {
 
 	t.Run("MissingBucketAndPath", func(t *testing.T) {
 		os.Clearenv()
+		require.NoError(t, os.Setenv(s3DefaultCredentialsEnvVariable, "true"))
 
 		opts := BucketOpts{}
 		_, err := opts.getS3Options()
@@ -21,6 +27,7 @@ func TestGetS3Options(t *testing.T) {
 
 	t.Run("MissingPathWithBucket", func(t *testing.T) {
 		os.Clearenv()
+		require.NoError(t, os.Setenv(s3DefaultCredentialsEnvVariable, "true"))
 
 		bucket := "the_bucket"
 		require.NoError(t, os.Setenv(s3BucketEnvVariable, bucket))
@@ -33,6 +40,7 @@ func TestGetS3Options(t *testing.T) {
 
 	t.Run("MissingBucketWithPath", func(t *testing.T) {
 		os.Clearenv()
+		require.NoError(t, os.Setenv(s3DefaultCredentialsEnvVariable, "true"))
 
 		path := "the_path"
 		opts := BucketOpts{Path: path}
@@ -40,4 +48,193 @@ func TestGetS3Options(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Equal(t, path, s3Opts.Name)
 	})
+
+	t.Run("ExplicitKeys", func(t *testing.T) {
+		os.Clearenv()
+		require.NoError(t, os.Setenv(s3KeyEnvVariable, "key"))
+		require.NoError(t, os.Setenv(s3SecretEnvVariable, "secret"))
+
+		opts := BucketOpts{Path: "the_path"}
+		s3Opts, err := opts.getS3Options()
+		require.NoError(t, err)
+		require.NotNil(t, s3Opts.Credentials)
+		creds, err := s3Opts.Credentials.Get()
+		require.NoError(t, err)
+		assert.Equal(t, "key", creds.AccessKeyID)
+		assert.Equal(t, "secret", creds.SecretAccessKey)
+	})
+
+	t.Run("ExplicitKeysTakePrecedenceOverDefaultChain", func(t *testing.T) {
+		os.Clearenv()
+		require.NoError(t, os.Setenv(s3KeyEnvVariable, "key"))
+		require.NoError(t, os.Setenv(s3SecretEnvVariable, "secret"))
+		require.NoError(t, os.Setenv(s3DefaultCredentialsEnvVariable, "true"))
+
+		opts := BucketOpts{Path: "the_path"}
+		s3Opts, err := opts.getS3Options()
+		require.NoError(t, err)
+		assert.NotNil(t, s3Opts.Credentials)
+	})
+
+	t.Run("DefaultChain", func(t *testing.T) {
+		os.Clearenv()
+		require.NoError(t, os.Setenv(s3DefaultCredentialsEnvVariable, "true"))
+
+		opts := BucketOpts{Path: "the_path"}
+		s3Opts, err := opts.getS3Options()
+		require.NoError(t, err)
+		assert.Nil(t, s3Opts.Credentials)
+	})
+
+	t.Run("MissingCredentials", func(t *testing.T) {
+		os.Clearenv()
+
+		opts := BucketOpts{Path: "the_path"}
+		_, err := opts.getS3Options()
+		assert.Error(t, err)
+	})
+
+	t.Run("DefaultChainDisabled", func(t *testing.T) {
+		os.Clearenv()
+		require.NoError(t, os.Setenv(s3DefaultCredentialsEnvVariable, "false"))
+
+		opts := BucketOpts{Path: "the_path"}
+		_, err := opts.getS3Options()
+		assert.Error(t, err)
+	})
+
+	t.Run("PartialKeys", func(t *testing.T) {
+		os.Clearenv()
+		require.NoError(t, os.Setenv(s3KeyEnvVariable, "key"))
+		require.NoError(t, os.Setenv(s3DefaultCredentialsEnvVariable, "true"))
+
+		opts := BucketOpts{Path: "the_path"}
+		_, err := opts.getS3Options()
+		assert.Error(t, err)
+	})
+}
+
+func TestBucketOperationStats(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bucket, err := NewBucket(BucketOpts{Location: PailLocal, Path: t.TempDir()})
+	require.NoError(t, err)
+	FlushOperationStats()
+
+	require.NoError(t, bucket.Put(ctx, "k0", strings.NewReader("v0")))
+	require.NoError(t, bucket.Put(ctx, "k1", strings.NewReader("v1")))
+	r, err := bucket.Get(ctx, "k0")
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	_, err = bucket.List(ctx, "")
+	require.NoError(t, err)
+	_, err = bucket.Exists(ctx, "k2")
+	require.NoError(t, err)
+
+	stats := FlushOperationStats()
+	assert.Equal(t, 2, stats[OperationPut].Count)
+	assert.Len(t, stats[OperationPut].LatencyMS, 2)
+	assert.Equal(t, 1, stats[OperationGet].Count)
+	assert.Equal(t, 1, stats[OperationList].Count)
+	assert.Equal(t, 1, stats[OperationExists].Count)
+
+	assert.Empty(t, FlushOperationStats())
+}
+
+func TestListsKeyPrefixes(t *testing.T) {
+	t.Setenv(s3KeyEnvVariable, "key")
+	t.Setenv(s3SecretEnvVariable, "secret")
+	s3Opts := BucketOpts{Location: PailS3, Path: "the_bucket"}
+	localOpts := BucketOpts{Location: PailLocal, Path: t.TempDir()}
+
+	bucket, err := NewBucket(s3Opts)
+	require.NoError(t, err)
+	assert.True(t, bucket.ListsKeyPrefixes())
+
+	bucket, err = NewBucket(localOpts)
+	require.NoError(t, err)
+	assert.False(t, bucket.ListsKeyPrefixes())
+
+	bucket, err = NewFallbackBucket(s3Opts, s3Opts)
+	require.NoError(t, err)
+	assert.True(t, bucket.ListsKeyPrefixes())
+
+	bucket, err = NewFallbackBucket(s3Opts, localOpts)
+	require.NoError(t, err)
+	assert.False(t, bucket.ListsKeyPrefixes())
+}
+
+type failingRemoveBucket struct {
+	pail.Bucket
+	failKey string
+}
+
+func (b failingRemoveBucket) Remove(ctx context.Context, key string) error {
+	if key == b.failKey {
+		return errors.New("remove failed")
+	}
+
+	return b.Bucket.Remove(ctx, key)
+}
+
+func TestRemoveConcurrently(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	newBucket := func(t *testing.T, numKeys int) (Bucket, []string) {
+		bucket, err := NewBucket(BucketOpts{Location: PailLocal, Path: t.TempDir()})
+		require.NoError(t, err)
+
+		keys := make([]string, numKeys)
+		for i := range keys {
+			keys[i] = fmt.Sprintf("prefix/k%d", i)
+			require.NoError(t, bucket.Put(ctx, keys[i], strings.NewReader("v")))
+		}
+
+		return bucket, keys
+	}
+	remainingKeys := func(t *testing.T, bucket Bucket) []string {
+		iter, err := bucket.List(ctx, "prefix")
+		require.NoError(t, err)
+
+		var keys []string
+		for iter.Next(ctx) {
+			keys = append(keys, iter.Item().Name())
+		}
+		require.NoError(t, iter.Err())
+
+		return keys
+	}
+
+	t.Run("AllKeys", func(t *testing.T) {
+		bucket, keys := newBucket(t, 500)
+		require.NoError(t, bucket.RemoveConcurrently(ctx, keys, 8))
+		assert.Empty(t, remainingKeys(t, bucket))
+	})
+	t.Run("DefaultConcurrency", func(t *testing.T) {
+		bucket, keys := newBucket(t, 50)
+		require.NoError(t, bucket.RemoveConcurrently(ctx, keys, 0))
+		assert.Empty(t, remainingKeys(t, bucket))
+	})
+	t.Run("NoKeys", func(t *testing.T) {
+		bucket, _ := newBucket(t, 0)
+		assert.NoError(t, bucket.RemoveConcurrently(ctx, nil, 8))
+	})
+	t.Run("FailingKey", func(t *testing.T) {
+		bucket, keys := newBucket(t, 100)
+		failing := Bucket{Bucket: failingRemoveBucket{Bucket: bucket.Bucket, failKey: keys[10]}}
+
+		err := failing.RemoveConcurrently(ctx, keys, 8)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), keys[10])
+		assert.Equal(t, []string{keys[10]}, remainingKeys(t, bucket))
+	})
+	t.Run("CanceledContext", func(t *testing.T) {
+		bucket, keys := newBucket(t, 10)
+		canceledCtx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		assert.Error(t, bucket.RemoveConcurrently(canceledCtx, keys, 8))
+	})
 }
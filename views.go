@@ -1,11 +1,18 @@
 package logkeeper
 
 import (
+	"bufio"
+	"compress/gzip"
 	"context"
+	"crypto/subtle"
+	"encoding/json"
 	"fmt"
 	"html/template"
+	"io"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -16,6 +23,7 @@ import (
 	"go.opentelemetry.io/otel/codes"
 
 	"github.com/evergreen-ci/logkeeper/model"
+	"github.com/evergreen-ci/logkeeper/storage"
 	"github.com/evergreen-ci/render"
 	"github.com/evergreen-ci/utility"
 	"github.com/gorilla/handlers"
@@ -23,6 +31,7 @@ import (
 	"github.com/mongodb/grip"
 	"github.com/mongodb/grip/message"
 	"github.com/mongodb/grip/recovery"
+	"github.com/pkg/errors"
 	otelTrace "go.opentelemetry.io/otel/trace"
 )
 
@@ -30,7 +39,16 @@ const (
 	corsOriginsEnvVariable = "LK_CORS_ORIGINS"
 	evergreenEnvVariable   = "LK_EVERGREEN_ORIGIN"
 	parsleyEnvVariable     = "LK_PARSLEY_ORIGIN"
+	maintenanceEnvVariable = "LK_MAINTENANCE_TOKEN"
+	scrubbedHeader         = "X-Logkeeper-Scrubbed"
+	buildIDHeader          = "X-Logkeeper-Build-Id"
+	testIDHeader           = "X-Logkeeper-Test-Id"
 	maxLogBytes            = 4 * bytesPerMB // 4 MB
+
+	defaultRawBufferSize    = 64 * 1024
+	defaultRawFlushInterval = time.Second
+
+	defaultSSEHeartbeatInterval = 15 * time.Second
 )
 
 var corsOrigins []string
@@ -59,9 +77,31 @@ func addCORSHeaders(w http.ResponseWriter, r *http.Request) {
 type apiError struct {
 	Err     string `json:"err"`
 	MaxSize int    `json:"max_size,omitempty"`
+	// TraceID and SpanID identify the span that handled the failed
+	// request, if it was traced.
+	TraceID string `json:"trace_id,omitempty"`
+	SpanID  string `json:"span_id,omitempty"`
 	code    int
 }
 
+// writeError writes the error as JSON with the given status code. If the
+// request is traced, the error includes the IDs of the trace and of the span
+// in ctx so that it can be looked up.
+func (lk *logkeeper) writeError(ctx context.Context, w http.ResponseWriter, code int, err apiError) {
+	if spanContext := otelTrace.SpanFromContext(ctx).SpanContext(); spanContext.IsValid() {
+		err.TraceID = spanContext.TraceID().String()
+		err.SpanID = spanContext.SpanID().String()
+	}
+
+	lk.render.WriteJSON(w, code, err)
+}
+
+type buildFetchResponse struct {
+	build   *model.Build
+	tests   []model.Test
+	hasLogs bool
+}
+
 type logFetchResponse struct {
 	logLines chan *model.LogLineItem
 	build    *model.Build
@@ -88,12 +128,86 @@ type LogkeeperOptions struct {
 	URL string
 	// MaxRequestSize is the maximum allowable request size.
 	MaxRequestSize int
+	// RawBufferSize is the size in bytes of the buffer raw log lines are
+	// written through. Defaults to 64 KB.
+	RawBufferSize int
+	// RawFlushInterval is how often buffered raw log lines are flushed to
+	// the client while streaming. Defaults to 1 second.
+	RawFlushInterval time.Duration
+	// DisableLobsterRedirect, if set, serves the built-in HTML log view to
+	// requests that would otherwise be redirected to lobster.
+	DisableLobsterRedirect bool
+	// CompressionLevel is the gzip level log downloads are compressed with
+	// for clients that accept it, trading CPU for size. Defaults to
+	// gzip.DefaultCompression.
+	CompressionLevel int
+	// SSEHeartbeatInterval is how long a server-sent event stream may be
+	// idle before a heartbeat is sent to keep proxies from closing it.
+	// Defaults to 15 seconds.
+	SSEHeartbeatInterval time.Duration
+	// MaxStreamDuration is how long a server-sent event stream may last
+	// before it's ended with a final end event. Zero or less leaves streams
+	// bounded only by the server's write timeout.
+	MaxStreamDuration time.Duration
+	// ServeOrphanedTestLogs, if set, serves the lines of a test that has
+	// chunks but no metadata, without any of the build's lines, rather
+	// than responding that the test wasn't found. Disabled by default,
+	// since such a test's lines can't be placed among the build's.
+	ServeOrphanedTestLogs bool
+	// Prefetch, if set, tunes how far ahead of slow clients log chunks are
+	// downloaded. By default, the next batch of chunks is only downloaded
+	// once the current one is exhausted.
+	Prefetch *model.PrefetchOptions
+	// TemplateDirectory is the directory HTML views are rendered from.
+	// Defaults to DefaultTemplateDirectory.
+	TemplateDirectory string
+}
+
+// DefaultTemplateDirectory is the directory HTML views are rendered from by
+// default, relative to the working directory.
+const DefaultTemplateDirectory = "templates"
+
+// requiredTemplates are the templates, relative to the template directory,
+// that HTML views are rendered from.
+var requiredTemplates = []string{"build.html", "test.html", "lobster/build/index.html"}
+
+// ValidateTemplates returns an error listing the templates HTML views are
+// rendered from that are missing from the given directory. Templates are
+// otherwise only read when a view is first rendered, so a missing template
+// would only surface as failing requests.
+func ValidateTemplates(dir string) error {
+	var missing []string
+	for _, name := range requiredTemplates {
+		info, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil || !info.Mode().IsRegular() {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return errors.Errorf("template directory '%s' is missing templates: %s", dir, strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// ValidateCompressionLevel returns an error if the given level is neither
+// gzip.DefaultCompression nor between gzip.BestSpeed and
+// gzip.BestCompression.
+func ValidateCompressionLevel(level int) error {
+	if level != gzip.DefaultCompression && (level < gzip.BestSpeed || level > gzip.BestCompression) {
+		return errors.Errorf("compression level %d must be between %d and %d, or %d for the default", level, gzip.BestSpeed, gzip.BestCompression, gzip.DefaultCompression)
+	}
+
+	return nil
 }
 
 // NewLogkeeper returns a new Logkeeper REST service with the given options.
 func NewLogkeeper(opts LogkeeperOptions) *logkeeper {
+	if opts.TemplateDirectory == "" {
+		opts.TemplateDirectory = DefaultTemplateDirectory
+	}
 	r := render.New(render.Options{
-		Directory: "templates",
+		Directory: opts.TemplateDirectory,
 		HtmlFuncs: template.FuncMap{
 			"MutableVar": func() interface{} {
 				return &MutableVar{""}
@@ -106,6 +220,19 @@ func NewLogkeeper(opts LogkeeperOptions) *logkeeper {
 			},
 		},
 	})
+	if opts.RawBufferSize <= 0 {
+		opts.RawBufferSize = defaultRawBufferSize
+	}
+	if opts.RawFlushInterval <= 0 {
+		opts.RawFlushInterval = defaultRawFlushInterval
+	}
+	if opts.CompressionLevel == 0 {
+		opts.CompressionLevel = gzip.DefaultCompression
+	}
+	if opts.SSEHeartbeatInterval <= 0 {
+		opts.SSEHeartbeatInterval = defaultSSEHeartbeatInterval
+	}
+
 	tracer := otel.GetTracerProvider().Tracer("github.com/evergreen-ci/logkeeper/logkeeper")
 	return &logkeeper{render: r, opts: opts, tracer: tracer}
 }
@@ -157,6 +284,24 @@ func recordError(ctx context.Context, err error) {
 	span.RecordError(err)
 }
 
+// writeMetadataJSON writes the metadata as JSON, indented unless the request
+// asks for compact JSON with pretty=false.
+func (lk *logkeeper) writeMetadataJSON(w http.ResponseWriter, r *http.Request, data interface{}) {
+	if r.FormValue("pretty") != "false" {
+		lk.render.WriteJSON(w, http.StatusOK, data)
+		return
+	}
+
+	out, err := json.Marshal(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(out)
+}
+
 ///////////////////////////////////////////////////////////////////////////////
 //
 // GET /build/{build_id}
@@ -171,44 +316,44 @@ func (lk *logkeeper) viewBuild(w http.ResponseWriter, r *http.Request) {
 
 	recordAttributes(ctx, attribute.String("evergreen.build_id", buildID))
 
-	var (
-		build    *model.Build
-		tests    []model.Test
-		fetchErr *apiError
-	)
-	build, tests, fetchErr = lk.viewBucketBuild(ctx, buildID)
+	resp, fetchErr := lk.viewBucketBuild(ctx, buildID)
 	if fetchErr != nil {
-		lk.render.WriteJSON(w, fetchErr.code, *fetchErr)
+		lk.writeError(ctx, w, fetchErr.code, *fetchErr)
 		return
 	}
+	addIDHeaders(w, buildID, "")
 
 	if r.FormValue("metadata") == "true" {
 		payload := struct {
 			model.Build
-			Tests []model.Test `json:"tests"`
-		}{*build, tests}
-		lk.render.WriteJSON(w, http.StatusOK, payload)
+			Tests   []model.Test `json:"tests"`
+			HasLogs bool         `json:"has_logs"`
+		}{*resp.build, resp.tests, resp.hasLogs}
+		lk.writeMetadataJSON(w, r, payload)
 		return
 	}
 
 	lk.render.WriteHTML(w, http.StatusOK, struct {
 		Build        *model.Build
 		Tests        []model.Test
+		HasLogs      bool
 		EvergreenURL string
 		ParsleyURL   string
-	}{build, tests, os.Getenv(evergreenEnvVariable), os.Getenv(parsleyEnvVariable)}, "base", "build.html")
+	}{resp.build, resp.tests, resp.hasLogs, os.Getenv(evergreenEnvVariable), os.Getenv(parsleyEnvVariable)}, "base", "build.html")
 }
 
-func (lk *logkeeper) viewBucketBuild(ctx context.Context, buildID string) (*model.Build, []model.Test, *apiError) {
+func (lk *logkeeper) viewBucketBuild(ctx context.Context, buildID string) (*buildFetchResponse, *apiError) {
 	var (
-		wg       sync.WaitGroup
-		build    *model.Build
-		buildErr error
-		tests    []model.Test
-		testsErr error
+		wg         sync.WaitGroup
+		build      *model.Build
+		buildErr   error
+		tests      []model.Test
+		testsErr   error
+		hasLogs    bool
+		hasLogsErr error
 	)
 
-	wg.Add(2)
+	wg.Add(3)
 	go func() {
 		defer recovery.LogStackTraceAndContinue("finding build from bucket")
 		defer wg.Done()
@@ -221,22 +366,36 @@ func (lk *logkeeper) viewBucketBuild(ctx context.Context, buildID string) (*mode
 
 		tests, testsErr = model.FindTestsForBuild(ctx, lk.tracer, buildID)
 	}()
+	go func() {
+		defer recovery.LogStackTraceAndContinue("checking for build logs in bucket")
+		defer wg.Done()
+
+		hasLogs, hasLogsErr = model.BuildHasLogs(ctx, lk.tracer, buildID)
+	}()
 	wg.Wait()
 
 	if buildErr != nil {
 		logErrorf(ctx, "finding build '%s': %v", buildID, buildErr)
-		return nil, nil, &apiError{Err: "finding build", code: http.StatusInternalServerError}
+		return nil, &apiError{Err: "finding build", code: http.StatusInternalServerError}
 	}
 	if build == nil {
-		return nil, nil, &apiError{Err: "build not found", code: http.StatusNotFound}
+		return nil, &apiError{Err: "build not found", code: http.StatusNotFound}
 	}
 
 	if testsErr != nil {
 		logErrorf(ctx, "finding tests for build '%s': %v", buildID, testsErr)
-		return nil, nil, &apiError{Err: testsErr.Error(), code: http.StatusInternalServerError}
+		return nil, &apiError{Err: testsErr.Error(), code: http.StatusInternalServerError}
+	}
+	if hasLogsErr != nil {
+		logErrorf(ctx, "checking for logs for build '%s': %v", buildID, hasLogsErr)
+		return nil, &apiError{Err: "checking for build logs", code: http.StatusInternalServerError}
 	}
 
-	return build, tests, nil
+	return &buildFetchResponse{
+		build:   build,
+		tests:   tests,
+		hasLogs: hasLogs,
+	}, nil
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -253,26 +412,47 @@ func (lk *logkeeper) viewAllLogs(w http.ResponseWriter, r *http.Request) {
 
 	recordAttributes(ctx, attribute.String("evergreen.build_id", buildID))
 
-	if lobsterRedirect(r) {
+	if !lk.opts.DisableLobsterRedirect && lobsterRedirect(r) {
 		http.Redirect(w, r, fmt.Sprintf("/lobster/build/%s/all", buildID), http.StatusFound)
 		return
 	}
 
-	resp, fetchErr := lk.viewBucketLogs(ctx, buildID, "")
+	opts, fetchErr := parseDownloadOptions(r)
+	if fetchErr != nil {
+		lk.writeError(ctx, w, fetchErr.code, *fetchErr)
+		return
+	}
+	contentType, fetchErr := parseRawContentType(r)
+	if fetchErr != nil {
+		lk.writeError(ctx, w, fetchErr.code, *fetchErr)
+		return
+	}
+
+	resp, fetchErr := lk.viewBucketLogs(ctx, buildID, "", opts)
 	if fetchErr != nil {
-		lk.render.WriteJSON(w, fetchErr.code, *fetchErr)
+		lk.writeError(ctx, w, fetchErr.code, *fetchErr)
 		return
 	}
+	addScrubbedHeader(w, resp.build)
+	addIDHeaders(w, buildID, "")
 
 	if r.FormValue("metadata") == "true" {
-		lk.render.WriteJSON(w, http.StatusOK, resp.build)
+		lk.writeMetadataJSON(w, r, resp.build)
+		return
+	}
+
+	if r.FormValue("format") == "sse" {
+		if err := writeSSELines(ctx, w, resp.logLines, lk.opts.SSEHeartbeatInterval, lk.opts.MaxStreamDuration); err != nil {
+			logErrorf(ctx, "writing log lines from build '%s' as events: %v", buildID, err)
+		}
 		return
 	}
 
 	if len(r.FormValue("raw")) > 0 || r.Header.Get("Accept") == "text/plain" {
-		if err := writeRawLines(w, resp); err != nil {
+		w.Header().Set("Content-Type", contentType)
+		if err := writeRawLines(w, resp, lk.opts.RawBufferSize, lk.opts.RawFlushInterval, r.FormValue("line_numbers") == "true"); err != nil {
 			logErrorf(ctx, "writing raw log lines from build '%s': %v", buildID, err)
-			lk.render.WriteJSON(w, http.StatusInternalServerError, apiError{Err: "rendering log lines"})
+			lk.writeError(ctx, w, http.StatusInternalServerError, apiError{Err: "rendering log lines"})
 		}
 		return
 	} else {
@@ -286,7 +466,8 @@ func (lk *logkeeper) viewAllLogs(w http.ResponseWriter, r *http.Request) {
 			TaskExecution int
 		}{resp.logLines, resp.build.ID, resp.build.Builder, "", "All logs", resp.build.TaskID, resp.build.TaskExecution}, "base", "test.html")
 		if err != nil {
-			logErrorf(ctx, "rendering template: %v", err)
+			logErrorf(ctx, "rendering template for build '%s': %v", buildID, err)
+			writeRenderErrorBanner(w)
 		}
 	}
 }
@@ -310,26 +491,47 @@ func (lk *logkeeper) viewTestLogs(w http.ResponseWriter, r *http.Request) {
 		attribute.String("evergreen.test_id", testID),
 	)
 
-	if lobsterRedirect(r) {
+	if !lk.opts.DisableLobsterRedirect && lobsterRedirect(r) {
 		http.Redirect(w, r, fmt.Sprintf("/lobster/build/%s/test/%s", buildID, testID), http.StatusFound)
 		return
 	}
 
-	resp, fetchErr := lk.viewBucketLogs(ctx, buildID, testID)
+	opts, fetchErr := parseDownloadOptions(r)
+	if fetchErr != nil {
+		lk.writeError(ctx, w, fetchErr.code, *fetchErr)
+		return
+	}
+	contentType, fetchErr := parseRawContentType(r)
+	if fetchErr != nil {
+		lk.writeError(ctx, w, fetchErr.code, *fetchErr)
+		return
+	}
+
+	resp, fetchErr := lk.viewBucketLogs(ctx, buildID, testID, opts)
 	if fetchErr != nil {
-		lk.render.WriteJSON(w, fetchErr.code, *fetchErr)
+		lk.writeError(ctx, w, fetchErr.code, *fetchErr)
 		return
 	}
+	addScrubbedHeader(w, resp.build)
+	addIDHeaders(w, buildID, testID)
 
 	if r.FormValue("metadata") == "true" {
-		lk.render.WriteJSON(w, http.StatusOK, resp.test)
+		lk.writeMetadataJSON(w, r, resp.test)
+		return
+	}
+
+	if r.FormValue("format") == "sse" {
+		if err := writeSSELines(ctx, w, resp.logLines, lk.opts.SSEHeartbeatInterval, lk.opts.MaxStreamDuration); err != nil {
+			logErrorf(ctx, "writing log lines from test '%s' for build '%s' as events: %v", testID, buildID, err)
+		}
 		return
 	}
 
 	if len(r.FormValue("raw")) > 0 || r.Header.Get("Accept") == "text/plain" {
-		if err := writeRawLines(w, resp); err != nil {
+		w.Header().Set("Content-Type", contentType)
+		if err := writeRawLines(w, resp, lk.opts.RawBufferSize, lk.opts.RawFlushInterval, r.FormValue("line_numbers") == "true"); err != nil {
 			logErrorf(ctx, "writing raw log lines from test '%s' for build '%s': %v", testID, buildID, err)
-			lk.render.WriteJSON(w, http.StatusInternalServerError, apiError{Err: "rendering log lines"})
+			lk.writeError(ctx, w, http.StatusInternalServerError, apiError{Err: "rendering log lines"})
 		}
 	} else {
 		err := lk.render.StreamHTML(w, http.StatusOK, struct {
@@ -342,12 +544,13 @@ func (lk *logkeeper) viewTestLogs(w http.ResponseWriter, r *http.Request) {
 			TaskExecution int
 		}{resp.logLines, resp.build.ID, resp.build.Builder, resp.test.ID, resp.test.Name, resp.test.TaskID, resp.test.TaskExecution}, "base", "test.html")
 		if err != nil {
-			logErrorf(ctx, "rendering template: %v", err)
+			logErrorf(ctx, "rendering template for test '%s' for build '%s': %v", testID, buildID, err)
+			writeRenderErrorBanner(w)
 		}
 	}
 }
 
-func (lk *logkeeper) viewBucketLogs(ctx context.Context, buildID string, testID string) (*logFetchResponse, *apiError) {
+func (lk *logkeeper) viewBucketLogs(ctx context.Context, buildID string, testID string, opts model.DownloadOptions) (*logFetchResponse, *apiError) {
 	var (
 		wg          sync.WaitGroup
 		build       *model.Build
@@ -358,6 +561,11 @@ func (lk *logkeeper) viewBucketLogs(ctx context.Context, buildID string, testID
 		logLinesErr error
 	)
 
+	if lk.opts.ServeOrphanedTestLogs {
+		opts.MissingTest = model.MissingTestOrphanedChunks
+	}
+	opts.Prefetch = lk.opts.Prefetch
+
 	wg.Add(3)
 	go func() {
 		defer recovery.LogStackTraceAndContinue("finding build from bucket")
@@ -378,7 +586,7 @@ func (lk *logkeeper) viewBucketLogs(ctx context.Context, buildID string, testID
 		defer recovery.LogStackTraceAndContinue("downloading log lines from bucket")
 		defer wg.Done()
 
-		logLines, logLinesErr = model.DownloadLogLines(ctx, lk.tracer, buildID, testID)
+		logLines, logLinesErr = model.DownloadLogLinesWithOptions(ctx, lk.tracer, buildID, testID, opts)
 	}()
 	wg.Wait()
 
@@ -394,7 +602,17 @@ func (lk *logkeeper) viewBucketLogs(ctx context.Context, buildID string, testID
 		return nil, &apiError{Err: "finding test", code: http.StatusInternalServerError}
 	}
 	if testID != "" && test == nil {
-		return nil, &apiError{Err: "test not found", code: http.StatusNotFound}
+		if !lk.opts.ServeOrphanedTestLogs || errors.Is(logLinesErr, model.ErrTestNotFound) {
+			return nil, &apiError{Err: "test not found", code: http.StatusNotFound}
+		}
+		// The test has chunks but no metadata, so only its ID is known.
+		test = &model.Test{ID: testID, BuildID: buildID}
+	}
+	if test != nil && opts.TaskExecution != nil && test.TaskExecution != *opts.TaskExecution {
+		return nil, &apiError{Err: "test not found for task execution", code: http.StatusNotFound}
+	}
+	if errors.Is(logLinesErr, model.ErrNoBuildKeys) {
+		return nil, &apiError{Err: "no logs found for build", code: http.StatusNotFound}
 	}
 	if logLinesErr != nil {
 		logErrorf(ctx, "downloading logs for build '%s': %v", buildID, logLinesErr)
@@ -408,7 +626,125 @@ func (lk *logkeeper) viewBucketLogs(ctx context.Context, buildID string, testID
 	}, nil
 }
 
-func writeRawLines(w http.ResponseWriter, resp *logFetchResponse) error {
+// addScrubbedHeader marks the response as the logs of a build whose logs were
+// removed, so that clients can tell an empty log apart from a scrubbed one.
+func addScrubbedHeader(w http.ResponseWriter, build *model.Build) {
+	if build.Scrubbed {
+		w.Header().Set(scrubbedHeader, "true")
+	}
+}
+
+// addIDHeaders identifies the build, and the test if there is one, that the
+// response is for, so that clients that follow redirects or cache responses
+// can still tell which logs they have.
+func addIDHeaders(w http.ResponseWriter, buildID string, testID string) {
+	w.Header().Set(buildIDHeader, buildID)
+	if testID != "" {
+		w.Header().Set(testIDHeader, testID)
+	}
+}
+
+// renderErrorBanner is appended to an HTML log page whose template failed
+// after the response was already being streamed. The status code can no
+// longer be changed at that point, so the banner is the only way to tell the
+// user that the page is incomplete.
+const renderErrorBanner = `
+<!-- logkeeper: rendering failed, the log is incomplete -->
+<div class="render-error">Error rendering the log: the lines shown above are incomplete. Try reloading the page or viewing the raw log.</div>
+`
+
+func writeRenderErrorBanner(w http.ResponseWriter) {
+	// The client may already be gone, in which case there's no one to show
+	// the banner to.
+	_, _ = io.WriteString(w, renderErrorBanner)
+}
+
+// parseDownloadOptions returns the options for downloading log lines
+// requested by the max_bytes, task_execution, order, best_effort, after,
+// strip_ansi and strict_window form values.
+func parseDownloadOptions(r *http.Request) (model.DownloadOptions, *apiError) {
+	maxBytes, fetchErr := parseMaxBytes(r)
+	if fetchErr != nil {
+		return model.DownloadOptions{}, fetchErr
+	}
+	opts := model.DownloadOptions{MaxBytes: maxBytes}
+
+	if value := r.FormValue("task_execution"); value != "" {
+		execution, err := strconv.Atoi(value)
+		if err != nil || execution < 0 {
+			return model.DownloadOptions{}, &apiError{Err: "task_execution must be a non-negative integer", code: http.StatusBadRequest}
+		}
+		opts.TaskExecution = &execution
+	}
+
+	switch r.FormValue("order") {
+	case "", "asc":
+	case "desc":
+		opts.Reverse = true
+	default:
+		return model.DownloadOptions{}, &apiError{Err: "order must be either 'asc' or 'desc'", code: http.StatusBadRequest}
+	}
+	opts.BestEffort = r.FormValue("best_effort") == "true"
+	opts.StripANSI = r.FormValue("strip_ansi") == "true"
+	opts.StrictWindow = r.FormValue("strict_window") == "true"
+
+	if value := r.FormValue("after"); value != "" {
+		after, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return model.DownloadOptions{}, &apiError{Err: "after must be an RFC 3339 timestamp", code: http.StatusBadRequest}
+		}
+		opts.After = &after
+	}
+
+	return opts, nil
+}
+
+// rawContentTypes are the media types raw log lines may be served as, keyed
+// by the value of the content_type form value that requests them.
+var rawContentTypes = map[string]string{
+	"text/plain":       "text/plain; charset=utf-8",
+	"application/json": "application/json; charset=utf-8",
+}
+
+// parseRawContentType returns the Content-Type raw log lines are served with,
+// as requested by the content_type form value. Lines are served as plain text
+// unless, for example, they're structured logs that a client wants to handle
+// as JSON.
+func parseRawContentType(r *http.Request) (string, *apiError) {
+	value := r.FormValue("content_type")
+	if value == "" {
+		return rawContentTypes["text/plain"], nil
+	}
+
+	contentType, ok := rawContentTypes[value]
+	if !ok {
+		return "", &apiError{Err: "content_type must be either 'text/plain' or 'application/json'", code: http.StatusBadRequest}
+	}
+
+	return contentType, nil
+}
+
+// parseMaxBytes returns the byte budget requested by the max_bytes form
+// value, or 0 if it is unset.
+func parseMaxBytes(r *http.Request) (int, *apiError) {
+	value := r.FormValue("max_bytes")
+	if value == "" {
+		return 0, nil
+	}
+
+	maxBytes, err := strconv.Atoi(value)
+	if err != nil || maxBytes <= 0 {
+		return 0, &apiError{Err: "max_bytes must be a positive integer", code: http.StatusBadRequest}
+	}
+
+	return maxBytes, nil
+}
+
+// writeRawLines writes the log lines as plain text through a buffer of
+// bufferSize bytes. Buffered lines are flushed to the client every
+// flushInterval so that slow downloads still stream. If lineNumbers is true,
+// each line is prefixed with its 1-based position in the response.
+func writeRawLines(w http.ResponseWriter, resp *logFetchResponse, bufferSize int, flushInterval time.Duration, lineNumbers bool) error {
 	var (
 		numLines    int
 		totalSize   int
@@ -416,25 +752,62 @@ func writeRawLines(w http.ResponseWriter, resp *logFetchResponse) error {
 		minLineSize = maxLogBytes + len("\n")
 	)
 
-	var hasLines bool
-	for line := range resp.logLines {
-		hasLines = true
-
-		lineData := []byte(line.Data + "\n")
-		_, err := w.Write(lineData)
-		if err != nil {
+	// Lines are streamed as they are downloaded, so the response's length
+	// isn't known up front and byte ranges can't be served.
+	w.Header().Set("Accept-Ranges", "none")
+	buffered := bufio.NewWriterSize(w, bufferSize)
+	flusher, _ := w.(http.Flusher)
+	flush := func() error {
+		if err := buffered.Flush(); err != nil {
 			return err
 		}
-
-		lineSize := len(lineData)
-		if lineSize > maxLineSize {
-			maxLineSize = lineSize
+		if flusher != nil {
+			flusher.Flush()
 		}
-		if lineSize < minLineSize {
-			minLineSize = lineSize
+		return nil
+	}
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var hasLines bool
+lines:
+	for {
+		select {
+		case line, ok := <-resp.logLines:
+			if !ok {
+				break lines
+			}
+			hasLines = true
+
+			data := line.Data
+			if lineNumbers {
+				data = fmt.Sprintf("%d: %s", numLines+1, data)
+			}
+			lineSize, err := buffered.WriteString(data + "\n")
+			if err != nil {
+				return err
+			}
+
+			if lineSize > maxLineSize {
+				maxLineSize = lineSize
+			}
+			if lineSize < minLineSize {
+				minLineSize = lineSize
+			}
+			numLines++
+			totalSize += lineSize
+		case <-ticker.C:
+			if buffered.Buffered() == 0 {
+				continue
+			}
+			if err := flush(); err != nil {
+				return err
+			}
 		}
-		numLines++
-		totalSize += lineSize
+	}
+	if err := flush(); err != nil {
+		return err
 	}
 
 	avgLineSize := float64(totalSize) / float64(numLines)
@@ -466,6 +839,336 @@ func writeRawLines(w http.ResponseWriter, resp *logFetchResponse) error {
 	return nil
 }
 
+// sseEndEvent ends a server-sent event stream that reached its maximum
+// duration. Clients can resume from the last event ID they received.
+const sseEndEvent = "event: end\ndata: maximum stream duration reached\n\n"
+
+// writeSSELines writes each log line as a server-sent event, with the line's
+// timestamp in milliseconds as the event ID, flushing after every event. A
+// heartbeat comment is sent whenever no line is written for heartbeatInterval
+// to keep the connection alive. If maxDuration is positive, the stream is
+// ended with sseEndEvent once it has lasted that long.
+func writeSSELines(ctx context.Context, w http.ResponseWriter, lines chan *model.LogLineItem, heartbeatInterval time.Duration, maxDuration time.Duration) error {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	flush()
+
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	var deadline <-chan time.Time
+	if maxDuration > 0 {
+		timer := time.NewTimer(maxDuration)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline:
+			// Lines still being downloaded are abandoned, which stops
+			// the download once the request's context is canceled.
+			if _, err := io.WriteString(w, sseEndEvent); err != nil {
+				return err
+			}
+			flush()
+			return nil
+		case line, ok := <-lines:
+			if !ok {
+				return nil
+			}
+
+			var event strings.Builder
+			fmt.Fprintf(&event, "id: %d\n", line.Timestamp.UnixMilli())
+			for _, data := range strings.Split(line.Data, "\n") {
+				fmt.Fprintf(&event, "data: %s\n", data)
+			}
+			event.WriteString("\n")
+			if _, err := io.WriteString(w, event.String()); err != nil {
+				return err
+			}
+			flush()
+			ticker.Reset(heartbeatInterval)
+		case <-ticker.C:
+			if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+				return err
+			}
+			flush()
+		}
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////
+//
+// GET /build/{build_id}/test/latest
+
+func (lk *logkeeper) viewLatestTestLogs(w http.ResponseWriter, r *http.Request) {
+	ctx, span := lk.tracer.Start(r.Context(), "ViewLatestTestLogs")
+	defer span.End()
+	addCORSHeaders(w, r)
+
+	buildID := mux.Vars(r)["build_id"]
+
+	recordAttributes(ctx, attribute.String("evergreen.build_id", buildID))
+
+	testID, err := model.FindLatestTestID(ctx, lk.tracer, buildID)
+	if err != nil {
+		logErrorf(ctx, "finding latest test for build '%s': %v", buildID, err)
+		lk.writeError(ctx, w, http.StatusInternalServerError, apiError{Err: "finding latest test"})
+		return
+	}
+	if testID == "" {
+		lk.writeError(ctx, w, http.StatusNotFound, apiError{Err: "build has no tests"})
+		return
+	}
+
+	// Redirecting, rather than serving the logs here, lets the test's logs
+	// be served exactly as they are from their own URL, with the same
+	// query parameters.
+	target := fmt.Sprintf("/build/%s/test/%s", buildID, testID)
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+//
+// GET /builds/merge?ids={build_id},{build_id},...
+
+func (lk *logkeeper) viewMergedLogs(w http.ResponseWriter, r *http.Request) {
+	ctx, span := lk.tracer.Start(r.Context(), "ViewMergedLogs")
+	defer span.End()
+	addCORSHeaders(w, r)
+
+	var buildIDs []string
+	for _, id := range strings.Split(r.FormValue("ids"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			buildIDs = append(buildIDs, id)
+		}
+	}
+	if len(buildIDs) == 0 {
+		lk.writeError(ctx, w, http.StatusBadRequest, apiError{Err: "must specify at least one build ID"})
+		return
+	}
+
+	recordAttributes(ctx, attribute.StringSlice("evergreen.build_ids", buildIDs))
+
+	it, err := model.NewCrossBuildIterator(ctx, lk.tracer, buildIDs, model.AllTime)
+	if errors.Is(err, model.ErrTooManyIterators) {
+		lk.writeError(ctx, w, http.StatusBadRequest, apiError{Err: fmt.Sprintf("too many builds to merge: %d", len(buildIDs))})
+		return
+	}
+	if err != nil {
+		logErrorf(ctx, "merging logs for builds '%s': %v", strings.Join(buildIDs, ","), err)
+		lk.writeError(ctx, w, http.StatusInternalServerError, apiError{Err: "downloading logs"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Accept-Ranges", "none")
+	for line := range it.Stream(ctx) {
+		if _, err := w.Write([]byte(line.Data + "\n")); err != nil {
+			logErrorf(ctx, "writing merged log lines for builds '%s': %v", strings.Join(buildIDs, ","), err)
+			return
+		}
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////
+//
+// POST /build/{build_id}/repair
+
+func (lk *logkeeper) repairLineCounts(w http.ResponseWriter, r *http.Request) {
+	ctx, span := lk.tracer.Start(r.Context(), "RepairLineCounts")
+	defer span.End()
+
+	vars := mux.Vars(r)
+	buildID := vars["build_id"]
+
+	recordAttributes(ctx, attribute.String("evergreen.build_id", buildID))
+
+	if !isMaintenanceAuthorized(r) {
+		lk.writeError(ctx, w, http.StatusUnauthorized, apiError{Err: "not authorized for maintenance"})
+		return
+	}
+
+	build, err := model.FindBuildByID(ctx, lk.tracer, buildID)
+	if err != nil {
+		logErrorf(ctx, "finding build '%s': %v", buildID, err)
+		lk.writeError(ctx, w, http.StatusInternalServerError, apiError{Err: "finding build"})
+		return
+	}
+	if build == nil {
+		lk.writeError(ctx, w, http.StatusNotFound, apiError{Err: "build not found"})
+		return
+	}
+
+	repair, err := model.RepairLineCounts(ctx, lk.tracer, buildID)
+	if err != nil {
+		logErrorf(ctx, "repairing line counts for build '%s': %v", buildID, err)
+		lk.writeError(ctx, w, http.StatusInternalServerError, apiError{Err: "repairing line counts"})
+		return
+	}
+
+	lk.render.WriteJSON(w, http.StatusOK, repair)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+//
+// POST /build/{build_id}/scrub
+
+func (lk *logkeeper) scrubBuildLogs(w http.ResponseWriter, r *http.Request) {
+	ctx, span := lk.tracer.Start(r.Context(), "ScrubBuildLogs")
+	defer span.End()
+
+	vars := mux.Vars(r)
+	buildID := vars["build_id"]
+
+	recordAttributes(ctx, attribute.String("evergreen.build_id", buildID))
+
+	if !isMaintenanceAuthorized(r) {
+		lk.writeError(ctx, w, http.StatusUnauthorized, apiError{Err: "not authorized for maintenance"})
+		return
+	}
+
+	build, err := model.DeleteBuildLogs(ctx, lk.tracer, buildID, storage.DefaultRemoveConcurrency)
+	if err != nil {
+		logErrorf(ctx, "deleting logs of build '%s': %v", buildID, err)
+		lk.writeError(ctx, w, http.StatusInternalServerError, apiError{Err: "deleting logs"})
+		return
+	}
+	if build == nil {
+		lk.writeError(ctx, w, http.StatusNotFound, apiError{Err: "build not found"})
+		return
+	}
+
+	lk.render.WriteJSON(w, http.StatusOK, build)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+//
+// PATCH /build/{build_id}/labels
+
+// maxLabelsRequestSize bounds the body of a labels request, which is large
+// enough for the maximum number of labels at their maximum size.
+const maxLabelsRequestSize = 2 * model.MaxBuildLabels * (model.MaxLabelKeySize + model.MaxLabelValueSize)
+
+func (lk *logkeeper) addBuildLabels(w http.ResponseWriter, r *http.Request) {
+	ctx, span := lk.tracer.Start(r.Context(), "AddBuildLabels")
+	defer span.End()
+	addCORSHeaders(w, r)
+
+	vars := mux.Vars(r)
+	buildID := vars["build_id"]
+
+	recordAttributes(ctx, attribute.String("evergreen.build_id", buildID))
+
+	if !isMaintenanceAuthorized(r) {
+		lk.writeError(ctx, w, http.StatusUnauthorized, apiError{Err: "not authorized for maintenance"})
+		return
+	}
+
+	var labels map[string]string
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxLabelsRequestSize)).Decode(&labels); err != nil {
+		lk.writeError(ctx, w, http.StatusBadRequest, apiError{Err: "labels must be a JSON object of string keys and values"})
+		return
+	}
+	if err := model.ValidateLabels(labels); err != nil {
+		lk.writeError(ctx, w, http.StatusBadRequest, apiError{Err: err.Error()})
+		return
+	}
+
+	build, err := model.AddBuildLabels(ctx, lk.tracer, buildID, labels)
+	if model.IsInvalidLabelsError(err) {
+		lk.writeError(ctx, w, http.StatusBadRequest, apiError{Err: err.Error()})
+		return
+	}
+	if err != nil {
+		logErrorf(ctx, "adding labels to build '%s': %v", buildID, err)
+		lk.writeError(ctx, w, http.StatusInternalServerError, apiError{Err: "adding labels"})
+		return
+	}
+	if build == nil {
+		lk.writeError(ctx, w, http.StatusNotFound, apiError{Err: "build not found"})
+		return
+	}
+
+	lk.render.WriteJSON(w, http.StatusOK, build)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+//
+// PATCH /build/{build_id}/execution
+
+// maxExecutionRequestSize bounds the body of an execution request.
+const maxExecutionRequestSize = 1024
+
+type taskExecution struct {
+	Execution *int `json:"execution"`
+}
+
+func (lk *logkeeper) setBuildTaskExecution(w http.ResponseWriter, r *http.Request) {
+	ctx, span := lk.tracer.Start(r.Context(), "SetBuildTaskExecution")
+	defer span.End()
+	addCORSHeaders(w, r)
+
+	vars := mux.Vars(r)
+	buildID := vars["build_id"]
+
+	recordAttributes(ctx, attribute.String("evergreen.build_id", buildID))
+
+	if !isMaintenanceAuthorized(r) {
+		lk.writeError(ctx, w, http.StatusUnauthorized, apiError{Err: "not authorized for maintenance"})
+		return
+	}
+
+	var req taskExecution
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxExecutionRequestSize)).Decode(&req); err != nil || req.Execution == nil {
+		lk.writeError(ctx, w, http.StatusBadRequest, apiError{Err: "execution must be a JSON object with an integer execution"})
+		return
+	}
+	if *req.Execution < 0 {
+		lk.writeError(ctx, w, http.StatusBadRequest, apiError{Err: "execution must be a non-negative integer"})
+		return
+	}
+
+	build, err := model.SetBuildTaskExecution(ctx, lk.tracer, buildID, *req.Execution)
+	if err != nil {
+		logErrorf(ctx, "setting task execution of build '%s': %v", buildID, err)
+		lk.writeError(ctx, w, http.StatusInternalServerError, apiError{Err: "setting task execution"})
+		return
+	}
+	if build == nil {
+		lk.writeError(ctx, w, http.StatusNotFound, apiError{Err: "build not found"})
+		return
+	}
+
+	lk.render.WriteJSON(w, http.StatusOK, build)
+}
+
+// isMaintenanceAuthorized returns whether the request carries the bearer
+// token configured for maintenance routes. Maintenance routes are disabled
+// when no token is configured.
+func isMaintenanceAuthorized(r *http.Request) bool {
+	token := os.Getenv(maintenanceEnvVariable)
+	if token == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) == 1
+}
+
 ///////////////////////////////////////////////////////////////////////////////
 //
 // GET /status
@@ -484,12 +1187,387 @@ func (lk *logkeeper) checkAppHealth(w http.ResponseWriter, r *http.Request) {
 	lk.render.WriteJSON(w, http.StatusOK, &resp)
 }
 
+///////////////////////////////////////////////////////////////////////////////
+//
+// GET /build/{build_id}/manifest
+
+func (lk *logkeeper) viewBuildManifest(w http.ResponseWriter, r *http.Request) {
+	ctx, span := lk.tracer.Start(r.Context(), "ViewBuildManifest")
+	defer span.End()
+	addCORSHeaders(w, r)
+
+	vars := mux.Vars(r)
+	buildID := vars["build_id"]
+
+	recordAttributes(ctx, attribute.String("evergreen.build_id", buildID))
+
+	exists, err := model.CheckBuildMetadata(ctx, lk.tracer, buildID)
+	if err != nil {
+		logErrorf(ctx, "checking metadata for build '%s': %v", buildID, err)
+		lk.writeError(ctx, w, http.StatusInternalServerError, apiError{Err: "finding build"})
+		return
+	}
+	if !exists {
+		lk.writeError(ctx, w, http.StatusNotFound, apiError{Err: "build not found"})
+		return
+	}
+
+	chunks, err := model.BuildManifest(ctx, lk.tracer, buildID)
+	if err != nil {
+		logErrorf(ctx, "getting manifest for build '%s': %v", buildID, err)
+		lk.writeError(ctx, w, http.StatusInternalServerError, apiError{Err: "getting build manifest"})
+		return
+	}
+
+	var totalSize int64
+	for _, chunk := range chunks {
+		totalSize += chunk.Size
+	}
+	addIDHeaders(w, buildID, "")
+	lk.render.WriteJSON(w, http.StatusOK, buildManifest{
+		BuildID:   buildID,
+		TotalSize: totalSize,
+		Chunks:    chunks,
+	})
+}
+
+type buildManifest struct {
+	BuildID   string                `json:"build_id"`
+	TotalSize int64                 `json:"total_size"`
+	Chunks    []model.ManifestChunk `json:"chunks"`
+}
+
+///////////////////////////////////////////////////////////////////////////////
+//
+// GET /build/{build_id}/chunk
+
+func (lk *logkeeper) viewLogChunk(w http.ResponseWriter, r *http.Request) {
+	ctx, span := lk.tracer.Start(r.Context(), "ViewLogChunk")
+	defer span.End()
+	addCORSHeaders(w, r)
+
+	vars := mux.Vars(r)
+	buildID := vars["build_id"]
+
+	recordAttributes(ctx, attribute.String("evergreen.build_id", buildID))
+
+	// Chunk keys contain slashes, so the key is a query parameter rather
+	// than part of the path.
+	key := r.FormValue("key")
+	if key == "" {
+		lk.writeError(ctx, w, http.StatusBadRequest, apiError{Err: "key is required"})
+		return
+	}
+
+	chunk, err := model.GetLogChunk(ctx, lk.tracer, buildID, key)
+	if err != nil {
+		logErrorf(ctx, "getting chunk '%s' of build '%s': %v", key, buildID, err)
+		lk.writeError(ctx, w, http.StatusInternalServerError, apiError{Err: "getting log chunk"})
+		return
+	}
+	if chunk == nil {
+		lk.writeError(ctx, w, http.StatusNotFound, apiError{Err: "chunk not found"})
+		return
+	}
+	addIDHeaders(w, buildID, "")
+
+	// The chunk's hash is its entity tag, so clients that already have a
+	// chunk with the hash listed in the manifest can skip downloading it
+	// again.
+	etag := fmt.Sprintf(`"%s"`, chunk.Hash)
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(chunk.Data)))
+	w.WriteHeader(http.StatusOK)
+	if _, err = w.Write(chunk.Data); err != nil {
+		logErrorf(ctx, "writing chunk '%s' of build '%s': %v", key, buildID, err)
+	}
+}
+
+// etagMatches returns whether the If-None-Match header value matches the
+// entity tag. Weak tags are compared as if they were strong, since a chunk's
+// contents either match its hash or they don't.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+///////////////////////////////////////////////////////////////////////////////
+//
+// GET /build/{build_id}/summary
+
+func (lk *logkeeper) viewBuildSummary(w http.ResponseWriter, r *http.Request) {
+	ctx, span := lk.tracer.Start(r.Context(), "ViewBuildSummary")
+	defer span.End()
+	addCORSHeaders(w, r)
+
+	vars := mux.Vars(r)
+	buildID := vars["build_id"]
+
+	recordAttributes(ctx, attribute.String("evergreen.build_id", buildID))
+
+	summary, err := model.SummarizeBuild(ctx, lk.tracer, buildID)
+	if err != nil {
+		logErrorf(ctx, "summarizing build '%s': %v", buildID, err)
+		lk.writeError(ctx, w, http.StatusInternalServerError, apiError{Err: "summarizing build"})
+		return
+	}
+	if summary == nil {
+		lk.writeError(ctx, w, http.StatusNotFound, apiError{Err: "build not found"})
+		return
+	}
+
+	addIDHeaders(w, buildID, "")
+	lk.render.WriteJSON(w, http.StatusOK, summary)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+//
+// GET /build/{build_id}/sequence
+
+func (lk *logkeeper) checkLineSequence(w http.ResponseWriter, r *http.Request) {
+	ctx, span := lk.tracer.Start(r.Context(), "CheckLineSequence")
+	defer span.End()
+	addCORSHeaders(w, r)
+
+	vars := mux.Vars(r)
+	buildID := vars["build_id"]
+
+	recordAttributes(ctx, attribute.String("evergreen.build_id", buildID))
+
+	report, err := model.CheckLineSequence(ctx, lk.tracer, buildID)
+	if err != nil {
+		logErrorf(ctx, "checking line sequence of build '%s': %v", buildID, err)
+		lk.writeError(ctx, w, http.StatusInternalServerError, apiError{Err: "checking line sequence"})
+		return
+	}
+	if report == nil {
+		lk.writeError(ctx, w, http.StatusNotFound, apiError{Err: "build not found"})
+		return
+	}
+
+	addIDHeaders(w, buildID, "")
+	lk.render.WriteJSON(w, http.StatusOK, report)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+//
+// GET /build/{build_id}/all/count
+// GET /build/{build_id}/test/{test_id}/count
+
+func (lk *logkeeper) countLogLines(w http.ResponseWriter, r *http.Request) {
+	ctx, span := lk.tracer.Start(r.Context(), "CountLogLines")
+	defer span.End()
+	addCORSHeaders(w, r)
+
+	vars := mux.Vars(r)
+	buildID := vars["build_id"]
+	testID := vars["test_id"]
+
+	recordAttributes(
+		ctx,
+		attribute.String("evergreen.build_id", buildID),
+		attribute.String("evergreen.test_id", testID),
+	)
+
+	exists, err := model.CheckBuildMetadata(ctx, lk.tracer, buildID)
+	if err != nil {
+		logErrorf(ctx, "checking metadata for build '%s': %v", buildID, err)
+		lk.writeError(ctx, w, http.StatusInternalServerError, apiError{Err: "finding build"})
+		return
+	}
+	if !exists {
+		lk.writeError(ctx, w, http.StatusNotFound, apiError{Err: "build not found"})
+		return
+	}
+	if testID != "" {
+		exists, err = model.CheckTestMetadata(ctx, lk.tracer, buildID, testID)
+		if err != nil {
+			logErrorf(ctx, "checking metadata for test '%s' of build '%s': %v", testID, buildID, err)
+			lk.writeError(ctx, w, http.StatusInternalServerError, apiError{Err: "finding test"})
+			return
+		}
+		if !exists {
+			lk.writeError(ctx, w, http.StatusNotFound, apiError{Err: "test not found"})
+			return
+		}
+	}
+
+	count, err := model.CountLogLines(ctx, lk.tracer, buildID, testID)
+	if err != nil {
+		logErrorf(ctx, "counting lines for build '%s' test '%s': %v", buildID, testID, err)
+		lk.writeError(ctx, w, http.StatusInternalServerError, apiError{Err: "counting lines"})
+		return
+	}
+
+	addIDHeaders(w, buildID, testID)
+	lk.render.WriteJSON(w, http.StatusOK, lineCount{
+		BuildID: buildID,
+		TestID:  testID,
+		Count:   count,
+	})
+}
+
+type lineCount struct {
+	BuildID string `json:"build_id"`
+	TestID  string `json:"test_id,omitempty"`
+	Count   int    `json:"count"`
+}
+
+///////////////////////////////////////////////////////////////////////////////
+//
+// GET /build/{build_id}/line/{line}
+
+func (lk *logkeeper) viewLogLine(w http.ResponseWriter, r *http.Request) {
+	ctx, span := lk.tracer.Start(r.Context(), "ViewLogLine")
+	defer span.End()
+	addCORSHeaders(w, r)
+
+	vars := mux.Vars(r)
+	buildID := vars["build_id"]
+
+	recordAttributes(ctx, attribute.String("evergreen.build_id", buildID))
+
+	n, err := strconv.Atoi(vars["line"])
+	if err != nil || n < 1 {
+		lk.writeError(ctx, w, http.StatusBadRequest, apiError{Err: "line must be a positive integer"})
+		return
+	}
+
+	exists, err := model.CheckBuildMetadata(ctx, lk.tracer, buildID)
+	if err != nil {
+		logErrorf(ctx, "checking metadata for build '%s': %v", buildID, err)
+		lk.writeError(ctx, w, http.StatusInternalServerError, apiError{Err: "finding build"})
+		return
+	}
+	if !exists {
+		lk.writeError(ctx, w, http.StatusNotFound, apiError{Err: "build not found"})
+		return
+	}
+
+	// raw_prefix is a diagnostic option that returns the line exactly as
+	// stored, timestamp prefix included.
+	line, err := model.FindLogLineWithOptions(ctx, lk.tracer, buildID, n, model.FindLogLineOptions{
+		RawPrefix: r.FormValue("raw_prefix") == "true",
+	})
+	if err != nil {
+		logErrorf(ctx, "finding line %d of build '%s': %v", n, buildID, err)
+		lk.writeError(ctx, w, http.StatusInternalServerError, apiError{Err: "finding line"})
+		return
+	}
+	if line == nil {
+		lk.writeError(ctx, w, http.StatusNotFound, apiError{Err: "line not found"})
+		return
+	}
+
+	addIDHeaders(w, buildID, "")
+	lk.render.WriteJSON(w, http.StatusOK, logLine{
+		Line:      n,
+		Timestamp: line.Timestamp,
+		Data:      line.Data,
+	})
+}
+
+type logLine struct {
+	Line      int       `json:"line"`
+	Timestamp time.Time `json:"timestamp"`
+	Data      string    `json:"data"`
+}
+
+///////////////////////////////////////////////////////////////////////////////
+//
+// GET /builds
+
+func (lk *logkeeper) listBuilds(w http.ResponseWriter, r *http.Request) {
+	ctx, span := lk.tracer.Start(r.Context(), "ListBuilds")
+	defer span.End()
+	addCORSHeaders(w, r)
+
+	opts := model.ListBuildsOptions{
+		Prefix: r.FormValue("prefix"),
+		Token:  r.FormValue("token"),
+	}
+	if value := r.FormValue("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > model.MaxListBuildsLimit {
+			lk.writeError(ctx, w, http.StatusBadRequest, apiError{Err: fmt.Sprintf("limit must be a positive integer no greater than %d", model.MaxListBuildsLimit)})
+			return
+		}
+		opts.Limit = limit
+	}
+
+	buildIDs, nextToken, err := model.ListBuildIDs(ctx, lk.tracer, opts)
+	if model.IsInvalidTokenError(err) {
+		lk.writeError(ctx, w, http.StatusBadRequest, apiError{Err: "invalid token"})
+		return
+	}
+	if err != nil {
+		logErrorf(ctx, "listing builds: %v", err)
+		lk.writeError(ctx, w, http.StatusInternalServerError, apiError{Err: "listing builds"})
+		return
+	}
+	if buildIDs == nil {
+		buildIDs = []string{}
+	}
+
+	lk.render.WriteJSON(w, http.StatusOK, buildList{
+		BuildIDs:  buildIDs,
+		NextToken: nextToken,
+	})
+}
+
+type buildList struct {
+	BuildIDs  []string `json:"build_ids"`
+	NextToken string   `json:"next_token,omitempty"`
+}
+
+///////////////////////////////////////////////////////////////////////////////
+//
+// GET /stats/storage
+
+func (lk *logkeeper) viewStorageStats(w http.ResponseWriter, r *http.Request) {
+	ctx, span := lk.tracer.Start(r.Context(), "ViewStorageStats")
+	defer span.End()
+
+	usage, computed := model.GetStorageUsage()
+	if computed && r.FormValue("recompute") != "true" {
+		lk.render.WriteJSON(w, http.StatusOK, usage)
+		return
+	}
+
+	// Computing the usage lists the whole bucket, so only maintainers may
+	// trigger it.
+	if !isMaintenanceAuthorized(r) {
+		lk.writeError(ctx, w, http.StatusUnauthorized, apiError{Err: "not authorized to compute storage usage"})
+		return
+	}
+	usage, err := model.ComputeStorageUsage(ctx, lk.tracer)
+	if err != nil {
+		logErrorf(ctx, "computing storage usage: %v", err)
+		lk.writeError(ctx, w, http.StatusInternalServerError, apiError{Err: "computing storage usage"})
+		return
+	}
+
+	lk.render.WriteJSON(w, http.StatusOK, usage)
+}
+
 ///////////////////////////////////////////////////////////////////////////////
 //
 // Lobster
 
 func lobsterRedirect(r *http.Request) bool {
-	return len(r.FormValue("html")) == 0 && len(r.FormValue("raw")) == 0 && r.Header.Get("Accept") != "text/plain" && r.FormValue("metadata") != "true"
+	return len(r.FormValue("html")) == 0 && len(r.FormValue("raw")) == 0 && r.Header.Get("Accept") != "text/plain" && r.FormValue("metadata") != "true" && r.FormValue("format") != "sse"
 }
 
 func (lk *logkeeper) viewInLobster(w http.ResponseWriter, r *http.Request) {
@@ -513,10 +1591,25 @@ func (lk *logkeeper) NewRouter() *mux.Router {
 
 	// Read methods.
 	r.StrictSlash(true).Path("/build/{build_id}").Methods("GET").HandlerFunc(lk.viewBuild)
-	r.StrictSlash(true).Path("/build/{build_id}/all").Methods("GET").Handler(handlers.CompressHandler(http.HandlerFunc(lk.viewAllLogs)))
-	r.StrictSlash(true).Path("/build/{build_id}/test/{test_id}").Methods("GET").Handler(handlers.CompressHandler(http.HandlerFunc(lk.viewTestLogs)))
+	r.StrictSlash(true).Path("/build/{build_id}/all").Methods("GET").Handler(handlers.CompressHandlerLevel(http.HandlerFunc(lk.viewAllLogs), lk.opts.CompressionLevel))
+	r.StrictSlash(true).Path("/build/{build_id}/test/latest").Methods("GET").HandlerFunc(lk.viewLatestTestLogs)
+	r.StrictSlash(true).Path("/build/{build_id}/test/{test_id}").Methods("GET").Handler(handlers.CompressHandlerLevel(http.HandlerFunc(lk.viewTestLogs), lk.opts.CompressionLevel))
+	r.StrictSlash(true).Path("/build/{build_id}/all/count").Methods("GET").HandlerFunc(lk.countLogLines)
+	r.StrictSlash(true).Path("/build/{build_id}/test/{test_id}/count").Methods("GET").HandlerFunc(lk.countLogLines)
+	r.StrictSlash(true).Path("/build/{build_id}/manifest").Methods("GET").HandlerFunc(lk.viewBuildManifest)
+	r.StrictSlash(true).Path("/build/{build_id}/chunk").Methods("GET").HandlerFunc(lk.viewLogChunk)
+	r.StrictSlash(true).Path("/build/{build_id}/summary").Methods("GET").HandlerFunc(lk.viewBuildSummary)
+	r.StrictSlash(true).Path("/build/{build_id}/sequence").Methods("GET").HandlerFunc(lk.checkLineSequence)
+	r.StrictSlash(true).Path("/build/{build_id}/line/{line}").Methods("GET").HandlerFunc(lk.viewLogLine)
+	r.StrictSlash(true).Path("/build/{build_id}/repair").Methods("POST").HandlerFunc(lk.repairLineCounts)
+	r.StrictSlash(true).Path("/build/{build_id}/scrub").Methods("POST").HandlerFunc(lk.scrubBuildLogs)
+	r.StrictSlash(true).Path("/build/{build_id}/labels").Methods("PATCH").HandlerFunc(lk.addBuildLabels)
+	r.StrictSlash(true).Path("/build/{build_id}/execution").Methods("PATCH").HandlerFunc(lk.setBuildTaskExecution)
+	r.StrictSlash(true).Path("/builds").Methods("GET").HandlerFunc(lk.listBuilds)
+	r.StrictSlash(true).Path("/builds/merge").Methods("GET").Handler(handlers.CompressHandlerLevel(http.HandlerFunc(lk.viewMergedLogs), lk.opts.CompressionLevel))
 	r.PathPrefix("/lobster").Methods("GET").HandlerFunc(lk.viewInLobster)
 	r.Path("/status").Methods("GET").HandlerFunc(lk.checkAppHealth)
+	r.Path("/stats/storage").Methods("GET").HandlerFunc(lk.viewStorageStats)
 
 	return r
 }
@@ -2,18 +2,38 @@ package logkeeper
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"html/template"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
 
+	"github.com/evergreen-ci/logkeeper/env"
 	"github.com/evergreen-ci/logkeeper/model"
+	"github.com/evergreen-ci/logkeeper/storage"
 	"github.com/evergreen-ci/logkeeper/testutil"
+	"github.com/evergreen-ci/pail"
+	"github.com/evergreen-ci/render"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -69,6 +89,9 @@ func TestViewBuild(t *testing.T) {
 			MaxRequestSize: testMaxReqSize,
 		},
 	)
+	emptyBuildID := "empty"
+	require.NoError(t, (&model.Build{ID: emptyBuildID, Builder: "builder"}).UploadMetadata(ctx, tracer))
+
 	for _, test := range []struct {
 		name               string
 		buildID            string
@@ -101,9 +124,10 @@ func TestViewBuild(t *testing.T) {
 				require.NoError(t, lk.render.HTML(expectedOut, struct {
 					Build        *model.Build
 					Tests        []model.Test
+					HasLogs      bool
 					EvergreenURL string
 					ParsleyURL   string
-				}{build, tests, "", ""}, "base", "build.html"))
+				}{build, tests, true, "", ""}, "base", "build.html"))
 				assert.Equal(t, expectedOut.Bytes(), resp.Body.Bytes())
 			},
 		},
@@ -120,10 +144,55 @@ func TestViewBuild(t *testing.T) {
 
 				expectedOut, err := json.MarshalIndent(struct {
 					model.Build
-					Tests []model.Test `json:"tests"`
-				}{*build, tests}, "", "  ")
+					Tests   []model.Test `json:"tests"`
+					HasLogs bool         `json:"has_logs"`
+				}{*build, tests, true}, "", "  ")
+				require.NoError(t, err)
+				assert.Equal(t, expectedOut, resp.Body.Bytes())
+			},
+		},
+		{
+			name:               "CompactMetadata",
+			buildID:            buildID,
+			params:             "metadata=true&pretty=false",
+			expectedStatusCode: http.StatusOK,
+			test: func(t *testing.T, resp *httptest.ResponseRecorder) {
+				build, err := model.FindBuildByID(ctx, tracer, buildID)
+				require.NoError(t, err)
+				tests, err := model.FindTestsForBuild(ctx, tracer, buildID)
+				require.NoError(t, err)
+
+				expectedOut, err := json.Marshal(struct {
+					model.Build
+					Tests   []model.Test `json:"tests"`
+					HasLogs bool         `json:"has_logs"`
+				}{*build, tests, true})
 				require.NoError(t, err)
 				assert.Equal(t, expectedOut, resp.Body.Bytes())
+				assert.Equal(t, "application/json; charset=UTF-8", resp.Header().Get("Content-Type"))
+			},
+		},
+		{
+			name:               "BuildWithoutLogs",
+			buildID:            emptyBuildID,
+			expectedStatusCode: http.StatusOK,
+			test: func(t *testing.T, resp *httptest.ResponseRecorder) {
+				assert.Contains(t, resp.Body.String(), "No logs have been uploaded for this build yet.")
+			},
+		},
+		{
+			name:               "MetadataWithoutLogs",
+			buildID:            emptyBuildID,
+			params:             "metadata=true",
+			expectedStatusCode: http.StatusOK,
+			test: func(t *testing.T, resp *httptest.ResponseRecorder) {
+				var out struct {
+					ID      string `json:"id"`
+					HasLogs bool   `json:"has_logs"`
+				}
+				require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &out))
+				assert.Equal(t, emptyBuildID, out.ID)
+				assert.False(t, out.HasLogs)
 			},
 		},
 	} {
@@ -195,6 +264,56 @@ func TestViewAllLogs(t *testing.T) {
 				assert.Equal(t, expectedOut.Bytes(), resp.Body.Bytes())
 			},
 		},
+		{
+			name:               "InvalidMaxBytes",
+			buildID:            buildID,
+			params:             "raw=true&max_bytes=-1",
+			expectedStatusCode: http.StatusBadRequest,
+			test: func(t *testing.T, resp *httptest.ResponseRecorder) {
+				var out apiError
+				require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &out))
+				assert.NotEmpty(t, out.Err)
+			},
+		},
+		{
+			name:               "RawLogsMaxBytes",
+			buildID:            buildID,
+			params:             "raw=true&max_bytes=100",
+			expectedStatusCode: http.StatusOK,
+			test: func(t *testing.T, resp *httptest.ResponseRecorder) {
+				lines, err := model.DownloadLogLinesWithByteLimit(ctx, tracer, buildID, "", 100)
+				require.NoError(t, err)
+
+				expectedOut := &bytes.Buffer{}
+				for line := range lines {
+					_, err := expectedOut.WriteString(line.Data + "\n")
+					require.NoError(t, err)
+				}
+				assert.Equal(t, expectedOut.Bytes(), resp.Body.Bytes())
+				assert.Contains(t, resp.Body.String(), "output truncated after")
+			},
+		},
+		{
+			name:               "ServerSentEvents",
+			buildID:            buildID,
+			params:             "format=sse",
+			expectedStatusCode: http.StatusOK,
+			test: func(t *testing.T, resp *httptest.ResponseRecorder) {
+				assert.Equal(t, "text/event-stream", resp.Header().Get("Content-Type"))
+
+				lines, err := model.DownloadLogLines(ctx, tracer, buildID, "")
+				require.NoError(t, err)
+				var expectedEvents []sseEvent
+				for line := range lines {
+					expectedEvents = append(expectedEvents, sseEvent{
+						id:   strconv.FormatInt(line.Timestamp.UnixMilli(), 10),
+						data: line.Data,
+					})
+				}
+				events, _ := parseSSE(t, resp.Body.String())
+				assert.Equal(t, expectedEvents, events)
+			},
+		},
 		{
 			name:               "RawLogsHeader",
 			buildID:            buildID,
@@ -251,6 +370,20 @@ func TestViewAllLogs(t *testing.T) {
 				assert.Equal(t, expectedOut, resp.Body.Bytes())
 			},
 		},
+		{
+			name:               "CompactMetadata",
+			buildID:            buildID,
+			params:             "metadata=true&pretty=false",
+			expectedStatusCode: http.StatusOK,
+			test: func(t *testing.T, resp *httptest.ResponseRecorder) {
+				build, err := model.FindBuildByID(ctx, tracer, buildID)
+				require.NoError(t, err)
+
+				expectedOut, err := json.Marshal(build)
+				require.NoError(t, err)
+				assert.Equal(t, expectedOut, resp.Body.Bytes())
+			},
+		},
 	} {
 		t.Run(test.name, func(t *testing.T) {
 			resp := doReq(t, lk.NewRouter(), http.MethodGet, test.headers, fmt.Sprintf("%s/build/%s/all?%s", lk.opts.URL, test.buildID, test.params), nil)
@@ -338,6 +471,36 @@ func TestViewTestLogs(t *testing.T) {
 				assert.Equal(t, expectedOut.Bytes(), resp.Body.Bytes())
 			},
 		},
+		{
+			name:               "RawLogsLineNumbers",
+			buildID:            buildID,
+			testID:             testID,
+			params:             "raw=true&line_numbers=true",
+			expectedStatusCode: http.StatusOK,
+			test: func(t *testing.T, resp *httptest.ResponseRecorder) {
+				lines, err := model.DownloadLogLines(ctx, tracer, buildID, testID)
+				require.NoError(t, err)
+
+				// The test's lines are interleaved with the build's
+				// global lines, which are stored in a separate chunk, so
+				// the numbering must carry across chunk boundaries.
+				var expectedLines []string
+				var hasGlobal, hasTest bool
+				for line := range lines {
+					expectedLines = append(expectedLines, line.Data)
+					hasGlobal = hasGlobal || line.Global
+					hasTest = hasTest || !line.Global
+				}
+				require.True(t, hasGlobal)
+				require.True(t, hasTest)
+
+				actualLines := strings.Split(strings.TrimSuffix(resp.Body.String(), "\n"), "\n")
+				require.Len(t, actualLines, len(expectedLines))
+				for i, line := range actualLines {
+					assert.Equal(t, fmt.Sprintf("%d: %s", i+1, expectedLines[i]), line)
+				}
+			},
+		},
 		{
 			name:               "RawLogsHeader",
 			buildID:            buildID,
@@ -393,6 +556,36 @@ func TestViewTestLogs(t *testing.T) {
 				test, err := model.FindTestByID(ctx, tracer, buildID, testID)
 				require.NoError(t, err)
 
+				expectedOut, err := json.MarshalIndent(test, "", "  ")
+				require.NoError(t, err)
+				assert.Equal(t, expectedOut, resp.Body.Bytes())
+			},
+		},
+		{
+			name:               "CompactMetadata",
+			buildID:            buildID,
+			testID:             testID,
+			params:             "metadata=true&pretty=false",
+			expectedStatusCode: http.StatusOK,
+			test: func(t *testing.T, resp *httptest.ResponseRecorder) {
+				test, err := model.FindTestByID(ctx, tracer, buildID, testID)
+				require.NoError(t, err)
+
+				expectedOut, err := json.Marshal(test)
+				require.NoError(t, err)
+				assert.Equal(t, expectedOut, resp.Body.Bytes())
+			},
+		},
+		{
+			name:               "PrettyMetadata",
+			buildID:            buildID,
+			testID:             testID,
+			params:             "metadata=true&pretty=true",
+			expectedStatusCode: http.StatusOK,
+			test: func(t *testing.T, resp *httptest.ResponseRecorder) {
+				test, err := model.FindTestByID(ctx, tracer, buildID, testID)
+				require.NoError(t, err)
+
 				expectedOut, err := json.MarshalIndent(test, "", "  ")
 				require.NoError(t, err)
 				assert.Equal(t, expectedOut, resp.Body.Bytes())
@@ -408,6 +601,1753 @@ func TestViewTestLogs(t *testing.T) {
 	}
 }
 
+func TestDisableLobsterRedirect(t *testing.T) {
+	defer testutil.SetBucket(t, "testdata/simple")()
+
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	testID := "17046404de18d0000000000000000000"
+	for _, test := range []struct {
+		name string
+		path string
+	}{
+		{
+			name: "AllLogs",
+			path: fmt.Sprintf("/build/%s/all", buildID),
+		},
+		{
+			name: "TestLogs",
+			path: fmt.Sprintf("/build/%s/test/%s", buildID, testID),
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Run("Enabled", func(t *testing.T) {
+				lk := NewLogkeeper(LogkeeperOptions{URL: "https://logkeeper.com", MaxRequestSize: testMaxReqSize})
+				resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, lk.opts.URL+test.path, nil)
+				require.Equal(t, http.StatusFound, resp.Code)
+				assert.Equal(t, "/lobster"+test.path, resp.Header().Get("Location"))
+			})
+			t.Run("Disabled", func(t *testing.T) {
+				lk := NewLogkeeper(LogkeeperOptions{URL: "https://logkeeper.com", MaxRequestSize: testMaxReqSize, DisableLobsterRedirect: true})
+				resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, lk.opts.URL+test.path, nil)
+				require.Equal(t, http.StatusOK, resp.Code)
+				checkCORSHeader(t, resp.Header())
+				assert.Contains(t, resp.Header().Get("Content-Type"), "text/html")
+
+				htmlResp := doReq(t, lk.NewRouter(), http.MethodGet, nil, lk.opts.URL+test.path+"?html=true", nil)
+				require.Equal(t, http.StatusOK, htmlResp.Code)
+				assert.Equal(t, htmlResp.Body.String(), resp.Body.String())
+			})
+		})
+	}
+}
+
+func TestViewMergedLogs(t *testing.T) {
+	defer testutil.SetBucket(t, "testdata/simple")()
+
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	lk := NewLogkeeper(
+		LogkeeperOptions{
+			URL:            "https://logkeeper.com",
+			MaxRequestSize: testMaxReqSize,
+		},
+	)
+	for _, test := range []struct {
+		name               string
+		params             string
+		expectedStatusCode int
+		test               func(*testing.T, *httptest.ResponseRecorder)
+	}{
+		{
+			name:               "NoBuildIDs",
+			params:             "ids=",
+			expectedStatusCode: http.StatusBadRequest,
+			test: func(t *testing.T, resp *httptest.ResponseRecorder) {
+				var out apiError
+				require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &out))
+				assert.NotEmpty(t, out.Err)
+			},
+		},
+		{
+			name:               "TooManyBuilds",
+			params:             "ids=" + strings.Repeat("DNE,", env.DefaultMaxMergeIterators/2) + buildID,
+			expectedStatusCode: http.StatusBadRequest,
+			test: func(t *testing.T, resp *httptest.ResponseRecorder) {
+				var out apiError
+				require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &out))
+				assert.Contains(t, out.Err, "too many builds")
+			},
+		},
+		{
+			name:               "MissingBuildsAreExcluded",
+			params:             fmt.Sprintf("ids=DNE,%s", buildID),
+			expectedStatusCode: http.StatusOK,
+			test: func(t *testing.T, resp *httptest.ResponseRecorder) {
+				lines, err := model.DownloadLogLines(ctx, tracer, buildID, "")
+				require.NoError(t, err)
+
+				expectedOut := &bytes.Buffer{}
+				for line := range lines {
+					_, err := expectedOut.WriteString(line.Data + "\n")
+					require.NoError(t, err)
+				}
+				assert.Equal(t, expectedOut.Bytes(), resp.Body.Bytes())
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, fmt.Sprintf("%s/builds/merge?%s", lk.opts.URL, test.params), nil)
+			require.Equal(t, test.expectedStatusCode, resp.Code)
+			checkCORSHeader(t, resp.Header())
+			test.test(t, resp)
+		})
+	}
+}
+
+func TestIDHeaders(t *testing.T) {
+	defer testutil.SetBucket(t, "testdata/simple")()
+
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	testID := "17046404de18d0000000000000000000"
+	lk := NewLogkeeper(
+		LogkeeperOptions{
+			URL:            "https://logkeeper.com",
+			MaxRequestSize: testMaxReqSize,
+		},
+	)
+	for _, test := range []struct {
+		name   string
+		path   string
+		testID string
+	}{
+		{name: "BuildMetadata", path: fmt.Sprintf("/build/%s?metadata=true", buildID)},
+		{name: "AllLogs", path: fmt.Sprintf("/build/%s/all?raw=true", buildID)},
+		{name: "AllLogsMetadata", path: fmt.Sprintf("/build/%s/all?metadata=true", buildID)},
+		{name: "TestLogs", path: fmt.Sprintf("/build/%s/test/%s?raw=true", buildID, testID), testID: testID},
+		{name: "TestLogsMetadata", path: fmt.Sprintf("/build/%s/test/%s?metadata=true", buildID, testID), testID: testID},
+		{name: "TestLogsEvents", path: fmt.Sprintf("/build/%s/test/%s?format=sse", buildID, testID), testID: testID},
+		{name: "TestCount", path: fmt.Sprintf("/build/%s/test/%s/count", buildID, testID), testID: testID},
+		{name: "Manifest", path: fmt.Sprintf("/build/%s/manifest", buildID)},
+		{name: "Summary", path: fmt.Sprintf("/build/%s/summary", buildID)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, lk.opts.URL+test.path, nil)
+			require.Equal(t, http.StatusOK, resp.Code)
+			assert.Equal(t, buildID, resp.Header().Get(buildIDHeader))
+			if test.testID != "" {
+				assert.Equal(t, test.testID, resp.Header().Get(testIDHeader))
+			} else {
+				assert.NotContains(t, resp.Header(), testIDHeader)
+			}
+		})
+	}
+	t.Run("NotFound", func(t *testing.T) {
+		resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, lk.opts.URL+"/build/DNE/all?raw=true", nil)
+		require.Equal(t, http.StatusNotFound, resp.Code)
+		assert.NotContains(t, resp.Header(), buildIDHeader)
+	})
+}
+
+func TestViewLogsGlobalLines(t *testing.T) {
+	defer testutil.SetBucket(t, "testdata/simple")()
+
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	testID := "17046404de18d0000000000000000000"
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	lk := NewLogkeeper(
+		LogkeeperOptions{
+			URL:            "https://logkeeper.com",
+			MaxRequestSize: testMaxReqSize,
+		},
+	)
+
+	lines, err := model.DownloadLogLines(ctx, tracer, buildID, testID)
+	require.NoError(t, err)
+	var expectedGlobal []bool
+	for line := range lines {
+		expectedGlobal = append(expectedGlobal, line.Global)
+	}
+	require.Contains(t, expectedGlobal, true)
+	require.Contains(t, expectedGlobal, false)
+
+	resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, fmt.Sprintf("%s/build/%s/test/%s?html=true", lk.opts.URL, buildID, testID), nil)
+	require.Equal(t, http.StatusOK, resp.Code)
+
+	rows := regexp.MustCompile(`<td class="log ([^"]*)"><pre id="line-(\d+)">`).FindAllStringSubmatch(resp.Body.String(), -1)
+	require.Len(t, rows, len(expectedGlobal))
+	for i, row := range rows {
+		assert.Equal(t, strconv.Itoa(i), row[2])
+		assert.Equal(t, expectedGlobal[i], slices.Contains(strings.Fields(row[1]), "global"), "line %d", i)
+	}
+}
+
+func TestAcceptRangesHeader(t *testing.T) {
+	defer testutil.SetBucket(t, "testdata/simple")()
+
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	testID := "17046404de18d0000000000000000000"
+	lk := NewLogkeeper(
+		LogkeeperOptions{
+			URL:            "https://logkeeper.com",
+			MaxRequestSize: testMaxReqSize,
+		},
+	)
+	for _, test := range []struct {
+		name                 string
+		url                  string
+		headers              map[string]string
+		expectedAcceptRanges string
+	}{
+		{
+			name:                 "RawAllLogs",
+			url:                  fmt.Sprintf("/build/%s/all?raw=true", buildID),
+			expectedAcceptRanges: "none",
+		},
+		{
+			name:                 "RawTestLogs",
+			url:                  fmt.Sprintf("/build/%s/test/%s?raw=true", buildID, testID),
+			expectedAcceptRanges: "none",
+		},
+		{
+			name:                 "RawTestLogsWithRange",
+			url:                  fmt.Sprintf("/build/%s/test/%s?raw=true", buildID, testID),
+			headers:              map[string]string{"Range": "bytes=0-10"},
+			expectedAcceptRanges: "none",
+		},
+		{
+			name:                 "MergedLogs",
+			url:                  fmt.Sprintf("/builds/merge?ids=%s", buildID),
+			expectedAcceptRanges: "none",
+		},
+		{
+			name: "HTMLLogs",
+			url:  fmt.Sprintf("/build/%s/all?html=true", buildID),
+		},
+		{
+			name: "Metadata",
+			url:  fmt.Sprintf("/build/%s/all?metadata=true", buildID),
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			resp := doReq(t, lk.NewRouter(), http.MethodGet, test.headers, lk.opts.URL+test.url, nil)
+			require.Equal(t, http.StatusOK, resp.Code)
+			assert.Equal(t, test.expectedAcceptRanges, resp.Header().Get("Accept-Ranges"))
+		})
+	}
+}
+
+func TestViewLogsForTaskExecution(t *testing.T) {
+	defer testutil.SetBucket(t, "")()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	lk := NewLogkeeper(
+		LogkeeperOptions{
+			URL:            "https://logkeeper.com",
+			MaxRequestSize: testMaxReqSize,
+		},
+	)
+
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	start := time.Unix(1000000000, 0).UTC()
+	require.NoError(t, (&model.Build{ID: buildID, TaskExecution: 1}).UploadMetadata(ctx, tracer))
+	testIDs := make([]string, 2)
+	for execution := range testIDs {
+		testIDs[execution] = model.NewTestID(start.Add(time.Duration(execution) * time.Second))
+		require.NoError(t, (&model.Test{ID: testIDs[execution], BuildID: buildID, TaskExecution: execution}).UploadTestMetadata(ctx, tracer))
+		_, err := model.InsertLogLines(ctx, tracer, buildID, testIDs[execution], []model.LogLineItem{
+			{Timestamp: start.Add(time.Duration(execution)*time.Second + 100*time.Millisecond), Data: fmt.Sprintf("execution %d", execution)},
+		}, testMaxReqSize)
+		require.NoError(t, err)
+	}
+
+	for _, test := range []struct {
+		name               string
+		url                string
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		{
+			name:               "AllLogsForExecution0",
+			url:                fmt.Sprintf("/build/%s/all?raw=true&task_execution=0", buildID),
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       "execution 0\n",
+		},
+		{
+			name:               "AllLogsForExecution1",
+			url:                fmt.Sprintf("/build/%s/all?raw=true&task_execution=1", buildID),
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       "execution 1\n",
+		},
+		{
+			name:               "TestLogsForMatchingExecution",
+			url:                fmt.Sprintf("/build/%s/test/%s?raw=true&task_execution=1", buildID, testIDs[1]),
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       "execution 1\n",
+		},
+		{
+			name:               "TestLogsForOtherExecution",
+			url:                fmt.Sprintf("/build/%s/test/%s?raw=true&task_execution=0", buildID, testIDs[1]),
+			expectedStatusCode: http.StatusNotFound,
+		},
+		{
+			name:               "NegativeExecution",
+			url:                fmt.Sprintf("/build/%s/all?raw=true&task_execution=-1", buildID),
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:               "InvalidExecution",
+			url:                fmt.Sprintf("/build/%s/all?raw=true&task_execution=latest", buildID),
+			expectedStatusCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, lk.opts.URL+test.url, nil)
+			require.Equal(t, test.expectedStatusCode, resp.Code)
+			checkCORSHeader(t, resp.Header())
+			if test.expectedStatusCode == http.StatusOK {
+				assert.Equal(t, test.expectedBody, resp.Body.String())
+			}
+		})
+	}
+}
+
+func TestViewLogsRenderError(t *testing.T) {
+	defer testutil.SetBucket(t, "testdata/simple")()
+
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	testID := "17046404de18d0000000000000000000"
+
+	// The template fails after rendering the first line, by which point
+	// the status and part of the page have been written.
+	templateDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(templateDir, "test.html"), []byte(
+		`{{define "base"}}<html>{{range $index, $line := .LogLines}}<pre>{{$line.Data}}</pre>{{Fail $index}}{{end}}</html>{{end}}`,
+	), 0644))
+	lk := NewLogkeeper(
+		LogkeeperOptions{
+			URL:            "https://logkeeper.com",
+			MaxRequestSize: testMaxReqSize,
+		},
+	)
+	lk.render = render.New(render.Options{
+		Directory: templateDir,
+		HtmlFuncs: template.FuncMap{
+			"Fail": func(index int) (string, error) {
+				if index > 0 {
+					return "", errors.New("rendering failed")
+				}
+				return "", nil
+			},
+		},
+	})
+
+	for _, test := range []struct {
+		name string
+		url  string
+	}{
+		{
+			name: "AllLogs",
+			url:  fmt.Sprintf("/build/%s/all?html=true", buildID),
+		},
+		{
+			name: "TestLogs",
+			url:  fmt.Sprintf("/build/%s/test/%s?html=true", buildID, testID),
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, lk.opts.URL+test.url, nil)
+			require.Equal(t, http.StatusOK, resp.Code)
+			checkCORSHeader(t, resp.Header())
+
+			body := resp.Body.String()
+			assert.True(t, strings.HasPrefix(body, "<html><pre>"))
+			assert.True(t, strings.HasSuffix(body, renderErrorBanner))
+			assert.NotContains(t, body, "</html>")
+		})
+	}
+}
+
+func TestViewLogsDescending(t *testing.T) {
+	defer testutil.SetBucket(t, "")()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	lk := NewLogkeeper(
+		LogkeeperOptions{
+			URL:            "https://logkeeper.com",
+			MaxRequestSize: testMaxReqSize,
+		},
+	)
+
+	// Upload a build whose global and test lines are interleaved and
+	// split across several chunks each.
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	start := time.Unix(1000000000, 0).UTC()
+	require.NoError(t, (&model.Build{ID: buildID}).UploadMetadata(ctx, tracer))
+	testIDs := make([]string, 2)
+	var expectedAll []string
+	for i := range testIDs {
+		testIDs[i] = model.NewTestID(start.Add(time.Duration(i) * time.Second))
+		require.NoError(t, (&model.Test{ID: testIDs[i], BuildID: buildID}).UploadTestMetadata(ctx, tracer))
+	}
+	var globalLines []model.LogLineItem
+	testLines := make([][]model.LogLineItem, len(testIDs))
+	for i := 0; i < 20; i++ {
+		ts := start.Add(time.Duration(i) * 100 * time.Millisecond)
+		if i%2 == 0 {
+			globalLines = append(globalLines, model.LogLineItem{Timestamp: ts, Data: fmt.Sprintf("line %d", i), Global: true})
+		} else {
+			testIdx := i / 10
+			testLines[testIdx] = append(testLines[testIdx], model.LogLineItem{Timestamp: ts, Data: fmt.Sprintf("line %d", i)})
+		}
+		expectedAll = append([]string{fmt.Sprintf("line %d", i)}, expectedAll...)
+	}
+	_, err := model.InsertLogLinesWithLineLimit(ctx, tracer, buildID, "", globalLines, testMaxReqSize, 3)
+	require.NoError(t, err)
+	for i, lines := range testLines {
+		_, err := model.InsertLogLinesWithLineLimit(ctx, tracer, buildID, testIDs[i], lines, testMaxReqSize, 2)
+		require.NoError(t, err)
+	}
+
+	for _, test := range []struct {
+		name               string
+		url                string
+		expectedStatusCode int
+		expectedLines      []string
+	}{
+		{
+			name:               "AllLogs",
+			url:                fmt.Sprintf("/build/%s/all?raw=true&order=desc", buildID),
+			expectedStatusCode: http.StatusOK,
+			expectedLines:      expectedAll,
+		},
+		{
+			name:               "TestLogs",
+			url:                fmt.Sprintf("/build/%s/test/%s?raw=true&order=desc", buildID, testIDs[1]),
+			expectedStatusCode: http.StatusOK,
+			expectedLines:      []string{"line 19", "line 18", "line 17", "line 16", "line 15", "line 14", "line 13", "line 12", "line 11", "line 10"},
+		},
+		{
+			name:               "Ascending",
+			url:                fmt.Sprintf("/build/%s/test/%s?raw=true&order=asc", buildID, testIDs[1]),
+			expectedStatusCode: http.StatusOK,
+			expectedLines:      []string{"line 10", "line 11", "line 12", "line 13", "line 14", "line 15", "line 16", "line 17", "line 18", "line 19"},
+		},
+		{
+			name:               "InvalidOrder",
+			url:                fmt.Sprintf("/build/%s/all?raw=true&order=newest", buildID),
+			expectedStatusCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, lk.opts.URL+test.url, nil)
+			require.Equal(t, test.expectedStatusCode, resp.Code)
+			checkCORSHeader(t, resp.Header())
+			if test.expectedStatusCode == http.StatusOK {
+				assert.Equal(t, strings.Join(test.expectedLines, "\n")+"\n", resp.Body.String())
+			}
+		})
+	}
+}
+
+func TestViewLogsPreservedNewlines(t *testing.T) {
+	defer testutil.SetBucket(t, "")()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	lk := NewLogkeeper(
+		LogkeeperOptions{
+			URL:            "https://logkeeper.com",
+			MaxRequestSize: testMaxReqSize,
+		},
+	)
+
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	start := time.Unix(1000000000, 0).UTC()
+	require.NoError(t, (&model.Build{ID: buildID}).UploadMetadata(ctx, tracer))
+	testID := model.NewTestID(start)
+	require.NoError(t, (&model.Test{ID: testID, BuildID: buildID}).UploadTestMetadata(ctx, tracer))
+	lines := []model.LogLineItem{
+		{Timestamp: start, Data: "stack trace:\n\tframe 0\n\tframe 1"},
+		{Timestamp: start.Add(time.Second), Data: `escaped \n stays escaped`},
+		{Timestamp: start.Add(2 * time.Second), Data: "\n"},
+	}
+	opts := model.InsertOptions{MaxSize: testMaxReqSize, PreserveNewlines: true}
+	_, err := model.InsertLogLinesWithOptions(ctx, tracer, buildID, testID, lines, opts)
+	require.NoError(t, err)
+
+	var expected strings.Builder
+	for _, line := range lines {
+		expected.WriteString(line.Data + "\n")
+	}
+	resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, fmt.Sprintf("%s/build/%s/test/%s?raw=true", lk.opts.URL, buildID, testID), nil)
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, expected.String(), resp.Body.String())
+
+	test, err := model.FindTestByID(ctx, tracer, buildID, testID)
+	require.NoError(t, err)
+	assert.Equal(t, len(lines), test.NumLines)
+}
+
+func TestViewLogsBestEffort(t *testing.T) {
+	defer testutil.SetBucket(t, "testdata/simple")()
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	testID := "17046404de18d0000000000000000000"
+	failedPrefix := fmt.Sprintf("builds/%s/tests/%s/", buildID, testID)
+	require.NoError(t, env.SetBucket(&storage.Bucket{Bucket: failingChunkBucket{Bucket: env.Bucket().Bucket, failPrefix: failedPrefix}}))
+
+	lk := NewLogkeeper(LogkeeperOptions{URL: "https://logkeeper.com"})
+	allURL := fmt.Sprintf("%s/build/%s/all?raw=true", lk.opts.URL, buildID)
+
+	resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, allURL, nil)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.NotContains(t, resp.Body.String(), "WARNING")
+
+	resp = doReq(t, lk.NewRouter(), http.MethodGet, nil, allURL+"&best_effort=true", nil)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	checkCORSHeader(t, resp.Header())
+	lines := strings.Split(strings.TrimSuffix(resp.Body.String(), "\n"), "\n")
+	require.Greater(t, len(lines), 1)
+	assert.Equal(t, "[WARNING: 1 chunks failed to load]", lines[len(lines)-1])
+	assert.Contains(t, lines, "I am a global log within the test start/stop ranges.")
+}
+
+func TestViewOrphanedTestLogs(t *testing.T) {
+	defer testutil.SetBucket(t, "testdata/overlapping")()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	orphanID := model.NewTestID(time.Unix(1000000000, 0))
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer")
+	_, err := model.InsertLogLines(ctx, tracer, buildID, orphanID, []model.LogLineItem{
+		{Timestamp: time.Unix(0, 1000000000450000000), Data: "Orphan Log450"},
+	}, 4*1024*1024)
+	require.NoError(t, err)
+
+	t.Run("Strict", func(t *testing.T) {
+		lk := NewLogkeeper(LogkeeperOptions{URL: "https://logkeeper.com"})
+		for _, testID := range []string{"DNE", orphanID} {
+			resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, fmt.Sprintf("%s/build/%s/test/%s?raw=true", lk.opts.URL, buildID, testID), nil)
+			assert.Equal(t, http.StatusNotFound, resp.Code, testID)
+		}
+	})
+	t.Run("Lenient", func(t *testing.T) {
+		lk := NewLogkeeper(LogkeeperOptions{URL: "https://logkeeper.com", ServeOrphanedTestLogs: true})
+
+		resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, fmt.Sprintf("%s/build/%s/test/DNE?raw=true", lk.opts.URL, buildID), nil)
+		assert.Equal(t, http.StatusNotFound, resp.Code)
+
+		resp = doReq(t, lk.NewRouter(), http.MethodGet, nil, fmt.Sprintf("%s/build/%s/test/%s?raw=true", lk.opts.URL, buildID, orphanID), nil)
+		require.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, "Orphan Log450\n", resp.Body.String())
+	})
+}
+
+// failingChunkBucket fails to get any log chunk under the given prefix.
+type failingChunkBucket struct {
+	pail.Bucket
+	failPrefix string
+}
+
+func (b failingChunkBucket) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if strings.HasPrefix(key, b.failPrefix) && !strings.HasSuffix(key, "metadata.json") {
+		return nil, errors.New("injected failure")
+	}
+	return b.Bucket.Get(ctx, key)
+}
+
+func TestViewLogsKeyErrors(t *testing.T) {
+	defer testutil.SetBucket(t, "testdata/simple")()
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	bucket := env.Bucket()
+	lk := NewLogkeeper(LogkeeperOptions{URL: "https://logkeeper.com"})
+	allURL := fmt.Sprintf("%s/build/%s/all?raw=true", lk.opts.URL, buildID)
+
+	t.Run("NoKeys", func(t *testing.T) {
+		defer func() { require.NoError(t, env.SetBucket(bucket)) }()
+		require.NoError(t, env.SetBucket(&storage.Bucket{Bucket: listingBucket{Bucket: bucket.Bucket}}))
+
+		resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, allURL, nil)
+		assert.Equal(t, http.StatusNotFound, resp.Code)
+		checkCORSHeader(t, resp.Header())
+	})
+	t.Run("ListFails", func(t *testing.T) {
+		defer func() { require.NoError(t, env.SetBucket(bucket)) }()
+		require.NoError(t, env.SetBucket(&storage.Bucket{Bucket: listingBucket{Bucket: bucket.Bucket, listErr: errors.New("injected list failure")}}))
+
+		resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, allURL, nil)
+		assert.Equal(t, http.StatusInternalServerError, resp.Code)
+		checkCORSHeader(t, resp.Header())
+	})
+}
+
+// listingBucket fails every listing with listErr or, if it's nil, lists no
+// keys, while still getting keys such as the build metadata.
+type listingBucket struct {
+	pail.Bucket
+	listErr error
+}
+
+func (b listingBucket) List(ctx context.Context, _ string) (pail.BucketIterator, error) {
+	if b.listErr != nil {
+		return nil, b.listErr
+	}
+	return b.Bucket.List(ctx, "nonexistent/")
+}
+
+func TestViewLogsAfter(t *testing.T) {
+	defer testutil.SetBucket(t, "testdata/overlapping")()
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	lk := NewLogkeeper(LogkeeperOptions{URL: "https://logkeeper.com"})
+	allURL := fmt.Sprintf("%s/build/%s/all?raw=true", lk.opts.URL, buildID)
+
+	resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, allURL, nil)
+	require.Equal(t, http.StatusOK, resp.Code)
+	allLines := strings.Split(strings.TrimSuffix(resp.Body.String(), "\n"), "\n")
+	require.Len(t, allLines, 40)
+
+	t.Run("InvalidTimestamp", func(t *testing.T) {
+		resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, allURL+"&after=yesterday", nil)
+		assert.Equal(t, http.StatusBadRequest, resp.Code)
+	})
+	t.Run("BeforeAllLines", func(t *testing.T) {
+		resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, allURL+"&after=1970-01-01T00:00:00Z", nil)
+		require.Equal(t, http.StatusOK, resp.Code)
+		checkCORSHeader(t, resp.Header())
+		assert.Equal(t, allLines, strings.Split(strings.TrimSuffix(resp.Body.String(), "\n"), "\n"))
+	})
+	t.Run("AfterLastLine", func(t *testing.T) {
+		resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, allURL+"&after="+url.QueryEscape(time.Unix(1000000000, 900000000).UTC().Format(time.RFC3339Nano)), nil)
+		require.Equal(t, http.StatusOK, resp.Code)
+		assert.Empty(t, resp.Body.String())
+	})
+	t.Run("InTheFuture", func(t *testing.T) {
+		resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, allURL+"&after="+url.QueryEscape(time.Now().Add(time.Hour).Format(time.RFC3339Nano)), nil)
+		require.Equal(t, http.StatusOK, resp.Code)
+		assert.Empty(t, resp.Body.String())
+	})
+}
+
+func TestValidateCompressionLevel(t *testing.T) {
+	for _, level := range []int{gzip.DefaultCompression, gzip.BestSpeed, 5, gzip.BestCompression} {
+		assert.NoError(t, ValidateCompressionLevel(level), "level %d", level)
+	}
+	for _, level := range []int{gzip.HuffmanOnly, gzip.NoCompression, 10} {
+		assert.Error(t, ValidateCompressionLevel(level), "level %d", level)
+	}
+}
+
+func TestValidateTemplates(t *testing.T) {
+	t.Run("Default", func(t *testing.T) {
+		lk := NewLogkeeper(LogkeeperOptions{URL: "https://logkeeper.com"})
+		assert.Equal(t, DefaultTemplateDirectory, lk.opts.TemplateDirectory)
+		assert.NoError(t, ValidateTemplates(lk.opts.TemplateDirectory))
+	})
+	t.Run("MissingTemplates", func(t *testing.T) {
+		dir := t.TempDir()
+		data, err := os.ReadFile(filepath.Join(DefaultTemplateDirectory, "test.html"))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "test.html"), data, 0644))
+		// A directory in place of a template doesn't count.
+		require.NoError(t, os.Mkdir(filepath.Join(dir, "build.html"), 0755))
+
+		lk := NewLogkeeper(LogkeeperOptions{URL: "https://logkeeper.com", TemplateDirectory: dir})
+		err = ValidateTemplates(lk.opts.TemplateDirectory)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "build.html, lobster/build/index.html")
+		assert.NotContains(t, err.Error(), "test.html")
+	})
+	t.Run("NonexistentDirectory", func(t *testing.T) {
+		err := ValidateTemplates(filepath.Join(t.TempDir(), "DNE"))
+		require.Error(t, err)
+		for _, name := range requiredTemplates {
+			assert.Contains(t, err.Error(), name)
+		}
+	})
+}
+
+func TestViewLogsCompressionLevel(t *testing.T) {
+	defer testutil.SetBucket(t, "testdata/simple")()
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+
+	lk := NewLogkeeper(LogkeeperOptions{URL: "https://logkeeper.com"})
+	allURL := fmt.Sprintf("%s/build/%s/all?raw=true", lk.opts.URL, buildID)
+	resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, allURL, nil)
+	require.Equal(t, http.StatusOK, resp.Code)
+	expected := resp.Body.String()
+	require.NotEmpty(t, expected)
+
+	for _, level := range []int{0, gzip.BestSpeed, gzip.DefaultCompression, gzip.BestCompression} {
+		t.Run(fmt.Sprintf("Level%d", level), func(t *testing.T) {
+			lk := NewLogkeeper(LogkeeperOptions{URL: "https://logkeeper.com", CompressionLevel: level})
+			resp := doReq(t, lk.NewRouter(), http.MethodGet, map[string]string{"Accept-Encoding": "gzip"}, allURL, nil)
+			require.Equal(t, http.StatusOK, resp.Code)
+			assert.Equal(t, "gzip", resp.Header().Get("Content-Encoding"))
+
+			r, err := gzip.NewReader(resp.Body)
+			require.NoError(t, err)
+			data, err := io.ReadAll(r)
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+			assert.Equal(t, expected, string(data))
+		})
+	}
+}
+
+func TestViewLogLine(t *testing.T) {
+	defer testutil.SetBucket(t, "testdata/overlapping")()
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	lk := NewLogkeeper(LogkeeperOptions{URL: "https://logkeeper.com"})
+
+	for _, test := range []struct {
+		name         string
+		buildID      string
+		line         string
+		expectedCode int
+		expectedData string
+	}{
+		{name: "FirstLine", buildID: buildID, line: "1", expectedCode: http.StatusOK, expectedData: "Log300"},
+		{name: "ChunkBoundary", buildID: buildID, line: "11", expectedCode: http.StatusOK, expectedData: "Log501"},
+		{name: "LastLine", buildID: buildID, line: "20", expectedCode: http.StatusOK, expectedData: "Log900"},
+		{name: "OutOfRange", buildID: buildID, line: "21", expectedCode: http.StatusNotFound},
+		{name: "Zero", buildID: buildID, line: "0", expectedCode: http.StatusBadRequest},
+		{name: "NotANumber", buildID: buildID, line: "first", expectedCode: http.StatusBadRequest},
+		{name: "NonexistentBuild", buildID: "DNE", line: "1", expectedCode: http.StatusNotFound},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, fmt.Sprintf("%s/build/%s/line/%s", lk.opts.URL, test.buildID, test.line), nil)
+			require.Equal(t, test.expectedCode, resp.Code)
+			checkCORSHeader(t, resp.Header())
+			if test.expectedCode != http.StatusOK {
+				return
+			}
+
+			var line logLine
+			require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &line))
+			assert.Equal(t, test.expectedData, line.Data)
+			assert.Equal(t, test.line, strconv.Itoa(line.Line))
+			assert.False(t, line.Timestamp.IsZero())
+		})
+	}
+	t.Run("RawPrefix", func(t *testing.T) {
+		resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, fmt.Sprintf("%s/build/%s/line/11?raw_prefix=true", lk.opts.URL, buildID), nil)
+		require.Equal(t, http.StatusOK, resp.Code)
+
+		var line logLine
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &line))
+		assert.Equal(t, fmt.Sprintf("  0%20d%s\n", line.Timestamp.UnixMilli(), "Log501"), line.Data)
+	})
+}
+
+func TestListBuilds(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	defer testutil.SetBucket(t, "")()
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	buildIDs := []string{"aa01", "aa02", "ab01", "ba01"}
+	for _, buildID := range buildIDs {
+		require.NoError(t, (&model.Build{ID: buildID}).UploadMetadata(ctx, tracer))
+	}
+	lk := NewLogkeeper(LogkeeperOptions{URL: "https://logkeeper.com"})
+
+	list := func(t *testing.T, query string) buildList {
+		resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, fmt.Sprintf("%s/builds?%s", lk.opts.URL, query), nil)
+		require.Equal(t, http.StatusOK, resp.Code)
+		checkCORSHeader(t, resp.Header())
+
+		var page buildList
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &page))
+		return page
+	}
+
+	t.Run("AllBuilds", func(t *testing.T) {
+		page := list(t, "")
+		assert.Equal(t, buildIDs, page.BuildIDs)
+		assert.Empty(t, page.NextToken)
+	})
+	t.Run("Paginated", func(t *testing.T) {
+		var ids []string
+		query := "prefix=a&limit=2"
+		page := list(t, query)
+		ids = append(ids, page.BuildIDs...)
+		require.NotEmpty(t, page.NextToken)
+
+		page = list(t, query+"&token="+url.QueryEscape(page.NextToken))
+		ids = append(ids, page.BuildIDs...)
+		assert.Empty(t, page.NextToken)
+		assert.Equal(t, buildIDs[:3], ids)
+	})
+	t.Run("NoMatches", func(t *testing.T) {
+		page := list(t, "prefix=c")
+		assert.NotNil(t, page.BuildIDs)
+		assert.Empty(t, page.BuildIDs)
+	})
+	t.Run("InvalidLimit", func(t *testing.T) {
+		for _, limit := range []string{"0", "-1", "many", strconv.Itoa(model.MaxListBuildsLimit + 1)} {
+			resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, fmt.Sprintf("%s/builds?limit=%s", lk.opts.URL, limit), nil)
+			assert.Equal(t, http.StatusBadRequest, resp.Code, "limit '%s'", limit)
+		}
+	})
+	t.Run("InvalidToken", func(t *testing.T) {
+		resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, fmt.Sprintf("%s/builds?token=%s", lk.opts.URL, url.QueryEscape("not a token!")), nil)
+		assert.Equal(t, http.StatusBadRequest, resp.Code)
+	})
+}
+
+func TestViewLogsStripANSI(t *testing.T) {
+	defer testutil.SetBucket(t, "")()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	lk := NewLogkeeper(LogkeeperOptions{URL: "https://logkeeper.com", MaxRequestSize: testMaxReqSize})
+
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	start := time.Unix(1000000000, 0).UTC()
+	require.NoError(t, (&model.Build{ID: buildID}).UploadMetadata(ctx, tracer))
+	testID := model.NewTestID(start)
+	require.NoError(t, (&model.Test{ID: testID, BuildID: buildID}).UploadTestMetadata(ctx, tracer))
+	lines := []model.LogLineItem{
+		{Timestamp: start, Data: "\x1b[32m[ OK ]\x1b[0m test passed"},
+		{Timestamp: start.Add(time.Second), Data: "plain line"},
+		{Timestamp: start.Add(2 * time.Second), Data: "\x1b[1;31mFAILED\x1b[0m"},
+	}
+	_, err := model.InsertLogLinesWithOptions(ctx, tracer, buildID, testID, lines, model.InsertOptions{MaxSize: testMaxReqSize})
+	require.NoError(t, err)
+	testURL := fmt.Sprintf("%s/build/%s/test/%s?raw=true", lk.opts.URL, buildID, testID)
+
+	resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, testURL, nil)
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "\x1b[32m[ OK ]\x1b[0m test passed\nplain line\n\x1b[1;31mFAILED\x1b[0m\n", resp.Body.String())
+
+	resp = doReq(t, lk.NewRouter(), http.MethodGet, nil, testURL+"&strip_ansi=true", nil)
+	require.Equal(t, http.StatusOK, resp.Code)
+	checkCORSHeader(t, resp.Header())
+	assert.Equal(t, "[ OK ] test passed\nplain line\nFAILED\n", resp.Body.String())
+}
+
+func TestViewLogsContentType(t *testing.T) {
+	defer testutil.SetBucket(t, "testdata/simple")()
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	testID := "17046404de18d0000000000000000000"
+	lk := NewLogkeeper(LogkeeperOptions{URL: "https://logkeeper.com", MaxRequestSize: testMaxReqSize})
+
+	for name, rawURL := range map[string]string{
+		"AllLogs":  fmt.Sprintf("%s/build/%s/all?raw=true", lk.opts.URL, buildID),
+		"TestLogs": fmt.Sprintf("%s/build/%s/test/%s?raw=true", lk.opts.URL, buildID, testID),
+	} {
+		t.Run(name, func(t *testing.T) {
+			resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, rawURL, nil)
+			require.Equal(t, http.StatusOK, resp.Code)
+			assert.Equal(t, "text/plain; charset=utf-8", resp.Header().Get("Content-Type"))
+			logs := resp.Body.String()
+			require.NotEmpty(t, logs)
+
+			t.Run("PlainText", func(t *testing.T) {
+				resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, rawURL+"&content_type=text/plain", nil)
+				require.Equal(t, http.StatusOK, resp.Code)
+				assert.Equal(t, "text/plain; charset=utf-8", resp.Header().Get("Content-Type"))
+				assert.Equal(t, logs, resp.Body.String())
+			})
+			t.Run("JSON", func(t *testing.T) {
+				resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, rawURL+"&content_type=application/json", nil)
+				require.Equal(t, http.StatusOK, resp.Code)
+				checkCORSHeader(t, resp.Header())
+				assert.Equal(t, "application/json; charset=utf-8", resp.Header().Get("Content-Type"))
+				assert.Equal(t, logs, resp.Body.String())
+			})
+			t.Run("Invalid", func(t *testing.T) {
+				for _, contentType := range []string{"text/html", "application/octet-stream", "json"} {
+					resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, rawURL+"&content_type="+url.QueryEscape(contentType), nil)
+					assert.Equal(t, http.StatusBadRequest, resp.Code, contentType)
+				}
+			})
+		})
+	}
+}
+
+func TestViewLogsStrictWindow(t *testing.T) {
+	defer testutil.SetBucket(t, "")()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	lk := NewLogkeeper(LogkeeperOptions{URL: "https://logkeeper.com", MaxRequestSize: testMaxReqSize})
+
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	start := time.Unix(1000000000, 0).UTC()
+	require.NoError(t, (&model.Build{ID: buildID}).UploadMetadata(ctx, tracer))
+	testID := model.NewTestID(start)
+	require.NoError(t, (&model.Test{ID: testID, BuildID: buildID}).UploadTestMetadata(ctx, tracer))
+	require.NoError(t, (&model.Test{ID: model.NewTestID(start.Add(2 * time.Second)), BuildID: buildID}).UploadTestMetadata(ctx, tracer))
+	lines := []model.LogLineItem{
+		{Timestamp: start.Add(time.Second), Data: "in window"},
+		{Timestamp: start.Add(3 * time.Second), Data: "after the next test started"},
+	}
+	_, err := model.InsertLogLines(ctx, tracer, buildID, testID, lines, testMaxReqSize)
+	require.NoError(t, err)
+	testURL := fmt.Sprintf("%s/build/%s/test/%s?raw=true", lk.opts.URL, buildID, testID)
+
+	resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, testURL, nil)
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "in window\nafter the next test started\n", resp.Body.String())
+
+	resp = doReq(t, lk.NewRouter(), http.MethodGet, nil, testURL+"&strict_window=true", nil)
+	require.Equal(t, http.StatusOK, resp.Code)
+	checkCORSHeader(t, resp.Header())
+	assert.Equal(t, "in window\n", resp.Body.String())
+}
+
+func TestViewLatestTestLogs(t *testing.T) {
+	defer testutil.SetBucket(t, "")()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	lk := NewLogkeeper(LogkeeperOptions{URL: "https://logkeeper.com", MaxRequestSize: testMaxReqSize})
+
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	start := time.Unix(1000000000, 0).UTC()
+	require.NoError(t, (&model.Build{ID: buildID}).UploadMetadata(ctx, tracer))
+	var latestID string
+	for i, offset := range []time.Duration{time.Hour, 2 * time.Hour, 0} {
+		testID := model.NewTestID(start.Add(offset))
+		if offset == 2*time.Hour {
+			latestID = testID
+		}
+		require.NoError(t, (&model.Test{ID: testID, BuildID: buildID}).UploadTestMetadata(ctx, tracer))
+		lines := []model.LogLineItem{{Timestamp: start.Add(offset), Data: fmt.Sprintf("test %d", i)}}
+		_, err := model.InsertLogLinesWithOptions(ctx, tracer, buildID, testID, lines, model.InsertOptions{MaxSize: testMaxReqSize})
+		require.NoError(t, err)
+	}
+
+	resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, fmt.Sprintf("%s/build/%s/test/latest?raw=true", lk.opts.URL, buildID), nil)
+	require.Equal(t, http.StatusFound, resp.Code)
+	checkCORSHeader(t, resp.Header())
+	location := resp.Header().Get("Location")
+	assert.Equal(t, fmt.Sprintf("/build/%s/test/%s?raw=true", buildID, latestID), location)
+
+	resp = doReq(t, lk.NewRouter(), http.MethodGet, nil, lk.opts.URL+location, nil)
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "test 1\n", resp.Body.String())
+
+	t.Run("NoTests", func(t *testing.T) {
+		require.NoError(t, (&model.Build{ID: "no_tests"}).UploadMetadata(ctx, tracer))
+
+		resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, fmt.Sprintf("%s/build/no_tests/test/latest?raw=true", lk.opts.URL), nil)
+		assert.Equal(t, http.StatusNotFound, resp.Code)
+	})
+}
+
+func TestCountLogLines(t *testing.T) {
+	defer testutil.SetBucket(t, "testdata/overlapping")()
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	testID := "0de0b6b3bf3b84000000000000000000"
+	lk := NewLogkeeper(LogkeeperOptions{URL: "https://logkeeper.com"})
+
+	for _, test := range []struct {
+		name        string
+		countURL    string
+		downloadURL string
+	}{
+		{
+			name:        "AllLogs",
+			countURL:    fmt.Sprintf("%s/build/%s/all/count", lk.opts.URL, buildID),
+			downloadURL: fmt.Sprintf("%s/build/%s/all?raw=true", lk.opts.URL, buildID),
+		},
+		{
+			name:        "TestLogs",
+			countURL:    fmt.Sprintf("%s/build/%s/test/%s/count", lk.opts.URL, buildID, testID),
+			downloadURL: fmt.Sprintf("%s/build/%s/test/%s?raw=true", lk.opts.URL, buildID, testID),
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, test.downloadURL, nil)
+			require.Equal(t, http.StatusOK, resp.Code)
+			expected := strings.Count(resp.Body.String(), "\n")
+
+			resp = doReq(t, lk.NewRouter(), http.MethodGet, nil, test.countURL, nil)
+			require.Equal(t, http.StatusOK, resp.Code)
+			checkCORSHeader(t, resp.Header())
+			var count lineCount
+			require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &count))
+			assert.Equal(t, expected, count.Count)
+			assert.Equal(t, buildID, count.BuildID)
+		})
+	}
+	t.Run("NonexistentBuild", func(t *testing.T) {
+		resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, fmt.Sprintf("%s/build/DNE/all/count", lk.opts.URL), nil)
+		assert.Equal(t, http.StatusNotFound, resp.Code)
+	})
+	t.Run("NonexistentTest", func(t *testing.T) {
+		resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, fmt.Sprintf("%s/build/%s/test/DNE/count", lk.opts.URL, buildID), nil)
+		assert.Equal(t, http.StatusNotFound, resp.Code)
+	})
+}
+
+func TestViewBuildManifest(t *testing.T) {
+	defer testutil.SetBucket(t, "testdata/overlapping")()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	lk := NewLogkeeper(
+		LogkeeperOptions{
+			URL:            "https://logkeeper.com",
+			MaxRequestSize: testMaxReqSize,
+		},
+	)
+
+	t.Run("BuildDNE", func(t *testing.T) {
+		resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, lk.opts.URL+"/build/DNE/manifest", nil)
+		require.Equal(t, http.StatusNotFound, resp.Code)
+		checkCORSHeader(t, resp.Header())
+	})
+	t.Run("Build", func(t *testing.T) {
+		resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, fmt.Sprintf("%s/build/%s/manifest", lk.opts.URL, buildID), nil)
+		require.Equal(t, http.StatusOK, resp.Code)
+		checkCORSHeader(t, resp.Header())
+
+		var manifest buildManifest
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &manifest))
+		assert.Equal(t, buildID, manifest.BuildID)
+		require.Len(t, manifest.Chunks, 4)
+
+		// Each chunk's range of the concatenated chunks must hold
+		// exactly that chunk's contents.
+		var concatenated bytes.Buffer
+		var chunkData [][]byte
+		for _, chunk := range manifest.Chunks {
+			r, err := env.Bucket().Get(ctx, chunk.Key)
+			require.NoError(t, err)
+			data, err := io.ReadAll(r)
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+			chunkData = append(chunkData, data)
+			concatenated.Write(data)
+		}
+		assert.EqualValues(t, concatenated.Len(), manifest.TotalSize)
+		for i, chunk := range manifest.Chunks {
+			assert.Equal(t, chunkData[i], concatenated.Bytes()[chunk.Offset:chunk.Offset+chunk.Size])
+		}
+	})
+}
+
+func TestViewLogChunk(t *testing.T) {
+	defer testutil.SetBucket(t, "testdata/overlapping")()
+
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	lk := NewLogkeeper(
+		LogkeeperOptions{
+			URL:            "https://logkeeper.com",
+			MaxRequestSize: testMaxReqSize,
+		},
+	)
+
+	resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, fmt.Sprintf("%s/build/%s/manifest", lk.opts.URL, buildID), nil)
+	require.Equal(t, http.StatusOK, resp.Code)
+	var manifest buildManifest
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &manifest))
+	require.NotEmpty(t, manifest.Chunks)
+	chunk := manifest.Chunks[0]
+	chunkURL := fmt.Sprintf("%s/build/%s/chunk?key=%s", lk.opts.URL, buildID, url.QueryEscape(chunk.Key))
+
+	t.Run("MissingKey", func(t *testing.T) {
+		resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, fmt.Sprintf("%s/build/%s/chunk", lk.opts.URL, buildID), nil)
+		assert.Equal(t, http.StatusBadRequest, resp.Code)
+		checkCORSHeader(t, resp.Header())
+	})
+	t.Run("ChunkDNE", func(t *testing.T) {
+		resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, fmt.Sprintf("%s/build/DNE/chunk?key=%s", lk.opts.URL, url.QueryEscape(chunk.Key)), nil)
+		assert.Equal(t, http.StatusNotFound, resp.Code)
+		checkCORSHeader(t, resp.Header())
+	})
+	for _, test := range []struct {
+		name         string
+		ifNoneMatch  string
+		expectedCode int
+	}{
+		{name: "NoIfNoneMatch", expectedCode: http.StatusOK},
+		{name: "MatchingHash", ifNoneMatch: fmt.Sprintf(`"%s"`, chunk.Hash), expectedCode: http.StatusNotModified},
+		{name: "MatchingWeakHash", ifNoneMatch: fmt.Sprintf(`W/"%s"`, chunk.Hash), expectedCode: http.StatusNotModified},
+		{name: "MatchingHashInList", ifNoneMatch: fmt.Sprintf(`"other", "%s"`, chunk.Hash), expectedCode: http.StatusNotModified},
+		{name: "Wildcard", ifNoneMatch: "*", expectedCode: http.StatusNotModified},
+		{name: "MismatchedHash", ifNoneMatch: fmt.Sprintf(`"%s"`, strings.Repeat("0", len(chunk.Hash))), expectedCode: http.StatusOK},
+		{name: "UnquotedHash", ifNoneMatch: chunk.Hash, expectedCode: http.StatusOK},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var headers map[string]string
+			if test.ifNoneMatch != "" {
+				headers = map[string]string{"If-None-Match": test.ifNoneMatch}
+			}
+			resp := doReq(t, lk.NewRouter(), http.MethodGet, headers, chunkURL, nil)
+			require.Equal(t, test.expectedCode, resp.Code)
+			checkCORSHeader(t, resp.Header())
+			assert.Equal(t, fmt.Sprintf(`"%s"`, chunk.Hash), resp.Header().Get("ETag"))
+			if test.expectedCode == http.StatusNotModified {
+				assert.Empty(t, resp.Body.Bytes())
+				return
+			}
+
+			assert.EqualValues(t, chunk.Size, resp.Body.Len())
+			hash := sha256.Sum256(resp.Body.Bytes())
+			assert.Equal(t, chunk.Hash, hex.EncodeToString(hash[:]))
+		})
+	}
+}
+
+func TestViewBuildSummary(t *testing.T) {
+	defer testutil.SetBucket(t, "testdata/overlapping")()
+
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	lk := NewLogkeeper(
+		LogkeeperOptions{
+			URL:            "https://logkeeper.com",
+			MaxRequestSize: testMaxReqSize,
+		},
+	)
+
+	t.Run("BuildDNE", func(t *testing.T) {
+		resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, lk.opts.URL+"/build/DNE/summary", nil)
+		require.Equal(t, http.StatusNotFound, resp.Code)
+		checkCORSHeader(t, resp.Header())
+	})
+	t.Run("MatchesIndividualEndpoints", func(t *testing.T) {
+		// The test data predates recorded sizes, so they're recorded
+		// first for the summary's total size to cover every chunk.
+		_, err := model.RepairLineCounts(context.Background(), lk.tracer, buildID)
+		require.NoError(t, err)
+
+		resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, fmt.Sprintf("%s/build/%s/summary", lk.opts.URL, buildID), nil)
+		require.Equal(t, http.StatusOK, resp.Code)
+		checkCORSHeader(t, resp.Header())
+
+		var summary model.BuildSummary
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &summary))
+		require.NotNil(t, summary.Build)
+		assert.Equal(t, buildID, summary.Build.ID)
+		assert.Equal(t, "builder", summary.Build.Builder)
+		assert.Equal(t, 1, summary.NumTests)
+
+		resp = doReq(t, lk.NewRouter(), http.MethodGet, nil, fmt.Sprintf("%s/build/%s/all/count", lk.opts.URL, buildID), nil)
+		require.Equal(t, http.StatusOK, resp.Code)
+		var count lineCount
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &count))
+		assert.Equal(t, count.Count, summary.NumLines)
+
+		resp = doReq(t, lk.NewRouter(), http.MethodGet, nil, fmt.Sprintf("%s/build/%s/manifest", lk.opts.URL, buildID), nil)
+		require.Equal(t, http.StatusOK, resp.Code)
+		var manifest buildManifest
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &manifest))
+		assert.Equal(t, manifest.TotalSize, summary.TotalBytes)
+		assert.Zero(t, summary.UnsizedChunks)
+		require.NotEmpty(t, manifest.Chunks)
+		start, end := manifest.Chunks[0].Start, manifest.Chunks[0].End
+		for _, chunk := range manifest.Chunks {
+			if chunk.End.After(end) {
+				end = chunk.End
+			}
+		}
+		assert.True(t, start.Equal(summary.TimeRange.StartAt))
+		assert.True(t, end.Equal(summary.TimeRange.EndAt))
+	})
+}
+
+func TestCheckLineSequence(t *testing.T) {
+	defer testutil.SetBucket(t, "")()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	lk := NewLogkeeper(LogkeeperOptions{URL: "https://logkeeper.com", MaxRequestSize: testMaxReqSize})
+
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	require.NoError(t, (&model.Build{ID: buildID}).UploadMetadata(ctx, tracer))
+	lines, err := model.UnmarshalLogJSON(ctx, tracer, strings.NewReader(`[[1000000000.1, "line0", 0], [1000000000.2, "line1", 1], [1000000000.3, "line3", 3], [1000000000.4, "line3", 3]]`))
+	require.NoError(t, err)
+	_, err = model.InsertLogLines(ctx, tracer, buildID, "", lines, testMaxReqSize)
+	require.NoError(t, err)
+
+	resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, fmt.Sprintf("%s/build/%s/sequence", lk.opts.URL, buildID), nil)
+	require.Equal(t, http.StatusOK, resp.Code)
+	checkCORSHeader(t, resp.Header())
+	var report model.SequenceReport
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &report))
+	assert.Equal(t, 4, report.NumSequenced)
+	assert.Equal(t, []model.SequenceRange{{Start: 2, End: 2}}, report.Gaps)
+	assert.Equal(t, []model.SequenceRange{{Start: 3, End: 3}}, report.Duplicates)
+
+	resp = doReq(t, lk.NewRouter(), http.MethodGet, nil, fmt.Sprintf("%s/build/DNE/sequence", lk.opts.URL), nil)
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+}
+
+func TestViewStorageStats(t *testing.T) {
+	defer testutil.SetBucket(t, "")()
+	t.Setenv(maintenanceEnvVariable, "token")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+	lk := NewLogkeeper(
+		LogkeeperOptions{
+			URL:            "https://logkeeper.com",
+			MaxRequestSize: testMaxReqSize,
+		},
+	)
+	auth := map[string]string{"Authorization": "Bearer token"}
+	getUsage := func(t *testing.T, headers map[string]string, params string) model.StorageUsage {
+		resp := doReq(t, lk.NewRouter(), http.MethodGet, headers, lk.opts.URL+"/stats/storage"+params, nil)
+		require.Equal(t, http.StatusOK, resp.Code)
+
+		var usage model.StorageUsage
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &usage))
+		return usage
+	}
+
+	resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, lk.opts.URL+"/stats/storage?recompute=true", nil)
+	require.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	usage := getUsage(t, auth, "?recompute=true")
+	assert.Zero(t, usage.Builds)
+	assert.Zero(t, usage.Chunks)
+
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	start := time.Unix(1000000000, 0).UTC()
+	require.NoError(t, (&model.Build{ID: buildID}).UploadMetadata(ctx, tracer))
+	_, err := model.InsertLogLines(ctx, tracer, buildID, "", []model.LogLineItem{
+		{Timestamp: start, Data: "line0"},
+		{Timestamp: start.Add(time.Millisecond), Data: "line1"},
+	}, testMaxReqSize)
+	require.NoError(t, err)
+
+	// The cached usage is returned without the maintenance token.
+	usage = getUsage(t, nil, "")
+	assert.Equal(t, 1, usage.Builds)
+	assert.Equal(t, 1, usage.Chunks)
+	recomputed := getUsage(t, auth, "?recompute=true")
+	assert.Equal(t, usage.Builds, recomputed.Builds)
+	assert.Equal(t, usage.Chunks, recomputed.Chunks)
+	assert.True(t, recomputed.ComputedAt.After(usage.ComputedAt))
+
+	require.NoError(t, model.DeleteBuild(ctx, tracer, buildID, 0))
+	usage = getUsage(t, nil, "")
+	assert.Zero(t, usage.Builds)
+	assert.Zero(t, usage.Chunks)
+}
+
+func TestAddBuildLabels(t *testing.T) {
+	defer testutil.SetBucket(t, "testdata/simple")()
+	t.Setenv(maintenanceEnvVariable, "token")
+
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	lk := NewLogkeeper(
+		LogkeeperOptions{
+			URL:            "https://logkeeper.com",
+			MaxRequestSize: testMaxReqSize,
+		},
+	)
+	labelsURL := fmt.Sprintf("%s/build/%s/labels", lk.opts.URL, buildID)
+	getLabels := func(t *testing.T) map[string]string {
+		resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, fmt.Sprintf("%s/build/%s?metadata=true", lk.opts.URL, buildID), nil)
+		require.Equal(t, http.StatusOK, resp.Code)
+		var build model.Build
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &build))
+		return build.Labels
+	}
+
+	auth := map[string]string{"Authorization": "Bearer token"}
+
+	t.Run("MissingToken", func(t *testing.T) {
+		resp := doReq(t, lk.NewRouter(), http.MethodPatch, nil, labelsURL, map[string]string{"branch": "main"})
+		require.Equal(t, http.StatusUnauthorized, resp.Code)
+		assert.Empty(t, getLabels(t))
+	})
+	t.Run("Set", func(t *testing.T) {
+		resp := doReq(t, lk.NewRouter(), http.MethodPatch, auth, labelsURL, map[string]string{"branch": "main", "pr": "1"})
+		require.Equal(t, http.StatusOK, resp.Code)
+		checkCORSHeader(t, resp.Header())
+		var build model.Build
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &build))
+		assert.Equal(t, buildID, build.ID)
+		assert.Equal(t, map[string]string{"branch": "main", "pr": "1"}, build.Labels)
+		assert.Equal(t, build.Labels, getLabels(t))
+	})
+	t.Run("Merge", func(t *testing.T) {
+		resp := doReq(t, lk.NewRouter(), http.MethodPatch, auth, labelsURL, map[string]string{"pr": "2", "branch": ""})
+		require.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, map[string]string{"pr": "2"}, getLabels(t))
+	})
+	t.Run("ValueTooLarge", func(t *testing.T) {
+		resp := doReq(t, lk.NewRouter(), http.MethodPatch, auth, labelsURL, map[string]string{"pr": strings.Repeat("v", model.MaxLabelValueSize+1)})
+		require.Equal(t, http.StatusBadRequest, resp.Code)
+		assert.Equal(t, map[string]string{"pr": "2"}, getLabels(t))
+	})
+	t.Run("TooManyAfterMerge", func(t *testing.T) {
+		labels := map[string]string{}
+		for i := 0; i < model.MaxBuildLabels; i++ {
+			labels[fmt.Sprintf("key%d", i)] = "value"
+		}
+		resp := doReq(t, lk.NewRouter(), http.MethodPatch, auth, labelsURL, labels)
+		require.Equal(t, http.StatusBadRequest, resp.Code)
+		assert.Contains(t, resp.Body.String(), "exceeds the maximum")
+		assert.Equal(t, map[string]string{"pr": "2"}, getLabels(t))
+	})
+	t.Run("InvalidBody", func(t *testing.T) {
+		resp := doReq(t, lk.NewRouter(), http.MethodPatch, auth, labelsURL, map[string]int{"pr": 2})
+		require.Equal(t, http.StatusBadRequest, resp.Code)
+	})
+	t.Run("BuildDNE", func(t *testing.T) {
+		resp := doReq(t, lk.NewRouter(), http.MethodPatch, auth, fmt.Sprintf("%s/build/DNE/labels", lk.opts.URL), map[string]string{"branch": "main"})
+		require.Equal(t, http.StatusNotFound, resp.Code)
+	})
+}
+
+func TestSetBuildTaskExecution(t *testing.T) {
+	defer testutil.SetBucket(t, "testdata/simple")()
+	t.Setenv(maintenanceEnvVariable, "token")
+
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	lk := NewLogkeeper(
+		LogkeeperOptions{
+			URL:            "https://logkeeper.com",
+			MaxRequestSize: testMaxReqSize,
+		},
+	)
+	executionURL := fmt.Sprintf("%s/build/%s/execution", lk.opts.URL, buildID)
+	allURL := fmt.Sprintf("%s/build/%s/all?raw=true", lk.opts.URL, buildID)
+	getExecution := func(t *testing.T) int {
+		resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, fmt.Sprintf("%s/build/%s?metadata=true", lk.opts.URL, buildID), nil)
+		require.Equal(t, http.StatusOK, resp.Code)
+		var build model.Build
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &build))
+		return build.TaskExecution
+	}
+
+	resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, allURL, nil)
+	require.Equal(t, http.StatusOK, resp.Code)
+	logs := resp.Body.String()
+	require.NotEmpty(t, logs)
+
+	auth := map[string]string{"Authorization": "Bearer token"}
+
+	t.Run("MissingToken", func(t *testing.T) {
+		resp := doReq(t, lk.NewRouter(), http.MethodPatch, nil, executionURL, map[string]int{"execution": 3})
+		require.Equal(t, http.StatusUnauthorized, resp.Code)
+		assert.Zero(t, getExecution(t))
+	})
+	t.Run("Set", func(t *testing.T) {
+		resp := doReq(t, lk.NewRouter(), http.MethodPatch, auth, executionURL, map[string]int{"execution": 3})
+		require.Equal(t, http.StatusOK, resp.Code)
+		checkCORSHeader(t, resp.Header())
+		var build model.Build
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &build))
+		assert.Equal(t, buildID, build.ID)
+		assert.Equal(t, 3, build.TaskExecution)
+		assert.Equal(t, 3, getExecution(t))
+
+		resp = doReq(t, lk.NewRouter(), http.MethodGet, nil, allURL, nil)
+		require.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, logs, resp.Body.String())
+	})
+	t.Run("Negative", func(t *testing.T) {
+		resp := doReq(t, lk.NewRouter(), http.MethodPatch, auth, executionURL, map[string]int{"execution": -1})
+		require.Equal(t, http.StatusBadRequest, resp.Code)
+		assert.Equal(t, 3, getExecution(t))
+	})
+	t.Run("InvalidBody", func(t *testing.T) {
+		for _, body := range []interface{}{map[string]string{"execution": "1"}, map[string]int{}} {
+			resp := doReq(t, lk.NewRouter(), http.MethodPatch, auth, executionURL, body)
+			require.Equal(t, http.StatusBadRequest, resp.Code)
+		}
+	})
+	t.Run("BuildDNE", func(t *testing.T) {
+		resp := doReq(t, lk.NewRouter(), http.MethodPatch, auth, fmt.Sprintf("%s/build/DNE/execution", lk.opts.URL), map[string]int{"execution": 1})
+		require.Equal(t, http.StatusNotFound, resp.Code)
+	})
+}
+
+func TestRepairLineCounts(t *testing.T) {
+	defer testutil.SetBucket(t, "testdata/simple")()
+	t.Setenv(maintenanceEnvVariable, "token")
+
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	lk := NewLogkeeper(
+		LogkeeperOptions{
+			URL:            "https://logkeeper.com",
+			MaxRequestSize: testMaxReqSize,
+		},
+	)
+	for _, test := range []struct {
+		name               string
+		headers            map[string]string
+		buildID            string
+		expectedStatusCode int
+		test               func(*testing.T, *httptest.ResponseRecorder)
+	}{
+		{
+			name:               "MissingToken",
+			buildID:            buildID,
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:               "InvalidToken",
+			headers:            map[string]string{"Authorization": "Bearer nope"},
+			buildID:            buildID,
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:               "BuildDNE",
+			headers:            map[string]string{"Authorization": "Bearer token"},
+			buildID:            "DNE",
+			expectedStatusCode: http.StatusNotFound,
+		},
+		{
+			name:               "CorrectCounts",
+			headers:            map[string]string{"Authorization": "Bearer token"},
+			buildID:            buildID,
+			expectedStatusCode: http.StatusOK,
+			test: func(t *testing.T, resp *httptest.ResponseRecorder) {
+				// Only the legacy test's size is recorded.
+				var out model.LineCountRepair
+				require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &out))
+				assert.Equal(t, model.LineCountRepair{Tests: 1}, out)
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			resp := doReq(t, lk.NewRouter(), http.MethodPost, test.headers, fmt.Sprintf("%s/build/%s/repair", lk.opts.URL, test.buildID), nil)
+			require.Equal(t, test.expectedStatusCode, resp.Code)
+			if test.test != nil {
+				test.test(t, resp)
+			}
+		})
+	}
+
+	t.Run("Disabled", func(t *testing.T) {
+		t.Setenv(maintenanceEnvVariable, "")
+
+		resp := doReq(t, lk.NewRouter(), http.MethodPost, map[string]string{"Authorization": "Bearer "}, fmt.Sprintf("%s/build/%s/repair", lk.opts.URL, buildID), nil)
+		assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	})
+}
+
+func TestScrubBuildLogs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	defer testutil.SetBucket(t, "")()
+	t.Setenv(maintenanceEnvVariable, "token")
+	tracer := otel.GetTracerProvider().Tracer("noop_tracer") // default noop
+
+	start := time.Unix(1000000000, 0).UTC()
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	testID := model.NewTestID(start)
+	require.NoError(t, (&model.Build{ID: buildID}).UploadMetadata(ctx, tracer))
+	require.NoError(t, (&model.Test{ID: testID, BuildID: buildID}).UploadTestMetadata(ctx, tracer))
+	lines := []model.LogLineItem{{Timestamp: start, Data: "secret"}}
+	_, err := model.InsertLogLines(ctx, tracer, buildID, "", lines, testMaxReqSize)
+	require.NoError(t, err)
+	_, err = model.InsertLogLines(ctx, tracer, buildID, testID, lines, testMaxReqSize)
+	require.NoError(t, err)
+
+	lk := NewLogkeeper(LogkeeperOptions{URL: "https://logkeeper.com", MaxRequestSize: testMaxReqSize})
+	allURL := fmt.Sprintf("%s/build/%s/all?raw=true", lk.opts.URL, buildID)
+	testURL := fmt.Sprintf("%s/build/%s/test/%s?raw=true", lk.opts.URL, buildID, testID)
+	scrubURL := fmt.Sprintf("%s/build/%s/scrub", lk.opts.URL, buildID)
+
+	resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, allURL, nil)
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), "secret")
+	assert.Empty(t, resp.Header().Get(scrubbedHeader))
+
+	t.Run("MissingToken", func(t *testing.T) {
+		resp := doReq(t, lk.NewRouter(), http.MethodPost, nil, scrubURL, nil)
+		assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	})
+	t.Run("BuildDNE", func(t *testing.T) {
+		resp := doReq(t, lk.NewRouter(), http.MethodPost, map[string]string{"Authorization": "Bearer token"}, fmt.Sprintf("%s/build/DNE/scrub", lk.opts.URL), nil)
+		assert.Equal(t, http.StatusNotFound, resp.Code)
+	})
+	t.Run("Scrub", func(t *testing.T) {
+		resp := doReq(t, lk.NewRouter(), http.MethodPost, map[string]string{"Authorization": "Bearer token"}, scrubURL, nil)
+		require.Equal(t, http.StatusOK, resp.Code)
+		build := &model.Build{}
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), build))
+		assert.Equal(t, buildID, build.ID)
+		assert.True(t, build.Scrubbed)
+
+		for _, url := range []string{allURL, testURL} {
+			resp = doReq(t, lk.NewRouter(), http.MethodGet, nil, url, nil)
+			require.Equal(t, http.StatusOK, resp.Code, url)
+			assert.Empty(t, resp.Body.String(), url)
+			assert.Equal(t, "true", resp.Header().Get(scrubbedHeader), url)
+		}
+
+		resp = doReq(t, lk.NewRouter(), http.MethodGet, nil, fmt.Sprintf("%s/build/%s/all?metadata=true", lk.opts.URL, buildID), nil)
+		require.Equal(t, http.StatusOK, resp.Code)
+		build = &model.Build{}
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), build))
+		assert.True(t, build.Scrubbed)
+	})
+}
+
+func TestErrorTraceIDs(t *testing.T) {
+	defer testutil.SetBucket(t, "")()
+	defer otel.SetTracerProvider(otel.GetTracerProvider())
+
+	t.Run("Traced", func(t *testing.T) {
+		recorder := tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+		lk := NewLogkeeper(LogkeeperOptions{URL: "https://logkeeper.com"})
+
+		resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, fmt.Sprintf("%s/build/DNE", lk.opts.URL), nil)
+		require.Equal(t, http.StatusNotFound, resp.Code)
+		var apiErr apiError
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &apiErr))
+		assert.Equal(t, "build not found", apiErr.Err)
+		require.NotEmpty(t, apiErr.TraceID)
+		require.NotEmpty(t, apiErr.SpanID)
+
+		var found bool
+		for _, span := range recorder.Ended() {
+			if span.SpanContext().SpanID().String() == apiErr.SpanID {
+				found = true
+				assert.Equal(t, "ViewBuild", span.Name())
+				assert.Equal(t, apiErr.TraceID, span.SpanContext().TraceID().String())
+			}
+		}
+		assert.True(t, found, "span '%s' wasn't recorded", apiErr.SpanID)
+	})
+	t.Run("Untraced", func(t *testing.T) {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		lk := NewLogkeeper(LogkeeperOptions{URL: "https://logkeeper.com"})
+
+		resp := doReq(t, lk.NewRouter(), http.MethodGet, nil, fmt.Sprintf("%s/build/DNE", lk.opts.URL), nil)
+		require.Equal(t, http.StatusNotFound, resp.Code)
+		assert.NotContains(t, resp.Body.String(), "trace_id")
+		assert.NotContains(t, resp.Body.String(), "span_id")
+	})
+}
+
+func TestWriteRawLines(t *testing.T) {
+	newResponse := func(numLines int) *logFetchResponse {
+		lines := make(chan *model.LogLineItem, numLines)
+		for i := 0; i < numLines; i++ {
+			lines <- &model.LogLineItem{Timestamp: time.UnixMilli(int64(i)), Data: fmt.Sprintf("line%d", i)}
+		}
+		close(lines)
+
+		return &logFetchResponse{logLines: lines, build: &model.Build{ID: "build"}}
+	}
+	expectedBody := func(numLines int) string {
+		var body strings.Builder
+		for i := 0; i < numLines; i++ {
+			fmt.Fprintf(&body, "line%d\n", i)
+		}
+		return body.String()
+	}
+
+	t.Run("BufferingReducesWrites", func(t *testing.T) {
+		const numLines = 10000
+
+		unbuffered := newWriteCountingRecorder()
+		require.NoError(t, writeRawLines(unbuffered, newResponse(numLines), 1, time.Minute, false))
+		buffered := newWriteCountingRecorder()
+		require.NoError(t, writeRawLines(buffered, newResponse(numLines), defaultRawBufferSize, time.Minute, false))
+
+		assert.Equal(t, numLines, unbuffered.writes)
+		assert.Less(t, buffered.writes, numLines/100)
+		assert.Equal(t, expectedBody(numLines), unbuffered.Body.String())
+		assert.Equal(t, expectedBody(numLines), buffered.Body.String())
+		assert.True(t, buffered.Flushed)
+	})
+	t.Run("NoLines", func(t *testing.T) {
+		w := newWriteCountingRecorder()
+		require.NoError(t, writeRawLines(w, newResponse(0), defaultRawBufferSize, time.Minute, false))
+		assert.Empty(t, w.Body.String())
+	})
+	t.Run("FlushesWhileStreaming", func(t *testing.T) {
+		lines := make(chan *model.LogLineItem)
+		w := newWriteCountingRecorder()
+		errs := make(chan error, 1)
+		go func() {
+			errs <- writeRawLines(w, &logFetchResponse{logLines: lines, build: &model.Build{ID: "build"}}, defaultRawBufferSize, 10*time.Millisecond, false)
+		}()
+
+		lines <- &model.LogLineItem{Timestamp: time.UnixMilli(0), Data: "line0"}
+		select {
+		case <-w.flushes:
+		case <-time.After(time.Second):
+			require.FailNow(t, "buffered line was not flushed while waiting for more lines")
+		}
+		assert.Equal(t, "line0\n", w.Body.String())
+
+		close(lines)
+		require.NoError(t, <-errs)
+	})
+}
+
+// writeCountingRecorder is a ResponseRecorder that counts the writes made to
+// it and signals each flush.
+type writeCountingRecorder struct {
+	*httptest.ResponseRecorder
+	writes  int
+	flushes chan struct{}
+}
+
+func newWriteCountingRecorder() *writeCountingRecorder {
+	return &writeCountingRecorder{ResponseRecorder: httptest.NewRecorder(), flushes: make(chan struct{}, 1)}
+}
+
+func (w *writeCountingRecorder) Write(data []byte) (int, error) {
+	w.writes++
+	return w.ResponseRecorder.Write(data)
+}
+
+func (w *writeCountingRecorder) WriteString(data string) (int, error) {
+	w.writes++
+	return w.ResponseRecorder.WriteString(data)
+}
+
+func (w *writeCountingRecorder) Flush() {
+	w.ResponseRecorder.Flush()
+	select {
+	case w.flushes <- struct{}{}:
+	default:
+	}
+}
+
+func TestWriteSSELines(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	t.Run("Events", func(t *testing.T) {
+		lines := make(chan *model.LogLineItem, 3)
+		lines <- &model.LogLineItem{Timestamp: time.UnixMilli(1000), Data: "line0"}
+		lines <- &model.LogLineItem{Timestamp: time.UnixMilli(2000), Data: "line1"}
+		lines <- &model.LogLineItem{Timestamp: time.UnixMilli(3000), Data: "multi\nline"}
+		close(lines)
+
+		w := httptest.NewRecorder()
+		require.NoError(t, writeSSELines(ctx, w, lines, time.Minute, 0))
+		assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+		assert.True(t, w.Flushed)
+
+		events, heartbeats := parseSSE(t, w.Body.String())
+		assert.Equal(t, []sseEvent{
+			{id: "1000", data: "line0"},
+			{id: "2000", data: "line1"},
+			{id: "3000", data: "multi\nline"},
+		}, events)
+		assert.Zero(t, heartbeats)
+	})
+	t.Run("HeartbeatWhileIdle", func(t *testing.T) {
+		lines := make(chan *model.LogLineItem)
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			lines <- &model.LogLineItem{Timestamp: time.UnixMilli(1000), Data: "line0"}
+			close(lines)
+		}()
+
+		w := httptest.NewRecorder()
+		require.NoError(t, writeSSELines(ctx, w, lines, 10*time.Millisecond, 0))
+
+		events, heartbeats := parseSSE(t, w.Body.String())
+		assert.Equal(t, []sseEvent{{id: "1000", data: "line0"}}, events)
+		assert.GreaterOrEqual(t, heartbeats, 2)
+	})
+	t.Run("EndsAtMaxDuration", func(t *testing.T) {
+		lines := make(chan *model.LogLineItem, 1)
+		lines <- &model.LogLineItem{Timestamp: time.UnixMilli(1000), Data: "line0"}
+
+		w := httptest.NewRecorder()
+		start := time.Now()
+		require.NoError(t, writeSSELines(ctx, w, lines, 10*time.Millisecond, 100*time.Millisecond))
+		assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+
+		events, heartbeats := parseSSE(t, w.Body.String())
+		assert.Equal(t, []sseEvent{
+			{id: "1000", data: "line0"},
+			{event: "end", data: "maximum stream duration reached"},
+		}, events)
+		assert.GreaterOrEqual(t, heartbeats, 2)
+	})
+	t.Run("ContextCanceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		w := httptest.NewRecorder()
+		assert.Error(t, writeSSELines(ctx, w, make(chan *model.LogLineItem), time.Minute, 0))
+	})
+}
+
+type sseEvent struct {
+	id    string
+	event string
+	data  string
+}
+
+// parseSSE returns the events and the number of heartbeat comments in the
+// given server-sent event stream.
+func parseSSE(t *testing.T, body string) ([]sseEvent, int) {
+	var (
+		events     []sseEvent
+		heartbeats int
+	)
+	for _, block := range strings.Split(strings.TrimSuffix(body, "\n\n"), "\n\n") {
+		if block == "" {
+			continue
+		}
+		if block == ": heartbeat" {
+			heartbeats++
+			continue
+		}
+
+		var (
+			event sseEvent
+			data  []string
+		)
+		for _, field := range strings.Split(block, "\n") {
+			switch {
+			case strings.HasPrefix(field, "id: "):
+				event.id = strings.TrimPrefix(field, "id: ")
+			case strings.HasPrefix(field, "event: "):
+				event.event = strings.TrimPrefix(field, "event: ")
+			case strings.HasPrefix(field, "data: "):
+				data = append(data, strings.TrimPrefix(field, "data: "))
+			default:
+				t.Fatalf("unexpected event field '%s'", field)
+			}
+		}
+		event.data = strings.Join(data, "\n")
+		events = append(events, event)
+	}
+
+	return events, heartbeats
+}
+
 func doReq(t *testing.T, handler http.Handler, method string, headers map[string]string, url string, body interface{}) *httptest.ResponseRecorder {
 	var r io.Reader
 	if body != nil {